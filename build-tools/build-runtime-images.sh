@@ -18,6 +18,7 @@ mkdir -p $WKDIR/python
 cp python/*.py $WKDIR/python/
 cp python/k8s-runtime-requirements.txt $WKDIR/
 cp vendor/src/f5/schemas/bigip-virtual-server_v*.json $WKDIR/
+cp schemas/bigip-virtual-server_v*.json $WKDIR/
 
 echo "Docker build context:"
 ls -la $WKDIR
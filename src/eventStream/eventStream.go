@@ -20,8 +20,10 @@ import (
 	"time"
 
 	v1core "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
+	v1beta1ext "k8s.io/client-go/1.4/kubernetes/typed/extensions/v1beta1"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/1.4/pkg/fields"
 	"k8s.io/client-go/1.4/pkg/labels"
 	"k8s.io/client-go/1.4/pkg/runtime"
@@ -89,15 +91,16 @@ func NewEventStream(eventListWatch *EventListWatch, dataType interface{}, resync
 	return eventStream
 }
 
-// Creates a new EventStream for *v1.Service
+// Creates a new EventStream for *v1.Service. Services are read as JSON, to
+// keep the fields v1.Service lacks, see DecodeService
 func NewServiceEventStream(core v1core.CoreInterface, namespace string, resyncPeriod time.Duration, onChangeFunc OnChangeFunc, labelSelector labels.Selector, fieldSelector fields.Selector) *EventStream {
 	return NewEventStream(
 		&EventListWatch{
 			ListFunc: func(options api.ListOptions) (runtime.Object, error) {
-				return core.Services(namespace).List(options)
+				return listServices(core.GetRESTClient(), namespace, options)
 			},
 			WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
-				return core.Services(namespace).Watch(options)
+				return watchServices(core.GetRESTClient(), namespace, options)
 			},
 			OnChangeFunc: onChangeFunc,
 		},
@@ -151,3 +154,75 @@ func NewEndpointsEventStream(core v1core.CoreInterface, namespace string, resync
 		&v1.Endpoints{},
 		resyncPeriod)
 }
+
+// Creates a new EventStream for *v1.Secret
+func NewSecretEventStream(core v1core.CoreInterface, namespace string, resyncPeriod time.Duration, onChangeFunc OnChangeFunc, labelSelector labels.Selector, fieldSelector fields.Selector) *EventStream {
+	return NewEventStream(
+		&EventListWatch{
+			ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+				// add the specified labelSelector and fieldSelector object to the options list
+				opts := options
+				opts.LabelSelector = labelSelector
+				opts.FieldSelector = fieldSelector
+				return core.Secrets(namespace).List(opts)
+			},
+			WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+				// add the specified labelSelector and fieldSelector object to the options list
+				opts := options
+				opts.LabelSelector = labelSelector
+				opts.FieldSelector = fieldSelector
+				return core.Secrets(namespace).Watch(opts)
+			},
+			OnChangeFunc: onChangeFunc,
+		},
+		&v1.Secret{},
+		resyncPeriod)
+}
+
+// Creates a new EventStream for *v1.Pod
+func NewPodEventStream(core v1core.CoreInterface, namespace string, resyncPeriod time.Duration, onChangeFunc OnChangeFunc, labelSelector labels.Selector, fieldSelector fields.Selector) *EventStream {
+	return NewEventStream(
+		&EventListWatch{
+			ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+				// add the specified labelSelector and fieldSelector object to the options list
+				opts := options
+				opts.LabelSelector = labelSelector
+				opts.FieldSelector = fieldSelector
+				return core.Pods(namespace).List(opts)
+			},
+			WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+				// add the specified labelSelector and fieldSelector object to the options list
+				opts := options
+				opts.LabelSelector = labelSelector
+				opts.FieldSelector = fieldSelector
+				return core.Pods(namespace).Watch(opts)
+			},
+			OnChangeFunc: onChangeFunc,
+		},
+		&v1.Pod{},
+		resyncPeriod)
+}
+
+// Creates a new EventStream for *v1beta1.Ingress
+func NewIngressEventStream(ext v1beta1ext.ExtensionsInterface, namespace string, resyncPeriod time.Duration, onChangeFunc OnChangeFunc, labelSelector labels.Selector, fieldSelector fields.Selector) *EventStream {
+	return NewEventStream(
+		&EventListWatch{
+			ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+				// add the specified labelSelector and fieldSelector object to the options list
+				opts := options
+				opts.LabelSelector = labelSelector
+				opts.FieldSelector = fieldSelector
+				return ext.Ingresses(namespace).List(opts)
+			},
+			WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+				// add the specified labelSelector and fieldSelector object to the options list
+				opts := options
+				opts.LabelSelector = labelSelector
+				opts.FieldSelector = fieldSelector
+				return ext.Ingresses(namespace).Watch(opts)
+			},
+			OnChangeFunc: onChangeFunc,
+		},
+		&v1beta1.Ingress{},
+		resyncPeriod)
+}
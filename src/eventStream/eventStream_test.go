@@ -24,9 +24,11 @@ import (
 	"time"
 
 	"k8s.io/client-go/1.4/kubernetes/typed/core/v1/fake"
+	extfake "k8s.io/client-go/1.4/kubernetes/typed/extensions/v1beta1/fake"
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/1.4/pkg/runtime"
 	"k8s.io/client-go/1.4/pkg/watch"
 )
@@ -75,6 +77,20 @@ func newConfigMap(id, namespace, rv string) *v1.ConfigMap {
 	}
 }
 
+func newIngress(id, namespace, rv string) *v1beta1.Ingress {
+	return &v1beta1.Ingress{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "Ingress",
+			APIVersion: "extensions/v1beta1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:            id,
+			Namespace:       namespace,
+			ResourceVersion: rv,
+		},
+	}
+}
+
 func newService(id, namespace, rv string) *v1.Service {
 	return &v1.Service{
 		TypeMeta: unversioned.TypeMeta{
@@ -89,6 +105,35 @@ func newService(id, namespace, rv string) *v1.Service {
 	}
 }
 
+func newSecret(id, namespace, rv string) *v1.Secret {
+	return &v1.Secret{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: "v1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:            id,
+			Namespace:       namespace,
+			ResourceVersion: rv,
+		},
+		Type: v1.SecretTypeTLS,
+	}
+}
+
+func newPod(id, namespace, rv string) *v1.Pod {
+	return &v1.Pod{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "Pod",
+			APIVersion: "v1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:            id,
+			Namespace:       namespace,
+			ResourceVersion: rv,
+		},
+	}
+}
+
 func TestRunnerStartStop(t *testing.T) {
 	// This is the existing data on 'startup'
 	existingData := []v1.ConfigMap{
@@ -309,3 +354,69 @@ func TestNewServiceEventStream(t *testing.T) {
 	require.Equal(t, len(existingData), len(items), "Expected %v items in store, but got %v",
 		len(existingData), len(items))
 }
+
+func TestNewSecretEventStream(t *testing.T) {
+	namespace := "testns"
+	eventStream := NewSecretEventStream(&fake.FakeCore{}, namespace, 0, nil, nil, nil)
+	require.NotNil(t, eventStream, "Unexpected nil eventStream")
+
+	eventStore := eventStream.Store()
+	require.NotNil(t, eventStore, "Unexpected nil eventStore")
+
+	existingData := []v1.Secret{
+		*newSecret("secret0", namespace, "0"),
+		*newSecret("secret1", namespace, "1"),
+		*newSecret("secret2", namespace, "2"),
+	}
+	for _, item := range existingData {
+		err := eventStore.Add(&item)
+		require.Nil(t, err, "eventStore.Add() failed, err=%v", err)
+	}
+	items := eventStore.List()
+	require.Equal(t, len(existingData), len(items), "Expected %v items in store, but got %v",
+		len(existingData), len(items))
+}
+
+func TestNewPodEventStream(t *testing.T) {
+	namespace := "testns"
+	eventStream := NewPodEventStream(&fake.FakeCore{}, namespace, 0, nil, nil, nil)
+	require.NotNil(t, eventStream, "Unexpected nil eventStream")
+
+	eventStore := eventStream.Store()
+	require.NotNil(t, eventStore, "Unexpected nil eventStore")
+
+	existingData := []v1.Pod{
+		*newPod("pod0", namespace, "0"),
+		*newPod("pod1", namespace, "1"),
+		*newPod("pod2", namespace, "2"),
+	}
+	for _, item := range existingData {
+		err := eventStore.Add(&item)
+		require.Nil(t, err, "eventStore.Add() failed, err=%v", err)
+	}
+	items := eventStore.List()
+	require.Equal(t, len(existingData), len(items), "Expected %v items in store, but got %v",
+		len(existingData), len(items))
+}
+
+func TestNewIngressEventStream(t *testing.T) {
+	namespace := "testns"
+	eventStream := NewIngressEventStream(&extfake.FakeExtensions{}, namespace, 0, nil, nil, nil)
+	require.NotNil(t, eventStream, "Unexpected nil eventStream")
+
+	eventStore := eventStream.Store()
+	require.NotNil(t, eventStore, "Unexpected nil eventStore")
+
+	existingData := []v1beta1.Ingress{
+		*newIngress("ingress0", namespace, "0"),
+		*newIngress("ingress1", namespace, "1"),
+		*newIngress("ingress2", namespace, "2"),
+	}
+	for _, item := range existingData {
+		err := eventStore.Add(&item)
+		require.Nil(t, err, "eventStore.Add() failed, err=%v", err)
+	}
+	items := eventStore.List()
+	require.Equal(t, len(existingData), len(items), "Expected %v items in store, but got %v",
+		len(existingData), len(items))
+}
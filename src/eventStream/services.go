@@ -0,0 +1,138 @@
+/*-
+ * Copyright (c) 2016,2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eventStream
+
+import (
+	"encoding/json"
+	"io"
+
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/pkg/watch"
+	"k8s.io/client-go/1.4/rest"
+)
+
+// Annotation DecodeService records a Service's spec.externalTrafficPolicy
+// in, the client's v1.Service predates the field. Only set on the objects in
+// the stores, it must not be written back to the API server.
+const ExternalTrafficPolicyAnnotation = "eventstream.f5.com/external-traffic-policy"
+
+// Decode a Service from its JSON, keeping spec.externalTrafficPolicy
+func DecodeService(data []byte) (*v1.Service, error) {
+	var svc v1.Service
+	if err := json.Unmarshal(data, &svc); nil != err {
+		return nil, err
+	}
+	var fields struct {
+		Spec struct {
+			ExternalTrafficPolicy string `json:"externalTrafficPolicy"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(data, &fields); nil != err {
+		return nil, err
+	}
+	if policy := fields.Spec.ExternalTrafficPolicy; 0 != len(policy) {
+		if nil == svc.ObjectMeta.Annotations {
+			svc.ObjectMeta.Annotations = make(map[string]string)
+		}
+		svc.ObjectMeta.Annotations[ExternalTrafficPolicyAnnotation] = policy
+	}
+	return &svc, nil
+}
+
+// List the Services of a namespace, decoding them with DecodeService
+func listServices(
+	client *rest.RESTClient,
+	namespace string,
+	options api.ListOptions) (*v1.ServiceList, error) {
+
+	data, err := client.Get().
+		Namespace(namespace).
+		Resource("services").
+		VersionedParams(&options, api.ParameterCodec).
+		Do().
+		Raw()
+	if nil != err {
+		return nil, err
+	}
+	var raw struct {
+		Metadata unversioned.ListMeta `json:"metadata"`
+		Items    []json.RawMessage    `json:"items"`
+	}
+	if err = json.Unmarshal(data, &raw); nil != err {
+		return nil, err
+	}
+	list := &v1.ServiceList{ListMeta: raw.Metadata}
+	for _, item := range raw.Items {
+		svc, err := DecodeService(item)
+		if nil != err {
+			return nil, err
+		}
+		list.Items = append(list.Items, *svc)
+	}
+	return list, nil
+}
+
+// Watch the Services of a namespace, decoding them with DecodeService
+func watchServices(
+	client *rest.RESTClient,
+	namespace string,
+	options api.ListOptions) (watch.Interface, error) {
+
+	stream, err := client.Get().
+		Prefix("watch").
+		Namespace(namespace).
+		Resource("services").
+		VersionedParams(&options, api.ParameterCodec).
+		Stream()
+	if nil != err {
+		return nil, err
+	}
+	return watch.NewStreamWatcher(&serviceDecoder{
+		stream:  stream,
+		decoder: json.NewDecoder(stream),
+	}), nil
+}
+
+// Decoder of the events of a Service watch
+type serviceDecoder struct {
+	stream  io.ReadCloser
+	decoder *json.Decoder
+}
+
+func (d *serviceDecoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.decoder.Decode(&event); nil != err {
+		return "", nil, err
+	}
+	if watch.Error == event.Type {
+		var status unversioned.Status
+		err := json.Unmarshal(event.Object, &status)
+		return event.Type, &status, err
+	}
+	svc, err := DecodeService(event.Object)
+	return event.Type, svc, err
+}
+
+func (d *serviceDecoder) Close() {
+	d.stream.Close()
+}
@@ -0,0 +1,84 @@
+/*-
+ * Copyright (c) 2016,2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eventStream
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/watch"
+)
+
+var serviceLocal string = `{
+  "metadata": {"name": "foo", "namespace": "default", "resourceVersion": "1"},
+  "spec": {
+    "type": "NodePort",
+    "ports": [{"port": 80, "nodePort": 30001}],
+    "externalTrafficPolicy": "Local"
+  }
+}`
+
+func TestDecodeService(t *testing.T) {
+	require := require.New(t)
+
+	svc, err := DecodeService([]byte(serviceLocal))
+	require.Nil(err)
+	require.Equal("foo", svc.ObjectMeta.Name)
+	require.Equal(v1.ServiceTypeNodePort, svc.Spec.Type)
+	require.Equal(int32(30001), svc.Spec.Ports[0].NodePort)
+	require.Equal(map[string]string{ExternalTrafficPolicyAnnotation: "Local"},
+		svc.ObjectMeta.Annotations,
+		"Expected the traffic policy to be kept without any annotation")
+
+	svc, err = DecodeService([]byte(`{"metadata": {"name": "bar",
+		"annotations": {"a": "b"}}, "spec": {"type": "ClusterIP"}}`))
+	require.Nil(err)
+	require.Equal(map[string]string{"a": "b"}, svc.ObjectMeta.Annotations)
+
+	_, err = DecodeService([]byte(`{"metadata": []}`))
+	require.NotNil(err)
+}
+
+func TestServiceDecoder(t *testing.T) {
+	require := require.New(t)
+
+	stream := ioutil.NopCloser(strings.NewReader(
+		`{"type": "ADDED", "object": ` + serviceLocal + `}
+		{"type": "ERROR", "object": {"status": "Failure", "code": 410}}`))
+	decoder := &serviceDecoder{stream: stream, decoder: json.NewDecoder(stream)}
+
+	eventType, obj, err := decoder.Decode()
+	require.Nil(err)
+	require.Equal(watch.Added, eventType)
+	svc, ok := obj.(*v1.Service)
+	require.True(ok)
+	require.Equal("Local",
+		svc.ObjectMeta.Annotations[ExternalTrafficPolicyAnnotation])
+
+	eventType, obj, err = decoder.Decode()
+	require.Nil(err)
+	require.Equal(watch.Error, eventType)
+	require.Equal(&unversioned.Status{Status: "Failure", Code: 410}, obj)
+
+	_, _, err = decoder.Decode()
+	require.NotNil(err)
+}
@@ -18,7 +18,9 @@ package main
 
 import (
 	"bufio"
+	"expvar"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -29,6 +31,7 @@ import (
 
 	"eventStream"
 	"openshift"
+	"tools/nodeAddress"
 	"tools/pollers"
 	"tools/writer"
 	"virtualServer"
@@ -39,9 +42,14 @@ import (
 	"github.com/spf13/pflag"
 
 	"k8s.io/client-go/1.4/kubernetes"
+	v1core "k8s.io/client-go/1.4/kubernetes/typed/core/v1"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/fields"
 	"k8s.io/client-go/1.4/pkg/labels"
 	"k8s.io/client-go/1.4/rest"
 	"k8s.io/client-go/1.4/tools/clientcmd"
+	"k8s.io/client-go/1.4/tools/record"
 )
 
 type GlobalSection struct {
@@ -63,17 +71,24 @@ var (
 	bigIPFlags        *pflag.FlagSet
 	kubeFlags         *pflag.FlagSet
 	openshiftSDNFlags *pflag.FlagSet
+	ipamFlags         *pflag.FlagSet
 
 	pythonBaseDir    *string
 	logLevel         *string
 	verifyInterval   *int
 	nodePollInterval *int
-
-	namespace       *string
-	useNodeInternal *bool
-	poolMemberType  *string
-	inCluster       *bool
-	kubeConfig      *string
+	metricsAddress   *string
+
+	namespaces        *[]string
+	allNamespaces     *bool
+	useNodeInternal   *bool
+	nodeAddressFamily *string
+	poolMemberType    *string
+	inCluster         *bool
+	kubeConfig        *string
+	drainPeriod       *int
+	nodeLabels        *string
+	nodeAddressTypes  *string
 
 	bigIPURL        *string
 	bigIPUsername   *string
@@ -83,8 +98,14 @@ var (
 	openshiftSDNMode string
 	openshiftSDNName *string
 
+	ipamRanges    *[]string
+	ipamNamespace *string
+	ipamConfigMap *string
+
 	// package variables
-	isNodePort bool
+	isNodePort     bool
+	nodeSelector   labels.Selector
+	nodeAddrPolicy *nodeAddress.Policy
 )
 
 func init() {
@@ -93,6 +114,7 @@ func init() {
 	bigIPFlags = pflag.NewFlagSet("BigIP", pflag.ContinueOnError)
 	kubeFlags = pflag.NewFlagSet("Kubernetes", pflag.ContinueOnError)
 	openshiftSDNFlags = pflag.NewFlagSet("Openshift SDN", pflag.ContinueOnError)
+	ipamFlags = pflag.NewFlagSet("IPAM", pflag.ContinueOnError)
 
 	// Global flags
 	pythonBaseDir = globalFlags.String("python-basedir", "/app/python",
@@ -103,6 +125,8 @@ func init() {
 		"Optional, interval (in seconds) at which to verify the BIG-IP configuration.")
 	nodePollInterval = globalFlags.Int("node-poll-interval", 30,
 		"Optional, interval (in seconds) at which to poll for cluster nodes.")
+	metricsAddress = globalFlags.String("metrics-address", "",
+		"Optional, address (e.g. ':9090') to serve metrics on, at /debug/vars.")
 
 	globalFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "  Global:\n%s\n", globalFlags.FlagUsages())
@@ -123,19 +147,39 @@ func init() {
 	}
 
 	// Kubernetes flags
-	namespace = kubeFlags.String("namespace", "",
-		"Required, Kubernetes namespace to watch")
+	namespaces = kubeFlags.StringArray("namespace", []string{},
+		"Required, Kubernetes namespace(s) to watch, "+
+			"unless --all-namespaces is given")
+	allNamespaces = kubeFlags.Bool("all-namespaces", false,
+		"Optional, watch all Kubernetes namespaces instead of --namespace")
 	useNodeInternal = kubeFlags.Bool("use-node-internal", true,
 		"Optional, provide kubernetes InternalIP addresses to pool")
+	nodeAddressFamily = kubeFlags.String("node-address-family",
+		virtualServer.AddressFamilyAny,
+		"Optional, address family of the node addresses to pool, "+
+			"'ipv4', 'ipv6' or 'any' for all of them.")
 	poolMemberType = kubeFlags.String("pool-member-type", "nodeport",
 		"Optional, type of BIG-IP pool members to create. "+
-			"'nodeport' will use k8s service NodePort. "+
+			"'nodeport' will use k8s service NodePort, only the nodes "+
+			"running the pods of Services with "+
+			"spec.externalTrafficPolicy Local or annotated "+
+			"service.beta.kubernetes.io/external-traffic: OnlyLocal. "+
 			"'cluster' will use service endpoints. "+
 			"The BIG-IP must be able access the cluster network")
 	inCluster = kubeFlags.Bool("running-in-cluster", true,
 		"Optional, if this controller is running in a kubernetes cluster, use the pod secrets for creating a Kubernetes client.")
 	kubeConfig = kubeFlags.String("kubeconfig", "./config",
 		"Optional, absolute path to the kubeconfig file")
+	drainPeriod = kubeFlags.Int("pool-member-drain-period", 0,
+		"Optional, time (in seconds) removed pool members are kept on the "+
+			"BIG-IP, without new connections, before they are deleted.")
+	nodeLabels = kubeFlags.String("node-label-selector", "",
+		"Optional, label selector of the nodes used as pool members in "+
+			"nodeport mode. If not provided all schedulable nodes are used.")
+	nodeAddressTypes = kubeFlags.String("node-address-types", "",
+		"Optional, comma separated node address types to pool, in order of "+
+			"preference, e.g. 'InternalIP,ExternalIP,Hostname'. "+
+			"Overrides use-node-internal.")
 
 	kubeFlags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "  Kubernetes:\n%s\n", kubeFlags.FlagUsages())
@@ -155,10 +199,25 @@ func init() {
 		fmt.Fprintf(os.Stderr, "  Openshift SDN:\n%s\n", openshiftSDNFlags.FlagUsages())
 	}
 
+	// IPAM flags
+	ipamRanges = ipamFlags.StringArray("ipam-range", []string{},
+		"Optional, CIDR range to allocate virtual addresses from when a "+
+			"virtual server has no bindAddr. May be limited to a partition or "+
+			"namespace with 'partition:<name>=<cidr>' or 'namespace:<name>=<cidr>'.")
+	ipamNamespace = ipamFlags.String("ipam-namespace", "kube-system",
+		"Optional, namespace of the ConfigMap storing IPAM allocations")
+	ipamConfigMap = ipamFlags.String("ipam-configmap", "f5-ipam",
+		"Optional, name of the ConfigMap storing IPAM allocations")
+
+	ipamFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "  IPAM:\n%s\n", ipamFlags.FlagUsages())
+	}
+
 	flags.AddFlagSet(globalFlags)
 	flags.AddFlagSet(bigIPFlags)
 	flags.AddFlagSet(kubeFlags)
 	flags.AddFlagSet(openshiftSDNFlags)
+	flags.AddFlagSet(ipamFlags)
 
 	flags.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s\n", os.Args[0])
@@ -166,6 +225,7 @@ func init() {
 		bigIPFlags.Usage()
 		kubeFlags.Usage()
 		openshiftSDNFlags.Usage()
+		ipamFlags.Usage()
 	}
 }
 
@@ -305,7 +365,7 @@ func verifyArgs() error {
 	}
 
 	if len(*bigIPURL) == 0 || len(*bigIPUsername) == 0 || len(*bigIPPassword) == 0 ||
-		len(*bigIPPartitions) == 0 || len(*namespace) == 0 || len(*poolMemberType) == 0 {
+		len(*bigIPPartitions) == 0 || len(*poolMemberType) == 0 {
 		return fmt.Errorf("Missing required parameter")
 	}
 
@@ -329,6 +389,53 @@ func verifyArgs() error {
 			u.Path)
 	}
 
+	// Each namespace is watched once, however often it is given
+	seen := make(map[string]bool)
+	uniqueNamespaces := []string{}
+	for _, ns := range *namespaces {
+		if len(ns) == 0 {
+			return fmt.Errorf("Namespace cannot be an empty string")
+		}
+		if !seen[ns] {
+			seen[ns] = true
+			uniqueNamespaces = append(uniqueNamespaces, ns)
+		}
+	}
+	*namespaces = uniqueNamespaces
+	if *allNamespaces && 0 != len(*namespaces) {
+		return fmt.Errorf("--namespace cannot be used with --all-namespaces")
+	}
+	if !*allNamespaces && 0 == len(*namespaces) {
+		return fmt.Errorf("Missing required parameter --namespace, " +
+			"or --all-namespaces to watch all namespaces")
+	}
+
+	if *drainPeriod < 0 {
+		return fmt.Errorf("pool-member-drain-period cannot be negative")
+	}
+
+	addrTypes := []string{string(v1.NodeExternalIP)}
+	if 0 != len(*nodeAddressTypes) {
+		addrTypes = strings.Split(*nodeAddressTypes, ",")
+	} else if *useNodeInternal {
+		addrTypes = []string{string(v1.NodeInternalIP)}
+	}
+	policy, err := nodeAddress.NewPolicy(addrTypes, *nodeAddressFamily)
+	if nil != err {
+		return fmt.Errorf("Invalid node address settings: %v", err)
+	}
+	nodeAddrPolicy = policy
+
+	nodeSelector = nil
+	if 0 != len(*nodeLabels) {
+		selector, err := labels.Parse(*nodeLabels)
+		if nil != err {
+			return fmt.Errorf("Invalid node-label-selector '%v': %v",
+				*nodeLabels, err)
+		}
+		nodeSelector = selector
+	}
+
 	if *poolMemberType == "nodeport" {
 		isNodePort = true
 	} else if *poolMemberType == "cluster" {
@@ -350,12 +457,13 @@ func verifyArgs() error {
 func setupNodePolling(
 	kubeClient kubernetes.Interface,
 	configWriter writer.Writer,
+	vsm *virtualServer.Manager,
 ) (pollers.Poller, error) {
 	intervalFactor := time.Duration(*nodePollInterval)
 	np := pollers.NewNodePoller(kubeClient, intervalFactor*time.Second)
 
 	if isNodePort {
-		err := np.RegisterListener(virtualServer.ProcessNodeUpdate)
+		err := np.RegisterListener(vsm.ProcessNodeUpdate)
 		if nil != err {
 			return nil,
 				fmt.Errorf("error registering node update listener for nodeport mode: %v",
@@ -367,7 +475,7 @@ func setupNodePolling(
 		osMgr, err := openshift.NewOpenshiftSDNMgr(
 			openshiftSDNMode,
 			*openshiftSDNName,
-			*useNodeInternal,
+			nodeAddrPolicy,
 			configWriter,
 		)
 		if nil != err {
@@ -385,6 +493,117 @@ func setupNodePolling(
 	return np, nil
 }
 
+// Create and run the Pod, Service, ConfigMap, iRule ConfigMap, Ingress,
+// Endpoints and Secret event streams for a single namespace (or all
+// namespaces when given api.NamespaceAll)
+func setupWatchers(
+	kubeClient kubernetes.Interface,
+	vsm *virtualServer.Manager,
+	namespace string,
+	f5ConfigMapSelector labels.Selector,
+	iRuleSelector labels.Selector,
+) []eventStream.EventStreamRunner {
+	var streams []eventStream.EventStreamRunner
+	var endptEventStore *eventStream.EventStore
+
+	// Pods are only read, for the readiness probes behind each Service
+	podEventStream := eventStream.NewPodEventStream(
+		kubeClient.Core(),
+		namespace,
+		5*time.Second,
+		nil,
+		nil,
+		nil)
+	vsm.AddPodStore(podEventStream.Store())
+	podEventStream.Run()
+	streams = append(streams, podEventStream)
+
+	onServiceChange := func(changeType eventStream.ChangeType, obj interface{}) {
+		vsm.ProcessServiceUpdate(changeType, obj, endptEventStore)
+	}
+	serviceEventStream := eventStream.NewServiceEventStream(
+		kubeClient.Core(),
+		namespace,
+		5*time.Second,
+		onServiceChange,
+		nil,
+		nil)
+	serviceEventStream.Run()
+	streams = append(streams, serviceEventStream)
+
+	onConfigMapChange := func(changeType eventStream.ChangeType, obj interface{}) {
+		vsm.ProcessConfigMapUpdate(changeType, obj, endptEventStore)
+	}
+	configMapEventStream := eventStream.NewConfigMapEventStream(
+		kubeClient.Core(),
+		namespace,
+		5*time.Second,
+		onConfigMapChange,
+		f5ConfigMapSelector,
+		nil)
+	// Endpoints are the pool members in cluster mode. In either mode they
+	// change with the pods, whose readiness probes become health monitors
+	onEpChange := func(changeType eventStream.ChangeType, obj interface{}) {
+		vsm.ProcessEndpointsUpdate(changeType, obj, serviceEventStream.Store())
+	}
+	endptEventStream := eventStream.NewEndpointsEventStream(
+		kubeClient.Core(),
+		namespace,
+		5*time.Second,
+		onEpChange,
+		nil,
+		nil)
+	endptEventStore = endptEventStream.Store()
+	endptEventStream.Run()
+	streams = append(streams, endptEventStream)
+
+	configMapEventStream.Run()
+	streams = append(streams, configMapEventStream)
+
+	onIRuleChange := func(changeType eventStream.ChangeType, obj interface{}) {
+		vsm.ProcessIRuleUpdate(changeType, obj)
+	}
+	iRuleEventStream := eventStream.NewConfigMapEventStream(
+		kubeClient.Core(),
+		namespace,
+		5*time.Second,
+		onIRuleChange,
+		iRuleSelector,
+		nil)
+	iRuleEventStream.Run()
+	streams = append(streams, iRuleEventStream)
+
+	onIngressChange := func(changeType eventStream.ChangeType, obj interface{}) {
+		vsm.ProcessIngressUpdate(changeType, obj, endptEventStore)
+	}
+	ingressEventStream := eventStream.NewIngressEventStream(
+		kubeClient.Extensions(),
+		namespace,
+		5*time.Second,
+		onIngressChange,
+		nil,
+		nil)
+	ingressEventStream.Run()
+	streams = append(streams, ingressEventStream)
+
+	onSecretChange := func(changeType eventStream.ChangeType, obj interface{}) {
+		vsm.ProcessSecretUpdate(changeType, obj)
+	}
+	// Only TLS Secrets hold certificates, leave every other Secret unread
+	secretEventStream := eventStream.NewSecretEventStream(
+		kubeClient.Core(),
+		namespace,
+		5*time.Second,
+		onSecretChange,
+		nil,
+		fields.OneTermEqualSelector("type", string(v1.SecretTypeTLS)))
+	vsm.AddSecretStore(secretEventStream.Store())
+	secretEventStream.Run()
+	streams = append(streams, secretEventStream)
+
+	return streams
+}
+
 func main() {
 	err := flags.Parse(os.Args)
 	if nil != err {
@@ -398,18 +617,20 @@ func main() {
 		os.Exit(1)
 	}
 
-	// FIXME(yacobucci) virtualServer should really be an object and not a
-	// singleton at some point
+	if 0 != len(*metricsAddress) {
+		// Metrics are published with expvar
+		go func() {
+			err := http.ListenAndServe(*metricsAddress, nil)
+			log.Warningf("Failed serving metrics on %s: %v", *metricsAddress, err)
+		}()
+	}
+
 	configWriter, err := writer.NewConfigWriter()
 	if nil != err {
 		log.Fatalf("Failed creating ConfigWriter tool: %v", err)
 	}
 	defer configWriter.Stop()
 
-	virtualServer.SetConfigWriter(configWriter)
-	virtualServer.SetUseNodeInternal(*useNodeInternal)
-	virtualServer.SetNamespace(*namespace)
-
 	subPidCh, err := startPythonDriver(configWriter)
 	if nil != err {
 		log.Fatalf("Could not initialize subprocess configuration: %v", err)
@@ -448,8 +669,45 @@ func main() {
 		log.Fatalf("failed to create client: %v", err)
 	}
 
+	// Record configuration problems as Kubernetes Events
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{
+		Interface: kubeClient.Core().Events(""),
+	})
+	eventRecorder := eventBroadcaster.NewRecorder(
+		v1.EventSource{Component: "k8s-bigip-ctlr"})
+
+	var ipam *virtualServer.IPAM
+	if 0 != len(*ipamRanges) {
+		ipam, err = virtualServer.NewIPAM(kubeClient, *ipamNamespace,
+			*ipamConfigMap, *ipamRanges)
+		if nil != err {
+			log.Fatalf("Failed to set up IPAM: %v", err)
+		}
+	}
+
+	vsm := virtualServer.NewManager(&virtualServer.Params{
+		KubeClient:      kubeClient,
+		ConfigWriter:    configWriter,
+		Namespaces:      *namespaces,
+		UseNodeInternal: *useNodeInternal,
+		IsNodePort:      isNodePort,
+		NodeSelector:    nodeSelector,
+		EventRecorder:   eventRecorder,
+		IPAM:            ipam,
+		// LoadBalancer Services go to the first partition
+		DefaultPartition: (*bigIPPartitions)[0],
+		DrainPeriod:      time.Duration(*drainPeriod) * time.Second,
+		// Dual-stack nodes can be pooled by one of their addresses
+		NodeAddressFamily: *nodeAddressFamily,
+		NodeAddressPolicy: nodeAddrPolicy,
+	})
+	expvar.Publish("schemaValidation", expvar.Func(func() interface{} {
+		return vsm.GetSchemaStats()
+	}))
+
 	if isNodePort || 0 != len(openshiftSDNMode) {
-		poller, err := setupNodePolling(kubeClient, configWriter)
+		poller, err := setupNodePolling(kubeClient, configWriter, vsm)
 		if nil != err {
 			log.Fatalf("Required polling utility for node updates failed setup: %v",
 				err)
@@ -459,54 +717,31 @@ func main() {
 		defer poller.Stop()
 	}
 
-	var endptEventStore *eventStream.EventStore
-
-	onServiceChange := func(changeType eventStream.ChangeType, obj interface{}) {
-		virtualServer.ProcessServiceUpdate(kubeClient, changeType, obj, isNodePort, endptEventStore)
-	}
-	serviceEventStream := eventStream.NewServiceEventStream(
-		kubeClient.Core(),
-		*namespace,
-		5*time.Second,
-		onServiceChange,
-		nil,
-		nil)
-	serviceEventStream.Run()
-	defer serviceEventStream.Stop()
-
-	onConfigMapChange := func(changeType eventStream.ChangeType, obj interface{}) {
-		virtualServer.ProcessConfigMapUpdate(kubeClient, changeType, obj, isNodePort, endptEventStore)
-	}
 	f5ConfigMapSelector, err := labels.Parse("f5type in (virtual-server)")
 	if err != nil {
 		log.Warningf("failed to parse Label Selector string - controller will not filter for F5 specific objects - label: f5type : virtual-server, err %v", err)
 		f5ConfigMapSelector = nil
 	}
-	configMapEventStream := eventStream.NewConfigMapEventStream(
-		kubeClient.Core(),
-		*namespace,
-		5*time.Second,
-		onConfigMapChange,
-		f5ConfigMapSelector,
-		nil)
-	if !isNodePort {
-		onEpChange := func(changeType eventStream.ChangeType, obj interface{}) {
-			virtualServer.ProcessEndpointsUpdate(kubeClient, changeType, obj, serviceEventStream.Store())
+	iRuleSelector := labels.SelectorFromSet(labels.Set{"f5type": "irule"})
+
+	watchNamespaces := *namespaces
+	if *allNamespaces {
+		log.Infof("Watching all namespaces")
+		watchNamespaces = []string{api.NamespaceAll}
+	}
+
+	for _, ns := range watchNamespaces {
+		streams := setupWatchers(kubeClient, vsm, ns, f5ConfigMapSelector,
+			iRuleSelector)
+		for _, es := range streams {
+			defer es.Stop()
 		}
-		endptEventStream := eventStream.NewEndpointsEventStream(
-			kubeClient.Core(),
-			*namespace,
-			5*time.Second,
-			onEpChange,
-			nil,
-			nil)
-		endptEventStore = endptEventStream.Store()
-		endptEventStream.Run()
-		defer endptEventStream.Stop()
 	}
 
-	configMapEventStream.Run()
-	defer configMapEventStream.Stop()
+	// Free the addresses of resources deleted while the controller was down
+	if err := vsm.ReclaimAddresses(); nil != err {
+		log.Warningf("Failed to reclaim IPAM addresses: %v", err)
+	}
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -28,6 +28,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
 )
 
 type MockOut struct{}
@@ -40,12 +42,18 @@ func resetFlags() {
 	pythonBaseDir = new(string)
 	logLevel = new(string)
 	verifyInterval = new(int)
+	metricsAddress = new(string)
 
-	namespace = new(string)
+	namespaces = &[]string{}
+	allNamespaces = new(bool)
 	useNodeInternal = new(bool)
+	nodeAddressFamily = new(string)
 	poolMemberType = new(string)
 	inCluster = new(bool)
 	kubeConfig = new(string)
+	drainPeriod = new(int)
+	nodeLabels = new(string)
+	nodeAddressTypes = new(string)
 
 	bigIPURL = new(string)
 	bigIPUsername = new(string)
@@ -55,8 +63,14 @@ func resetFlags() {
 	openshiftSDNMode = ""
 	openshiftSDNName = new(string)
 
+	ipamRanges = &[]string{}
+	ipamNamespace = new(string)
+	ipamConfigMap = new(string)
+
 	// package variables
 	isNodePort = false
+	nodeSelector = nil
+	nodeAddrPolicy = nil
 }
 
 func TestConfigSetup(t *testing.T) {
@@ -253,7 +267,7 @@ func TestVerifyArgs(t *testing.T) {
 	flags.Parse(os.Args)
 	argError := verifyArgs()
 	assert.Nil(t, argError, "there should not be an error")
-	assert.Equal(t, "testing", *namespace, "namespace flag not parsed correctly")
+	assert.Equal(t, []string{"testing"}, *namespaces, "namespace flag not parsed correctly")
 	assert.Equal(t, "https://bigip.example.com", *bigIPURL, "bigipUrl flag not parsed correctly")
 	assert.Equal(t, "admin", *bigIPUsername, "bigipUsername flag not parsed correctly")
 	assert.Equal(t, "admin", *bigIPPassword, "bigipPassword flag not parsed correctly")
@@ -273,7 +287,6 @@ func TestVerifyArgs(t *testing.T) {
 
 	// Test empty required args
 	allArgs := map[string]*string{
-		"namespace":     namespace,
 		"bigipUrl":      bigIPURL,
 		"bigipUsername": bigIPUsername,
 		"bigipPassword": bigIPPassword,
@@ -296,6 +309,151 @@ func TestVerifyArgs(t *testing.T) {
 	*bigIPPartitions = holder
 }
 
+func TestVerifyArgsNamespaces(t *testing.T) {
+	os.Args = []string{
+		"./bin/k8s-bigip-ctlr",
+		"--namespace=testing",
+		"--namespace=production",
+		"--bigip-partition=velcro1",
+		"--bigip-password=admin",
+		"--bigip-url=bigip.example.com",
+		"--bigip-username=admin",
+		"--pool-member-type=nodeport"}
+
+	flags.Parse(os.Args)
+	argError := verifyArgs()
+	assert.Nil(t, argError, "there should not be an error")
+	assert.Equal(t, []string{"testing", "production"}, *namespaces,
+		"namespace flag not parsed correctly")
+
+	// All namespaces are only watched when asked for
+	*namespaces = []string{}
+	argError = verifyArgs()
+	assert.Error(t, argError, "namespace should be required")
+	*allNamespaces = true
+	argError = verifyArgs()
+	assert.Nil(t, argError, "there should not be an error")
+	*namespaces = []string{"testing"}
+	argError = verifyArgs()
+	assert.Error(t, argError,
+		"namespace should not be allowed with all-namespaces")
+	*allNamespaces = false
+
+	*namespaces = []string{"testing", ""}
+	argError = verifyArgs()
+	assert.Error(t, argError, "empty namespace should not be allowed")
+
+	*namespaces = []string{"testing", "production", "testing"}
+	argError = verifyArgs()
+	assert.Nil(t, argError, "there should not be an error")
+	assert.Equal(t, []string{"testing", "production"}, *namespaces,
+		"namespaces should only be watched once")
+}
+
+func TestVerifyArgsDrainPeriod(t *testing.T) {
+	os.Args = []string{
+		"./bin/k8s-bigip-ctlr",
+		"--namespace=testing",
+		"--bigip-partition=velcro1",
+		"--bigip-password=admin",
+		"--bigip-url=bigip.example.com",
+		"--bigip-username=admin",
+		"--pool-member-type=cluster"}
+
+	flags.Parse(os.Args)
+	*drainPeriod = 30
+	argError := verifyArgs()
+	assert.Nil(t, argError, "there should not be an error")
+
+	*drainPeriod = -1
+	argError = verifyArgs()
+	assert.Error(t, argError, "negative drain period should not be allowed")
+	*drainPeriod = 0
+}
+
+func TestVerifyArgsNodeLabelSelector(t *testing.T) {
+	os.Args = []string{
+		"./bin/k8s-bigip-ctlr",
+		"--namespace=testing",
+		"--bigip-partition=velcro1",
+		"--bigip-password=admin",
+		"--bigip-url=bigip.example.com",
+		"--bigip-username=admin",
+		"--node-label-selector=role=edge"}
+
+	flags.Parse(os.Args)
+	argError := verifyArgs()
+	assert.Nil(t, argError, "there should not be an error")
+	require.NotNil(t, nodeSelector)
+	assert.True(t, nodeSelector.Matches(labels.Set{"role": "edge"}))
+	assert.False(t, nodeSelector.Matches(labels.Set{"role": "worker"}))
+
+	*nodeLabels = "role in (edge"
+	argError = verifyArgs()
+	assert.Error(t, argError, "invalid selector should not be allowed")
+	*nodeLabels = ""
+	argError = verifyArgs()
+	assert.Nil(t, argError, "there should not be an error")
+	assert.Nil(t, nodeSelector, "no selector should select all nodes")
+}
+
+func TestVerifyArgsNodeAddressFamily(t *testing.T) {
+	os.Args = []string{
+		"./bin/k8s-bigip-ctlr",
+		"--namespace=testing",
+		"--bigip-partition=velcro1",
+		"--bigip-password=admin",
+		"--bigip-url=bigip.example.com",
+		"--bigip-username=admin",
+		"--node-address-family=ipv6"}
+
+	flags.Parse(os.Args)
+	argError := verifyArgs()
+	assert.Nil(t, argError, "there should not be an error")
+	assert.Equal(t, "ipv6", *nodeAddressFamily)
+
+	*nodeAddressFamily = "ipx"
+	argError = verifyArgs()
+	assert.Error(t, argError, "unknown address family should not be allowed")
+	*nodeAddressFamily = "any"
+}
+
+func TestVerifyArgsNodeAddressTypes(t *testing.T) {
+	os.Args = []string{
+		"./bin/k8s-bigip-ctlr",
+		"--namespace=testing",
+		"--bigip-partition=velcro1",
+		"--bigip-password=admin",
+		"--bigip-url=bigip.example.com",
+		"--bigip-username=admin",
+		"--node-address-types=InternalIP,ExternalIP,Hostname"}
+
+	flags.Parse(os.Args)
+	argError := verifyArgs()
+	assert.Nil(t, argError, "there should not be an error")
+	require.NotNil(t, nodeAddrPolicy)
+	assert.Equal(t, []v1.NodeAddressType{
+		v1.NodeInternalIP, v1.NodeExternalIP, v1.NodeHostName},
+		nodeAddrPolicy.Types)
+
+	*nodeAddressTypes = "InternalIP,PublicIP"
+	argError = verifyArgs()
+	assert.Error(t, argError, "unknown address type should not be allowed")
+
+	// Without types use-node-internal chooses one
+	*nodeAddressTypes = ""
+	*useNodeInternal = false
+	argError = verifyArgs()
+	assert.Nil(t, argError, "there should not be an error")
+	assert.Equal(t, []v1.NodeAddressType{v1.NodeExternalIP},
+		nodeAddrPolicy.Types)
+	*useNodeInternal = true
+	argError = verifyArgs()
+	assert.Nil(t, argError, "there should not be an error")
+	assert.Equal(t, []v1.NodeAddressType{v1.NodeInternalIP},
+		nodeAddrPolicy.Types)
+}
+
 func TestOpenshiftSDNFlags(t *testing.T) {
 	os.Args = []string{
 		"./bin/k8s-bigip-ctlr",
@@ -21,6 +21,7 @@ import (
 	"time"
 
 	log "f5/vlogger"
+	"tools/nodeAddress"
 	"tools/writer"
 
 	"k8s.io/client-go/1.4/pkg/api/v1"
@@ -34,20 +35,22 @@ type sdnSection struct {
 type OpenshiftSDNMgr struct {
 	mode       string
 	vxLAN      string
-	useNodeInt bool
+	addrPolicy *nodeAddress.Policy
 	config     writer.Writer
 }
 
 func NewOpenshiftSDNMgr(
 	mode string,
 	vxLAN string,
-	useNodeInternal bool,
+	addrPolicy *nodeAddress.Policy,
 	config writer.Writer,
 ) (*OpenshiftSDNMgr, error) {
 	if 0 == len(mode) {
 		return nil, fmt.Errorf("required parameter mode not supplied")
 	} else if 0 == len(vxLAN) {
 		return nil, fmt.Errorf("required parameter vxlan not supplied")
+	} else if nil == addrPolicy {
+		return nil, fmt.Errorf("required parameter address policy not supplied")
 	} else if nil == config {
 		return nil, fmt.Errorf("required parameter ConfigWriter not supplied")
 	}
@@ -59,7 +62,7 @@ func NewOpenshiftSDNMgr(
 	osMgr := &OpenshiftSDNMgr{
 		mode:       mode,
 		vxLAN:      vxLAN,
-		useNodeInt: useNodeInternal,
+		addrPolicy: addrPolicy,
 		config:     config,
 	}
 
@@ -81,20 +84,8 @@ func (osm *OpenshiftSDNMgr) ProcessNodeUpdate(obj interface{}, err error) {
 	}
 
 	var addrs []string
-	var addrType v1.NodeAddressType
-	if osm.useNodeInt {
-		addrType = v1.NodeInternalIP
-	} else {
-		addrType = v1.NodeExternalIP
-	}
-
-	for _, node := range nodes {
-		nodeAddrs := node.Status.Addresses
-		for _, addr := range nodeAddrs {
-			if addr.Type == addrType {
-				addrs = append(addrs, addr.Address)
-			}
-		}
+	for i := range nodes {
+		addrs = append(addrs, osm.addrPolicy.Addresses(&nodes[i])...)
 	}
 
 	doneCh, errCh, err := osm.config.SendSection(
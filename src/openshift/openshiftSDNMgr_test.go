@@ -21,6 +21,7 @@ import (
 	"testing"
 
 	"test"
+	"tools/nodeAddress"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -28,6 +29,8 @@ import (
 	"k8s.io/client-go/1.4/pkg/api/v1"
 )
 
+var internalPolicy = nodeAddress.NewInternalPolicy(true, "")
+
 func newNode(id, rv string, unsched bool,
 	addresses []v1.NodeAddress) *v1.Node {
 	return &v1.Node{
@@ -81,23 +84,27 @@ func TestOpenshiftMgrCreate(t *testing.T) {
 		Sections:  make(map[string]interface{}),
 	}
 
-	osMgr, err := NewOpenshiftSDNMgr("", "vxlan500", true, mock)
+	osMgr, err := NewOpenshiftSDNMgr("", "vxlan500", internalPolicy, mock)
 	assert.Error(t, err)
 	assert.Nil(t, osMgr)
 
-	osMgr, err = NewOpenshiftSDNMgr("gobbledy-goo", "vxlan500", true, mock)
+	osMgr, err = NewOpenshiftSDNMgr("gobbledy-goo", "vxlan500", internalPolicy, mock)
 	assert.Error(t, err)
 	assert.Nil(t, osMgr)
 
-	osMgr, err = NewOpenshiftSDNMgr("maintain", "", true, mock)
+	osMgr, err = NewOpenshiftSDNMgr("maintain", "", internalPolicy, mock)
 	assert.Error(t, err)
 	assert.Nil(t, osMgr)
 
-	osMgr, err = NewOpenshiftSDNMgr("maintain", "vxlan500", true, nil)
+	osMgr, err = NewOpenshiftSDNMgr("maintain", "vxlan500", nil, mock)
 	assert.Error(t, err)
 	assert.Nil(t, osMgr)
 
-	osMgr, err = NewOpenshiftSDNMgr("maintain", "vxlan500", true, mock)
+	osMgr, err = NewOpenshiftSDNMgr("maintain", "vxlan500", internalPolicy, nil)
+	assert.Error(t, err)
+	assert.Nil(t, osMgr)
+
+	osMgr, err = NewOpenshiftSDNMgr("maintain", "vxlan500", internalPolicy, mock)
 	assert.NoError(t, err)
 	assert.NotNil(t, osMgr)
 }
@@ -108,7 +115,7 @@ func TestOpenshiftMgrNodeUpdateCallFail(t *testing.T) {
 		Sections:  make(map[string]interface{}),
 	}
 
-	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", true, mock)
+	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", internalPolicy, mock)
 	assert.NoError(t, err)
 	require.NotPanics(t, func() {
 		osMgr.ProcessNodeUpdate(struct{}{}, fmt.Errorf("an error"))
@@ -122,7 +129,7 @@ func TestOpenshiftNodeUpdateBadData(t *testing.T) {
 		Sections:  make(map[string]interface{}),
 	}
 
-	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", true, mock)
+	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", internalPolicy, mock)
 	assert.NoError(t, err)
 	require.NotPanics(t, func() {
 		osMgr.ProcessNodeUpdate(struct{}{}, nil)
@@ -138,7 +145,7 @@ func TestOpenshiftNodeUpdate(t *testing.T) {
 
 	nodeList := getNodeList()
 
-	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", true, mock)
+	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", internalPolicy, mock)
 	assert.NoError(t, err)
 	require.NotPanics(t, func() {
 		osMgr.ProcessNodeUpdate(nodeList, nil)
@@ -166,7 +173,7 @@ func TestOpenshiftNodeUpdate(t *testing.T) {
 
 	assert.EqualValues(t, expected, section)
 
-	osMgr.useNodeInt = false
+	osMgr.addrPolicy = nodeAddress.NewInternalPolicy(false, "")
 	require.NotPanics(t, func() {
 		osMgr.ProcessNodeUpdate(nodeList, nil)
 	})
@@ -195,6 +202,48 @@ func TestOpenshiftNodeUpdate(t *testing.T) {
 	assert.EqualValues(t, expected, section)
 }
 
+func TestOpenshiftNodeAddressPolicy(t *testing.T) {
+	mock := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+
+	policy, err := nodeAddress.NewPolicy(
+		[]string{"InternalIP", "ExternalIP", "Hostname"}, "")
+	require.NoError(t, err)
+	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", policy, mock)
+	require.NoError(t, err)
+
+	// Nodes without an internal IP keep their other addresses, and the
+	// annotation overrides them
+	nodeList := getNodeList()
+	nodeList[3].ObjectMeta.Annotations = map[string]string{
+		nodeAddress.AddressAnnotation: "127.2.2.3",
+	}
+	osMgr.ProcessNodeUpdate(nodeList, nil)
+
+	expected := sdnSection{
+		VxLAN: "vxlan500",
+		Nodes: []string{
+			"127.0.0.0",
+			"127.0.0.1",
+			"127.1.1.2",
+			"127.2.2.3",
+			"127.0.0.4",
+			"127.1.1.5",
+			"127.0.0.6",
+			"127.0.0.7",
+			"127.0.0.8",
+		},
+	}
+
+	mock.Lock()
+	section, ok := mock.Sections["openshift-sdn"].(sdnSection)
+	mock.Unlock()
+	assert.True(t, ok)
+	assert.EqualValues(t, expected, section)
+}
+
 func TestOpenshiftNodeUpdateSendFail(t *testing.T) {
 	mock := &test.MockWriter{
 		FailStyle: test.ImmediateFail,
@@ -203,7 +252,7 @@ func TestOpenshiftNodeUpdateSendFail(t *testing.T) {
 
 	nodeList := getNodeList()
 
-	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", true, mock)
+	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", internalPolicy, mock)
 	assert.NoError(t, err)
 	require.NotPanics(t, func() {
 		osMgr.ProcessNodeUpdate(nodeList, nil)
@@ -219,7 +268,7 @@ func TestOpenshiftNodeUpdateSendFailAsync(t *testing.T) {
 
 	nodeList := getNodeList()
 
-	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", true, mock)
+	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", internalPolicy, mock)
 	assert.NoError(t, err)
 	require.NotPanics(t, func() {
 		osMgr.ProcessNodeUpdate(nodeList, nil)
@@ -235,7 +284,7 @@ func TestOpenshiftNodeUpdateSendFailTimeout(t *testing.T) {
 
 	nodeList := getNodeList()
 
-	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", true, mock)
+	osMgr, err := NewOpenshiftSDNMgr("maintain", "vxlan500", internalPolicy, mock)
 	assert.NoError(t, err)
 	require.NotPanics(t, func() {
 		osMgr.ProcessNodeUpdate(nodeList, nil)
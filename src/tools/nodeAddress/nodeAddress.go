@@ -0,0 +1,280 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nodeAddress
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "f5/vlogger"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Node annotation overriding the addresses the BIG-IP uses for a node,
+// one address or an IPv4 and an IPv6 address separated by a comma
+const AddressAnnotation = "virtual-server.f5.com/node-address"
+
+// Address families of node addresses, any uses every address of a node
+const (
+	FamilyAny  = "any"
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// How long NewPolicy reuses the IPs a host name resolved to
+const DefaultLookupTTL = 5 * time.Minute
+
+// IPs a host name resolved to, and when to resolve it again
+type cachedLookup struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// Chooses the addresses the BIG-IP uses for each node
+type Policy struct {
+	// Node address types in order of preference, the addresses of the first
+	// type a node has are used
+	Types []v1.NodeAddressType
+	// Family of the addresses used, empty or FamilyAny uses all of them
+	Family string
+	// Resolves Hostname addresses that are not IPs, net.LookupIP if nil
+	LookupIP func(host string) ([]net.IP, error)
+	// How long resolved host names are reused, 0 resolves them every time.
+	// Failed lookups are always retried.
+	LookupTTL time.Duration
+
+	lookupsMutex sync.Mutex
+	lookups      map[string]cachedLookup
+	// Warnings last logged for each node, nodes are polled again and again
+	warnedMutex sync.Mutex
+	warned      map[string]string
+}
+
+// Create a Policy from address type names, in order of preference
+func NewPolicy(types []string, family string) (*Policy, error) {
+	switch family {
+	case "", FamilyAny, FamilyIPv4, FamilyIPv6:
+	default:
+		return nil, fmt.Errorf("unknown address family %q", family)
+	}
+	if 0 == len(types) {
+		return nil, fmt.Errorf("no node address types given")
+	}
+
+	p := &Policy{Family: family, LookupTTL: DefaultLookupTTL}
+	for _, t := range types {
+		addrType := v1.NodeAddressType(strings.TrimSpace(t))
+		switch addrType {
+		case v1.NodeInternalIP, v1.NodeExternalIP, v1.NodeHostName,
+			v1.NodeLegacyHostIP:
+		default:
+			return nil, fmt.Errorf("unknown node address type %q", t)
+		}
+		for _, seen := range p.Types {
+			if seen == addrType {
+				return nil, fmt.Errorf("node address type %s given twice", t)
+			}
+		}
+		p.Types = append(p.Types, addrType)
+	}
+	return p, nil
+}
+
+// Create the Policy of the use-node-internal setting, only internal or only
+// external IPs
+func NewInternalPolicy(useNodeInternal bool, family string) *Policy {
+	addrType := v1.NodeExternalIP
+	if useNodeInternal {
+		addrType = v1.NodeInternalIP
+	}
+	return &Policy{
+		Types:  []v1.NodeAddressType{addrType},
+		Family: family,
+	}
+}
+
+// Check if an address is of the Policy's family
+func (p *Policy) isFamily(ip net.IP) bool {
+	switch p.Family {
+	case FamilyIPv4:
+		return nil != ip.To4()
+	case FamilyIPv6:
+		return nil == ip.To4()
+	}
+	return true
+}
+
+// Add an address of the Policy's family to a list, once
+func (p *Policy) appendAddr(addrs []string, ip net.IP) []string {
+	if !p.isFamily(ip) {
+		return addrs
+	}
+	addr := ip.String()
+	for _, a := range addrs {
+		if a == addr {
+			return addrs
+		}
+	}
+	return append(addrs, addr)
+}
+
+// Get the IPs of a node address, resolving host names, or a warning why
+// there are none
+func (p *Policy) lookup(node string, addr v1.NodeAddress) ([]net.IP, string) {
+	if ip := net.ParseIP(addr.Address); nil != ip {
+		return []net.IP{ip}, ""
+	}
+	if v1.NodeHostName != addr.Type {
+		return nil, fmt.Sprintf("Node %s %s address %s is not an IP address",
+			node, addr.Type, addr.Address)
+	}
+	ips, err := p.lookupHost(addr.Address)
+	if nil != err {
+		return nil, fmt.Sprintf("Node %s host name %s could not be resolved: %v",
+			node, addr.Address, err)
+	}
+	return ips, ""
+}
+
+// Resolve a host name, reusing the IPs of a lookup within LookupTTL
+func (p *Policy) lookupHost(host string) ([]net.IP, error) {
+	now := time.Now()
+	p.lookupsMutex.Lock()
+	cached, ok := p.lookups[host]
+	p.lookupsMutex.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.ips, nil
+	}
+
+	lookupIP := p.LookupIP
+	if nil == lookupIP {
+		lookupIP = net.LookupIP
+	}
+	ips, err := lookupIP(host)
+	if nil != err || 0 == p.LookupTTL {
+		return ips, err
+	}
+
+	p.lookupsMutex.Lock()
+	defer p.lookupsMutex.Unlock()
+	if nil == p.lookups {
+		p.lookups = make(map[string]cachedLookup)
+	}
+	// Drop the host names of nodes that are gone
+	for name, c := range p.lookups {
+		if !now.Before(c.expires) {
+			delete(p.lookups, name)
+		}
+	}
+	p.lookups[host] = cachedLookup{ips, now.Add(p.LookupTTL)}
+	return ips, nil
+}
+
+// Get the addresses of a node from its AddressAnnotation, ok is false if it
+// has none or it is not valid, with a warning if it is not valid
+func (p *Policy) overrideAddresses(
+	node *v1.Node) (addrs []string, ok bool, warning string) {
+
+	value, found := node.ObjectMeta.Annotations[AddressAnnotation]
+	if !found {
+		return nil, false, ""
+	}
+	for _, a := range strings.Split(value, ",") {
+		ip := net.ParseIP(strings.TrimSpace(a))
+		if nil == ip {
+			return nil, false, fmt.Sprintf(
+				"Node %s annotation %s value %q is not valid, "+
+					"using its status addresses", node.ObjectMeta.Name,
+				AddressAnnotation, value)
+		}
+		addrs = p.appendAddr(addrs, ip)
+	}
+	return addrs, true, ""
+}
+
+// Log the warnings about the addresses of a node, unless they are those
+// logged for it last time, so a node is only warned about as its addresses
+// change and not at every poll. Returns true if they were logged
+func (p *Policy) warn(node string, warnings []string) bool {
+	state := strings.Join(warnings, "\n")
+	p.warnedMutex.Lock()
+	defer p.warnedMutex.Unlock()
+	if state == p.warned[node] {
+		return false
+	}
+	if 0 == len(warnings) {
+		delete(p.warned, node)
+		return false
+	}
+	if nil == p.warned {
+		p.warned = make(map[string]string)
+	}
+	p.warned[node] = state
+	for _, w := range warnings {
+		log.Warningf("%s", w)
+	}
+	return true
+}
+
+// Get the addresses the BIG-IP uses for a node, those of its
+// AddressAnnotation or else those of the first preferred type it has
+func (p *Policy) Addresses(node *v1.Node) []string {
+	name := node.ObjectMeta.Name
+	var warnings []string
+	addrs, ok, warning := p.overrideAddresses(node)
+	if 0 != len(warning) {
+		warnings = append(warnings, warning)
+	}
+	if ok {
+		if 0 == len(addrs) {
+			warnings = append(warnings, fmt.Sprintf(
+				"Node %s annotation %s has no %s address", name,
+				AddressAnnotation, p.Family))
+		}
+		p.warn(name, warnings)
+		return addrs
+	}
+
+	for _, addrType := range p.Types {
+		var addrs []string
+		for _, addr := range node.Status.Addresses {
+			if addr.Type != addrType {
+				continue
+			}
+			ips, warning := p.lookup(name, addr)
+			if 0 != len(warning) {
+				warnings = append(warnings, warning)
+			}
+			for _, ip := range ips {
+				addrs = p.appendAddr(addrs, ip)
+			}
+		}
+		if 0 != len(addrs) {
+			p.warn(name, warnings)
+			return addrs
+		}
+	}
+	warnings = append(warnings, fmt.Sprintf(
+		"Node %s has no usable address, types %v family %q", name,
+		p.Types, p.Family))
+	p.warn(name, warnings)
+	return nil
+}
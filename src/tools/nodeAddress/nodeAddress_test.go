@@ -0,0 +1,201 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nodeAddress
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func newNode(
+	id string,
+	annotations map[string]string,
+	addresses []v1.NodeAddress,
+) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        id,
+			Annotations: annotations,
+		},
+		Status: v1.NodeStatus{
+			Addresses: addresses,
+		},
+	}
+}
+
+func lookupIP(host string) ([]net.IP, error) {
+	switch host {
+	case "node0.example.com":
+		return []net.IP{net.ParseIP("10.0.0.10"), net.ParseIP("fd00::10")}, nil
+	}
+	return nil, fmt.Errorf("no such host %s", host)
+}
+
+func TestNewPolicy(t *testing.T) {
+	p, err := NewPolicy([]string{"InternalIP", " ExternalIP", "Hostname"}, "")
+	require.Nil(t, err)
+	assert.Equal(t, []v1.NodeAddressType{
+		v1.NodeInternalIP, v1.NodeExternalIP, v1.NodeHostName}, p.Types)
+
+	_, err = NewPolicy([]string{"InternalIP"}, FamilyIPv6)
+	assert.Nil(t, err)
+	_, err = NewPolicy(nil, "")
+	assert.NotNil(t, err)
+	_, err = NewPolicy([]string{"PublicIP"}, "")
+	assert.NotNil(t, err)
+	_, err = NewPolicy([]string{"InternalIP", "InternalIP"}, "")
+	assert.NotNil(t, err)
+	_, err = NewPolicy([]string{"InternalIP"}, "ipx")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []v1.NodeAddressType{v1.NodeInternalIP},
+		NewInternalPolicy(true, "").Types)
+	assert.Equal(t, []v1.NodeAddressType{v1.NodeExternalIP},
+		NewInternalPolicy(false, "").Types)
+}
+
+func TestAddresses(t *testing.T) {
+	p, err := NewPolicy([]string{"InternalIP", "ExternalIP", "Hostname"}, "")
+	require.Nil(t, err)
+	p.LookupIP = lookupIP
+
+	both := newNode("node0", nil, []v1.NodeAddress{
+		{"ExternalIP", "127.0.0.1"},
+		{"InternalIP", "10.0.0.1"},
+		{"Hostname", "node0.example.com"},
+	})
+	external := newNode("node1", nil, []v1.NodeAddress{
+		{"Hostname", "node1.example.com"},
+		{"ExternalIP", "127.0.0.2"},
+	})
+	hostname := newNode("node0", nil, []v1.NodeAddress{
+		{"Hostname", "node0.example.com"},
+	})
+	unresolved := newNode("node2", nil, []v1.NodeAddress{
+		{"Hostname", "node2.example.com"},
+	})
+
+	// The first preferred type a node has is used
+	assert.Equal(t, []string{"10.0.0.1"}, p.Addresses(both))
+	assert.Equal(t, []string{"127.0.0.2"}, p.Addresses(external))
+	assert.Equal(t, []string{"10.0.0.10", "fd00::10"}, p.Addresses(hostname))
+	assert.Nil(t, p.Addresses(unresolved))
+
+	p.Types = []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP}
+	assert.Equal(t, []string{"127.0.0.1"}, p.Addresses(both))
+	assert.Nil(t, p.Addresses(hostname))
+
+	// Addresses of other families are skipped
+	p.Types = []v1.NodeAddressType{v1.NodeHostName}
+	p.Family = FamilyIPv6
+	assert.Equal(t, []string{"fd00::10"}, p.Addresses(hostname))
+	p.Family = FamilyIPv4
+	assert.Equal(t, []string{"10.0.0.10"}, p.Addresses(hostname))
+}
+
+func TestAddressAnnotation(t *testing.T) {
+	p := NewInternalPolicy(true, "")
+
+	node := newNode("node0", map[string]string{
+		AddressAnnotation: "192.168.0.1",
+	}, []v1.NodeAddress{{"InternalIP", "10.0.0.1"}})
+	assert.Equal(t, []string{"192.168.0.1"}, p.Addresses(node))
+
+	node.ObjectMeta.Annotations[AddressAnnotation] = "192.168.0.1, fd00::1"
+	assert.Equal(t, []string{"192.168.0.1", "fd00::1"}, p.Addresses(node))
+	p.Family = FamilyIPv6
+	assert.Equal(t, []string{"fd00::1"}, p.Addresses(node))
+
+	// Invalid annotations are ignored
+	p.Family = ""
+	node.ObjectMeta.Annotations[AddressAnnotation] = "node0.example.com"
+	assert.Equal(t, []string{"10.0.0.1"}, p.Addresses(node))
+}
+
+func TestWarnings(t *testing.T) {
+	p := NewInternalPolicy(true, "")
+	node := newNode("node0", nil, []v1.NodeAddress{{"ExternalIP", "127.0.0.1"}})
+	noAddress := `Node node0 has no usable address, types [InternalIP] family ""`
+
+	// Nodes are warned about once, until their addresses change
+	assert.Nil(t, p.Addresses(node))
+	assert.Equal(t, map[string]string{"node0": noAddress}, p.warned)
+	assert.False(t, p.warn("node0", []string{noAddress}))
+	assert.Nil(t, p.Addresses(node))
+	assert.Equal(t, map[string]string{"node0": noAddress}, p.warned)
+
+	node.ObjectMeta.Annotations = map[string]string{AddressAnnotation: "bad"}
+	assert.Nil(t, p.Addresses(node))
+	assert.Equal(t, 2, len(strings.Split(p.warned["node0"], "\n")))
+
+	node.Status.Addresses = []v1.NodeAddress{{"InternalIP", "10.0.0.1"}}
+	node.ObjectMeta.Annotations = nil
+	assert.Equal(t, []string{"10.0.0.1"}, p.Addresses(node))
+	assert.Empty(t, p.warned)
+	assert.False(t, p.warn("node0", nil))
+
+	// and again when they lose them
+	node.Status.Addresses = nil
+	assert.Nil(t, p.Addresses(node))
+	assert.Equal(t, map[string]string{"node0": noAddress}, p.warned)
+	assert.True(t, p.warn("node1", []string{noAddress}))
+}
+
+func TestLookupCache(t *testing.T) {
+	p, err := NewPolicy([]string{"Hostname"}, "")
+	require.Nil(t, err)
+	lookups := 0
+	p.LookupIP = func(host string) ([]net.IP, error) {
+		lookups++
+		return lookupIP(host)
+	}
+	node := newNode("node0", nil, []v1.NodeAddress{
+		{"Hostname", "node0.example.com"},
+	})
+	unresolved := newNode("node2", nil, []v1.NodeAddress{
+		{"Hostname", "node2.example.com"},
+	})
+
+	// Resolved host names are reused until they expire
+	assert.Equal(t, []string{"10.0.0.10", "fd00::10"}, p.Addresses(node))
+	assert.Equal(t, []string{"10.0.0.10", "fd00::10"}, p.Addresses(node))
+	assert.Equal(t, 1, lookups)
+	cached := p.lookups["node0.example.com"]
+	cached.expires = time.Now().Add(-time.Second)
+	p.lookups["node0.example.com"] = cached
+	assert.Equal(t, []string{"10.0.0.10", "fd00::10"}, p.Addresses(node))
+	assert.Equal(t, 2, lookups)
+
+	// Failures are retried
+	assert.Nil(t, p.Addresses(unresolved))
+	assert.Nil(t, p.Addresses(unresolved))
+	assert.Equal(t, 4, lookups)
+
+	// Without a TTL every lookup resolves
+	p.LookupTTL = 0
+	p.lookups = nil
+	p.Addresses(node)
+	p.Addresses(node)
+	assert.Equal(t, 6, lookups)
+}
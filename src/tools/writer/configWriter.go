@@ -177,7 +177,9 @@ func (cw *configWriter) _lockAndWrite(
 }
 
 func (cw *configWriter) lockAndWrite(output []byte) (wroteSome bool, err error) {
-	f, err := os.OpenFile(cw.configFile, os.O_WRONLY|os.O_CREATE, 0644)
+	// Only the owner can read the config, it holds the BIG-IP password and
+	// the private keys of TLS Secrets
+	f, err := os.OpenFile(cw.configFile, os.O_WRONLY|os.O_CREATE, 0600)
 	if nil != err {
 		return wroteSome, err
 	}
@@ -318,6 +318,11 @@ func TestConfigWriterSimpleWrite(t *testing.T) {
 
 	assert.EqualValues(t, expected, written)
 
+	info, err := os.Stat(f)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(),
+		"Config should only be readable by its owner")
+
 	// test empty section and overwrite
 	empty := struct {
 		Section struct {
@@ -0,0 +1,115 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"tools/nodeAddress"
+)
+
+// Address families of the node addresses used as pool members, any uses
+// every address of the node, so dual-stack nodes are members twice
+const (
+	AddressFamilyAny  = nodeAddress.FamilyAny
+	AddressFamilyIPv4 = nodeAddress.FamilyIPv4
+	AddressFamilyIPv6 = nodeAddress.FamilyIPv6
+)
+
+// Suffix of the name of the IPv6 virtual server of a dual-stack config
+const ipv6NameSuffix = "_ipv6"
+
+// Check if an address is an IPv6 address
+func isIPv6(addr string) bool {
+	ip := net.ParseIP(addr)
+	return nil != ip && nil == ip.To4()
+}
+
+// Parse a bind address annotation, either an address or, for a dual-stack
+// virtual server, an IPv4 and an IPv6 address separated by a comma.
+// Returns the bind address and the IPv6 address of a dual-stack one
+func parseBindAddrs(value string) (string, string, error) {
+	addrs := strings.Split(value, ",")
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+		if nil == net.ParseIP(addrs[i]) {
+			return "", "", fmt.Errorf("%s is not an IP address", addrs[i])
+		}
+	}
+	switch len(addrs) {
+	case 1:
+		return addrs[0], "", nil
+	case 2:
+		if isIPv6(addrs[0]) {
+			addrs[0], addrs[1] = addrs[1], addrs[0]
+		}
+		if isIPv6(addrs[0]) || !isIPv6(addrs[1]) {
+			return "", "", fmt.Errorf("%s must be an IPv4 and an IPv6 address",
+				value)
+		}
+		return addrs[0], addrs[1], nil
+	}
+	return "", "", fmt.Errorf("%s has more than two addresses", value)
+}
+
+// Check the bind addresses of a config
+func validateVirtualAddress(cfg *VirtualServerConfig) error {
+	va := cfg.VirtualServer.Frontend.VirtualAddress
+	if nil == va {
+		return nil
+	}
+	if 0 != len(va.BindAddr) && nil == net.ParseIP(va.BindAddr) {
+		return fmt.Errorf("bindAddr %s is not an IP address", va.BindAddr)
+	}
+	if 0 == len(va.BindAddr6) {
+		return nil
+	}
+	if 0 != len(cfg.VirtualServer.Frontend.IApp) {
+		return fmt.Errorf("iApps cannot have bindAddr6")
+	}
+	if !isIPv6(va.BindAddr6) {
+		return fmt.Errorf("bindAddr6 %s is not an IPv6 address", va.BindAddr6)
+	}
+	if isIPv6(va.BindAddr) {
+		return fmt.Errorf("bindAddr %s must be IPv4 with bindAddr6", va.BindAddr)
+	}
+	return nil
+}
+
+// Split a dual-stack config into a config per address family, the IPv6 one
+// named with ipv6NameSuffix. Both use the same pool members.
+func splitDualStack(cfg *VirtualServerConfig) []*VirtualServerConfig {
+	va := cfg.VirtualServer.Frontend.VirtualAddress
+	if nil == va || 0 == len(va.BindAddr6) {
+		return []*VirtualServerConfig{cfg}
+	}
+
+	ipv4 := *cfg
+	ipv4.VirtualServer.Frontend.VirtualAddress = &VirtualAddress{
+		BindAddr: va.BindAddr,
+		Port:     va.Port,
+	}
+	ipv6 := *cfg
+	ipv6.VirtualServer.Frontend.VirtualServerName += ipv6NameSuffix
+	ipv6.VirtualServer.Frontend.VirtualAddress = &VirtualAddress{
+		BindAddr: va.BindAddr6,
+		Port:     va.Port,
+	}
+	return []*VirtualServerConfig{&ipv4, &ipv6}
+}
@@ -0,0 +1,260 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"eventStream"
+	log "f5/vlogger"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Service annotations describing a virtual server. A Service is configured
+// from its annotations when it has the port annotation.
+const (
+	serviceBindAddrAnnotation    = "virtual-server.f5.com/ip"
+	servicePortAnnotation        = "virtual-server.f5.com/port"
+	serviceBackendPortAnnotation = "virtual-server.f5.com/service-port"
+	serviceModeAnnotation        = "virtual-server.f5.com/mode"
+	serviceBalanceAnnotation     = "virtual-server.f5.com/balance"
+	servicePartitionAnnotation   = "virtual-server.f5.com/partition"
+	serviceSslProfileAnnotation  = "virtual-server.f5.com/ssl-profile"
+	serviceHealthAnnotation      = "virtual-server.f5.com/health"
+)
+
+// Schema that Service annotation configs are validated against
+var serviceSchema string = "f5schemadb://bigip-virtual-server_v0.1.3.json"
+
+// Checks of a Service annotation config beyond its schema, run in order
+var serviceValidators = []func(*VirtualServerConfig) error{
+	validateBackendMonitors,
+	validateProtocol,
+}
+
+// Check if a Service is configured from its annotations, LoadBalancer
+// Services are configured from their spec instead
+func isAnnotatedService(svc *v1.Service) bool {
+	if nil == svc || isLoadBalancer(svc) {
+		return false
+	}
+	_, ok := svc.ObjectMeta.Annotations[servicePortAnnotation]
+	return ok
+}
+
+// Translate the annotations of a Service into a Virtual Server config. The
+// annotations are turned into the same data a ConfigMap would hold, so they
+// are validated against the same schema.
+func (vsm *Manager) parseServiceAnnotations(
+	svc *v1.Service) (*VirtualServerConfig, error) {
+
+	annotations := svc.ObjectMeta.Annotations
+
+	port, err := strconv.ParseInt(annotations[servicePortAnnotation], 10, 32)
+	if nil != err {
+		return nil, fmt.Errorf("service %s has invalid %s annotation: %s",
+			svc.ObjectMeta.Name, servicePortAnnotation,
+			annotations[servicePortAnnotation])
+	}
+
+	// The Service port is given by number or by name
+	var servicePort interface{}
+	portName := ""
+	if p, ok := annotations[serviceBackendPortAnnotation]; ok {
+		number, err := strconv.ParseInt(p, 10, 32)
+		if nil == err {
+			servicePort = number
+		} else if 0 != len(p) {
+			servicePort, portName = p, p
+		} else {
+			return nil, fmt.Errorf("service %s has invalid %s annotation: %s",
+				svc.ObjectMeta.Name, serviceBackendPortAnnotation, p)
+		}
+	} else if 1 == len(svc.Spec.Ports) {
+		servicePort = int64(svc.Spec.Ports[0].Port)
+	} else {
+		return nil, fmt.Errorf("service %s has %v ports and needs the %s annotation",
+			svc.ObjectMeta.Name, len(svc.Spec.Ports), serviceBackendPortAnnotation)
+	}
+	// A port number used by both TCP and UDP is taken as the TCP port
+	protocol := ""
+	for _, portSpec := range svc.Spec.Ports {
+		if portSpec.Name == portName ||
+			(0 == len(portName) && servicePort == int64(portSpec.Port)) {
+			protocol = serviceProtocol(portSpec.Protocol)
+			if 0 == len(protocol) || 0 != len(portName) {
+				break
+			}
+		}
+	}
+
+	virtualAddress := map[string]interface{}{"port": port}
+	if addrs, ok := annotations[serviceBindAddrAnnotation]; ok {
+		addr, addr6, err := parseBindAddrs(addrs)
+		if nil != err {
+			return nil, fmt.Errorf("service %s has invalid %s annotation: %v",
+				svc.ObjectMeta.Name, serviceBindAddrAnnotation, err)
+		}
+		virtualAddress["bindAddr"] = addr
+		if 0 != len(addr6) {
+			virtualAddress["bindAddr6"] = addr6
+		}
+	}
+	frontend := map[string]interface{}{
+		"partition":      vsm.defaultPartition,
+		"mode":           protocolTCP,
+		"balance":        "round-robin",
+		"virtualAddress": virtualAddress,
+	}
+	if protocolUDP == protocol {
+		frontend["mode"] = protocolUDP
+	}
+	if partition, ok := annotations[servicePartitionAnnotation]; ok {
+		frontend["partition"] = partition
+	}
+	if mode, ok := annotations[serviceModeAnnotation]; ok {
+		frontend["mode"] = mode
+	}
+	if balance, ok := annotations[serviceBalanceAnnotation]; ok {
+		frontend["balance"] = balance
+	}
+	if profile, ok := annotations[serviceSslProfileAnnotation]; ok {
+		frontend["sslProfile"] = map[string]interface{}{"f5ProfileName": profile}
+	}
+	backend := map[string]interface{}{
+		"serviceName": svc.ObjectMeta.Name,
+		"servicePort": servicePort,
+	}
+	if 0 != len(protocol) {
+		backend["serviceProtocol"] = protocol
+	}
+	if health, ok := annotations[serviceHealthAnnotation]; ok {
+		var monitors []interface{}
+		err = json.Unmarshal([]byte(health), &monitors)
+		if nil != err {
+			return nil, fmt.Errorf("service %s has invalid %s annotation: %v",
+				svc.ObjectMeta.Name, serviceHealthAnnotation, err)
+		}
+		backend["healthMonitors"] = monitors
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"virtualServer": map[string]interface{}{
+			"frontend": frontend,
+			"backend":  backend,
+		},
+	})
+	if nil != err {
+		return nil, err
+	}
+	err = vsm.validateSchema(serviceSchema, string(data))
+	if nil != err {
+		return nil, err
+	}
+
+	var cfg VirtualServerConfig
+	err = json.Unmarshal(data, &cfg)
+	if nil != err {
+		return nil, err
+	}
+	err = runValidators(&cfg, serviceValidators)
+	if nil != err {
+		return nil, fmt.Errorf("service %s: %v", svc.ObjectMeta.Name, err)
+	}
+	cfg.VirtualServer.Frontend.VirtualServerName = annotatedServiceOwner(svc)
+	return &cfg, nil
+}
+
+// Process a change in Service state for Services configured from their
+// annotations
+func (vsm *Manager) processAnnotatedService(
+	changeType eventStream.ChangeType,
+	obj interface{},
+	endptStore *eventStream.EventStore) bool {
+
+	var svc *v1.Service
+	var oldSvc *v1.Service
+	o, ok := obj.(eventStream.ChangedObject)
+	if !ok {
+		svc = obj.(*v1.Service)
+	} else {
+		switch changeType {
+		case eventStream.Added:
+			svc = o.New.(*v1.Service)
+		case eventStream.Updated:
+			svc = o.New.(*v1.Service)
+			oldSvc = o.Old.(*v1.Service)
+		case eventStream.Deleted:
+			svc = o.Old.(*v1.Service)
+			oldSvc = svc
+		}
+	}
+
+	namespace := svc.ObjectMeta.Namespace
+	if !vsm.watchingNamespace(namespace) {
+		return false
+	}
+	if !isAnnotatedService(svc) && !isAnnotatedService(oldSvc) {
+		return false
+	}
+
+	name := annotatedServiceOwner(svc)
+	var cfg *VirtualServerConfig
+	if eventStream.Deleted != changeType && isAnnotatedService(svc) {
+		var err error
+		cfg, err = vsm.parseServiceAnnotations(svc)
+		if nil == err {
+			err = vsm.assignBindAddr(cfg, namespace)
+		}
+		if nil != err {
+			log.Warningf("Could not get config for Service: %v - %v",
+				svc.ObjectMeta.Name, err)
+			vsm.recordWarning(svc, reasonInvalidConfig, "%v", err)
+			cfg = nil
+		} else {
+			vsm.setPoolMembers(cfg, svc, endptStore, svc)
+		}
+	}
+	if nil == cfg && isAnnotatedService(oldSvc) {
+		vsm.releaseBindAddr(name)
+	}
+
+	vsm.vservers.Lock()
+	defer vsm.vservers.Unlock()
+
+	if nil == cfg {
+		if !isAnnotatedService(oldSvc) {
+			return false
+		}
+		vsm.vservers.remove(name)
+		return true
+	}
+	if eventStream.Replaced != changeType && !isAnnotatedService(oldSvc) {
+		if _, ok := vsm.vservers.m[name]; ok {
+			log.Warningf(
+				"Overwriting existing entry for virtual server %v - change type: %v",
+				name, changeType)
+			vsm.recordWarning(svc, reasonOverwrite,
+				"Overwrote existing virtual server %v", name)
+		}
+	}
+	vsm.vservers.assign(namespace, cfg)
+	return true
+}
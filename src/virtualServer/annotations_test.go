@@ -0,0 +1,202 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func newAnnotatedService(id, rv string, annotations map[string]string,
+	portSpecList []v1.ServicePort) *v1.Service {
+	svc := newService(id, rv, namespace, v1.ServiceTypeNodePort, portSpecList)
+	svc.ObjectMeta.Annotations = annotations
+	return svc
+}
+
+func TestParseServiceAnnotations(t *testing.T) {
+	require := require.New(t)
+	defer func(s string) { serviceSchema = s }(serviceSchema)
+	serviceSchema = schemaUrl
+	vsm := NewManager(&Params{DefaultPartition: "common"})
+
+	svc := newAnnotatedService("foo", "1", map[string]string{
+		serviceBindAddrAnnotation:    "10.128.10.240",
+		servicePortAnnotation:        "443",
+		serviceBackendPortAnnotation: "8080",
+		serviceModeAnnotation:        "http",
+		servicePartitionAnnotation:   "velcro",
+		serviceSslProfileAnnotation:  "velcro/testcert",
+		serviceHealthAnnotation: `[{"protocol": "http", "send": "GET /",
+			"interval": 30, "timeout": 20}]`,
+	}, []v1.ServicePort{{Port: 80}, {Port: 8080}})
+	cfg, err := vsm.parseServiceAnnotations(svc)
+	require.Nil(err)
+	require.Equal("svc_default_foo", cfg.VirtualServer.Frontend.VirtualServerName)
+	require.Equal("foo", cfg.VirtualServer.Backend.ServiceName)
+	require.Equal(int32(8080), cfg.VirtualServer.Backend.ServicePort)
+	require.Equal(1, len(cfg.VirtualServer.Backend.HealthMonitors))
+	require.Equal("GET /", cfg.VirtualServer.Backend.HealthMonitors[0].Send)
+	require.Equal(30, cfg.VirtualServer.Backend.HealthMonitors[0].Interval)
+	frontend := cfg.VirtualServer.Frontend
+	require.Equal("velcro", frontend.Partition)
+	require.Equal("http", frontend.Mode)
+	require.Equal("round-robin", frontend.Balance)
+	require.Equal(&VirtualAddress{BindAddr: "10.128.10.240", Port: 443}, frontend.VirtualAddress)
+	require.Equal(&SslProfile{F5ProfileName: "velcro/testcert"}, frontend.SslProfile)
+
+	// Defaults for everything but the address and port
+	svc = newAnnotatedService("foo", "1", map[string]string{
+		serviceBindAddrAnnotation: "10.128.10.240",
+		servicePortAnnotation:     "80",
+	}, []v1.ServicePort{{Port: 8080}})
+	cfg, err = vsm.parseServiceAnnotations(svc)
+	require.Nil(err)
+	require.Equal(int32(8080), cfg.VirtualServer.Backend.ServicePort)
+	require.Nil(cfg.VirtualServer.Backend.HealthMonitors)
+	frontend = cfg.VirtualServer.Frontend
+	require.Equal("common", frontend.Partition)
+	require.Equal("tcp", frontend.Mode)
+	require.Equal("round-robin", frontend.Balance)
+	require.Equal(&VirtualAddress{BindAddr: "10.128.10.240", Port: 80}, frontend.VirtualAddress)
+	require.Nil(frontend.SslProfile)
+}
+
+func TestParseServiceAnnotationsErrors(t *testing.T) {
+	defer func(s string) { serviceSchema = s }(serviceSchema)
+	serviceSchema = schemaUrl
+	vsm := NewManager(&Params{DefaultPartition: "velcro"})
+
+	onePort := []v1.ServicePort{{Port: 80}}
+	tests := map[string]*v1.Service{
+		"bad port": newAnnotatedService("foo", "1", map[string]string{
+			servicePortAnnotation: "http"}, onePort),
+		"bad address": newAnnotatedService("foo", "1", map[string]string{
+			serviceBindAddrAnnotation: "10.128.10.260",
+			servicePortAnnotation:     "80"}, onePort),
+		"bad service port": newAnnotatedService("foo", "1", map[string]string{
+			servicePortAnnotation:        "80",
+			serviceBackendPortAnnotation: "0"}, onePort),
+		"ambiguous service port": newAnnotatedService("foo", "1",
+			map[string]string{servicePortAnnotation: "80"},
+			[]v1.ServicePort{{Port: 80}, {Port: 8080}}),
+		"bad health": newAnnotatedService("foo", "1", map[string]string{
+			servicePortAnnotation:   "80",
+			serviceHealthAnnotation: "{"}, onePort),
+		"bad mode": newAnnotatedService("foo", "1", map[string]string{
+			servicePortAnnotation: "80",
+			serviceModeAnnotation: "carrier-pigeon"}, onePort),
+	}
+	for desc, svc := range tests {
+		cfg, err := vsm.parseServiceAnnotations(svc)
+		assert.NotNil(t, err, "Expected an error for %s", desc)
+		assert.Nil(t, cfg, "Expected no config for %s", desc)
+	}
+}
+
+func TestProcessAnnotatedServiceNodePort(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+	defer func(s string) { serviceSchema = s }(serviceSchema)
+	serviceSchema = schemaUrl
+
+	annotations := map[string]string{
+		serviceBindAddrAnnotation: "10.128.10.240",
+		servicePortAnnotation:     "80",
+	}
+	foo := newAnnotatedService("foo", "1", annotations,
+		[]v1.ServicePort{{Port: 8080, NodePort: 30001}})
+	bar := newService("bar", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo, *bar}})
+	vsm := NewManager(&Params{
+		KubeClient:       fake,
+		ConfigWriter:     mw,
+		Namespaces:       []string{namespace},
+		IsNodePort:       true,
+		DefaultPartition: "velcro",
+	})
+	endptStore := newStore(nil)
+
+	setUseNodeInternal(vsm, true)
+	vsm.ProcessNodeUpdate([]v1.Node{
+		*newNode("node0", "0", false, []v1.NodeAddress{
+			{Type: "InternalIP", Address: "127.0.0.1"}}),
+	}, nil)
+
+	// Services without annotations are left alone
+	vsm.ProcessServiceUpdate(eventStream.Replaced,
+		[]interface{}{foo, bar}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
+	vs := getVirtualServer(t, vsm, serviceKey{"foo", 8080, namespace, v1.ProtocolTCP})
+	require.Equal("svc_default_foo", vs.VirtualServer.Frontend.VirtualServerName)
+	require.Equal("velcro", vs.VirtualServer.Frontend.Partition)
+	require.EqualValues(30001, vs.VirtualServer.Backend.PoolMemberPort)
+	require.EqualValues([]string{"127.0.0.1"}, vs.VirtualServer.Backend.PoolMemberAddrs)
+
+	// Changing an annotation changes the virtual server
+	foo2 := newAnnotatedService("foo", "2", map[string]string{
+		serviceBindAddrAnnotation: "10.128.10.240",
+		servicePortAnnotation:     "8000",
+	}, []v1.ServicePort{{Port: 8080, NodePort: 30001}})
+	vsm.ProcessServiceUpdate(eventStream.Updated,
+		eventStream.ChangedObject{foo, foo2}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
+	vs = getVirtualServer(t, vsm, serviceKey{"foo", 8080, namespace, v1.ProtocolTCP})
+	require.EqualValues(8000, vs.VirtualServer.Frontend.VirtualAddress.Port)
+
+	// Removing the annotations removes the virtual server
+	foo3 := newService("foo", "3", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 8080, NodePort: 30001}})
+	vsm.ProcessServiceUpdate(eventStream.Updated,
+		eventStream.ChangedObject{foo2, foo3}, endptStore)
+	require.Equal(0, len(vsm.vservers.m))
+
+	vsm.ProcessServiceUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, foo}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
+	vsm.ProcessServiceUpdate(eventStream.Deleted,
+		eventStream.ChangedObject{foo, nil}, endptStore)
+	require.Equal(0, len(vsm.vservers.m))
+	validateConfig(t, mw, emptyConfig)
+
+	// A ConfigMap of the same name has its own virtual server
+	cm := newConfigMap("foo", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo8080})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, endptStore)
+	vsm.ProcessServiceUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, foo}, endptStore)
+	require.Equal(2, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.m, "default_foo")
+	require.Contains(vsm.vservers.m, "svc_default_foo")
+	vsm.ProcessServiceUpdate(eventStream.Deleted,
+		eventStream.ChangedObject{foo, nil}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.m, "default_foo")
+}
@@ -0,0 +1,213 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "f5/vlogger"
+)
+
+// Big-IP states for pool members that are draining. Disabled members still
+// take connections for existing persistence sessions, forced offline members
+// only keep their active connections.
+const (
+	memberStateDisabled      = "disabled"
+	memberStateForcedOffline = "forced-offline"
+)
+
+// Drain periods a member past its drain period is held for at most, while
+// its endpoint is still listed as not ready
+const maxDrainHoldPeriods = 3
+
+// A removed pool member kept on the Big-IP until it has drained
+type drainingMember struct {
+	// Pool member port when the member was removed
+	port int32
+	// When the member may be deleted
+	until time.Time
+	// When the member is deleted even if its endpoint is not ready
+	deadline time.Time
+}
+
+// Check the drain settings of a config
+func validateDrain(cfg *VirtualServerConfig) error {
+	backend := &cfg.VirtualServer.Backend
+	if backend.DrainPeriod < 0 {
+		return fmt.Errorf("drainPeriod cannot be negative")
+	}
+	switch backend.DrainState {
+	case "", memberStateDisabled, memberStateForcedOffline:
+	default:
+		return fmt.Errorf("drainState must be %s or %s, not %q",
+			memberStateDisabled, memberStateForcedOffline, backend.DrainState)
+	}
+	return nil
+}
+
+// Get the config to write for a virtual server: the config itself, or a copy
+// that adds its removed pool members that are still draining. Members removed
+// since the last confirmed output start draining, members back in the pool
+// stop, and members whose drain period is over are deleted unless their
+// endpoints still list them as not ready, for up to maxDrainHoldPeriods.
+// Also returns the pool members of the config, to be recorded with
+// commitMembers once the output is confirmed.
+// This function MUST be called with the vservers lock held.
+func (vsm *Manager) drainMembers(
+	vs *VirtualServerConfig,
+	now time.Time) (*VirtualServerConfig, map[string]int32) {
+
+	backend := &vs.VirtualServer.Backend
+	name := vs.VirtualServer.Frontend.VirtualServerName
+	period := vsm.drainPeriod
+	if 0 != backend.DrainPeriod {
+		period = time.Duration(backend.DrainPeriod) * time.Second
+	}
+
+	current := make(map[string]int32)
+	if -1 != backend.PoolMemberPort {
+		for _, member := range backend.PoolMemberAddrs {
+			current[member] = backend.PoolMemberPort
+		}
+	}
+	draining := vsm.draining[name]
+	if nil == draining {
+		draining = make(map[string]drainingMember)
+	}
+	if 0 != period {
+		for member, port := range vsm.lastMembers[name] {
+			if _, ok := current[member]; ok {
+				continue
+			}
+			if _, ok := draining[member]; !ok {
+				log.Debugf("Draining pool member %v of virtual server %v for %v",
+					member, name, period)
+				draining[member] = drainingMember{
+					port:     port,
+					until:    now.Add(period),
+					deadline: now.Add(maxDrainHoldPeriods * period),
+				}
+			}
+		}
+	}
+	notReady := make(map[string]struct{})
+	for _, member := range backend.notReadyAddrs {
+		notReady[member] = struct{}{}
+	}
+	for member, d := range draining {
+		_, held := notReady[member]
+		_, back := current[member]
+		if back || (!now.Before(d.until) && (!held || !now.Before(d.deadline))) {
+			delete(draining, member)
+		}
+	}
+
+	// Node port members all share the pool member port, members drained
+	// from another node port cannot be kept
+	port := backend.PoolMemberPort
+	if -1 == port {
+		for _, d := range draining {
+			port = d.port
+			break
+		}
+	}
+	for member, d := range draining {
+		if d.port != port {
+			delete(draining, member)
+		}
+	}
+
+	if 0 == len(draining) {
+		delete(vsm.draining, name)
+		return vs, current
+	}
+	vsm.draining[name] = draining
+
+	state := backend.DrainState
+	if 0 == len(state) {
+		state = memberStateForcedOffline
+	}
+	out := *vs
+	outBackend := &out.VirtualServer.Backend
+	outBackend.PoolMemberPort = port
+	outBackend.PoolMemberAddrs = nil
+	if -1 != backend.PoolMemberPort {
+		outBackend.PoolMemberAddrs = append(outBackend.PoolMemberAddrs,
+			backend.PoolMemberAddrs...)
+	}
+	outBackend.PoolMemberOptions = make(map[string]PoolMemberOptions)
+	for member, opts := range backend.PoolMemberOptions {
+		outBackend.PoolMemberOptions[member] = opts
+	}
+	var drained []string
+	for member := range draining {
+		drained = append(drained, member)
+		opts := outBackend.PoolMemberOptions[member]
+		opts.State = state
+		outBackend.PoolMemberOptions[member] = opts
+	}
+	sort.Strings(drained)
+	outBackend.PoolMemberAddrs = append(outBackend.PoolMemberAddrs, drained...)
+	return &out, current
+}
+
+// Record the pool members of the virtual servers once their output is
+// confirmed, so members removed before a failed write still drain.
+// This function MUST be called with the vservers lock held.
+func (vsm *Manager) commitMembers(written map[string]map[string]int32) {
+	for name, members := range written {
+		vsm.lastMembers[name] = members
+	}
+}
+
+// Forget the pool members of virtual servers that no longer exist and
+// schedule the next output for when a draining member may be deleted.
+// This function MUST be called with the vservers lock held.
+func (vsm *Manager) scheduleDrain(now time.Time) {
+	for name := range vsm.lastMembers {
+		if _, ok := vsm.vservers.m[name]; !ok {
+			delete(vsm.lastMembers, name)
+			delete(vsm.draining, name)
+		}
+	}
+
+	var next time.Time
+	for _, draining := range vsm.draining {
+		for _, d := range draining {
+			// Members past their drain period wait for their endpoints, up
+			// to their deadline
+			at := d.until
+			if !at.After(now) {
+				at = d.deadline
+			}
+			if at.After(now) && (next.IsZero() || at.Before(next)) {
+				next = at
+			}
+		}
+	}
+	if nil != vsm.drainTimer {
+		vsm.drainTimer.Stop()
+		vsm.drainTimer = nil
+	}
+	if !next.IsZero() {
+		vsm.drainTimer = time.AfterFunc(next.Sub(now), func() {
+			vsm.outputConfig()
+		})
+	}
+}
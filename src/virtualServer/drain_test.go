@@ -0,0 +1,228 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"testing"
+	"time"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func newDrainConfig(name string, port int32, members ...string) *VirtualServerConfig {
+	cfg := &VirtualServerConfig{}
+	cfg.VirtualServer.Frontend.VirtualServerName = name
+	cfg.VirtualServer.Backend.PoolMemberPort = port
+	cfg.VirtualServer.Backend.PoolMemberAddrs = members
+	return cfg
+}
+
+// Drain the members of a config as a confirmed output does
+func drainWritten(
+	vsm *Manager,
+	vs *VirtualServerConfig,
+	now time.Time) *VirtualServerConfig {
+
+	out, members := vsm.drainMembers(vs, now)
+	vsm.commitMembers(map[string]map[string]int32{
+		vs.VirtualServer.Frontend.VirtualServerName: members})
+	return out
+}
+
+func TestValidateDrain(t *testing.T) {
+	cfg := newDrainConfig("default_foo", 0)
+	assert.Nil(t, validateDrain(cfg))
+	cfg.VirtualServer.Backend.DrainPeriod = 30
+	cfg.VirtualServer.Backend.DrainState = "disabled"
+	assert.Nil(t, validateDrain(cfg))
+
+	cfg.VirtualServer.Backend.DrainState = "offline"
+	assert.NotNil(t, validateDrain(cfg))
+	cfg.VirtualServer.Backend.DrainState = ""
+	cfg.VirtualServer.Backend.DrainPeriod = -1
+	assert.NotNil(t, validateDrain(cfg))
+}
+
+func TestDrainMembers(t *testing.T) {
+	require := require.New(t)
+	vsm := NewManager(&Params{DrainPeriod: time.Minute})
+	now := time.Now()
+
+	vs := newDrainConfig("default_foo", 0, "10.2.96.0:80", "10.2.96.1:80")
+	vs.VirtualServer.Backend.PoolMemberOptions = map[string]PoolMemberOptions{
+		"10.2.96.1:80": {Ratio: 2}}
+	require.True(vs == drainWritten(vsm, vs, now))
+
+	// A removed member is kept, forced offline
+	vs.VirtualServer.Backend.PoolMemberAddrs = []string{"10.2.96.0:80"}
+	vs.VirtualServer.Backend.PoolMemberOptions = nil
+	out := drainWritten(vsm, vs, now)
+	require.False(vs == out, "Config should be copied, not changed")
+	require.Equal([]string{"10.2.96.0:80"}, vs.VirtualServer.Backend.PoolMemberAddrs)
+	require.Equal([]string{"10.2.96.0:80", "10.2.96.1:80"},
+		out.VirtualServer.Backend.PoolMemberAddrs)
+	require.Equal(map[string]PoolMemberOptions{
+		"10.2.96.1:80": {State: "forced-offline"}},
+		out.VirtualServer.Backend.PoolMemberOptions)
+
+	// Not ready endpoints hold the member past its drain period
+	vs.VirtualServer.Backend.notReadyAddrs = []string{"10.2.96.1:80"}
+	out = drainWritten(vsm, vs, now.Add(2*time.Minute))
+	require.Equal(2, len(out.VirtualServer.Backend.PoolMemberAddrs))
+	out = drainWritten(vsm, vs, now.Add(3*time.Minute))
+	require.True(vs == out, "Members are held for at most 3 drain periods")
+	vs.VirtualServer.Backend.notReadyAddrs = nil
+
+	// A member back in the pool stops draining
+	vs.VirtualServer.Backend.PoolMemberAddrs = []string{}
+	out = drainWritten(vsm, vs, now)
+	require.Equal([]string{"10.2.96.0:80"}, out.VirtualServer.Backend.PoolMemberAddrs)
+	vs.VirtualServer.Backend.PoolMemberAddrs = []string{"10.2.96.0:80"}
+	require.True(vs == drainWritten(vsm, vs, now))
+	require.Empty(vsm.draining)
+
+	// The config can set its own drain period and state
+	vs.VirtualServer.Backend.DrainPeriod = 5
+	vs.VirtualServer.Backend.DrainState = "disabled"
+	vs.VirtualServer.Backend.PoolMemberAddrs = []string{}
+	out = drainWritten(vsm, vs, now)
+	require.Equal("disabled",
+		out.VirtualServer.Backend.PoolMemberOptions["10.2.96.0:80"].State)
+	require.True(vs == drainWritten(vsm, vs, now.Add(6*time.Second)))
+
+	// Without a drain period members go right away
+	vsm = NewManager(&Params{})
+	vs = newDrainConfig("default_foo", 0, "10.2.96.0:80", "10.2.96.1:80")
+	drainWritten(vsm, vs, now)
+	vs.VirtualServer.Backend.PoolMemberAddrs = []string{"10.2.96.0:80"}
+	require.True(vs == drainWritten(vsm, vs, now))
+}
+
+func TestDrainDeletedService(t *testing.T) {
+	require := require.New(t)
+	vsm := NewManager(&Params{DrainPeriod: time.Minute})
+	now := time.Now()
+
+	vs := newDrainConfig("default_foo", 30001, "127.0.0.0", "127.0.0.1")
+	drainWritten(vsm, vs, now)
+
+	// The whole pool drains on its last node port
+	vs.VirtualServer.Backend.PoolMemberPort = -1
+	vs.VirtualServer.Backend.PoolMemberAddrs = nil
+	out := drainWritten(vsm, vs, now)
+	require.EqualValues(30001, out.VirtualServer.Backend.PoolMemberPort)
+	require.Equal([]string{"127.0.0.0", "127.0.0.1"},
+		out.VirtualServer.Backend.PoolMemberAddrs)
+
+	// Members on the old node port cannot be kept with a new one
+	vs.VirtualServer.Backend.PoolMemberPort = 30002
+	vs.VirtualServer.Backend.PoolMemberAddrs = []string{"127.0.0.0"}
+	out = drainWritten(vsm, vs, now)
+	require.True(vs == out)
+}
+
+func TestDrainOutput(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	svcPorts := []v1.ServicePort{newServicePort("port0", 8080)}
+	foo := newService("foo", "1", namespace, v1.ServiceTypeClusterIP, svcPorts)
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   false,
+		DrainPeriod:  time.Minute,
+	})
+	svcStore := newStore(nil)
+	svcStore.Add(foo)
+	endptPorts := convertSvcPortsToEndpointPorts(svcPorts)
+	eps := newEndpoints("foo", "1", namespace,
+		[]string{"10.2.96.0", "10.2.96.1"}, nil, endptPorts)
+	endptStore := newStore(nil)
+	endptStore.Add(eps)
+
+	cfgFoo := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo8080})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cfgFoo}, endptStore)
+	services := func() VirtualServerConfigs {
+		return mw.Sections["services"].(VirtualServerConfigs)
+	}
+	require.Equal(1, len(services()))
+
+	// Members are only recorded once their output is confirmed, a member
+	// that never reached the Big-IP does not drain
+	mw.FailStyle = test.ImmediateFail
+	epsFailed := newEndpoints("foo", "2", namespace,
+		[]string{"10.2.96.0", "10.2.96.1", "10.2.96.2"}, nil, endptPorts)
+	vsm.ProcessEndpointsUpdate(eventStream.Updated,
+		eventStream.ChangedObject{eps, epsFailed}, svcStore)
+	require.Equal(map[string]int32{"10.2.96.0:8080": 0, "10.2.96.1:8080": 0},
+		vsm.lastMembers["default_foomap"])
+	mw.FailStyle = test.Success
+
+	// A pod shutting down is not ready, its member drains
+	eps2 := newEndpoints("foo", "2", namespace,
+		[]string{"10.2.96.0"}, []string{"10.2.96.1"}, endptPorts)
+	vsm.ProcessEndpointsUpdate(eventStream.Updated,
+		eventStream.ChangedObject{epsFailed, eps2}, svcStore)
+	backend := services()[0].VirtualServer.Backend
+	require.Equal([]string{"10.2.96.0:8080", "10.2.96.1:8080"},
+		backend.PoolMemberAddrs)
+	require.Equal("forced-offline",
+		backend.PoolMemberOptions["10.2.96.1:8080"].State)
+	require.NotNil(vsm.drainTimer, "Output should be scheduled")
+
+	// Once the drain period is over and the pod is gone, it is deleted
+	for member, d := range vsm.draining["default_foomap"] {
+		d.until = time.Now().Add(-time.Second)
+		vsm.draining["default_foomap"][member] = d
+	}
+	eps3 := newEndpoints("foo", "3", namespace,
+		[]string{"10.2.96.0"}, nil, endptPorts)
+	vsm.ProcessEndpointsUpdate(eventStream.Updated,
+		eventStream.ChangedObject{eps2, eps3}, svcStore)
+	backend = services()[0].VirtualServer.Backend
+	require.Equal([]string{"10.2.96.0:8080"}, backend.PoolMemberAddrs)
+	require.Empty(vsm.draining)
+
+	// Deleting the endpoints drains the whole pool
+	vsm.ProcessEndpointsUpdate(eventStream.Deleted,
+		eventStream.ChangedObject{eps3, nil}, svcStore)
+	require.Equal(1, len(services()))
+	backend = services()[0].VirtualServer.Backend
+	require.Equal([]string{"10.2.96.0:8080"}, backend.PoolMemberAddrs)
+
+	// Deleting the ConfigMap removes the virtual server right away
+	vsm.ProcessConfigMapUpdate(eventStream.Deleted,
+		eventStream.ChangedObject{cfgFoo, nil}, endptStore)
+	require.Equal(0, len(services()))
+	require.Empty(vsm.lastMembers)
+	require.Empty(vsm.draining)
+}
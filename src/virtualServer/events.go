@@ -0,0 +1,125 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+)
+
+// Reasons for the Events recorded by the controller
+const (
+	// The resource failed to parse or validate against its schema
+	reasonInvalidConfig = "InvalidConfig"
+	// The backend Service does not exist
+	reasonServiceNotFound = "ServiceNotFound"
+	// The backend Service does not have the requested port
+	reasonServicePortNotFound = "ServicePortNotFound"
+	// The backend Service has no node ports in nodeport mode
+	reasonServiceNotNodePort = "ServiceNotNodePort"
+	// The resource replaced a virtual server created by another resource
+	reasonOverwrite = "Overwrite"
+	// No virtual address could be allocated for the resource
+	reasonAddressNotAllocated = "AddressNotAllocated"
+	// The Secret for the SSL profile does not exist
+	reasonSecretNotFound = "SecretNotFound"
+	// The Secret for the SSL profile is not a usable TLS Secret
+	reasonInvalidSecret = "InvalidSecret"
+	// The iRule ConfigMap has no iRule source
+	reasonInvalidIRule = "InvalidIRule"
+	// An iRule the resource attaches does not exist or has no source
+	reasonIRuleNotFound = "IRuleNotFound"
+)
+
+// Object, reason and message of a recorded Warning Event
+type warningKey struct {
+	object  string
+	reason  string
+	message string
+}
+
+// Identify an object Events are recorded against, returns its resource
+// version as well
+func eventObject(obj runtime.Object) (string, string) {
+	var meta *v1.ObjectMeta
+	switch o := obj.(type) {
+	case *v1.ConfigMap:
+		meta = &o.ObjectMeta
+	case *v1.Service:
+		meta = &o.ObjectMeta
+	case *v1beta1.Ingress:
+		meta = &o.ObjectMeta
+	default:
+		return "", ""
+	}
+	return fmt.Sprintf("%T/%v/%v", obj, meta.Namespace, meta.Name),
+		meta.ResourceVersion
+}
+
+// Record a Warning Event against a Kubernetes object. Resyncs and updates of
+// other objects report the same problem again, so it is only recorded when
+// it first appears or the object changed.
+func (vsm *Manager) recordWarning(
+	obj runtime.Object,
+	reason string,
+	messageFmt string,
+	args ...interface{}) {
+
+	if nil == vsm.eventRecorder {
+		return
+	}
+	message := fmt.Sprintf(messageFmt, args...)
+	if object, rv := eventObject(obj); 0 != len(object) {
+		key := warningKey{object, reason, message}
+		vsm.warningsMutex.Lock()
+		recorded, ok := vsm.warnings[key]
+		vsm.warnings[key] = rv
+		vsm.warningsMutex.Unlock()
+		if ok && recorded == rv {
+			return
+		}
+	}
+	vsm.eventRecorder.Event(obj, v1.EventTypeWarning, reason, message)
+}
+
+// Forget the Warning Events of a reason recorded against an object once
+// the problem is fixed, so it is recorded again if it comes back
+func (vsm *Manager) clearWarning(obj runtime.Object, reason string) {
+	object, _ := eventObject(obj)
+	vsm.warningsMutex.Lock()
+	defer vsm.warningsMutex.Unlock()
+	for key, _ := range vsm.warnings {
+		if key.object == object && key.reason == reason {
+			delete(vsm.warnings, key)
+		}
+	}
+}
+
+// Forget the Warning Events recorded against a deleted object
+func (vsm *Manager) forgetWarnings(obj runtime.Object) {
+	object, _ := eventObject(obj)
+	vsm.warningsMutex.Lock()
+	defer vsm.warningsMutex.Unlock()
+	for key, _ := range vsm.warnings {
+		if key.object == object {
+			delete(vsm.warnings, key)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"strings"
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/tools/record"
+)
+
+// Collect the reasons of the events recorded so far
+func recordedReasons(recorder *record.FakeRecorder) []string {
+	var reasons []string
+	for {
+		select {
+		case e := <-recorder.Events:
+			// Events are formatted as "<type> <reason> <message>"
+			fields := strings.SplitN(e, " ", 3)
+			reasons = append(reasons, fields[1])
+		default:
+			return reasons
+		}
+	}
+}
+
+func TestRecordConfigMapEvents(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeClusterIP,
+		[]v1.ServicePort{{Port: 8080}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	recorder := record.NewFakeRecorder(100)
+	vsm := NewManager(&Params{
+		KubeClient:    fake,
+		ConfigWriter:  mw,
+		Namespaces:    []string{namespace},
+		IsNodePort:    true,
+		EventRecorder: recorder,
+	})
+	endptStore := newStore(nil)
+
+	// Invalid data
+	cfgBad := newConfigMap("badmap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   "{"})
+	vsm.processConfigMap(eventStream.Added,
+		eventStream.ChangedObject{nil, cfgBad}, endptStore)
+	require.Equal([]string{reasonInvalidConfig}, recordedReasons(recorder))
+
+	// No such service
+	cfgBar := newConfigMap("barmap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapBar})
+	vsm.processConfigMap(eventStream.Added,
+		eventStream.ChangedObject{nil, cfgBar}, endptStore)
+	require.Equal([]string{reasonServiceNotFound}, recordedReasons(recorder))
+
+	// Resyncs do not record the same problem again, changes do
+	vsm.processConfigMap(eventStream.Replaced, cfgBar, endptStore)
+	require.Empty(recordedReasons(recorder))
+	cfgBar2 := newConfigMap("barmap", "2", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapBar})
+	vsm.processConfigMap(eventStream.Updated,
+		eventStream.ChangedObject{cfgBar, cfgBar2}, endptStore)
+	require.Equal([]string{reasonServiceNotFound}, recordedReasons(recorder))
+
+	// Service without port 80 and not of type NodePort
+	cfgFoo := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	vsm.processConfigMap(eventStream.Added,
+		eventStream.ChangedObject{nil, cfgFoo}, endptStore)
+	require.Equal([]string{reasonServicePortNotFound, reasonServiceNotNodePort},
+		recordedReasons(recorder))
+
+	// Adding the same virtual server again overwrites it
+	vsm.processConfigMap(eventStream.Added,
+		eventStream.ChangedObject{nil, cfgFoo}, endptStore)
+	require.Contains(recordedReasons(recorder), reasonOverwrite)
+
+	// Without a recorder problems are only logged
+	vsm.eventRecorder = nil
+	require.NotPanics(func() {
+		vsm.processConfigMap(eventStream.Added,
+			eventStream.ChangedObject{nil, cfgBad}, endptStore)
+	})
+}
+
+func TestRecordServiceEvents(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	recorder := record.NewFakeRecorder(100)
+	vsm := NewManager(&Params{
+		KubeClient:    fake,
+		ConfigWriter:  mw,
+		Namespaces:    []string{namespace},
+		IsNodePort:    true,
+		EventRecorder: recorder,
+	})
+	endptStore := newStore(nil)
+
+	cfgFoo := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	vsm.processConfigMap(eventStream.Added,
+		eventStream.ChangedObject{nil, cfgFoo}, endptStore)
+	require.Empty(recordedReasons(recorder))
+
+	// Changing the Service type breaks the virtual server
+	fooClusterIP := newService("foo", "2", namespace, v1.ServiceTypeClusterIP,
+		[]v1.ServicePort{{Port: 80}})
+	vsm.processService(eventStream.Updated,
+		eventStream.ChangedObject{foo, fooClusterIP}, endptStore)
+	require.Equal([]string{reasonServiceNotNodePort}, recordedReasons(recorder))
+
+	// Resyncs do not record the same problem again
+	vsm.processService(eventStream.Replaced, fooClusterIP, endptStore)
+	vsm.processConfigMap(eventStream.Replaced, cfgFoo, endptStore)
+	require.Empty(recordedReasons(recorder))
+
+	// Until it is fixed and comes back
+	vsm.processService(eventStream.Updated,
+		eventStream.ChangedObject{fooClusterIP, foo}, endptStore)
+	vsm.processConfigMap(eventStream.Replaced, cfgFoo, endptStore)
+	require.Empty(recordedReasons(recorder))
+	vsm.processService(eventStream.Updated,
+		eventStream.ChangedObject{foo, fooClusterIP}, endptStore)
+	require.Equal([]string{reasonServiceNotNodePort}, recordedReasons(recorder))
+}
@@ -0,0 +1,257 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+
+	"eventStream"
+	log "f5/vlogger"
+
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.4/pkg/util/intstr"
+)
+
+// Ingress annotations understood by the controller
+const (
+	ingressClassAnnotation      = "kubernetes.io/ingress.class"
+	ingressBindAddrAnnotation   = "virtual-server.f5.com/ip"
+	ingressPartitionAnnotation  = "virtual-server.f5.com/partition"
+	ingressSslProfileAnnotation = "virtual-server.f5.com/ssl-profile"
+)
+
+// Ingress class handled by this controller
+const ingressClass = "f5"
+
+// Check if an Ingress is meant for this controller, Ingresses without a
+// class are claimed as well
+func isF5Ingress(ing *v1beta1.Ingress) bool {
+	class, ok := ing.ObjectMeta.Annotations[ingressClassAnnotation]
+	return !ok || class == ingressClass
+}
+
+// Name of the virtual server of an Ingress. Names cannot contain
+// underscores, so the kind prefix keeps it apart from a ConfigMap or Service
+// of the same name.
+func ingressName(ing *v1beta1.Ingress) string {
+	return fmt.Sprintf("ingress_%v_%v", ing.ObjectMeta.Namespace,
+		ing.ObjectMeta.Name)
+}
+
+// Translate an Ingress into Virtual Server configs keyed by name, one per
+// backend service port. The first backend (the default backend if there is one) carries the
+// virtual address and any host/path rules; the rest only provide pools for
+// those rules to select.
+func parseIngress(ing *v1beta1.Ingress) (map[string]*VirtualServerConfig, error) {
+	namespace := ing.ObjectMeta.Namespace
+	annotations := ing.ObjectMeta.Annotations
+
+	addrs, ok := annotations[ingressBindAddrAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("ingress %s does not contain %s annotation",
+			ing.ObjectMeta.Name, ingressBindAddrAnnotation)
+	}
+	bindAddr, bindAddr6, err := parseBindAddrs(addrs)
+	if nil != err {
+		return nil, fmt.Errorf("ingress %s has invalid %s annotation: %v",
+			ing.ObjectMeta.Name, ingressBindAddrAnnotation, err)
+	}
+	partition, ok := annotations[ingressPartitionAnnotation]
+	if !ok || 0 == len(partition) {
+		return nil, fmt.Errorf("ingress %s does not contain %s annotation",
+			ing.ObjectMeta.Name, ingressPartitionAnnotation)
+	}
+
+	// Host/path rules become L7 rules on the virtual server
+	var rules []RuleConfig
+	for _, rule := range ing.Spec.Rules {
+		if nil == rule.HTTP {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			port, portName := ingressBackendPort(path.Backend)
+			rules = append(rules, RuleConfig{
+				Host:            rule.Host,
+				Path:            path.Path,
+				ServiceName:     path.Backend.ServiceName,
+				ServicePort:     port,
+				servicePortName: portName,
+			})
+		}
+	}
+
+	var cfg VirtualServerConfig
+	if nil != ing.Spec.Backend {
+		port, portName := ingressBackendPort(*ing.Spec.Backend)
+		cfg.VirtualServer.Backend.ServiceName = ing.Spec.Backend.ServiceName
+		cfg.VirtualServer.Backend.ServicePort = port
+		cfg.VirtualServer.Backend.servicePortName = portName
+	} else if 0 != len(rules) {
+		cfg.VirtualServer.Backend.ServiceName = rules[0].ServiceName
+		cfg.VirtualServer.Backend.ServicePort = rules[0].ServicePort
+		cfg.VirtualServer.Backend.servicePortName = rules[0].servicePortName
+	} else {
+		return nil, fmt.Errorf("ingress %s does not define any backends",
+			ing.ObjectMeta.Name)
+	}
+	cfg.VirtualServer.Frontend.VirtualServerName = ingressName(ing)
+	cfg.VirtualServer.Frontend.Partition = partition
+	cfg.VirtualServer.Frontend.Balance = "round-robin"
+	cfg.VirtualServer.Frontend.Mode = "http"
+	cfg.VirtualServer.Frontend.VirtualAddress = &VirtualAddress{
+		BindAddr:  bindAddr,
+		Port:      80,
+		BindAddr6: bindAddr6,
+	}
+	if profile, ok := annotations[ingressSslProfileAnnotation]; ok {
+		cfg.VirtualServer.Frontend.VirtualAddress.Port = 443
+		cfg.VirtualServer.Frontend.SslProfile = &SslProfile{
+			F5ProfileName: profile,
+		}
+	} else if 0 != len(ing.Spec.TLS) && 0 != len(ing.Spec.TLS[0].SecretName) {
+		// The virtual server has a single client SSL profile, so only the
+		// first TLS Secret is used
+		cfg.VirtualServer.Frontend.VirtualAddress.Port = 443
+		cfg.VirtualServer.Frontend.SslProfile = &SslProfile{
+			SecretName: ing.Spec.TLS[0].SecretName,
+		}
+	}
+	cfg.VirtualServer.Frontend.Rules = rules
+
+	return expandRules(&cfg, namespace), nil
+}
+
+// Get the service port number or name of an Ingress backend, named ports
+// are looked up in the Service by resolveServicePort
+func ingressBackendPort(backend v1beta1.IngressBackend) (int32, string) {
+	if backend.ServicePort.Type != intstr.Int {
+		return 0, backend.ServicePort.StrVal
+	}
+	return backend.ServicePort.IntVal, ""
+}
+
+// Process Ingress objects from the eventStream
+func (vsm *Manager) ProcessIngressUpdate(
+	changeType eventStream.ChangeType,
+	obj interface{},
+	endptStore *eventStream.EventStore) {
+
+	updated := false
+
+	if changeType == eventStream.Replaced {
+		v := obj.([]interface{})
+		log.Debugf("ProcessIngressUpdate (%v) for %v Ingresses", changeType, len(v))
+		for _, item := range v {
+			updated = vsm.processIngress(changeType, item, endptStore) || updated
+		}
+	} else {
+		log.Debugf("ProcessIngressUpdate (%v) for 1 Ingress", changeType)
+		updated = vsm.processIngress(changeType, obj, endptStore) || updated
+	}
+
+	if updated {
+		// Output the Big-IP config
+		vsm.outputConfig()
+	}
+}
+
+// Process a change in Ingress state
+func (vsm *Manager) processIngress(
+	changeType eventStream.ChangeType,
+	obj interface{},
+	endptStore *eventStream.EventStore) bool {
+
+	var ing *v1beta1.Ingress
+	var oldIng *v1beta1.Ingress
+	o, ok := obj.(eventStream.ChangedObject)
+	if !ok {
+		ing = obj.(*v1beta1.Ingress)
+	} else {
+		switch changeType {
+		case eventStream.Added:
+			ing = o.New.(*v1beta1.Ingress)
+		case eventStream.Updated:
+			ing = o.New.(*v1beta1.Ingress)
+			oldIng = o.Old.(*v1beta1.Ingress)
+		case eventStream.Deleted:
+			ing = o.Old.(*v1beta1.Ingress)
+			oldIng = ing
+			vsm.forgetWarnings(ing)
+		}
+	}
+
+	namespace := ing.ObjectMeta.Namespace
+	if !vsm.watchingNamespace(namespace) {
+		log.Warningf("Recieving ingress updates for unwatched namespace %s", namespace)
+		return false
+	}
+
+	// Build the new configs; an Ingress that is deleted, invalid or meant
+	// for another controller has none
+	var cfgs map[string]*VirtualServerConfig
+	if eventStream.Deleted != changeType {
+		if isF5Ingress(ing) {
+			var err error
+			cfgs, err = parseIngress(ing)
+			if nil != err {
+				log.Warningf("Could not get config for Ingress: %v - %v",
+					ing.ObjectMeta.Name, err)
+				vsm.recordWarning(ing, reasonInvalidConfig, "%v", err)
+			}
+		} else {
+			log.Debugf("Ignoring Ingress %v with class %v", ing.ObjectMeta.Name,
+				ing.ObjectMeta.Annotations[ingressClassAnnotation])
+		}
+		for _, cfg := range cfgs {
+			vsm.checkSslSecret(cfg, namespace, ing)
+			if svc, ok := vsm.getBackendService(cfg, namespace, ing); ok {
+				vsm.setPoolMembers(cfg, svc, endptStore, ing)
+			}
+		}
+	}
+
+	var oldCfgs map[string]*VirtualServerConfig
+	if nil != oldIng && isF5Ingress(oldIng) {
+		oldCfgs, _ = parseIngress(oldIng)
+	}
+
+	vsm.vservers.Lock()
+	defer vsm.vservers.Unlock()
+
+	updateConfig := false
+	for vsName, _ := range oldCfgs {
+		if _, ok := cfgs[vsName]; !ok {
+			vsm.vservers.remove(vsName)
+			updateConfig = true
+		}
+	}
+	for vsName, cfg := range cfgs {
+		if eventStream.Added == changeType {
+			if _, ok := vsm.vservers.m[vsName]; ok {
+				log.Warningf(
+					"Overwriting existing entry for virtual server %v - change type: %v",
+					vsName, changeType)
+				vsm.recordWarning(ing, reasonOverwrite,
+					"Overwrote existing virtual server %v", vsName)
+			}
+		}
+		vsm.vservers.assign(namespace, cfg)
+		updateConfig = true
+	}
+
+	return updateConfig
+}
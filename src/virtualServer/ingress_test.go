@@ -0,0 +1,302 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.4/pkg/util/intstr"
+)
+
+func newIngress(id, rv, namespace string, annotations map[string]string,
+	spec v1beta1.IngressSpec) *v1beta1.Ingress {
+	return &v1beta1.Ingress{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "Ingress",
+			APIVersion: "extensions/v1beta1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:            id,
+			ResourceVersion: rv,
+			Namespace:       namespace,
+			Annotations:     annotations,
+		},
+		Spec: spec,
+	}
+}
+
+func newIngressBackend(svcName string, svcPort int) *v1beta1.IngressBackend {
+	return &v1beta1.IngressBackend{
+		ServiceName: svcName,
+		ServicePort: intstr.FromInt(svcPort),
+	}
+}
+
+func newIngressRule(host string, paths map[string]*v1beta1.IngressBackend) v1beta1.IngressRule {
+	rule := v1beta1.IngressRule{Host: host}
+	rule.HTTP = &v1beta1.HTTPIngressRuleValue{}
+	for path, backend := range paths {
+		rule.HTTP.Paths = append(rule.HTTP.Paths,
+			v1beta1.HTTPIngressPath{Path: path, Backend: *backend})
+	}
+	return rule
+}
+
+var ingressAnnotations = map[string]string{
+	ingressBindAddrAnnotation:  "10.128.10.250",
+	ingressPartitionAnnotation: "velcro",
+}
+
+func TestParseIngressDefaultBackend(t *testing.T) {
+	require := require.New(t)
+
+	ing := newIngress("ingress", "1", namespace, ingressAnnotations,
+		v1beta1.IngressSpec{Backend: newIngressBackend("foo", 80)})
+	cfgs, err := parseIngress(ing)
+	require.Nil(err)
+	require.Equal(1, len(cfgs))
+
+	cfg, ok := cfgs["ingress_default_ingress"]
+	require.True(ok)
+	frontend := cfg.VirtualServer.Frontend
+	require.Equal("foo", cfg.VirtualServer.Backend.ServiceName)
+	require.Equal(int32(80), cfg.VirtualServer.Backend.ServicePort)
+	require.Equal("velcro", frontend.Partition)
+	require.Equal("http", frontend.Mode)
+	require.Equal("round-robin", frontend.Balance)
+	require.Equal(&VirtualAddress{BindAddr: "10.128.10.250", Port: 80}, frontend.VirtualAddress)
+	require.Nil(frontend.SslProfile)
+	require.Nil(frontend.Rules)
+
+	// An SSL profile moves the virtual server to 443
+	sslAnnotations := map[string]string{
+		ingressSslProfileAnnotation: "velcro/testcert",
+	}
+	for k, v := range ingressAnnotations {
+		sslAnnotations[k] = v
+	}
+	ing = newIngress("ingress", "2", namespace, sslAnnotations,
+		v1beta1.IngressSpec{Backend: newIngressBackend("foo", 80)})
+	cfgs, err = parseIngress(ing)
+	require.Nil(err)
+	frontend = cfgs["ingress_default_ingress"].VirtualServer.Frontend
+	require.Equal(&VirtualAddress{BindAddr: "10.128.10.250", Port: 443}, frontend.VirtualAddress)
+	require.Equal(&SslProfile{F5ProfileName: "velcro/testcert"}, frontend.SslProfile)
+
+	// So does a TLS Secret
+	ing = newIngress("ingress", "3", namespace, ingressAnnotations,
+		v1beta1.IngressSpec{
+			Backend: newIngressBackend("foo", 80),
+			TLS: []v1beta1.IngressTLS{
+				{Hosts: []string{"foo.com"}, SecretName: "foo-tls"}},
+		})
+	cfgs, err = parseIngress(ing)
+	require.Nil(err)
+	frontend = cfgs["ingress_default_ingress"].VirtualServer.Frontend
+	require.Equal(&VirtualAddress{BindAddr: "10.128.10.250", Port: 443}, frontend.VirtualAddress)
+	require.Equal(&SslProfile{SecretName: "foo-tls"}, frontend.SslProfile)
+}
+
+func TestParseIngressRules(t *testing.T) {
+	require := require.New(t)
+
+	ing := newIngress("ingress", "1", namespace, ingressAnnotations,
+		v1beta1.IngressSpec{
+			Backend: newIngressBackend("foo", 80),
+			Rules: []v1beta1.IngressRule{
+				newIngressRule("bar.example.com", map[string]*v1beta1.IngressBackend{
+					"/": newIngressBackend("bar", 80),
+				}),
+				newIngressRule("baz.example.com", map[string]*v1beta1.IngressBackend{
+					"/foo": newIngressBackend("foo", 80),
+				}),
+				newIngressRule("", map[string]*v1beta1.IngressBackend{
+					"/baz": newIngressBackend("baz", 8080),
+				}),
+			},
+		})
+	cfgs, err := parseIngress(ing)
+	require.Nil(err)
+	require.Equal(3, len(cfgs), "Expected one config per backend")
+
+	primary := cfgs["ingress_default_ingress"].VirtualServer.Frontend
+	require.NotNil(primary.VirtualAddress)
+	require.Equal([]RuleConfig{
+		{Host: "bar.example.com", Path: "/", ServiceName: "bar", ServicePort: 80,
+			Pool: "ingress_default_ingress_bar_80"},
+		{Host: "baz.example.com", Path: "/foo", ServiceName: "foo", ServicePort: 80,
+			Pool: "ingress_default_ingress"},
+		{Path: "/baz", ServiceName: "baz", ServicePort: 8080,
+			Pool: "ingress_default_ingress_baz_8080"},
+	}, primary.Rules)
+
+	for _, name := range []string{
+		"ingress_default_ingress_bar_80",
+		"ingress_default_ingress_baz_8080",
+	} {
+		cfg, ok := cfgs[name]
+		require.True(ok)
+		require.Nil(cfg.VirtualServer.Frontend.VirtualAddress,
+			"Only the primary config should have a virtual address")
+		require.Nil(cfg.VirtualServer.Frontend.Rules)
+		require.Equal("velcro", cfg.VirtualServer.Frontend.Partition)
+	}
+
+	// Without a default backend the first rule provides the virtual address
+	ing.Spec.Backend = nil
+	cfgs, err = parseIngress(ing)
+	require.Nil(err)
+	require.Equal(3, len(cfgs))
+	require.Equal("bar", cfgs["ingress_default_ingress"].VirtualServer.Backend.ServiceName)
+	primary = cfgs["ingress_default_ingress"].VirtualServer.Frontend
+	require.NotNil(primary.VirtualAddress)
+	require.Equal(3, len(primary.Rules))
+}
+
+func TestParseIngressErrors(t *testing.T) {
+	tests := map[string]*v1beta1.Ingress{
+		"no bind address": newIngress("ingress", "1", namespace,
+			map[string]string{ingressPartitionAnnotation: "velcro"},
+			v1beta1.IngressSpec{Backend: newIngressBackend("foo", 80)}),
+		"bad bind address": newIngress("ingress", "1", namespace,
+			map[string]string{
+				ingressBindAddrAnnotation:  "10.128.10.260",
+				ingressPartitionAnnotation: "velcro",
+			},
+			v1beta1.IngressSpec{Backend: newIngressBackend("foo", 80)}),
+		"no partition": newIngress("ingress", "1", namespace,
+			map[string]string{ingressBindAddrAnnotation: "10.128.10.250"},
+			v1beta1.IngressSpec{Backend: newIngressBackend("foo", 80)}),
+		"no backends": newIngress("ingress", "1", namespace,
+			ingressAnnotations, v1beta1.IngressSpec{}),
+	}
+	for desc, ing := range tests {
+		cfgs, err := parseIngress(ing)
+		assert.NotNil(t, err, "Expected an error for %s", desc)
+		assert.Nil(t, cfgs, "Expected no configs for %s", desc)
+	}
+}
+
+func TestIngressClass(t *testing.T) {
+	assert := assert.New(t)
+
+	ing := newIngress("ingress", "1", namespace, map[string]string{},
+		v1beta1.IngressSpec{})
+	assert.True(isF5Ingress(ing), "Ingress without class should be handled")
+	ing.ObjectMeta.Annotations[ingressClassAnnotation] = "f5"
+	assert.True(isF5Ingress(ing))
+	ing.ObjectMeta.Annotations[ingressClassAnnotation] = "nginx"
+	assert.False(isF5Ingress(ing), "Ingress for another class should be ignored")
+}
+
+func TestProcessIngressUpdateNodePort(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	bar := newService("bar", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo, *bar}})
+	require.NotNil(fake, "Mock client should not be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+	endptStore := newStore(nil)
+
+	nodes := []v1.Node{
+		*newNode("node0", "0", false, []v1.NodeAddress{
+			{Type: "InternalIP", Address: "127.0.0.1"}}),
+	}
+	setUseNodeInternal(vsm, true)
+	vsm.ProcessNodeUpdate(nodes, nil)
+
+	ing := newIngress("ingress", "1", namespace, ingressAnnotations,
+		v1beta1.IngressSpec{
+			Backend: newIngressBackend("foo", 80),
+			Rules: []v1beta1.IngressRule{
+				newIngressRule("bar.example.com", map[string]*v1beta1.IngressBackend{
+					"/": newIngressBackend("bar", 80),
+				}),
+			},
+		})
+	vsm.ProcessIngressUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, ing}, endptStore)
+	require.Equal(2, len(vsm.vservers.m))
+	vs := vsm.vservers.m["ingress_default_ingress"]
+	require.EqualValues(30001, vs.VirtualServer.Backend.PoolMemberPort)
+	require.EqualValues([]string{"127.0.0.1"}, vs.VirtualServer.Backend.PoolMemberAddrs)
+	vs = vsm.vservers.m["ingress_default_ingress_bar_80"]
+	require.EqualValues(37001, vs.VirtualServer.Backend.PoolMemberPort)
+	require.Equal(2, mw.WrittenTimes, "Expected node and ingress writes")
+
+	// Dropping the rule removes its pool
+	ing2 := newIngress("ingress", "2", namespace, ingressAnnotations,
+		v1beta1.IngressSpec{Backend: newIngressBackend("foo", 80)})
+	vsm.ProcessIngressUpdate(eventStream.Updated, eventStream.ChangedObject{
+		ing, ing2}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, namespace, v1.ProtocolTCP})
+	require.Equal(3, mw.WrittenTimes)
+
+	// Handing the Ingress to another controller removes it
+	ing3 := newIngress("ingress", "3", namespace, map[string]string{
+		ingressClassAnnotation: "nginx"},
+		v1beta1.IngressSpec{Backend: newIngressBackend("foo", 80)})
+	vsm.ProcessIngressUpdate(eventStream.Updated, eventStream.ChangedObject{
+		ing2, ing3}, endptStore)
+	require.Equal(0, len(vsm.vservers.m))
+
+	vsm.ProcessIngressUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, ing2}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
+	vsm.ProcessIngressUpdate(eventStream.Deleted, eventStream.ChangedObject{
+		ing2, nil}, endptStore)
+	require.Equal(0, len(vsm.vservers.m))
+	validateConfig(t, mw, emptyConfig)
+
+	// A ConfigMap of the same name has its own virtual server
+	cm := newConfigMap("ingress", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, cm}, endptStore)
+	vsm.ProcessIngressUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, ing2}, endptStore)
+	require.Equal(2, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.m, "default_ingress")
+	require.Contains(vsm.vservers.m, "ingress_default_ingress")
+	vsm.ProcessIngressUpdate(eventStream.Deleted, eventStream.ChangedObject{
+		ing2, nil}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.m, "default_ingress")
+}
@@ -0,0 +1,480 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	log "f5/vlogger"
+
+	"k8s.io/client-go/1.4/kubernetes"
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+// Scopes an address range can be limited to
+const (
+	ipamScopePartition = "partition"
+	ipamScopeNamespace = "namespace"
+)
+
+// IPAM allocates virtual addresses from CIDR ranges for virtual servers
+// that do not specify one. Allocations are kept in a ConfigMap so they
+// survive restarts.
+type IPAM struct {
+	sync.Mutex
+	// Ranges usable by any virtual server
+	defaultRanges []*net.IPNet
+	// Ranges for virtual servers in a given partition
+	partitionRanges map[string][]*net.IPNet
+	// Ranges for virtual servers from a given namespace
+	namespaceRanges map[string][]*net.IPNet
+	// Allocated addresses keyed by owner, and owners keyed by address,
+	// including the owners of reserved addresses
+	allocated map[string]string
+	owners    map[string]string
+	// Addresses given explicitly, keyed by owner, never allocated to others
+	// and not stored
+	reserved map[string][]string
+	// Where the next scan of each range starts, keyed by range
+	cursors map[string]net.IP
+	// Owners loaded from the ConfigMap that have not allocated since, those
+	// whose resources are gone are released by ReleaseStale
+	restored map[string]bool
+	// Where the allocations are stored
+	kubeClient  kubernetes.Interface
+	cmNamespace string
+	cmName      string
+}
+
+// Create an IPAM from a list of ranges and load its existing allocations
+// from the ConfigMap cmNamespace/cmName. Each range is a CIDR such as
+// 10.128.10.0/24, optionally limited to a partition or namespace as in
+// partition:velcro=10.128.20.0/28 or namespace:default=10.128.30.0/28
+func NewIPAM(
+	kubeClient kubernetes.Interface,
+	cmNamespace string,
+	cmName string,
+	ranges []string) (*IPAM, error) {
+
+	ipam := &IPAM{
+		partitionRanges: make(map[string][]*net.IPNet),
+		namespaceRanges: make(map[string][]*net.IPNet),
+		allocated:       make(map[string]string),
+		owners:          make(map[string]string),
+		reserved:        make(map[string][]string),
+		cursors:         make(map[string]net.IP),
+		restored:        make(map[string]bool),
+		kubeClient:      kubeClient,
+		cmNamespace:     cmNamespace,
+		cmName:          cmName,
+	}
+
+	for _, r := range ranges {
+		scope, cidr := "", r
+		if i := strings.Index(r, "="); -1 != i {
+			scope, cidr = r[:i], r[i+1:]
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if nil != err {
+			return nil, fmt.Errorf("invalid IPAM range %s: %v", r, err)
+		}
+		if 0 == len(scope) {
+			ipam.defaultRanges = append(ipam.defaultRanges, ipNet)
+			continue
+		}
+		parts := strings.SplitN(scope, ":", 2)
+		if 2 != len(parts) || 0 == len(parts[1]) {
+			return nil, fmt.Errorf("invalid IPAM range %s: bad scope %s", r, scope)
+		}
+		switch parts[0] {
+		case ipamScopePartition:
+			ipam.partitionRanges[parts[1]] =
+				append(ipam.partitionRanges[parts[1]], ipNet)
+		case ipamScopeNamespace:
+			ipam.namespaceRanges[parts[1]] =
+				append(ipam.namespaceRanges[parts[1]], ipNet)
+		default:
+			return nil, fmt.Errorf("invalid IPAM range %s: unknown scope %s",
+				r, parts[0])
+		}
+	}
+
+	// A missing ConfigMap means nothing has been allocated yet
+	cm, err := kubeClient.Core().ConfigMaps(cmNamespace).Get(cmName)
+	if nil == err {
+		for owner, addr := range cm.Data {
+			ipam.allocated[owner] = addr
+			ipam.owners[addr] = owner
+			ipam.restored[owner] = true
+		}
+		log.Infof("Loaded %v IPAM allocations from ConfigMap %v/%v",
+			len(cm.Data), cmNamespace, cmName)
+	}
+
+	return ipam, nil
+}
+
+// Get the ranges of an address family to allocate from, the most specific
+// ones that have any of the family only
+func (ipam *IPAM) rangesFor(namespace, partition, family string) []*net.IPNet {
+	for _, ranges := range [][]*net.IPNet{
+		ipam.namespaceRanges[namespace],
+		ipam.partitionRanges[partition],
+		ipam.defaultRanges,
+	} {
+		var matching []*net.IPNet
+		for _, ipNet := range ranges {
+			isIPv4 := nil != ipNet.IP.To4()
+			if (AddressFamilyIPv4 == family && !isIPv4) ||
+				(AddressFamilyIPv6 == family && isIPv4) {
+				continue
+			}
+			matching = append(matching, ipNet)
+		}
+		if 0 != len(matching) {
+			return matching
+		}
+	}
+	return nil
+}
+
+// Allocate an address of an address family, AddressFamilyAny for either,
+// for owner. An owner that already has an address in the right range keeps
+// it. An address that cannot be stored is not allocated, so it is not
+// handed out again after a restart.
+func (ipam *IPAM) Allocate(
+	owner, namespace, partition, family string) (string, error) {
+
+	ipam.Lock()
+	defer ipam.Unlock()
+
+	delete(ipam.restored, owner)
+	ipam.unreserve(owner)
+	ranges := ipam.rangesFor(namespace, partition, family)
+	oldAddr, hadAddr := ipam.allocated[owner]
+	if hadAddr {
+		ip := net.ParseIP(oldAddr)
+		for _, ipNet := range ranges {
+			if ipNet.Contains(ip) {
+				return oldAddr, nil
+			}
+		}
+		// The ranges changed, move to a new address
+		delete(ipam.owners, oldAddr)
+		delete(ipam.allocated, owner)
+	}
+
+	for _, ipNet := range ranges {
+		ip := ipam.freeHost(ipNet)
+		if nil == ip {
+			continue
+		}
+		addr := ip.String()
+		ipam.allocated[owner] = addr
+		ipam.owners[addr] = owner
+		if err := ipam.persist(); nil != err {
+			delete(ipam.owners, addr)
+			delete(ipam.allocated, owner)
+			if hadAddr {
+				ipam.allocated[owner] = oldAddr
+				ipam.owners[oldAddr] = owner
+			}
+			return "", fmt.Errorf("failed to store IPAM allocation of %s: %v",
+				owner, err)
+		}
+		ipam.cursors[ipNet.String()] = nextHost(ipNet, ip)
+		return addr, nil
+	}
+	return "", fmt.Errorf("no free addresses for %s (namespace %s, partition %s)",
+		owner, namespace, partition)
+}
+
+// Find a free address in a range, scanning from where the last allocation
+// from it left off. Of any len(owners)+1 addresses one is free, so the scan
+// is short even in ranges too large to scan, such as IPv6 ones.
+// This function MUST be called with the IPAM lock held.
+func (ipam *IPAM) freeHost(ipNet *net.IPNet) net.IP {
+	start := ipam.cursors[ipNet.String()]
+	if nil == start {
+		start = firstHost(ipNet)
+	}
+	ip := start
+	for i := 0; i <= len(ipam.owners); i++ {
+		if _, ok := ipam.owners[ip.String()]; !ok {
+			return ip
+		}
+		if ip = nextHost(ipNet, ip); nil == ip {
+			ip = firstHost(ipNet)
+		}
+		if ip.Equal(start) {
+			break
+		}
+	}
+	return nil
+}
+
+// Reserve the addresses owner was given explicitly, such as a bindAddr,
+// releasing any address allocated to it. Addresses allocated to another
+// owner are left to it.
+func (ipam *IPAM) Reserve(owner string, addrs ...string) {
+	ipam.Lock()
+	defer ipam.Unlock()
+
+	ipam.release(owner)
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if nil == ip {
+			continue
+		}
+		addr = ip.String()
+		if other, ok := ipam.owners[addr]; ok && other != owner {
+			log.Warningf("Address %v of %v is also allocated to %v", addr, owner,
+				other)
+			continue
+		}
+		ipam.owners[addr] = owner
+		ipam.reserved[owner] = append(ipam.reserved[owner], addr)
+	}
+}
+
+// Drop the addresses reserved for owner.
+// This function MUST be called with the IPAM lock held.
+func (ipam *IPAM) unreserve(owner string) {
+	for _, addr := range ipam.reserved[owner] {
+		if owner == ipam.owners[addr] {
+			delete(ipam.owners, addr)
+		}
+	}
+	delete(ipam.reserved, owner)
+}
+
+// Release the address allocated to owner, or reserved for it, if any
+func (ipam *IPAM) Release(owner string) {
+	ipam.Lock()
+	defer ipam.Unlock()
+	ipam.release(owner)
+}
+
+// Release the address allocated to owner, or reserved for it, if any.
+// This function MUST be called with the IPAM lock held.
+func (ipam *IPAM) release(owner string) {
+	ipam.unreserve(owner)
+	addr, ok := ipam.allocated[owner]
+	if !ok {
+		return
+	}
+	delete(ipam.owners, addr)
+	delete(ipam.allocated, owner)
+	if err := ipam.persist(); nil != err {
+		log.Warningf("Failed to store IPAM allocations: %v", err)
+	}
+}
+
+// Release the addresses of owners loaded from the ConfigMap that are not
+// live and have not allocated since, their resources were deleted while the
+// controller was not running
+func (ipam *IPAM) ReleaseStale(isLive func(owner string) bool) error {
+	ipam.Lock()
+	defer ipam.Unlock()
+
+	released := 0
+	for owner, _ := range ipam.restored {
+		delete(ipam.restored, owner)
+		if isLive(owner) {
+			continue
+		}
+		addr := ipam.allocated[owner]
+		log.Infof("Releasing IPAM address %v of deleted owner %v", addr, owner)
+		delete(ipam.owners, addr)
+		delete(ipam.allocated, owner)
+		released++
+	}
+	if 0 == released {
+		return nil
+	}
+	return ipam.persist()
+}
+
+// Write the allocations to the IPAM ConfigMap
+// This function MUST be called with the IPAM lock held.
+func (ipam *IPAM) persist() error {
+	data := make(map[string]string, len(ipam.allocated))
+	for owner, addr := range ipam.allocated {
+		data[owner] = addr
+	}
+
+	cms := ipam.kubeClient.Core().ConfigMaps(ipam.cmNamespace)
+	cm, err := cms.Get(ipam.cmName)
+	if nil != err {
+		cm = &v1.ConfigMap{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      ipam.cmName,
+				Namespace: ipam.cmNamespace,
+			},
+			Data: data,
+		}
+		_, err = cms.Create(cm)
+		return err
+	}
+	cm.Data = data
+	_, err = cms.Update(cm)
+	return err
+}
+
+// Allocate a virtual address for a config that does not specify a bindAddr
+func (vsm *Manager) assignBindAddr(cfg *VirtualServerConfig, namespace string) error {
+	name := cfg.VirtualServer.Frontend.VirtualServerName
+	va := cfg.VirtualServer.Frontend.VirtualAddress
+	if nil == va {
+		vsm.releaseBindAddr(name)
+		return nil
+	}
+	if 0 != len(va.BindAddr) {
+		// Drop any address allocated before a bindAddr was given, and keep
+		// IPAM from handing out the given ones
+		vsm.reserveBindAddr(name, va.BindAddr, va.BindAddr6)
+		return nil
+	}
+	if nil == vsm.ipam {
+		return fmt.Errorf("virtual server %s has no bindAddr and IPAM is not "+
+			"configured", name)
+	}
+	// The bindAddr of a dual-stack virtual server is its IPv4 address
+	family := AddressFamilyAny
+	if 0 != len(va.BindAddr6) {
+		family = AddressFamilyIPv4
+	}
+	addr, err := vsm.ipam.Allocate(name, namespace,
+		cfg.VirtualServer.Frontend.Partition, family)
+	if nil != err {
+		return err
+	}
+	va.BindAddr = addr
+	return nil
+}
+
+// Release the virtual address allocated to a virtual server
+func (vsm *Manager) releaseBindAddr(name string) {
+	if nil != vsm.ipam {
+		vsm.ipam.Release(name)
+	}
+}
+
+// Reserve the virtual addresses a virtual server was given
+func (vsm *Manager) reserveBindAddr(name string, addrs ...string) {
+	if nil != vsm.ipam {
+		vsm.ipam.Reserve(name, addrs...)
+	}
+}
+
+// Release the virtual addresses of ConfigMaps and Services deleted while the
+// controller was not running. Resources that allocate again keep their
+// addresses, so this can run while the event streams list them.
+func (vsm *Manager) ReclaimAddresses() error {
+	if nil == vsm.ipam {
+		return nil
+	}
+	namespaces := []string{}
+	for ns, _ := range vsm.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	if 0 == len(namespaces) {
+		namespaces = []string{v1.NamespaceAll}
+	}
+
+	// Only F5 resource ConfigMaps have virtual servers
+	cmOptions := api.ListOptions{
+		LabelSelector: labels.SelectorFromSet(
+			labels.Set{"f5type": "virtual-server"}),
+	}
+	live := make(map[string]bool)
+	for _, ns := range namespaces {
+		cms, err := vsm.kubeClient.Core().ConfigMaps(ns).List(cmOptions)
+		if nil != err {
+			return err
+		}
+		for i := range cms.Items {
+			live[configMapName(&cms.Items[i])] = true
+		}
+		svcs, err := vsm.kubeClient.Core().Services(ns).List(api.ListOptions{})
+		if nil != err {
+			return err
+		}
+		for i := range svcs.Items {
+			live[serviceOwner(&svcs.Items[i])] = true
+		}
+	}
+	return vsm.ipam.ReleaseStale(func(owner string) bool {
+		// Owners of other namespaces may belong to another controller
+		return live[owner] || !vsm.watchingNamespace(ownerNamespace(owner))
+	})
+}
+
+// Get the namespace of an IPAM owner. Kubernetes names cannot contain
+// underscores, so owners are <namespace>_<name> or <kind>_<namespace>_<name>
+func ownerNamespace(owner string) string {
+	parts := strings.Split(owner, "_")
+	if 3 == len(parts) {
+		return parts[1]
+	}
+	return parts[0]
+}
+
+// Get the first usable address of a range, skipping the network address of
+// IPv4 ranges and the subnet-router anycast address of IPv6 ranges with room
+// for more than two addresses
+func firstHost(ipNet *net.IPNet) net.IP {
+	ip := make(net.IP, len(ipNet.IP))
+	copy(ip, ipNet.IP)
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones > 1 {
+		return nextHost(ipNet, ip)
+	}
+	return ip
+}
+
+// Get the address following ip in a range, or nil at the end of the range.
+// The broadcast address of IPv4 ranges is not used.
+func nextHost(ipNet *net.IPNet, ip net.IP) net.IP {
+	next := nextAddr(ip)
+	if !ipNet.Contains(next) {
+		return nil
+	}
+	ones, bits := ipNet.Mask.Size()
+	if 32 == bits && bits-ones > 1 && !ipNet.Contains(nextAddr(next)) {
+		return nil
+	}
+	return next
+}
+
+// Get the address following ip, wrapping around at the end
+func nextAddr(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if 0 != next[i] {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,386 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	core "k8s.io/client-go/1.4/testing"
+)
+
+func TestNewIPAMErrors(t *testing.T) {
+	fake := fake.NewSimpleClientset()
+	for _, r := range []string{
+		"10.128.10.0",
+		"10.128.10.0/33",
+		"velcro=10.128.10.0/24",
+		"partition:=10.128.10.0/24",
+		"cluster:velcro=10.128.10.0/24",
+	} {
+		ipam, err := NewIPAM(fake, "kube-system", "f5-ipam", []string{r})
+		assert.NotNil(t, err, "Expected an error for range %s", r)
+		assert.Nil(t, ipam)
+	}
+}
+
+func TestIPAMAllocate(t *testing.T) {
+	require := require.New(t)
+
+	fake := fake.NewSimpleClientset()
+	ipam, err := NewIPAM(fake, "kube-system", "f5-ipam", []string{
+		"10.128.10.0/30",
+		"partition:velcro=10.128.20.0/31",
+		"namespace:production=10.128.30.8/32",
+	})
+	require.Nil(err)
+
+	// Network and broadcast addresses are skipped
+	addr, err := ipam.Allocate("default_foo", "default", "common", AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.10.1", addr)
+	addr, err = ipam.Allocate("default_bar", "default", "common", AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.10.2", addr)
+	_, err = ipam.Allocate("default_baz", "default", "common", AddressFamilyAny)
+	require.NotNil(err, "Range should be exhausted")
+
+	// Owners keep their address
+	addr, err = ipam.Allocate("default_foo", "default", "common", AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.10.1", addr)
+
+	// Released addresses are reused
+	ipam.Release("default_foo")
+	addr, err = ipam.Allocate("default_baz", "default", "common", AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.10.1", addr)
+
+	// Namespace ranges win over partition ranges
+	addr, err = ipam.Allocate("default_velcro", "default", "velcro", AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.20.0", addr)
+	addr, err = ipam.Allocate("production_foo", "production", "velcro", AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.30.8", addr)
+
+	// An owner moved to another range gets a new address
+	addr, err = ipam.Allocate("default_bar", "default", "velcro", AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.20.1", addr)
+
+	cm, err := fake.Core().ConfigMaps("kube-system").Get("f5-ipam")
+	require.Nil(err, "Allocations should be stored")
+	require.Equal(map[string]string{
+		"default_baz":    "10.128.10.1",
+		"default_velcro": "10.128.20.0",
+		"production_foo": "10.128.30.8",
+		"default_bar":    "10.128.20.1",
+	}, cm.Data)
+}
+
+func TestIPAMRestore(t *testing.T) {
+	require := require.New(t)
+
+	cm := newConfigMap("f5-ipam", "1", "kube-system", map[string]string{
+		"default_foo": "10.128.10.1",
+	})
+	fake := fake.NewSimpleClientset(cm)
+	ipam, err := NewIPAM(fake, "kube-system", "f5-ipam",
+		[]string{"10.128.10.0/29"})
+	require.Nil(err)
+
+	addr, err := ipam.Allocate("default_bar", namespace, "velcro", AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.10.2", addr, "Stored allocations should be reserved")
+	addr, err = ipam.Allocate("default_foo", namespace, "velcro", AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.10.1", addr, "Stored allocations should be kept")
+}
+
+func TestIPAMIPv6(t *testing.T) {
+	fake := fake.NewSimpleClientset()
+	ipam, err := NewIPAM(fake, "kube-system", "f5-ipam", []string{
+		"fd00::/126",
+		"partition:velcro=fd00:1::/127",
+	})
+	require.Nil(t, err)
+
+	// The subnet-router anycast address is skipped
+	addr, err := ipam.Allocate("default_foo", "default", "common", AddressFamilyAny)
+	require.Nil(t, err)
+	assert.Equal(t, "fd00::1", addr)
+	addr, err = ipam.Allocate("default_bar", "default", "velcro", AddressFamilyAny)
+	require.Nil(t, err)
+	assert.Equal(t, "fd00:1::", addr, "Point-to-point ranges use both addresses")
+}
+
+func TestIPAMFamily(t *testing.T) {
+	fake := fake.NewSimpleClientset()
+	ipam, err := NewIPAM(fake, "kube-system", "f5-ipam", []string{
+		"10.128.10.0/30",
+		"fd00::/64",
+		"partition:velcro=fd00:1::/64",
+	})
+	require.Nil(t, err)
+
+	addr, err := ipam.Allocate("default_foo", "default", "common",
+		AddressFamilyIPv6)
+	require.Nil(t, err)
+	assert.Equal(t, "fd00::1", addr)
+	addr, err = ipam.Allocate("default_bar", "default", "common",
+		AddressFamilyIPv4)
+	require.Nil(t, err)
+	assert.Equal(t, "10.128.10.1", addr)
+
+	// Scopes without ranges of the family fall back to less specific ones
+	addr, err = ipam.Allocate("default_baz", "default", "velcro",
+		AddressFamilyIPv4)
+	require.Nil(t, err)
+	assert.Equal(t, "10.128.10.2", addr)
+	_, err = ipam.Allocate("default_qux", "default", "velcro",
+		AddressFamilyIPv4)
+	assert.NotNil(t, err, "IPv4 ranges should be exhausted")
+
+	// An owner moves to a range of the family it asks for
+	addr, err = ipam.Allocate("default_foo", "default", "common",
+		AddressFamilyIPv4)
+	assert.NotNil(t, err)
+	ipam.Release("default_bar")
+	addr, err = ipam.Allocate("default_foo", "default", "common",
+		AddressFamilyIPv4)
+	require.Nil(t, err)
+	assert.Equal(t, "10.128.10.1", addr)
+}
+
+func TestIPAMCursor(t *testing.T) {
+	require := require.New(t)
+
+	fake := fake.NewSimpleClientset()
+	ipam, err := NewIPAM(fake, "kube-system", "f5-ipam",
+		[]string{"10.128.10.0/29"})
+	require.Nil(err)
+
+	for i := 1; i <= 3; i++ {
+		addr, err := ipam.Allocate(fmt.Sprintf("default_foo%d", i), "default",
+			"common", AddressFamilyAny)
+		require.Nil(err)
+		require.Equal(fmt.Sprintf("10.128.10.%d", i), addr)
+	}
+	// Released addresses are only reused once the scan wraps around
+	ipam.Release("default_foo1")
+	for i := 4; i <= 6; i++ {
+		addr, err := ipam.Allocate(fmt.Sprintf("default_foo%d", i), "default",
+			"common", AddressFamilyAny)
+		require.Nil(err)
+		require.Equal(fmt.Sprintf("10.128.10.%d", i), addr)
+	}
+	addr, err := ipam.Allocate("default_foo7", "default", "common",
+		AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.10.1", addr)
+	_, err = ipam.Allocate("default_foo8", "default", "common",
+		AddressFamilyAny)
+	require.NotNil(err, "Range should be exhausted")
+
+	// Large ranges are not scanned to their end
+	ipam, err = NewIPAM(fake, "kube-system", "f5-ipam-v6",
+		[]string{"fd00::/64"})
+	require.Nil(err)
+	ipam.Reserve("default_foo", "fd00::1", "fd00::2")
+	addr, err = ipam.Allocate("default_bar", "default", "common",
+		AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("fd00::3", addr)
+}
+
+func TestIPAMReserve(t *testing.T) {
+	require := require.New(t)
+
+	fake := fake.NewSimpleClientset()
+	ipam, err := NewIPAM(fake, "kube-system", "f5-ipam",
+		[]string{"10.128.10.0/29"})
+	require.Nil(err)
+
+	// Given addresses are not handed out, nor stored
+	ipam.Reserve("default_foo", "10.128.10.1")
+	addr, err := ipam.Allocate("default_bar", "default", "common",
+		AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.10.2", addr)
+	cm, err := fake.Core().ConfigMaps("kube-system").Get("f5-ipam")
+	require.Nil(err)
+	require.Equal(map[string]string{"default_bar": "10.128.10.2"}, cm.Data)
+
+	// Reserving drops the allocation, an address allocated to another
+	// owner stays with it
+	ipam.Reserve("default_bar", "10.128.10.1", "10.128.10.3")
+	require.Empty(ipam.allocated)
+	require.Equal(map[string]string{
+		"10.128.10.1": "default_foo",
+		"10.128.10.3": "default_bar",
+	}, ipam.owners)
+
+	// Released or allocating owners give their reservations up
+	ipam.Release("default_foo")
+	addr, err = ipam.Allocate("default_bar", "default", "common",
+		AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.10.3", addr)
+	addr, err = ipam.Allocate("default_baz", "default", "common",
+		AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.10.4", addr)
+	require.Equal(map[string]string{
+		"10.128.10.3": "default_bar",
+		"10.128.10.4": "default_baz",
+	}, ipam.owners)
+}
+
+func TestIPAMPersistFailure(t *testing.T) {
+	require := require.New(t)
+
+	fake := fake.NewSimpleClientset()
+	fail := true
+	fake.PrependReactor("*", "configmaps",
+		func(action core.Action) (bool, runtime.Object, error) {
+			if fail && "get" != action.GetVerb() {
+				return true, nil, fmt.Errorf("storage unavailable")
+			}
+			return false, nil, nil
+		})
+	ipam, err := NewIPAM(fake, "kube-system", "f5-ipam",
+		[]string{"10.128.10.0/29", "partition:velcro=10.128.20.0/29"})
+	require.Nil(err)
+
+	// Addresses that cannot be stored are not handed out
+	_, err = ipam.Allocate("default_foo", "default", "common", AddressFamilyAny)
+	require.NotNil(err)
+	require.Empty(ipam.allocated)
+	require.Empty(ipam.owners)
+
+	fail = false
+	addr, err := ipam.Allocate("default_foo", "default", "common", AddressFamilyAny)
+	require.Nil(err)
+	require.Equal("10.128.10.1", addr)
+
+	// An owner that cannot move keeps its address
+	fail = true
+	_, err = ipam.Allocate("default_foo", "default", "velcro", AddressFamilyAny)
+	require.NotNil(err)
+	require.Equal(map[string]string{"default_foo": "10.128.10.1"},
+		ipam.allocated)
+	require.Equal(map[string]string{"10.128.10.1": "default_foo"}, ipam.owners)
+}
+
+func TestReclaimAddresses(t *testing.T) {
+	require := require.New(t)
+
+	// svc_default_foo is left from before foo became a LoadBalancer
+	ipamCm := newConfigMap("f5-ipam", "1", "kube-system", map[string]string{
+		"default_foomap":     "10.128.10.1",
+		"default_gonemap":    "10.128.10.2",
+		"default_plainmap":   "10.128.10.7",
+		"lb_default_foo":     "10.128.10.3",
+		"svc_default_gone":   "10.128.10.4",
+		"svc_default_foo":    "10.128.10.8",
+		"default_latermap":   "10.128.10.5",
+		"production_foomap2": "10.128.10.6",
+	})
+	foomap := newConfigMap("foomap", "1", namespace, map[string]string{})
+	foomap.ObjectMeta.Labels = map[string]string{"f5type": "virtual-server"}
+	// ConfigMaps without the label have no virtual servers
+	plainmap := newConfigMap("plainmap", "1", namespace, map[string]string{})
+	foo := newService("foo", "1", namespace, v1.ServiceTypeLoadBalancer,
+		[]v1.ServicePort{{Port: 80}})
+	fake := fake.NewSimpleClientset(ipamCm, foomap, plainmap, foo)
+	ipam, err := NewIPAM(fake, "kube-system", "f5-ipam",
+		[]string{"10.128.10.0/29"})
+	require.Nil(err)
+	vsm := NewManager(&Params{
+		KubeClient: fake,
+		Namespaces: []string{namespace},
+		IPAM:       ipam,
+	})
+
+	// Owners that allocated before the reclaim are kept, as are those of
+	// namespaces that are not watched
+	_, err = ipam.Allocate("default_latermap", namespace, "velcro",
+		AddressFamilyAny)
+	require.Nil(err)
+	require.Nil(vsm.ReclaimAddresses())
+	require.Equal(map[string]string{
+		"default_foomap":     "10.128.10.1",
+		"lb_default_foo":     "10.128.10.3",
+		"default_latermap":   "10.128.10.5",
+		"production_foomap2": "10.128.10.6",
+	}, ipam.allocated)
+
+	cm, err := fake.Core().ConfigMaps("kube-system").Get("f5-ipam")
+	require.Nil(err)
+	require.Equal(ipam.allocated, cm.Data)
+}
+
+func TestAssignBindAddr(t *testing.T) {
+	require := require.New(t)
+
+	fake := fake.NewSimpleClientset()
+	vsm := NewManager(&Params{KubeClient: fake})
+
+	var cfg VirtualServerConfig
+	cfg.VirtualServer.Frontend.VirtualServerName = "default_foomap"
+	cfg.VirtualServer.Frontend.Partition = "velcro"
+	cfg.VirtualServer.Frontend.VirtualAddress = &VirtualAddress{Port: 80}
+	require.NotNil(vsm.assignBindAddr(&cfg, namespace),
+		"Missing bindAddr should fail without IPAM")
+
+	ipam, err := NewIPAM(fake, "kube-system", "f5-ipam",
+		[]string{"10.128.10.0/29"})
+	require.Nil(err)
+	vsm.ipam = ipam
+	require.Nil(vsm.assignBindAddr(&cfg, namespace))
+	require.Equal("10.128.10.1", cfg.VirtualServer.Frontend.VirtualAddress.BindAddr)
+
+	// Giving a bindAddr releases the allocated address and reserves the
+	// given one
+	require.Nil(vsm.assignBindAddr(&cfg, namespace))
+	require.Equal("10.128.10.1", cfg.VirtualServer.Frontend.VirtualAddress.BindAddr)
+	require.Empty(ipam.allocated)
+	require.Equal(map[string]string{"10.128.10.1": "default_foomap"}, ipam.owners)
+
+	// The bindAddr of a dual-stack virtual server is IPv4
+	ipam, err = NewIPAM(fake, "kube-system", "f5-ipam-ds",
+		[]string{"fd00::/64", "10.128.20.0/29"})
+	require.Nil(err)
+	vsm.ipam = ipam
+	cfg.VirtualServer.Frontend.VirtualAddress = &VirtualAddress{
+		BindAddr6: "2001:db8::f0",
+		Port:      80,
+	}
+	require.Nil(vsm.assignBindAddr(&cfg, namespace))
+	require.Equal("10.128.20.1", cfg.VirtualServer.Frontend.VirtualAddress.BindAddr)
+
+	// Pool-only configs do not get an address
+	cfg.VirtualServer.Frontend.VirtualAddress = nil
+	require.Nil(vsm.assignBindAddr(&cfg, namespace))
+	require.Empty(ipam.allocated)
+}
@@ -0,0 +1,332 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"eventStream"
+	log "f5/vlogger"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+)
+
+// ConfigMap key holding the source of an iRule
+const iRuleCodeKey = "code"
+
+// Source of an iRule ConfigMap, written to the irules section for the driver
+// to create the iRule from
+type IRule struct {
+	// <namespace>_<configmap>, what the virtual servers' iRules refer to
+	Name string `json:"name"`
+	Code string `json:"code"`
+}
+
+// Check the iRules a config attaches are all named
+func validateIRules(cfg *VirtualServerConfig) error {
+	for _, name := range cfg.VirtualServer.Frontend.IRules {
+		if 0 == len(strings.TrimSpace(name)) {
+			return fmt.Errorf("iRules cannot have an empty name")
+		}
+	}
+	return nil
+}
+
+// iRules starting with / are existing Big-IP iRules, such as
+// /Common/_sys_https_redirect, the others name iRule ConfigMaps
+func isBigIPIRule(name string) bool {
+	return strings.HasPrefix(name, "/")
+}
+
+// Get the iRule from an iRule ConfigMap
+func configMapIRule(cm *v1.ConfigMap) (*IRule, error) {
+	code := cm.Data[iRuleCodeKey]
+	if 0 == len(strings.TrimSpace(code)) {
+		return nil, fmt.Errorf("configmap %s does not contain %s key",
+			cm.ObjectMeta.Name, iRuleCodeKey)
+	}
+	return &IRule{
+		Name: fmt.Sprintf("%v_%v", cm.ObjectMeta.Namespace, cm.ObjectMeta.Name),
+		Code: code,
+	}, nil
+}
+
+// Process iRule ConfigMap objects from the eventStream
+func (vsm *Manager) ProcessIRuleUpdate(
+	changeType eventStream.ChangeType,
+	obj interface{}) {
+
+	vsm.vservers.Lock()
+	defer vsm.vservers.Unlock()
+
+	updated := false
+	if changeType == eventStream.Replaced {
+		v := obj.([]interface{})
+		log.Debugf("ProcessIRuleUpdate (%v) for %v ConfigMaps", changeType, len(v))
+		for _, item := range v {
+			updated = vsm.processIRule(changeType, item) || updated
+		}
+	} else {
+		log.Debugf("ProcessIRuleUpdate (%v) for 1 ConfigMap", changeType)
+		updated = vsm.processIRule(changeType, obj) || updated
+	}
+
+	if updated {
+		// Output the Big-IP config
+		vsm.outputConfigLocked()
+	}
+}
+
+// Process a change in iRule ConfigMap state.
+// Returns true if a virtual server attaches the iRule.
+// This function MUST be called with the vservers lock held.
+func (vsm *Manager) processIRule(
+	changeType eventStream.ChangeType,
+	obj interface{}) bool {
+
+	var cm *v1.ConfigMap
+	o, ok := obj.(eventStream.ChangedObject)
+	if !ok {
+		cm = obj.(*v1.ConfigMap)
+	} else {
+		switch changeType {
+		case eventStream.Added:
+			cm = o.New.(*v1.ConfigMap)
+		case eventStream.Updated:
+			cm = o.New.(*v1.ConfigMap)
+		case eventStream.Deleted:
+			cm = o.Old.(*v1.ConfigMap)
+			vsm.forgetWarnings(cm)
+		}
+	}
+
+	namespace := cm.ObjectMeta.Namespace
+	if !vsm.watchingNamespace(namespace) {
+		return false
+	}
+
+	key := namespace + "/" + cm.ObjectMeta.Name
+	var rule *IRule
+	if eventStream.Deleted != changeType {
+		var err error
+		rule, err = configMapIRule(cm)
+		if nil != err {
+			log.Warningf("Could not get iRule from ConfigMap: %v", err)
+			vsm.recordWarning(cm, reasonInvalidIRule, "%v", err)
+		}
+	}
+	if reflect.DeepEqual(rule, vsm.irules[key]) {
+		return false
+	}
+	if nil == rule {
+		delete(vsm.irules, key)
+	} else {
+		vsm.irules[key] = rule
+	}
+
+	for name, vs := range vsm.vservers.m {
+		if vsm.vservers.backends[name].Namespace != namespace {
+			continue
+		}
+		if usesIRule(vs, cm.ObjectMeta.Name) {
+			log.Debugf("iRule %v changed for virtual server %v", key, name)
+			return true
+		}
+	}
+	return false
+}
+
+// Check if a virtual server attaches an iRule or persists with it
+func usesIRule(vs *VirtualServerConfig, name string) bool {
+	frontend := &vs.VirtualServer.Frontend
+	for _, ruleName := range frontend.IRules {
+		if ruleName == name {
+			return true
+		}
+	}
+	return nil != frontend.Persistence && name == frontend.Persistence.Rule
+}
+
+// Check the iRule ConfigMaps a config attaches all exist with source. The
+// virtual server is not written until they do, missing iRules are recorded
+// as events on owner.
+func (vsm *Manager) checkIRules(
+	cfg *VirtualServerConfig,
+	namespace string,
+	owner runtime.Object) error {
+
+	vsm.vservers.Lock()
+	var missing []string
+	for _, name := range cfgIRules(cfg) {
+		if _, ok := vsm.resolveIRule(name, namespace, nil); !ok {
+			missing = append(missing, name)
+		}
+	}
+	vsm.vservers.Unlock()
+
+	if 0 == len(missing) {
+		vsm.clearWarning(owner, reasonIRuleNotFound)
+		return nil
+	}
+	names := strings.Join(missing, ", ")
+	vsm.recordWarning(owner, reasonIRuleNotFound, "iRules %v not found", names)
+	return fmt.Errorf("iRules %v not found", names)
+}
+
+// The iRules a config attaches, and its universal persistence rule
+func cfgIRules(cfg *VirtualServerConfig) []string {
+	frontend := &cfg.VirtualServer.Frontend
+	names := append([]string{}, frontend.IRules...)
+	if nil != frontend.Persistence && 0 != len(frontend.Persistence.Rule) {
+		names = append(names, frontend.Persistence.Rule)
+	}
+	return names
+}
+
+// Get the config to write for a virtual server: the config itself, or a copy
+// whose iRules, and universal persistence rule, are the names of the iRules
+// written for it. Returns false, and records no iRules as used, if an iRule
+// ConfigMap does not exist yet; the virtual server is then not written.
+// This function MUST be called with the vservers lock held.
+func (vsm *Manager) attachIRules(
+	vs *VirtualServerConfig,
+	namespace string,
+	used map[string]*IRule) (*VirtualServerConfig, bool) {
+
+	frontend := &vs.VirtualServer.Frontend
+	persist := frontend.Persistence
+	hasRule := nil != persist && 0 != len(persist.Rule)
+	if 0 == len(frontend.IRules) && !hasRule {
+		return vs, true
+	}
+	attaches := make(map[string]*IRule)
+	var attached []string
+	for _, name := range frontend.IRules {
+		rule, ok := vsm.resolveIRule(name, namespace, attaches)
+		if !ok {
+			log.Warningf("No iRule %v in namespace %v, not writing virtual "+
+				"server %v", name, namespace, frontend.VirtualServerName)
+			return nil, false
+		}
+		attached = append(attached, rule)
+	}
+	out := *vs
+	out.VirtualServer.Frontend.IRules = attached
+	if hasRule {
+		outPersist := *persist
+		var ok bool
+		outPersist.Rule, ok = vsm.resolveIRule(persist.Rule, namespace, attaches)
+		if !ok {
+			log.Warningf("No iRule %v in namespace %v, not writing virtual "+
+				"server %v", persist.Rule, namespace, frontend.VirtualServerName)
+			return nil, false
+		}
+		out.VirtualServer.Frontend.Persistence = &outPersist
+	}
+	for name, rule := range attaches {
+		used[name] = rule
+	}
+	return &out, true
+}
+
+// Get the name an iRule is written under, recording the iRule ConfigMaps used
+// if used is not nil.
+// Returns false if the iRule ConfigMap does not exist.
+// This function MUST be called with the vservers lock held.
+func (vsm *Manager) resolveIRule(
+	name string,
+	namespace string,
+	used map[string]*IRule) (string, bool) {
+
+	if isBigIPIRule(name) {
+		return name, true
+	}
+	rule, ok := vsm.irules[namespace+"/"+name]
+	if !ok {
+		return "", false
+	}
+	if nil != used {
+		used[rule.Name] = rule
+	}
+	return rule.Name, true
+}
+
+// Write the irules section ahead of the virtual servers: the iRules they
+// attach, and those written before, which the virtual servers on the Big-IP
+// may still attach.
+// This function MUST be called with the vservers lock held.
+func (vsm *Manager) stageIRules(used map[string]*IRule) bool {
+	staged := make(map[string]*IRule)
+	for name, rule := range vsm.writtenIRules {
+		staged[name] = rule
+	}
+	for name, rule := range used {
+		staged[name] = rule
+	}
+	if 0 == len(staged) {
+		return true
+	}
+	if !vsm.sendSection("irules", sortedIRules(staged), len(staged)) {
+		return false
+	}
+	vsm.writtenIRules = staged
+	return true
+}
+
+// Remove the iRules the virtual servers no longer attach, once the virtual
+// servers have been written.
+// This function MUST be called with the vservers lock held.
+func (vsm *Manager) pruneIRules(used map[string]*IRule) bool {
+	// The staged iRules include the used ones
+	if len(vsm.writtenIRules) == len(used) {
+		return true
+	}
+	if !vsm.sendSection("irules", sortedIRules(used), len(used)) {
+		return false
+	}
+	vsm.writtenIRules = used
+	return true
+}
+
+type iRules []*IRule
+
+func (slice iRules) Len() int {
+	return len(slice)
+}
+
+func (slice iRules) Less(i, j int) bool {
+	return slice[i].Name < slice[j].Name
+}
+
+func (slice iRules) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
+
+// Sorted list of the iRules the virtual servers attach
+func sortedIRules(used map[string]*IRule) []*IRule {
+	// Initialize as empty so the section is written as '[]'
+	rules := iRules{}
+	for _, rule := range used {
+		rules = append(rules, rule)
+	}
+	sort.Sort(rules)
+	return rules
+}
@@ -0,0 +1,205 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"strings"
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/tools/record"
+)
+
+var configmapFooIRules string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 80
+      },
+      "iRules": [
+        "/Common/_sys_https_redirect",
+        "log-requests",
+        "add-headers"
+      ]
+    }
+  }
+}`)
+
+func TestConfigMapIRule(t *testing.T) {
+	rule, err := configMapIRule(newConfigMap("log-requests", "1", namespace,
+		map[string]string{"code": "when HTTP_REQUEST { log local0. [HTTP::uri] }"}))
+	require.Nil(t, err)
+	assert.Equal(t, &IRule{Name: "default_log-requests",
+		Code: "when HTTP_REQUEST { log local0. [HTTP::uri] }"}, rule)
+
+	_, err = configMapIRule(newConfigMap("log-requests", "1", namespace,
+		map[string]string{"data": "when HTTP_REQUEST {}"}))
+	assert.NotNil(t, err, "iRule source is under the code key")
+
+	var cfg VirtualServerConfig
+	cfg.VirtualServer.Frontend.IRules = []string{"log-requests"}
+	assert.Nil(t, validateIRules(&cfg))
+	cfg.VirtualServer.Frontend.IRules = append(cfg.VirtualServer.Frontend.IRules, " ")
+	assert.NotNil(t, validateIRules(&cfg))
+}
+
+// Records the order sections are written in
+type sectionOrderWriter struct {
+	*test.MockWriter
+	order []string
+}
+
+func (w *sectionOrderWriter) SendSection(
+	name string,
+	obj interface{},
+) (<-chan struct{}, <-chan error, error) {
+	w.order = append(w.order, name)
+	return w.MockWriter.SendSection(name, obj)
+}
+
+func TestProcessIRuleUpdate(t *testing.T) {
+	mw := &sectionOrderWriter{MockWriter: &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	recorder := record.NewFakeRecorder(100)
+	vsm := NewManager(&Params{
+		KubeClient:    fake,
+		ConfigWriter:  mw,
+		Namespaces:    []string{namespace},
+		IsNodePort:    true,
+		EventRecorder: recorder,
+	})
+	services := func() VirtualServerConfigs {
+		return mw.Sections["services"].(VirtualServerConfigs)
+	}
+	cmStatus := func(cm *v1.ConfigMap) configMapStatus {
+		vsm.processConfigMap(eventStream.Updated,
+			eventStream.ChangedObject{cm, cm}, newStore(nil))
+		return vsm.pendingStatus["default/foomap"].status
+	}
+
+	// The virtual server is withheld, and pending, until its iRules exist
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFooIRules})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, newStore(nil))
+	require.Equal(0, len(services()))
+	_, ok := mw.Sections["irules"]
+	require.False(ok, "No irules section without iRules")
+	require.Equal([]string{reasonIRuleNotFound}, recordedReasons(recorder))
+	status := cmStatus(cm)
+	require.Equal(statusPending, status.State)
+	require.Equal([]string{"iRules log-requests, add-headers not found"},
+		status.Errors)
+	recordedReasons(recorder)
+
+	// iRules keep the order of the config, not of their ConfigMaps
+	headers := newConfigMap("add-headers", "1", namespace, map[string]string{
+		"code": "when HTTP_REQUEST { HTTP::header insert X-Foo 1 }"})
+	logging := newConfigMap("log-requests", "1", namespace, map[string]string{
+		"code": "when HTTP_REQUEST { log local0. [HTTP::uri] }"})
+	vsm.ProcessIRuleUpdate(eventStream.Replaced,
+		[]interface{}{headers, logging})
+	require.Equal([]string{"/Common/_sys_https_redirect",
+		"default_log-requests", "default_add-headers"},
+		services()[0].VirtualServer.Frontend.IRules)
+	require.Equal([]*IRule{
+		{Name: "default_add-headers",
+			Code: "when HTTP_REQUEST { HTTP::header insert X-Foo 1 }"},
+		{Name: "default_log-requests",
+			Code: "when HTTP_REQUEST { log local0. [HTTP::uri] }"},
+	}, mw.Sections["irules"])
+	vs := getVirtualServer(t, vsm, serviceKey{"foo", 80, namespace, v1.ProtocolTCP})
+	require.Equal(3, len(vs.VirtualServer.Frontend.IRules),
+		"The stored config keeps the ConfigMap names")
+	require.Equal("log-requests", vs.VirtualServer.Frontend.IRules[1])
+	status = cmStatus(cm)
+	require.Equal(statusValid, status.State)
+	require.Nil(status.Errors)
+
+	// Changing an iRule rewrites it, resyncs and unused iRules do not
+	logging2 := newConfigMap("log-requests", "2", namespace, map[string]string{
+		"code": "when HTTP_REQUEST { log local0. [HTTP::host] }"})
+	vsm.ProcessIRuleUpdate(eventStream.Updated,
+		eventStream.ChangedObject{logging, logging2})
+	require.Equal("when HTTP_REQUEST { log local0. [HTTP::host] }",
+		mw.Sections["irules"].([]*IRule)[1].Code)
+	written := mw.WrittenTimes
+	vsm.ProcessIRuleUpdate(eventStream.Updated,
+		eventStream.ChangedObject{logging2, logging2})
+	vsm.ProcessIRuleUpdate(eventStream.Added, eventStream.ChangedObject{nil,
+		newConfigMap("unused", "1", namespace, map[string]string{"code": "x"})})
+	require.Equal(written, mw.WrittenTimes)
+
+	// A detached iRule is removed after the virtual servers are written
+	mw.order = nil
+	cm2 := newConfigMap("foomap", "2", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data": strings.Replace(configmapFooIRules,
+			",\n        \"add-headers\"", "", 1)})
+	vsm.ProcessConfigMapUpdate(eventStream.Updated,
+		eventStream.ChangedObject{cm, cm2}, newStore(nil))
+	require.Equal([]string{"irules", "services", "irules"}, mw.order)
+	require.Equal([]string{"/Common/_sys_https_redirect",
+		"default_log-requests"}, services()[0].VirtualServer.Frontend.IRules)
+	require.Equal([]*IRule{
+		{Name: "default_log-requests",
+			Code: "when HTTP_REQUEST { log local0. [HTTP::host] }"},
+	}, mw.Sections["irules"])
+
+	// A ConfigMap without source is recorded, and withholds the virtual
+	// server attaching it
+	mw.order = nil
+	bad := newConfigMap("log-requests", "3", namespace,
+		map[string]string{"data": "x"})
+	vsm.ProcessIRuleUpdate(eventStream.Updated,
+		eventStream.ChangedObject{logging2, bad})
+	require.Equal([]string{reasonInvalidIRule}, recordedReasons(recorder))
+	require.Equal([]string{"irules", "services", "irules"}, mw.order)
+	require.Equal(0, len(services()))
+	require.Equal([]*IRule{}, mw.Sections["irules"])
+	status = cmStatus(cm2)
+	require.Equal(statusPending, status.State)
+	require.Equal([]string{"iRules log-requests not found"}, status.Errors)
+
+	// Fixing the iRule writes the virtual server again
+	vsm.ProcessIRuleUpdate(eventStream.Updated,
+		eventStream.ChangedObject{bad, logging})
+	require.Equal([]string{"/Common/_sys_https_redirect",
+		"default_log-requests"}, services()[0].VirtualServer.Frontend.IRules)
+}
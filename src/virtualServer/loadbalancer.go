@@ -0,0 +1,223 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"net"
+
+	"eventStream"
+	log "f5/vlogger"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Check if a Service is one this controller load balances
+func isLoadBalancer(svc *v1.Service) bool {
+	return nil != svc && svc.Spec.Type == v1.ServiceTypeLoadBalancer
+}
+
+// Name of the IPAM allocation for a Service, prefixed with the kind of
+// virtual servers the Service has. ConfigMap and Service names cannot contain
+// underscores, so this never matches the virtual server or allocation of a
+// ConfigMap.
+func serviceOwner(svc *v1.Service) string {
+	if isLoadBalancer(svc) {
+		return loadBalancerOwner(svc)
+	}
+	return annotatedServiceOwner(svc)
+}
+
+// Name of the IPAM allocation of a LoadBalancer Service, which also prefixes
+// the names of its virtual servers
+func loadBalancerOwner(svc *v1.Service) string {
+	return fmt.Sprintf("lb_%v_%v", svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)
+}
+
+// Name of the virtual server, and IPAM allocation, of an annotated Service
+func annotatedServiceOwner(svc *v1.Service) string {
+	return fmt.Sprintf("svc_%v_%v", svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)
+}
+
+// Translate a LoadBalancer Service into Virtual Server configs keyed by
+// name, one per port, all listening on bindAddr. UDP ports get UDP virtual
+// servers, named apart from a TCP port with the same number.
+func parseLoadBalancer(
+	svc *v1.Service,
+	bindAddr string,
+	partition string) map[string]*VirtualServerConfig {
+
+	cfgs := make(map[string]*VirtualServerConfig)
+	for _, port := range svc.Spec.Ports {
+		var cfg VirtualServerConfig
+		cfg.VirtualServer.Backend.ServiceName = svc.ObjectMeta.Name
+		cfg.VirtualServer.Backend.ServicePort = port.Port
+		cfg.VirtualServer.Backend.ServiceProtocol = serviceProtocol(port.Protocol)
+		cfg.VirtualServer.Frontend.VirtualServerName = fmt.Sprintf("%v_%v",
+			loadBalancerOwner(svc), port.Port)
+		cfg.VirtualServer.Frontend.Partition = partition
+		cfg.VirtualServer.Frontend.Balance = "round-robin"
+		cfg.VirtualServer.Frontend.Mode = protocolTCP
+		if v1.ProtocolUDP == port.Protocol {
+			cfg.VirtualServer.Frontend.VirtualServerName += "_" + protocolUDP
+			cfg.VirtualServer.Frontend.Mode = protocolUDP
+		}
+		cfg.VirtualServer.Frontend.VirtualAddress = &VirtualAddress{
+			BindAddr: bindAddr,
+			Port:     port.Port,
+		}
+		cfgs[cfg.VirtualServer.Frontend.VirtualServerName] = &cfg
+	}
+	return cfgs
+}
+
+// Get the virtual server names a LoadBalancer Service would use
+func loadBalancerNames(svc *v1.Service) map[string]struct{} {
+	names := make(map[string]struct{})
+	if isLoadBalancer(svc) {
+		for name, _ := range parseLoadBalancer(svc, "", "") {
+			names[name] = struct{}{}
+		}
+	}
+	return names
+}
+
+// Process a change in Service state for LoadBalancer Services
+func (vsm *Manager) processLoadBalancer(
+	changeType eventStream.ChangeType,
+	obj interface{},
+	endptStore *eventStream.EventStore) bool {
+
+	var svc *v1.Service
+	var oldSvc *v1.Service
+	o, ok := obj.(eventStream.ChangedObject)
+	if !ok {
+		svc = obj.(*v1.Service)
+	} else {
+		switch changeType {
+		case eventStream.Added:
+			svc = o.New.(*v1.Service)
+		case eventStream.Updated:
+			svc = o.New.(*v1.Service)
+			oldSvc = o.Old.(*v1.Service)
+		case eventStream.Deleted:
+			svc = o.Old.(*v1.Service)
+			oldSvc = svc
+		}
+	}
+
+	namespace := svc.ObjectMeta.Namespace
+	if !vsm.watchingNamespace(namespace) {
+		return false
+	}
+	if !isLoadBalancer(svc) && !isLoadBalancer(oldSvc) {
+		return false
+	}
+
+	var cfgs map[string]*VirtualServerConfig
+	bindAddr := ""
+	if eventStream.Deleted != changeType && isLoadBalancer(svc) {
+		var err error
+		bindAddr, err = vsm.loadBalancerAddress(svc)
+		if nil != err {
+			log.Warningf("Could not get address for LoadBalancer Service: %v - %v",
+				svc.ObjectMeta.Name, err)
+			vsm.recordWarning(svc, reasonAddressNotAllocated, "%v", err)
+		} else {
+			cfgs = parseLoadBalancer(svc, bindAddr, vsm.loadBalancerPartition(svc))
+			for _, cfg := range cfgs {
+				vsm.setPoolMembers(cfg, svc, endptStore, svc)
+			}
+		}
+	} else {
+		vsm.releaseBindAddr(loadBalancerOwner(svc))
+	}
+	if eventStream.Deleted != changeType {
+		vsm.updateLoadBalancerStatus(svc, bindAddr)
+	}
+
+	vsm.vservers.Lock()
+	defer vsm.vservers.Unlock()
+
+	updateConfig := false
+	for vsName, _ := range loadBalancerNames(oldSvc) {
+		if _, ok := cfgs[vsName]; !ok {
+			vsm.vservers.remove(vsName)
+			updateConfig = true
+		}
+	}
+	for _, cfg := range cfgs {
+		vsm.vservers.assign(namespace, cfg)
+		updateConfig = true
+	}
+
+	return updateConfig
+}
+
+// Get the address of a LoadBalancer Service, the one it asks for or one
+// allocated by IPAM
+func (vsm *Manager) loadBalancerAddress(svc *v1.Service) (string, error) {
+	owner := loadBalancerOwner(svc)
+	if addr := svc.Spec.LoadBalancerIP; 0 != len(addr) {
+		if nil == net.ParseIP(addr) {
+			return "", fmt.Errorf("service %s has invalid loadBalancerIP %s",
+				svc.ObjectMeta.Name, addr)
+		}
+		vsm.reserveBindAddr(owner, addr)
+		return addr, nil
+	}
+	if nil == vsm.ipam {
+		return "", fmt.Errorf("service %s has no loadBalancerIP and IPAM is not "+
+			"configured", svc.ObjectMeta.Name)
+	}
+	return vsm.ipam.Allocate(owner, svc.ObjectMeta.Namespace,
+		vsm.loadBalancerPartition(svc), AddressFamilyAny)
+}
+
+// Get the partition of a LoadBalancer Service's virtual servers, the
+// default partition is used unless the Service has a partition annotation
+func (vsm *Manager) loadBalancerPartition(svc *v1.Service) string {
+	if p, ok := svc.ObjectMeta.Annotations[servicePartitionAnnotation]; ok {
+		return p
+	}
+	return vsm.defaultPartition
+}
+
+// Write the address of a LoadBalancer Service into its status, an empty
+// address clears it
+func (vsm *Manager) updateLoadBalancerStatus(svc *v1.Service, bindAddr string) {
+	var ingress []v1.LoadBalancerIngress
+	if 0 != len(bindAddr) {
+		ingress = []v1.LoadBalancerIngress{{IP: bindAddr}}
+	}
+	current := svc.Status.LoadBalancer.Ingress
+	if len(current) == len(ingress) &&
+		(0 == len(ingress) || current[0] == ingress[0]) {
+		return
+	}
+
+	// Leave the cached object alone
+	updated := *svc
+	updated.ObjectMeta.Annotations = apiAnnotations(svc)
+	updated.Status.LoadBalancer.Ingress = ingress
+	_, err := vsm.kubeClient.Core().Services(svc.ObjectMeta.Namespace).UpdateStatus(
+		&updated)
+	if nil != err {
+		log.Warningf("Could not update status for Service %v/%v: %v",
+			svc.ObjectMeta.Namespace, svc.ObjectMeta.Name, err)
+	}
+}
@@ -0,0 +1,146 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	core "k8s.io/client-go/1.4/testing"
+)
+
+func TestParseLoadBalancer(t *testing.T) {
+	require := require.New(t)
+
+	svc := newService("foo", "1", namespace, v1.ServiceTypeLoadBalancer,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}, {Port: 443, NodePort: 30002}})
+	cfgs := parseLoadBalancer(svc, "10.128.10.240", "velcro")
+	require.Equal(2, len(cfgs))
+
+	for name, port := range map[string]int32{
+		"lb_default_foo_80":  80,
+		"lb_default_foo_443": 443,
+	} {
+		cfg, ok := cfgs[name]
+		require.True(ok)
+		require.Equal("foo", cfg.VirtualServer.Backend.ServiceName)
+		require.Equal(port, cfg.VirtualServer.Backend.ServicePort)
+		require.Equal("velcro", cfg.VirtualServer.Frontend.Partition)
+		require.Equal("tcp", cfg.VirtualServer.Frontend.Mode)
+		require.Equal(&VirtualAddress{BindAddr: "10.128.10.240", Port: port},
+			cfg.VirtualServer.Frontend.VirtualAddress)
+	}
+}
+
+func TestProcessLoadBalancerNodePort(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeLoadBalancer,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}, {Port: 443, NodePort: 30002}})
+	foo.Spec.LoadBalancerIP = "10.128.10.240"
+	bar := newService("bar", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo, *bar}})
+	ipam, err := NewIPAM(fake, "kube-system", "f5-ipam",
+		[]string{"10.128.20.0/29"})
+	require.Nil(err)
+	vsm := NewManager(&Params{
+		KubeClient:       fake,
+		ConfigWriter:     mw,
+		Namespaces:       []string{namespace},
+		IsNodePort:       true,
+		IPAM:             ipam,
+		DefaultPartition: "velcro",
+	})
+	endptStore := newStore(nil)
+	serviceGets := 0
+	fake.PrependReactor("get", "services",
+		func(action core.Action) (bool, runtime.Object, error) {
+			serviceGets++
+			return false, nil, nil
+		})
+
+	setUseNodeInternal(vsm, true)
+	vsm.ProcessNodeUpdate([]v1.Node{
+		*newNode("node0", "0", false, []v1.NodeAddress{
+			{Type: "InternalIP", Address: "127.0.0.1"}}),
+	}, nil)
+
+	// Only LoadBalancer Services get virtual servers
+	vsm.ProcessServiceUpdate(eventStream.Replaced,
+		[]interface{}{foo, bar}, endptStore)
+	require.Equal(2, len(vsm.vservers.m))
+	vs := vsm.vservers.m["lb_default_foo_443"]
+	require.NotNil(vs)
+	require.Equal("velcro", vs.VirtualServer.Frontend.Partition)
+	require.EqualValues(30002, vs.VirtualServer.Backend.PoolMemberPort)
+	require.EqualValues([]string{"127.0.0.1"}, vs.VirtualServer.Backend.PoolMemberAddrs)
+	require.Equal(0, serviceGets,
+		"Pool members should come from the Service given, not the API server")
+
+	svc, err := fake.Core().Services(namespace).Get("foo")
+	require.Nil(err)
+	require.Equal([]v1.LoadBalancerIngress{{IP: "10.128.10.240"}},
+		svc.Status.LoadBalancer.Ingress, "Address should be reported")
+
+	// Dropping a port and the loadBalancerIP moves to an IPAM address
+	foo2 := newService("foo", "2", namespace, v1.ServiceTypeLoadBalancer,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	foo2.Status = svc.Status
+	vsm.ProcessServiceUpdate(eventStream.Updated,
+		eventStream.ChangedObject{foo, foo2}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
+	vs = vsm.vservers.m["lb_default_foo_80"]
+	require.NotNil(vs)
+	require.Equal("10.128.20.1",
+		vs.VirtualServer.Frontend.VirtualAddress.BindAddr)
+	svc, err = fake.Core().Services(namespace).Get("foo")
+	require.Nil(err)
+	require.Equal([]v1.LoadBalancerIngress{{IP: "10.128.20.1"}},
+		svc.Status.LoadBalancer.Ingress)
+
+	// No longer a LoadBalancer
+	foo3 := newService("foo", "3", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	foo3.Status = svc.Status
+	vsm.ProcessServiceUpdate(eventStream.Updated,
+		eventStream.ChangedObject{foo2, foo3}, endptStore)
+	require.Equal(0, len(vsm.vservers.m))
+	require.Empty(ipam.allocated, "IPAM address should be released")
+	svc, err = fake.Core().Services(namespace).Get("foo")
+	require.Nil(err)
+	require.Empty(svc.Status.LoadBalancer.Ingress, "Address should be cleared")
+
+	vsm.ProcessServiceUpdate(eventStream.Updated,
+		eventStream.ChangedObject{foo3, foo2}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
+	vsm.ProcessServiceUpdate(eventStream.Deleted,
+		eventStream.ChangedObject{foo2, nil}, endptStore)
+	require.Equal(0, len(vsm.vservers.m))
+	require.Empty(ipam.allocated)
+	validateConfig(t, mw, emptyConfig)
+}
@@ -0,0 +1,197 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+
+	log "f5/vlogger"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Pod and Node annotations setting the Big-IP attributes of the pool members
+// they back. Pod annotations win over the annotations of the pod's Node.
+const (
+	memberRatioAnnotation           = "virtual-server.f5.com/ratio"
+	memberConnectionLimitAnnotation = "virtual-server.f5.com/connection-limit"
+	memberPriorityGroupAnnotation   = "virtual-server.f5.com/priority-group"
+)
+
+// Big-IP attributes of a single pool member
+type PoolMemberOptions struct {
+	// Share of traffic for the ratio balancing modes
+	Ratio int32 `json:"ratio,omitempty"`
+	// Maximum concurrent connections, 0 is unlimited
+	ConnectionLimit int32 `json:"connectionLimit,omitempty"`
+	// Members of the highest group with enough members up get the traffic
+	PriorityGroup int32 `json:"priorityGroup,omitempty"`
+	// Set while a removed member drains, disabled or forced-offline
+	State string `json:"state,omitempty"`
+}
+
+// Read pool member attributes from the annotations of a Pod or Node, values
+// that are not valid are logged and ignored
+func parseMemberOptions(
+	kind string,
+	meta v1.ObjectMeta) (PoolMemberOptions, bool) {
+
+	var opts PoolMemberOptions
+	found := false
+	for annotation, field := range map[string]*int32{
+		memberRatioAnnotation:           &opts.Ratio,
+		memberConnectionLimitAnnotation: &opts.ConnectionLimit,
+		memberPriorityGroupAnnotation:   &opts.PriorityGroup,
+	} {
+		value, ok := meta.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		i, err := strconv.ParseInt(value, 10, 32)
+		if nil != err || i < 0 {
+			log.Warningf("%s %s has invalid %s annotation: %s",
+				kind, meta.Name, annotation, value)
+			continue
+		}
+		*field = int32(i)
+		found = true
+	}
+	return opts, found
+}
+
+// Check the priority group activation of a config's pool
+func validateMinActiveMembers(cfg *VirtualServerConfig) error {
+	if cfg.VirtualServer.Backend.MinActiveMembers < 0 {
+		return fmt.Errorf("minActiveMembers cannot be negative")
+	}
+	if 0 != cfg.VirtualServer.Backend.MinActiveMembers &&
+		0 != len(cfg.VirtualServer.Frontend.IApp) {
+		return fmt.Errorf("iApps cannot have minActiveMembers")
+	}
+	return nil
+}
+
+// Combine pool member attributes, the ones set in override win
+func (opts PoolMemberOptions) merge(
+	override PoolMemberOptions) PoolMemberOptions {
+
+	if 0 != override.Ratio {
+		opts.Ratio = override.Ratio
+	}
+	if 0 != override.ConnectionLimit {
+		opts.ConnectionLimit = override.ConnectionLimit
+	}
+	if 0 != override.PriorityGroup {
+		opts.PriorityGroup = override.PriorityGroup
+	}
+	return opts
+}
+
+// Get the pool member attributes of annotated Nodes, keyed by both Node name
+// and address. Returns nil if no Node is annotated
+func (vsm *Manager) getNodeMemberOptions(
+	obj interface{}) map[string]PoolMemberOptions {
+
+	nodes, ok := obj.([]v1.Node)
+	if !ok {
+		return nil
+	}
+	var options map[string]PoolMemberOptions
+	for _, node := range nodes {
+		opts, found := parseMemberOptions("Node", node.ObjectMeta)
+		if !found {
+			continue
+		}
+		if nil == options {
+			options = make(map[string]PoolMemberOptions)
+		}
+		options[node.ObjectMeta.Name] = opts
+		for _, addr := range node.Status.Addresses {
+			options[addr.Address] = opts
+		}
+	}
+	return options
+}
+
+// Return the Node pool member attributes cache
+func (vsm *Manager) getNodeMemberOptionsFromCache() map[string]PoolMemberOptions {
+	vsm.oldNodesMutex.Lock()
+	defer vsm.oldNodesMutex.Unlock()
+	return vsm.nodeMemberOptions
+}
+
+// Get the pool member attributes of each ready endpoint of a Service, keyed
+// by endpoint IP. Annotations of the endpoint's pod win over those of the
+// Node it runs on.
+func (vsm *Manager) getEndpointsMemberOptions(
+	svc *v1.Service,
+	eps *v1.Endpoints) map[string]PoolMemberOptions {
+
+	nodeOptions := vsm.getNodeMemberOptionsFromCache()
+	podOptions := make(map[string]PoolMemberOptions)
+	for _, pod := range vsm.getPodsForService(svc) {
+		if opts, found := parseMemberOptions("Pod", pod.ObjectMeta); found {
+			podOptions[pod.ObjectMeta.Name] = opts
+		}
+	}
+
+	options := make(map[string]PoolMemberOptions)
+	for _, subset := range eps.Subsets {
+		for _, addr := range subset.Addresses {
+			var opts PoolMemberOptions
+			if nil != addr.NodeName {
+				opts = nodeOptions[*addr.NodeName]
+			}
+			if nil != addr.TargetRef && "Pod" == addr.TargetRef.Kind {
+				opts = opts.merge(podOptions[addr.TargetRef.Name])
+			}
+			if (PoolMemberOptions{}) != opts {
+				options[addr.IP] = opts
+			}
+		}
+	}
+	return options
+}
+
+// Set the attributes of the pool members of a config from attributes keyed
+// by member IP.
+// Returns true if the attributes changed
+func setPoolMemberOptions(
+	cfg *VirtualServerConfig,
+	options map[string]PoolMemberOptions) bool {
+
+	var memberOptions map[string]PoolMemberOptions
+	for _, member := range cfg.VirtualServer.Backend.PoolMemberAddrs {
+		ip := member
+		if host, _, err := net.SplitHostPort(member); nil == err {
+			ip = host
+		}
+		if opts, ok := options[ip]; ok {
+			if nil == memberOptions {
+				memberOptions = make(map[string]PoolMemberOptions)
+			}
+			memberOptions[member] = opts
+		}
+	}
+	changed := !reflect.DeepEqual(memberOptions,
+		cfg.VirtualServer.Backend.PoolMemberOptions)
+	cfg.VirtualServer.Backend.PoolMemberOptions = memberOptions
+	return changed
+}
@@ -0,0 +1,231 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"strings"
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func TestParseMemberOptions(t *testing.T) {
+	opts, found := parseMemberOptions("Pod", v1.ObjectMeta{
+		Name: "foo",
+		Annotations: map[string]string{
+			memberRatioAnnotation:           "3",
+			memberConnectionLimitAnnotation: "100",
+			memberPriorityGroupAnnotation:   "10",
+		},
+	})
+	assert.True(t, found)
+	assert.Equal(t, PoolMemberOptions{Ratio: 3, ConnectionLimit: 100,
+		PriorityGroup: 10}, opts)
+
+	// Bad values are ignored
+	opts, found = parseMemberOptions("Node", v1.ObjectMeta{
+		Name: "node0",
+		Annotations: map[string]string{
+			memberRatioAnnotation:         "lots",
+			memberPriorityGroupAnnotation: "-1",
+		},
+	})
+	assert.False(t, found)
+	assert.Equal(t, PoolMemberOptions{}, opts)
+
+	_, found = parseMemberOptions("Pod", v1.ObjectMeta{Name: "bar"})
+	assert.False(t, found)
+
+	merged := PoolMemberOptions{Ratio: 2, PriorityGroup: 1}.merge(
+		PoolMemberOptions{Ratio: 5, ConnectionLimit: 50})
+	assert.Equal(t, PoolMemberOptions{Ratio: 5, ConnectionLimit: 50,
+		PriorityGroup: 1}, merged)
+}
+
+func TestMemberOptionsNodePort(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+	setUseNodeInternal(vsm, true)
+
+	big := newNode("node0", "0", false, []v1.NodeAddress{
+		{Type: "InternalIP", Address: "127.0.0.0"}})
+	big.ObjectMeta.Annotations = map[string]string{memberRatioAnnotation: "4"}
+	small := newNode("node1", "0", false, []v1.NodeAddress{
+		{Type: "InternalIP", Address: "127.0.0.1"}})
+	vsm.ProcessNodeUpdate([]v1.Node{*big, *small}, nil)
+
+	cfgFoo := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cfgFoo}, newStore(nil))
+	vs := getVirtualServer(t, vsm, serviceKey{"foo", 80, namespace, v1.ProtocolTCP})
+	require.Equal(map[string]PoolMemberOptions{"127.0.0.0": {Ratio: 4}},
+		vs.VirtualServer.Backend.PoolMemberOptions)
+
+	// Annotating a node changes the members without changing the nodes
+	small = newNode("node1", "1", false, []v1.NodeAddress{
+		{Type: "InternalIP", Address: "127.0.0.1"}})
+	small.ObjectMeta.Annotations = map[string]string{
+		memberPriorityGroupAnnotation: "5"}
+	vsm.ProcessNodeUpdate([]v1.Node{*big, *small}, nil)
+	require.Equal(map[string]PoolMemberOptions{
+		"127.0.0.0": {Ratio: 4},
+		"127.0.0.1": {PriorityGroup: 5},
+	}, vs.VirtualServer.Backend.PoolMemberOptions)
+
+	vsm.ProcessNodeUpdate([]v1.Node{
+		*newNode("node0", "1", false, []v1.NodeAddress{
+			{Type: "InternalIP", Address: "127.0.0.0"}}),
+	}, nil)
+	require.Nil(vs.VirtualServer.Backend.PoolMemberOptions)
+}
+
+func TestMemberOptionsCluster(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	labels := map[string]string{"app": "foo"}
+	svcPorts := []v1.ServicePort{newServicePort("port0", 8080)}
+	foo := newService("foo", "1", namespace, v1.ServiceTypeClusterIP, svcPorts)
+	foo.Spec.Selector = labels
+	standby := v1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "foo-standby",
+			Namespace: namespace,
+			Labels:    labels,
+			Annotations: map[string]string{
+				memberPriorityGroupAnnotation:   "1",
+				memberConnectionLimitAnnotation: "10",
+			},
+		},
+	}
+	fake := fake.NewSimpleClientset(
+		&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   false,
+	})
+	podStore := newStore(nil)
+	podStore.Add(&standby)
+	vsm.AddPodStore(podStore)
+	big := newNode("node0", "0", false, []v1.NodeAddress{
+		{Type: "InternalIP", Address: "127.0.0.0"}})
+	big.ObjectMeta.Annotations = map[string]string{
+		memberRatioAnnotation:         "4",
+		memberPriorityGroupAnnotation: "10",
+	}
+	vsm.ProcessNodeUpdate([]v1.Node{*big}, nil)
+
+	svcStore := newStore(nil)
+	svcStore.Add(foo)
+	eps := newEndpoints("foo", "1", namespace,
+		[]string{"10.2.96.0", "10.2.96.1", "10.2.96.2"}, nil,
+		convertSvcPortsToEndpointPorts(svcPorts))
+	nodeName := "node0"
+	eps.Subsets[0].Addresses[0].NodeName = &nodeName
+	eps.Subsets[0].Addresses[1].NodeName = &nodeName
+	eps.Subsets[0].Addresses[1].TargetRef = &v1.ObjectReference{
+		Kind: "Pod", Namespace: namespace, Name: "foo-standby"}
+	endptStore := newStore(nil)
+	endptStore.Add(eps)
+
+	cfgFoo := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo8080})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cfgFoo}, endptStore)
+	vs := getVirtualServer(t, vsm, serviceKey{"foo", 8080, namespace, v1.ProtocolTCP})
+	expected := map[string]PoolMemberOptions{
+		"10.2.96.0:8080": {Ratio: 4, PriorityGroup: 10},
+		// The pod's annotations win over its node's
+		"10.2.96.1:8080": {Ratio: 4, PriorityGroup: 1, ConnectionLimit: 10},
+	}
+	require.Equal(expected, vs.VirtualServer.Backend.PoolMemberOptions)
+
+	// Pod annotation changes are picked up with the endpoints resync
+	updated := standby
+	updated.ObjectMeta.Annotations = nil
+	podStore.Update(&updated)
+	vsm.ProcessEndpointsUpdate(eventStream.Updated,
+		eventStream.ChangedObject{eps, eps}, svcStore)
+	require.Equal(map[string]PoolMemberOptions{
+		"10.2.96.0:8080": {Ratio: 4, PriorityGroup: 10},
+		"10.2.96.1:8080": {Ratio: 4, PriorityGroup: 10},
+	}, vs.VirtualServer.Backend.PoolMemberOptions)
+}
+
+func TestMinActiveMembers(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	var cfg VirtualServerConfig
+	cfg.VirtualServer.Backend.MinActiveMembers = -1
+	require.NotNil(validateMinActiveMembers(&cfg))
+	cfg.VirtualServer.Backend.MinActiveMembers = 2
+	require.Nil(validateMinActiveMembers(&cfg))
+	cfg.VirtualServer.Frontend.IApp = "/Common/f5.http"
+	require.NotNil(validateMinActiveMembers(&cfg),
+		"iApps set up their own pools")
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 8080, NodePort: 30001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+	data := strings.Replace(configmapFoo8080, `"servicePort": 8080`,
+		`"servicePort": 8080, "minActiveMembers": 2`, 1)
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   data})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, newStore(nil))
+	services := mw.Sections["services"].(VirtualServerConfigs)
+	require.Equal(1, len(services))
+	require.EqualValues(2, services[0].VirtualServer.Backend.MinActiveMembers)
+}
@@ -0,0 +1,283 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"reflect"
+
+	log "f5/vlogger"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/intstr"
+)
+
+// Health monitor protocols supported on the Big-IP
+const (
+	monitorHTTP        = "http"
+	monitorHTTPS       = "https"
+	monitorTCP         = "tcp"
+	monitorTCPHalfOpen = "tcp-half-open"
+	monitorUDP         = "udp"
+	monitorICMP        = "icmp"
+)
+
+// Big-IP health monitor for the members of a Virtual Server's pool
+type HealthMonitor struct {
+	Interval int    `json:"interval,omitempty"`
+	Protocol string `json:"protocol"`
+	Send     string `json:"send,omitempty"`
+	// Response marking the member up
+	Recv string `json:"recv,omitempty"`
+	// Response marking the member disabled instead of up
+	RecvDisable string `json:"recvDisable,omitempty"`
+	Timeout     int    `json:"timeout,omitempty"`
+	// Port to check instead of the pool member port
+	AliasPort int32 `json:"aliasPort,omitempty"`
+	// Existing Big-IP server SSL profile, https only
+	SslProfile string `json:"sslProfile,omitempty"`
+	// Mark the member down, instead of up, when Recv matches
+	Reverse bool `json:"reverse,omitempty"`
+	// Seconds between checks once the member is up
+	UpInterval int `json:"upInterval,omitempty"`
+	// Seconds the member must pass checks before it is marked up
+	TimeUntilUp int `json:"timeUntilUp,omitempty"`
+}
+
+// Check the health monitors of a config's backend
+func validateBackendMonitors(cfg *VirtualServerConfig) error {
+	return validateHealthMonitors(cfg.VirtualServer.Backend.HealthMonitors)
+}
+
+// Check the options of each health monitor make sense for its protocol
+func validateHealthMonitors(monitors []HealthMonitor) error {
+	for i, m := range monitors {
+		// Monitors without a port or payload to check
+		portless := monitorICMP == m.Protocol
+		payloadless := portless || monitorTCPHalfOpen == m.Protocol
+
+		switch m.Protocol {
+		case monitorHTTP, monitorHTTPS, monitorTCP, monitorTCPHalfOpen,
+			monitorUDP, monitorICMP:
+		default:
+			return fmt.Errorf("health monitor %v has unknown protocol %q",
+				i, m.Protocol)
+		}
+		if payloadless && (0 != len(m.Send) || 0 != len(m.Recv) ||
+			0 != len(m.RecvDisable) || m.Reverse) {
+			return fmt.Errorf("health monitor %v: %s monitors cannot send or "+
+				"receive data", i, m.Protocol)
+		}
+		if 0 != len(m.RecvDisable) && 0 == len(m.Recv) {
+			return fmt.Errorf("health monitor %v: recvDisable requires recv", i)
+		}
+		if m.Reverse && 0 == len(m.Recv) {
+			return fmt.Errorf("health monitor %v: reverse requires recv", i)
+		}
+		if 0 != len(m.SslProfile) && monitorHTTPS != m.Protocol {
+			return fmt.Errorf("health monitor %v: sslProfile requires protocol %s",
+				i, monitorHTTPS)
+		}
+		if m.AliasPort < 0 || m.AliasPort > 65535 {
+			return fmt.Errorf("health monitor %v has invalid aliasPort %v",
+				i, m.AliasPort)
+		}
+		if portless && 0 != m.AliasPort {
+			return fmt.Errorf("health monitor %v: %s monitors cannot use "+
+				"aliasPort", i, m.Protocol)
+		}
+		if m.Interval < 0 || m.Timeout < 0 || m.UpInterval < 0 ||
+			m.TimeUntilUp < 0 {
+			return fmt.Errorf("health monitor %v has a negative time", i)
+		}
+	}
+	return nil
+}
+
+// Fill in the health monitors of a config from the readiness probes of its
+// Service's pods, unless the config lists its own monitors.
+// Returns true if the monitors changed
+func (vsm *Manager) setProbeMonitors(
+	cfg *VirtualServerConfig,
+	svc *v1.Service) bool {
+
+	backend := &cfg.VirtualServer.Backend
+	if 0 != len(backend.HealthMonitors) && !backend.probeMonitors {
+		return false
+	}
+
+	var monitors []HealthMonitor
+	// Readiness probes check TCP ports
+	if v1.ProtocolTCP == backendProtocol(cfg) {
+		monitors = vsm.probeHealthMonitors(svc, backend.ServicePort)
+	}
+	changed := !reflect.DeepEqual(monitors, backend.HealthMonitors)
+	if changed {
+		log.Debugf("Health monitors from readiness probes for backend %+v: %+v",
+			backendKey(cfg, svc.ObjectMeta.Namespace), monitors)
+	}
+	backend.HealthMonitors = monitors
+	backend.probeMonitors = 0 != len(monitors)
+	return changed
+}
+
+// Look up the pods behind a Service port and translate the readiness probe
+// of the container serving that port. The newest pod wins, so a probe change
+// rolling out through a Deployment is picked up with the first new pod.
+func (vsm *Manager) probeHealthMonitors(
+	svc *v1.Service,
+	servicePort int32) []HealthMonitor {
+
+	if 0 == len(svc.Spec.Selector) {
+		return nil
+	}
+	var targetPort intstr.IntOrString
+	found := false
+	for _, portSpec := range svc.Spec.Ports {
+		if portSpec.Port == servicePort &&
+			v1.ProtocolTCP == portProtocol(portSpec.Protocol) {
+			targetPort = portSpec.TargetPort
+			if intstr.Int == targetPort.Type && 0 == targetPort.IntVal {
+				// An unset targetPort defaults to the Service port
+				targetPort = intstr.FromInt(int(portSpec.Port))
+			}
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	var newest *v1.Pod
+	var probed v1.Container
+	var probedPort int32
+	for _, pod := range vsm.getPodsForService(svc) {
+		if nil != newest && !pod.ObjectMeta.CreationTimestamp.After(
+			newest.ObjectMeta.CreationTimestamp.Time) {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			port, ok := containerPort(container, targetPort)
+			if !ok && 1 == len(pod.Spec.Containers) &&
+				intstr.Int == targetPort.Type {
+				// A lone container need not declare its ports
+				port, ok = targetPort.IntVal, true
+			}
+			if ok && nil != container.ReadinessProbe {
+				newest, probed, probedPort = pod, container, port
+				break
+			}
+		}
+	}
+	if nil == newest {
+		return nil
+	}
+
+	monitor, ok := vsm.probeHealthMonitor(probed, probedPort)
+	if !ok {
+		return nil
+	}
+	return []HealthMonitor{monitor}
+}
+
+// Translate a container's readiness probe into a health monitor for the pool
+// members serving targetPort
+func (vsm *Manager) probeHealthMonitor(
+	container v1.Container,
+	targetPort int32) (HealthMonitor, bool) {
+
+	probe := container.ReadinessProbe
+
+	// Kubernetes defaults
+	period := probe.PeriodSeconds
+	if 0 == period {
+		period = 10
+	}
+	timeout := probe.TimeoutSeconds
+	if 0 == timeout {
+		timeout = 1
+	}
+	failures := probe.FailureThreshold
+	if 0 == failures {
+		failures = 3
+	}
+	monitor := HealthMonitor{
+		Interval: int(period),
+		// Time Kubernetes takes to mark the pod unready
+		Timeout: int(period*failures + timeout),
+	}
+
+	var probePort intstr.IntOrString
+	switch {
+	case nil != probe.HTTPGet:
+		probePort = probe.HTTPGet.Port
+		monitor.Protocol = monitorHTTP
+		if v1.URISchemeHTTPS == probe.HTTPGet.Scheme {
+			monitor.Protocol = monitorHTTPS
+		}
+		path := probe.HTTPGet.Path
+		if 0 == len(path) {
+			path = "/"
+		}
+		monitor.Send = fmt.Sprintf(`GET %s HTTP/1.0\r\n\r\n`, path)
+		// Kubernetes treats any 2xx or 3xx response as ready
+		monitor.Recv = `^HTTP/1\.[01] [23][0-9][0-9]`
+	case nil != probe.TCPSocket:
+		probePort = probe.TCPSocket.Port
+		monitor.Protocol = monitorTCP
+	default:
+		log.Debugf("Container %v readiness probe has no Big-IP equivalent",
+			container.Name)
+		return monitor, false
+	}
+
+	port, ok := containerPort(container, probePort)
+	if !ok {
+		if intstr.String == probePort.Type {
+			log.Debugf("Container %v readiness probe uses unknown port %v",
+				container.Name, probePort.StrVal)
+			return monitor, false
+		}
+		port = probePort.IntVal
+	}
+	if port != targetPort {
+		if vsm.isNodePort {
+			// Pool members are node ports, the probe port can't be reached
+			log.Debugf("Container %v readiness probe port %v is not its "+
+				"service port %v", container.Name, port, targetPort)
+			return monitor, false
+		}
+		monitor.AliasPort = port
+	}
+	return monitor, true
+}
+
+// Find the number of a container port given by number or name
+func containerPort(
+	container v1.Container,
+	port intstr.IntOrString) (int32, bool) {
+
+	for _, p := range container.Ports {
+		if intstr.String == port.Type && p.Name == port.StrVal {
+			return p.ContainerPort, true
+		}
+		if intstr.Int == port.Type && p.ContainerPort == port.IntVal {
+			return p.ContainerPort, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,331 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/util/intstr"
+)
+
+func newProbedPod(id string, created time.Time, labels map[string]string,
+	ports []v1.ContainerPort, probe *v1.Probe) *v1.Pod {
+	return &v1.Pod{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "Pod",
+			APIVersion: "v1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:              id,
+			Namespace:         namespace,
+			Labels:            labels,
+			CreationTimestamp: unversioned.NewTime(created),
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "sidecar", Ports: []v1.ContainerPort{{ContainerPort: 9000}}},
+				{Name: id, Ports: ports, ReadinessProbe: probe},
+			},
+		},
+	}
+}
+
+func TestValidateHealthMonitors(t *testing.T) {
+	valid := []HealthMonitor{
+		{Protocol: "http", Send: "GET /", Recv: "200 OK", RecvDisable: "503",
+			Interval: 5, Timeout: 16, UpInterval: 10, TimeUntilUp: 30},
+		{Protocol: "https", Send: "GET /healthz", Recv: "ok",
+			SslProfile: "Common/serverssl", AliasPort: 8443},
+		{Protocol: "tcp", Send: "PING", Recv: "PONG", Reverse: true},
+		{Protocol: "tcp-half-open", AliasPort: 6379},
+		{Protocol: "udp", Send: "ping"},
+		{Protocol: "icmp", Interval: 5, Timeout: 16},
+	}
+	assert.Nil(t, validateHealthMonitors(valid))
+
+	invalid := map[string]HealthMonitor{
+		"unknown protocol":     {Protocol: "smtp"},
+		"icmp with send":       {Protocol: "icmp", Send: "ping"},
+		"half open with recv":  {Protocol: "tcp-half-open", Recv: "ok"},
+		"disable without recv": {Protocol: "http", RecvDisable: "503"},
+		"reverse without recv": {Protocol: "tcp", Reverse: true},
+		"ssl profile for http": {Protocol: "http", SslProfile: "Common/serverssl"},
+		"icmp with alias port": {Protocol: "icmp", AliasPort: 80},
+		"bad alias port":       {Protocol: "tcp", AliasPort: 70000},
+		"negative interval":    {Protocol: "tcp", Interval: -1},
+	}
+	for desc, m := range invalid {
+		assert.NotNil(t, validateHealthMonitors([]HealthMonitor{m}),
+			"Expected an error for %s", desc)
+	}
+}
+
+var configmapFooMonitors string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80,
+      "healthMonitors": [ {
+        "protocol": "https",
+        "interval": 5,
+        "timeout": 16,
+        "send": "GET /",
+        "recv": "200",
+        "sslProfile": "Common/serverssl",
+        "aliasPort": 8443
+        }, {
+        "protocol": "icmp",
+        "upInterval": 30,
+        "timeUntilUp": 60
+        }
+      ]
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 5051
+      }
+    }
+  }
+}`)
+
+func TestHealthMonitorOutput(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+	setUseNodeInternal(vsm, true)
+	vsm.ProcessNodeUpdate([]v1.Node{
+		*newNode("node0", "0", false, []v1.NodeAddress{
+			{Type: "InternalIP", Address: "127.0.0.1"}}),
+	}, nil)
+
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFooMonitors})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, newStore(nil))
+
+	services, ok := mw.Sections["services"].(VirtualServerConfigs)
+	require.True(ok)
+	require.Equal(1, len(services))
+	data, err := json.Marshal(services[0].VirtualServer.Backend.HealthMonitors)
+	require.Nil(err)
+	require.JSONEq(`[{"protocol":"https","interval":5,"timeout":16,
+		"send":"GET /","recv":"200","sslProfile":"Common/serverssl",
+		"aliasPort":8443},{"protocol":"icmp","upInterval":30,
+		"timeUntilUp":60}]`, string(data))
+
+	// The schema checks the monitor fields
+	require.NotNil(vsm.validateSchema(schemaUrl, strings.Replace(
+		configmapFooMonitors, `"icmp"`, `"ftp"`, 1)))
+}
+
+func TestProbeHealthMonitor(t *testing.T) {
+	vsm := NewManager(&Params{IsNodePort: false})
+	ports := []v1.ContainerPort{
+		{Name: "http", ContainerPort: 8080},
+		{Name: "admin", ContainerPort: 8081},
+	}
+	container := func(probe v1.Probe) v1.Container {
+		return v1.Container{Name: "foo", Ports: ports, ReadinessProbe: &probe}
+	}
+
+	// Kubernetes defaults
+	m, ok := vsm.probeHealthMonitor(container(v1.Probe{
+		Handler: v1.Handler{HTTPGet: &v1.HTTPGetAction{
+			Port: intstr.FromInt(8080)}},
+	}), 8080)
+	require.True(t, ok)
+	assert.Equal(t, HealthMonitor{
+		Protocol: "http",
+		Interval: 10,
+		Timeout:  31,
+		Send:     `GET / HTTP/1.0\r\n\r\n`,
+		Recv:     `^HTTP/1\.[01] [23][0-9][0-9]`,
+	}, m)
+
+	// Named probe port other than the pool member port
+	m, ok = vsm.probeHealthMonitor(container(v1.Probe{
+		Handler: v1.Handler{HTTPGet: &v1.HTTPGetAction{
+			Path:   "/healthz",
+			Port:   intstr.FromString("admin"),
+			Scheme: v1.URISchemeHTTPS,
+		}},
+		PeriodSeconds:    5,
+		TimeoutSeconds:   2,
+		FailureThreshold: 2,
+	}), 8080)
+	require.True(t, ok)
+	assert.Equal(t, "https", m.Protocol)
+	assert.Equal(t, `GET /healthz HTTP/1.0\r\n\r\n`, m.Send)
+	assert.Equal(t, 5, m.Interval)
+	assert.Equal(t, 12, m.Timeout)
+	assert.EqualValues(t, 8081, m.AliasPort)
+
+	m, ok = vsm.probeHealthMonitor(container(v1.Probe{
+		Handler: v1.Handler{TCPSocket: &v1.TCPSocketAction{
+			Port: intstr.FromString("http")}},
+	}), 8080)
+	require.True(t, ok)
+	assert.Equal(t, "tcp", m.Protocol)
+	assert.Empty(t, m.Send)
+	assert.Zero(t, m.AliasPort)
+
+	noMonitor := map[string]v1.Probe{
+		"exec": {Handler: v1.Handler{
+			Exec: &v1.ExecAction{Command: []string{"true"}}}},
+		"unknown port name": {Handler: v1.Handler{TCPSocket: &v1.TCPSocketAction{
+			Port: intstr.FromString("metrics")}}},
+	}
+	for desc, probe := range noMonitor {
+		_, ok = vsm.probeHealthMonitor(container(probe), 8080)
+		assert.False(t, ok, "Expected no monitor for %s", desc)
+	}
+
+	// Node port pool members can't be checked on another port
+	vsm.isNodePort = true
+	_, ok = vsm.probeHealthMonitor(container(v1.Probe{
+		Handler: v1.Handler{TCPSocket: &v1.TCPSocketAction{
+			Port: intstr.FromInt(8081)}},
+	}), 8080)
+	assert.False(t, ok)
+}
+
+func TestProbeMonitorsFollowPods(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	labels := map[string]string{"app": "foo"}
+	svcPorts := []v1.ServicePort{newServicePort("port0", 8080)}
+	foo := newService("foo", "1", namespace, v1.ServiceTypeClusterIP, svcPorts)
+	foo.Spec.Selector = labels
+	created := time.Now().Add(-time.Hour)
+	pod1 := newProbedPod("foo-1", created, labels,
+		[]v1.ContainerPort{{ContainerPort: 8080}},
+		&v1.Probe{
+			Handler: v1.Handler{HTTPGet: &v1.HTTPGetAction{
+				Path: "/ready", Port: intstr.FromInt(8080)}},
+			PeriodSeconds: 5,
+		})
+	// Not behind the Service
+	other := newProbedPod("bar-1", created.Add(time.Minute),
+		map[string]string{"app": "bar"},
+		[]v1.ContainerPort{{ContainerPort: 8080}},
+		&v1.Probe{Handler: v1.Handler{TCPSocket: &v1.TCPSocketAction{
+			Port: intstr.FromInt(8080)}}})
+
+	// Pods are only read from the store of their event stream
+	fake := fake.NewSimpleClientset(
+		&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   false,
+	})
+	podStore := newStore(nil)
+	podStore.Add(pod1)
+	podStore.Add(other)
+	vsm.AddPodStore(podStore)
+	svcStore := newStore(nil)
+	svcStore.Add(foo)
+	endptPorts := convertSvcPortsToEndpointPorts(svcPorts)
+	eps := newEndpoints("foo", "1", namespace, []string{"10.2.96.0"}, nil,
+		endptPorts)
+	endptStore := newStore(nil)
+	endptStore.Add(eps)
+
+	// A config without monitors gets one from the readiness probe
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo8080})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, endptStore)
+	vs := getVirtualServer(t, vsm, serviceKey{"foo", 8080, namespace, v1.ProtocolTCP})
+	require.Equal([]HealthMonitor{{
+		Protocol: "http",
+		Interval: 5,
+		Timeout:  16,
+		Send:     `GET /ready HTTP/1.0\r\n\r\n`,
+		Recv:     `^HTTP/1\.[01] [23][0-9][0-9]`,
+	}}, vs.VirtualServer.Backend.HealthMonitors)
+
+	// Rolling out a new probe changes the pods and so the endpoints
+	pod2 := newProbedPod("foo-2", created.Add(2*time.Minute), labels,
+		[]v1.ContainerPort{{ContainerPort: 8080}, {ContainerPort: 8081}},
+		&v1.Probe{Handler: v1.Handler{TCPSocket: &v1.TCPSocketAction{
+			Port: intstr.FromInt(8081)}}})
+	podStore.Add(pod2)
+	eps2 := newEndpoints("foo", "2", namespace,
+		[]string{"10.2.96.0", "10.2.96.1"}, nil, endptPorts)
+	vsm.ProcessEndpointsUpdate(eventStream.Updated,
+		eventStream.ChangedObject{eps, eps2}, svcStore)
+	vs = getVirtualServer(t, vsm, serviceKey{"foo", 8080, namespace, v1.ProtocolTCP})
+	require.Equal([]HealthMonitor{{
+		Protocol:  "tcp",
+		Interval:  10,
+		Timeout:   31,
+		AliasPort: 8081,
+	}}, vs.VirtualServer.Backend.HealthMonitors)
+
+	// Monitors from the config are left alone
+	cfg := &VirtualServerConfig{}
+	cfg.VirtualServer.Backend.ServiceName = "foo"
+	cfg.VirtualServer.Backend.ServicePort = 8080
+	cfg.VirtualServer.Backend.HealthMonitors = []HealthMonitor{
+		{Protocol: "icmp"}}
+	require.False(vsm.setProbeMonitors(cfg, foo))
+	require.Equal([]HealthMonitor{{Protocol: "icmp"}},
+		cfg.VirtualServer.Backend.HealthMonitors)
+
+	// Without pods there is nothing to derive
+	podStore.Delete(pod1)
+	podStore.Delete(pod2)
+	vsm.ProcessEndpointsUpdate(eventStream.Updated,
+		eventStream.ChangedObject{eps2, eps}, svcStore)
+	vs = getVirtualServer(t, vsm, serviceKey{"foo", 8080, namespace, v1.ProtocolTCP})
+	require.Nil(vs.VirtualServer.Backend.HealthMonitors)
+}
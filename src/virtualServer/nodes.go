@@ -0,0 +1,147 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+// Check the node selector of a config can be parsed
+func validateNodeSelector(cfg *VirtualServerConfig) error {
+	selector := cfg.VirtualServer.Backend.NodeSelector
+	if 0 == len(selector) {
+		return nil
+	}
+	if _, err := labels.Parse(selector); nil != err {
+		return fmt.Errorf("backend nodeSelector %q is not valid: %v",
+			selector, err)
+	}
+	return nil
+}
+
+// Node selector of a config, nil if it uses the selector of the Manager
+func configNodeSelector(cfg *VirtualServerConfig) labels.Selector {
+	if 0 == len(cfg.VirtualServer.Backend.NodeSelector) {
+		return nil
+	}
+	// Checked by validateNodeSelector
+	selector, err := labels.Parse(cfg.VirtualServer.Backend.NodeSelector)
+	if nil != err {
+		return nil
+	}
+	return selector
+}
+
+// Schedulable Node behind a pool member address
+type nodeInfo struct {
+	name   string
+	labels labels.Set
+}
+
+// Schedulable Node and the addresses pool members use for it
+type nodeAddrs struct {
+	node  *v1.Node
+	addrs []string
+}
+
+// Get the addresses of the schedulable Nodes of a poll, in Node order. The
+// addresses of each Node are looked up once per poll.
+func (vsm *Manager) resolveNodes(obj interface{}) ([]nodeAddrs, error) {
+	nodes, ok := obj.([]v1.Node)
+	if false == ok {
+		return nil,
+			fmt.Errorf("poll update unexpected type, interface is not []v1.Node")
+	}
+
+	var resolved []nodeAddrs
+	for i, node := range nodes {
+		if node.Spec.Unschedulable {
+			// Skip master node
+			continue
+		}
+		resolved = append(resolved,
+			nodeAddrs{&nodes[i], vsm.addrPolicy.Addresses(&nodes[i])})
+	}
+	return resolved, nil
+}
+
+// Addresses of the resolved Nodes the Manager's node selector matches
+func (vsm *Manager) selectedNodeAddrs(resolved []nodeAddrs) []string {
+	addrs := []string{}
+	for _, n := range resolved {
+		if nil != vsm.nodeSelector &&
+			!vsm.nodeSelector.Matches(labels.Set(n.node.ObjectMeta.Labels)) {
+			continue
+		}
+		addrs = append(addrs, n.addrs...)
+	}
+	return addrs
+}
+
+// Get the names and labels of the resolved Nodes, keyed by the addresses
+// pool members use
+func getNodeInfo(resolved []nodeAddrs) map[string]nodeInfo {
+	nodesByAddr := make(map[string]nodeInfo)
+	for _, n := range resolved {
+		for _, addr := range n.addrs {
+			nodesByAddr[addr] = nodeInfo{
+				name:   n.node.ObjectMeta.Name,
+				labels: labels.Set(n.node.ObjectMeta.Labels),
+			}
+		}
+	}
+	return nodesByAddr
+}
+
+// Sorted addresses of the Nodes a selector matches
+func selectNodes(
+	selector labels.Selector,
+	nodesByAddr map[string]nodeInfo) []string {
+
+	addrs := []string{}
+	for addr, node := range nodesByAddr {
+		if selector.Matches(node.labels) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Get the Node addresses a config uses as pool members, from its own node
+// selector or the Manager's
+func configNodes(
+	cfg *VirtualServerConfig,
+	nodes []string,
+	nodesByAddr map[string]nodeInfo) []string {
+
+	if selector := configNodeSelector(cfg); nil != selector {
+		nodes = selectNodes(selector, nodesByAddr)
+	}
+	return filterLocalNodes(cfg, nodes, nodesByAddr)
+}
+
+// Return the cached Node addresses a config uses as pool members
+func (vsm *Manager) getConfigNodesFromCache(cfg *VirtualServerConfig) []string {
+	vsm.oldNodesMutex.Lock()
+	defer vsm.oldNodesMutex.Unlock()
+	return configNodes(cfg, vsm.oldNodes, vsm.nodesByAddr)
+}
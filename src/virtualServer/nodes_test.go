@@ -0,0 +1,196 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"net"
+	"testing"
+
+	"eventStream"
+	"test"
+	"tools/nodeAddress"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+var configmapBarNodeSelector string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "bar",
+      "servicePort": 80,
+      "nodeSelector": "zone=b"
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.241",
+        "port": 80
+      }
+    }
+  }
+}`)
+
+func newLabelledNode(id, address string, nodeLabels map[string]string) v1.Node {
+	node := newNode(id, "1", false, []v1.NodeAddress{{"ExternalIP", address}})
+	node.ObjectMeta.Labels = nodeLabels
+	return *node
+}
+
+func TestValidateNodeSelector(t *testing.T) {
+	var cfg VirtualServerConfig
+	assert.Nil(t, validateNodeSelector(&cfg))
+	assert.Nil(t, configNodeSelector(&cfg))
+
+	cfg.VirtualServer.Backend.NodeSelector = "role=edge,zone in (a, b)"
+	assert.Nil(t, validateNodeSelector(&cfg))
+	assert.True(t, configNodeSelector(&cfg).Matches(
+		labels.Set{"role": "edge", "zone": "a"}))
+
+	cfg.VirtualServer.Backend.NodeSelector = "zone in (a"
+	assert.NotNil(t, validateNodeSelector(&cfg))
+}
+
+func TestNodeSelector(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	selector, err := labels.Parse("role=edge")
+	require.Nil(err)
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	bar := newService("bar", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{
+		Items: []v1.Service{*foo, *bar}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+		NodeSelector: selector,
+	})
+	setUseNodeInternal(vsm, false)
+
+	nodes := []v1.Node{
+		newLabelledNode("edge0", "127.0.0.1", map[string]string{
+			"role": "edge", "zone": "a"}),
+		newLabelledNode("edge1", "127.0.0.2", map[string]string{
+			"role": "edge", "zone": "b"}),
+		newLabelledNode("worker0", "127.0.0.3", map[string]string{
+			"zone": "b"}),
+		newLabelledNode("worker1", "127.0.0.4", nil),
+	}
+	vsm.ProcessNodeUpdate(nodes, nil)
+	require.Equal([]string{"127.0.0.1", "127.0.0.2"}, vsm.getNodesFromCache())
+
+	// Configs use the controller's selector unless they have their own
+	fooMap := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	barMap := newConfigMap("barmap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapBarNodeSelector})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, fooMap}, newStore(nil))
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, barMap}, newStore(nil))
+	fooKey := serviceKey{"foo", 80, namespace, v1.ProtocolTCP}
+	barKey := serviceKey{"bar", 80, namespace, v1.ProtocolTCP}
+	require.Equal([]string{"127.0.0.1", "127.0.0.2"},
+		getVirtualServer(t, vsm, fooKey).VirtualServer.Backend.PoolMemberAddrs)
+	require.Equal([]string{"127.0.0.2", "127.0.0.3"},
+		getVirtualServer(t, vsm, barKey).VirtualServer.Backend.PoolMemberAddrs)
+
+	// Relabelling a node moves it between pools
+	nodes[3].ObjectMeta.Labels = map[string]string{"role": "edge", "zone": "b"}
+	vsm.ProcessNodeUpdate(nodes, nil)
+	require.Equal([]string{"127.0.0.1", "127.0.0.2", "127.0.0.4"},
+		getVirtualServer(t, vsm, fooKey).VirtualServer.Backend.PoolMemberAddrs)
+	require.Equal([]string{"127.0.0.2", "127.0.0.3", "127.0.0.4"},
+		getVirtualServer(t, vsm, barKey).VirtualServer.Backend.PoolMemberAddrs)
+
+	// Service changes keep the selected nodes
+	bar2 := newService("bar", "2", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 37002}})
+	vsm.ProcessServiceUpdate(eventStream.Updated,
+		eventStream.ChangedObject{bar, bar2}, newStore(nil))
+	vs := getVirtualServer(t, vsm, barKey)
+	require.EqualValues(37002, vs.VirtualServer.Backend.PoolMemberPort)
+	require.Equal([]string{"127.0.0.2", "127.0.0.3", "127.0.0.4"},
+		vs.VirtualServer.Backend.PoolMemberAddrs)
+}
+
+func TestNodeAddressPolicy(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	policy, err := nodeAddress.NewPolicy(
+		[]string{"InternalIP", "ExternalIP"}, "")
+	require.Nil(err)
+	vsm := NewManager(&Params{
+		KubeClient:        fake.NewSimpleClientset(),
+		ConfigWriter:      mw,
+		IsNodePort:        true,
+		NodeAddressPolicy: policy,
+	})
+
+	nodes := []v1.Node{
+		*newNode("node0", "1", false, []v1.NodeAddress{
+			{"ExternalIP", "127.0.0.1"}, {"InternalIP", "10.0.0.1"}}),
+		*newNode("node1", "1", false, []v1.NodeAddress{
+			{"ExternalIP", "127.0.0.2"}}),
+		*newNode("node2", "1", false, []v1.NodeAddress{
+			{"Hostname", "node2"}}),
+		*newNode("node3", "1", false, []v1.NodeAddress{
+			{"InternalIP", "10.0.0.3"}}),
+	}
+	nodes[3].ObjectMeta.Annotations = map[string]string{
+		nodeAddress.AddressAnnotation: "192.168.0.3",
+	}
+	vsm.ProcessNodeUpdate(nodes, nil)
+	require.Equal([]string{"10.0.0.1", "127.0.0.2", "192.168.0.3"},
+		vsm.getNodesFromCache())
+	require.Equal("node3", vsm.nodesByAddr["192.168.0.3"].name)
+
+	// Host names are looked up once per Node per poll
+	hostPolicy, err := nodeAddress.NewPolicy([]string{"Hostname"}, "")
+	require.Nil(err)
+	hostPolicy.LookupTTL = 0
+	lookups := 0
+	hostPolicy.LookupIP = func(host string) ([]net.IP, error) {
+		lookups++
+		return []net.IP{net.ParseIP("10.0.0.2")}, nil
+	}
+	vsm.addrPolicy = hostPolicy
+	vsm.ProcessNodeUpdate(nodes, nil)
+	require.Equal([]string{"10.0.0.2", "192.168.0.3"},
+		vsm.getNodesFromCache())
+	require.Equal("node2", vsm.nodesByAddr["10.0.0.2"].name)
+	require.Equal(1, lookups)
+}
@@ -0,0 +1,54 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"eventStream"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+)
+
+// Read Pods from the store of a Pod event stream. Call once for each
+// watched namespace.
+func (vsm *Manager) AddPodStore(store *eventStream.EventStore) {
+	vsm.podStoresMutex.Lock()
+	defer vsm.podStoresMutex.Unlock()
+	vsm.podStores = append(vsm.podStores, store)
+}
+
+// Get the Pods of a namespace that a Service selects
+func (vsm *Manager) getPodsForService(svc *v1.Service) []*v1.Pod {
+	if 0 == len(svc.Spec.Selector) {
+		return nil
+	}
+	selector := labels.SelectorFromSet(labels.Set(svc.Spec.Selector))
+
+	vsm.podStoresMutex.Lock()
+	defer vsm.podStoresMutex.Unlock()
+	var pods []*v1.Pod
+	for _, store := range vsm.podStores {
+		for _, obj := range store.List() {
+			pod := obj.(*v1.Pod)
+			if pod.ObjectMeta.Namespace == svc.ObjectMeta.Namespace &&
+				selector.Matches(labels.Set(pod.ObjectMeta.Labels)) {
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return pods
+}
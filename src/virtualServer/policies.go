@@ -0,0 +1,133 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+)
+
+// Big-IP local traffic policy generated from the rules of a virtual server,
+// written in its frontend for the driver to create and attach
+type Policy struct {
+	Name      string       `json:"name"`
+	Partition string       `json:"partition"`
+	Strategy  string       `json:"strategy"`
+	Controls  []string     `json:"controls"`
+	Requires  []string     `json:"requires"`
+	Rules     []PolicyRule `json:"rules"`
+}
+
+// A policy rule, forwarding the requests matching all its conditions
+type PolicyRule struct {
+	Name       string            `json:"name"`
+	Ordinal    int               `json:"ordinal"`
+	Conditions []PolicyCondition `json:"conditions"`
+	Actions    []PolicyAction    `json:"actions"`
+}
+
+// Match of the Host header, or of the start of the URI path
+type PolicyCondition struct {
+	HTTPHost   bool     `json:"httpHost,omitempty"`
+	Host       bool     `json:"host,omitempty"`
+	HTTPURI    bool     `json:"httpUri,omitempty"`
+	Path       bool     `json:"path,omitempty"`
+	Equals     bool     `json:"equals,omitempty"`
+	StartsWith bool     `json:"startsWith,omitempty"`
+	Request    bool     `json:"request"`
+	Values     []string `json:"values"`
+}
+
+// Forward a request to a pool
+type PolicyAction struct {
+	Forward bool   `json:"forward"`
+	Request bool   `json:"request"`
+	Select  bool   `json:"select"`
+	Pool    string `json:"pool"`
+}
+
+// Check a config with rules is in http mode, the policy matches requests
+func validateRules(cfg *VirtualServerConfig) error {
+	if 0 != len(cfg.VirtualServer.Frontend.Rules) &&
+		"http" != cfg.VirtualServer.Frontend.Mode {
+		return fmt.Errorf("rules require http mode")
+	}
+	return nil
+}
+
+// Get the config to write for a virtual server: the config itself, or a copy
+// with the policy of its rules. A policy given in a ConfigMap is never
+// written.
+func attachPolicy(vs *VirtualServerConfig) *VirtualServerConfig {
+	frontend := &vs.VirtualServer.Frontend
+	var policy *Policy
+	if 0 != len(frontend.Rules) {
+		policy = rulesPolicy(frontend.VirtualServerName, frontend.Partition,
+			frontend.Rules)
+	}
+	if nil == policy && nil == frontend.Policy {
+		return vs
+	}
+	out := *vs
+	out.VirtualServer.Frontend.Policy = policy
+	return &out
+}
+
+// Build the policy of a virtual server's rules, whose pools are set by
+// expandRules
+func rulesPolicy(name, partition string, rules []RuleConfig) *Policy {
+	policy := &Policy{
+		Name:      name,
+		Partition: partition,
+		Strategy:  "first-match",
+		Controls:  []string{"forwarding"},
+		Requires:  []string{"http"},
+		Rules:     []PolicyRule{},
+	}
+	for i, rule := range rules {
+		conditions := []PolicyCondition{}
+		if 0 != len(rule.Host) {
+			conditions = append(conditions, PolicyCondition{
+				HTTPHost: true,
+				Host:     true,
+				Equals:   true,
+				Request:  true,
+				Values:   []string{rule.Host},
+			})
+		}
+		if 0 != len(rule.Path) {
+			conditions = append(conditions, PolicyCondition{
+				HTTPURI:    true,
+				Path:       true,
+				StartsWith: true,
+				Request:    true,
+				Values:     []string{rule.Path},
+			})
+		}
+		policy.Rules = append(policy.Rules, PolicyRule{
+			Name:       fmt.Sprintf("rule%d", i),
+			Ordinal:    i,
+			Conditions: conditions,
+			Actions: []PolicyAction{{
+				Forward: true,
+				Request: true,
+				Select:  true,
+				Pool:    fmt.Sprintf("/%s/%s", partition, rule.Pool),
+			}},
+		})
+	}
+	return policy
+}
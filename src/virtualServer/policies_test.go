@@ -0,0 +1,164 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"strings"
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+var configmapFooRules string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 80
+      },
+      "rules": [
+        {"host": "bar.example.com", "path": "/api",
+          "serviceName": "bar", "servicePort": 8080},
+        {"host": "bar.example.com", "serviceName": "bar", "servicePort": 80},
+        {"path": "/foo", "serviceName": "foo", "servicePort": 80}
+      ]
+    }
+  }
+}`)
+
+func TestValidateRules(t *testing.T) {
+	vsm := NewManager(&Params{})
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFooRules})
+	cfg, err := vsm.parseVirtualServerConfig(cm)
+	assert.Nil(t, err)
+	assert.NotNil(t, cfg)
+
+	cm.Data["data"] = strings.Replace(configmapFooRules,
+		`"mode": "http"`, `"mode": "tcp"`, 1)
+	cfg, err = vsm.parseVirtualServerConfig(cm)
+	assert.Nil(t, cfg)
+	assert.EqualError(t, err, "configmap foomap: rules require http mode")
+}
+
+func TestRulesPolicy(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	bar := newService("bar", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{
+			{Port: 80, NodePort: 30002},
+			{Port: 8080, NodePort: 30003},
+		})
+	fake := fake.NewSimpleClientset(
+		&v1.ServiceList{Items: []v1.Service{*foo, *bar}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFooRules})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, newStore(nil))
+	services := mw.Sections["services"].(VirtualServerConfigs)
+	require.Equal(3, len(services), "Expected a pool for each rule service port")
+
+	byName := make(map[string]*VirtualServerConfig)
+	for _, vs := range services {
+		byName[vs.VirtualServer.Frontend.VirtualServerName] = vs
+	}
+	for _, name := range []string{"default_foomap_bar_80", "default_foomap_bar_8080"} {
+		pool, ok := byName[name]
+		require.True(ok, "Expected pool %v to be written", name)
+		require.Nil(pool.VirtualServer.Frontend.Policy)
+	}
+	vs := byName["default_foomap"]
+	require.NotNil(vs)
+	require.Equal(&Policy{
+		Name:      "default_foomap",
+		Partition: "velcro",
+		Strategy:  "first-match",
+		Controls:  []string{"forwarding"},
+		Requires:  []string{"http"},
+		Rules: []PolicyRule{
+			{
+				Name:    "rule0",
+				Ordinal: 0,
+				Conditions: []PolicyCondition{
+					{HTTPHost: true, Host: true, Equals: true, Request: true,
+						Values: []string{"bar.example.com"}},
+					{HTTPURI: true, Path: true, StartsWith: true, Request: true,
+						Values: []string{"/api"}},
+				},
+				Actions: []PolicyAction{{Forward: true, Request: true,
+					Select: true, Pool: "/velcro/default_foomap_bar_8080"}},
+			},
+			{
+				Name:    "rule1",
+				Ordinal: 1,
+				Conditions: []PolicyCondition{
+					{HTTPHost: true, Host: true, Equals: true, Request: true,
+						Values: []string{"bar.example.com"}},
+				},
+				Actions: []PolicyAction{{Forward: true, Request: true,
+					Select: true, Pool: "/velcro/default_foomap_bar_80"}},
+			},
+			{
+				Name:    "rule2",
+				Ordinal: 2,
+				Conditions: []PolicyCondition{
+					{HTTPURI: true, Path: true, StartsWith: true, Request: true,
+						Values: []string{"/foo"}},
+				},
+				Actions: []PolicyAction{{Forward: true, Request: true,
+					Select: true, Pool: "/velcro/default_foomap"}},
+			},
+		},
+	}, vs.VirtualServer.Frontend.Policy)
+
+	// The stored config is left without a policy
+	require.Nil(vsm.vservers.m["default_foomap"].VirtualServer.Frontend.Policy)
+
+	// Policies are only written for rules
+	vs = attachPolicy(byName["default_foomap_bar_80"])
+	require.Nil(vs.VirtualServer.Frontend.Policy)
+	vs.VirtualServer.Frontend.Policy = &Policy{Name: "/Common/other"}
+	require.Nil(attachPolicy(vs).VirtualServer.Frontend.Policy)
+}
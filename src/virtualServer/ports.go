@@ -0,0 +1,171 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "f5/vlogger"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Decode a Virtual Server config. The servicePort of the backend and of the
+// rules may be the name of the Service port instead of its number, the
+// number is then filled in from the Service by resolveServicePort.
+func (cfg *VirtualServerConfig) UnmarshalJSON(data []byte) error {
+	// Without the methods of VirtualServerConfig, to not recurse
+	type plainConfig VirtualServerConfig
+
+	var generic map[string]interface{}
+	if err := json.Unmarshal(data, &generic); nil != err {
+		return err
+	}
+	portName := ""
+	protocolGiven := false
+	var rulePortNames []string
+	if vs, ok := generic["virtualServer"].(map[string]interface{}); ok {
+		if backend, ok := vs["backend"].(map[string]interface{}); ok {
+			var err error
+			portName, err = takePortName(backend, "backend")
+			if nil != err {
+				return err
+			}
+			_, protocolGiven = backend["serviceProtocol"]
+		}
+		if frontend, ok := vs["frontend"].(map[string]interface{}); ok {
+			rules, _ := frontend["rules"].([]interface{})
+			for i := range rules {
+				name := ""
+				if rule, ok := rules[i].(map[string]interface{}); ok {
+					var err error
+					name, err = takePortName(rule, fmt.Sprintf("rule %d", i))
+					if nil != err {
+						return err
+					}
+				}
+				rulePortNames = append(rulePortNames, name)
+			}
+		}
+	}
+	data, err := json.Marshal(generic)
+	if nil != err {
+		return err
+	}
+
+	err = json.Unmarshal(data, (*plainConfig)(cfg))
+	if nil != err {
+		return err
+	}
+	cfg.VirtualServer.Backend.servicePortName = portName
+	cfg.VirtualServer.Backend.serviceProtocolGiven = protocolGiven
+	for i, name := range rulePortNames {
+		cfg.VirtualServer.Frontend.Rules[i].servicePortName = name
+	}
+	return nil
+}
+
+// Remove a servicePort given by name from a decoded backend or rule, for it
+// to decode as a number, and return the name
+func takePortName(obj map[string]interface{}, what string) (string, error) {
+	name, ok := obj["servicePort"].(string)
+	if !ok {
+		return "", nil
+	}
+	if 0 == len(name) {
+		return "", fmt.Errorf("%s servicePort cannot be empty", what)
+	}
+	delete(obj, "servicePort")
+	return name, nil
+}
+
+// Service port number, or name, a config's backend uses. Used to name pools
+// so a renumbered named port keeps its pool.
+func backendPortRef(cfg *VirtualServerConfig) string {
+	if name := cfg.VirtualServer.Backend.servicePortName; 0 != len(name) {
+		return name
+	}
+	return fmt.Sprint(cfg.VirtualServer.Backend.ServicePort)
+}
+
+// Fill in the number and protocol of a named backend Service port.
+// Returns true if they changed. A serviceProtocol given in the config is
+// kept, and the port must have it; the port's protocol must also suit the
+// mode of the config. Otherwise the port is left as it was and an error
+// returned. A port the Service no longer has keeps its last number, so it
+// is cleared like any other removed port.
+func resolveServicePort(cfg *VirtualServerConfig, svc *v1.Service) (bool, error) {
+	backend := &cfg.VirtualServer.Backend
+	if 0 == len(backend.servicePortName) {
+		return false, nil
+	}
+	for _, portSpec := range svc.Spec.Ports {
+		if portSpec.Name != backend.servicePortName {
+			continue
+		}
+		protocol := serviceProtocol(portSpec.Protocol)
+		if backend.serviceProtocolGiven {
+			if portProtocol(portSpec.Protocol) != backendProtocol(cfg) {
+				return false, fmt.Errorf(
+					"Service %v port %v is %v, not serviceProtocol %v",
+					svc.ObjectMeta.Name, backend.servicePortName,
+					portProtocol(portSpec.Protocol), backend.ServiceProtocol)
+			}
+			protocol = backend.ServiceProtocol
+		}
+		if portSpec.Port == backend.ServicePort &&
+			protocol == backend.ServiceProtocol {
+			return false, nil
+		}
+		resolved := *cfg
+		resolved.VirtualServer.Backend.ServicePort = portSpec.Port
+		resolved.VirtualServer.Backend.ServiceProtocol = protocol
+		if err := validateProtocol(&resolved); nil != err {
+			return false, fmt.Errorf("Service %v port %v: %v",
+				svc.ObjectMeta.Name, backend.servicePortName, err)
+		}
+		log.Debugf("Service %v port %v is %v/%v", svc.ObjectMeta.Name,
+			backend.servicePortName, portSpec.Port, portProtocol(portSpec.Protocol))
+		backend.ServicePort = portSpec.Port
+		backend.ServiceProtocol = protocol
+		return true, nil
+	}
+	return false, nil
+}
+
+// Resolve the named backend ports of the configs using a Service again, and
+// index them under their new number.
+// This function MUST be called with the vservers lock held.
+func (vsm *Manager) resolveNamedPorts(svc *v1.Service) {
+	namespace := svc.ObjectMeta.Namespace
+	named := vsm.vservers.namedPorts[namespace+"/"+svc.ObjectMeta.Name]
+	var changed []*VirtualServerConfig
+	for _, vs := range named {
+		resolved, err := resolveServicePort(vs, svc)
+		if nil != err {
+			log.Warningf("Virtual server %v: %v",
+				vs.VirtualServer.Frontend.VirtualServerName, err)
+		} else if resolved {
+			changed = append(changed, vs)
+		}
+	}
+	// Reindexing changes the map being ranged over
+	for _, vs := range changed {
+		vsm.vservers.assign(namespace, vs)
+	}
+}
@@ -0,0 +1,311 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/1.4/pkg/util/intstr"
+)
+
+var configmapFooNamedPort string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": "https"
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "tcp",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 443
+      }
+    }
+  }
+}`)
+
+func TestUnmarshalNamedPort(t *testing.T) {
+	require := require.New(t)
+
+	var cfg VirtualServerConfig
+	require.Nil(json.Unmarshal([]byte(configmapFooNamedPort), &cfg))
+	require.Equal("foo", cfg.VirtualServer.Backend.ServiceName)
+	require.Equal(int32(0), cfg.VirtualServer.Backend.ServicePort)
+	require.Equal("https", cfg.VirtualServer.Backend.servicePortName)
+	require.Equal("https", backendPortRef(&cfg))
+	require.Equal(&VirtualAddress{BindAddr: "10.128.10.240", Port: 443},
+		cfg.VirtualServer.Frontend.VirtualAddress)
+
+	cfg = VirtualServerConfig{}
+	require.Nil(json.Unmarshal([]byte(configmapFoo), &cfg))
+	require.Equal(int32(80), cfg.VirtualServer.Backend.ServicePort)
+	require.Empty(cfg.VirtualServer.Backend.servicePortName)
+	require.Equal("80", backendPortRef(&cfg))
+
+	err := json.Unmarshal([]byte(`{"virtualServer": {"backend": {
+		"serviceName": "foo", "servicePort": ""}}}`), &cfg)
+	require.NotNil(err)
+}
+
+func TestResolveServicePort(t *testing.T) {
+	var cfg VirtualServerConfig
+	cfg.VirtualServer.Backend.ServiceName = "foo"
+	cfg.VirtualServer.Backend.ServicePort = 80
+	svc := newService("foo", "1", namespace, v1.ServiceTypeClusterIP,
+		[]v1.ServicePort{{Name: "http", Port: 8080}})
+	resolved, err := resolveServicePort(&cfg, svc)
+	assert.Nil(t, err)
+	assert.False(t, resolved, "Numbered ports are kept")
+	assert.Equal(t, int32(80), cfg.VirtualServer.Backend.ServicePort)
+
+	cfg.VirtualServer.Backend.servicePortName = "http"
+	resolved, err = resolveServicePort(&cfg, svc)
+	assert.Nil(t, err)
+	assert.True(t, resolved)
+	assert.Equal(t, int32(8080), cfg.VirtualServer.Backend.ServicePort)
+	resolved, err = resolveServicePort(&cfg, svc)
+	assert.Nil(t, err)
+	assert.False(t, resolved)
+
+	// A UDP port is only resolved for a udp mode config
+	svc = newService("foo", "2", namespace, v1.ServiceTypeClusterIP,
+		[]v1.ServicePort{{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP}})
+	cfg.VirtualServer.Backend.servicePortName = "dns"
+	cfg.VirtualServer.Frontend.Mode = "tcp"
+	resolved, err = resolveServicePort(&cfg, svc)
+	assert.EqualError(t, err,
+		"Service foo port dns: serviceProtocol udp requires mode udp")
+	assert.False(t, resolved)
+	assert.Equal(t, int32(8080), cfg.VirtualServer.Backend.ServicePort)
+	assert.Empty(t, cfg.VirtualServer.Backend.ServiceProtocol)
+
+	cfg.VirtualServer.Frontend.Mode = "udp"
+	resolved, err = resolveServicePort(&cfg, svc)
+	assert.Nil(t, err)
+	assert.True(t, resolved)
+	assert.Equal(t, int32(53), cfg.VirtualServer.Backend.ServicePort)
+	assert.Equal(t, "udp", cfg.VirtualServer.Backend.ServiceProtocol)
+
+	cfg.VirtualServer.Backend.servicePortName = "gone"
+	resolved, err = resolveServicePort(&cfg, svc)
+	assert.Nil(t, err)
+	assert.False(t, resolved)
+	assert.Equal(t, int32(53), cfg.VirtualServer.Backend.ServicePort,
+		"Missing ports keep their last number")
+}
+
+func TestResolveServicePortGivenProtocol(t *testing.T) {
+	var cfg VirtualServerConfig
+	require.Nil(t, json.Unmarshal([]byte(strings.Replace(configmapFooNamedPort,
+		`"servicePort": "https"`,
+		`"servicePort": "https", "serviceProtocol": "tcp"`, 1)), &cfg))
+	require.True(t, cfg.VirtualServer.Backend.serviceProtocolGiven)
+
+	// The given protocol is kept
+	svc := newService("foo", "1", namespace, v1.ServiceTypeClusterIP,
+		[]v1.ServicePort{{Name: "https", Port: 8443}})
+	resolved, err := resolveServicePort(&cfg, svc)
+	assert.Nil(t, err)
+	assert.True(t, resolved)
+	assert.Equal(t, int32(8443), cfg.VirtualServer.Backend.ServicePort)
+	assert.Equal(t, "tcp", cfg.VirtualServer.Backend.ServiceProtocol)
+
+	// And the port must have it
+	svc = newService("foo", "2", namespace, v1.ServiceTypeClusterIP,
+		[]v1.ServicePort{{Name: "https", Port: 443, Protocol: v1.ProtocolUDP}})
+	resolved, err = resolveServicePort(&cfg, svc)
+	assert.EqualError(t, err, "Service foo port https is UDP, not serviceProtocol tcp")
+	assert.False(t, resolved)
+	assert.Equal(t, int32(8443), cfg.VirtualServer.Backend.ServicePort)
+	assert.Equal(t, "tcp", cfg.VirtualServer.Backend.ServiceProtocol)
+}
+
+func TestUnmarshalRuleNamedPort(t *testing.T) {
+	require := require.New(t)
+
+	var cfg VirtualServerConfig
+	data := strings.Replace(configmapFooRules,
+		`"serviceName": "bar", "servicePort": 8080`,
+		`"serviceName": "bar", "servicePort": "http-alt"`, 1)
+	require.Nil(json.Unmarshal([]byte(data), &cfg))
+	rules := cfg.VirtualServer.Frontend.Rules
+	require.Equal(3, len(rules))
+	require.Equal("http-alt", rules[0].servicePortName)
+	require.Equal(int32(0), rules[0].ServicePort)
+	require.Empty(rules[1].servicePortName)
+	require.Equal(int32(80), rules[1].ServicePort)
+
+	data = strings.Replace(configmapFooRules,
+		`"serviceName": "bar", "servicePort": 8080`,
+		`"serviceName": "bar", "servicePort": ""`, 1)
+	require.EqualError(json.Unmarshal([]byte(data), &cfg),
+		"rule 0 servicePort cannot be empty")
+}
+
+func TestNamedPortRenumberedNodePort(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{
+			{Name: "http", Port: 80, NodePort: 30001},
+			{Name: "https", Port: 443, NodePort: 30002},
+		})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFooNamedPort})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, newStore(nil))
+	require.Equal(1, len(vsm.vservers.m))
+	vs := getVirtualServer(t, vsm,
+		serviceKey{"foo", 443, namespace, v1.ProtocolTCP})
+	require.EqualValues(30002, vs.VirtualServer.Backend.PoolMemberPort)
+
+	// Renumbering the port moves the config to the new number
+	foo2 := newService("foo", "2", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{
+			{Name: "http", Port: 80, NodePort: 30001},
+			{Name: "https", Port: 8443, NodePort: 30003},
+		})
+	vsm.ProcessServiceUpdate(eventStream.Updated,
+		eventStream.ChangedObject{foo, foo2}, newStore(nil))
+	require.Equal(1, len(vsm.vservers.m))
+	vs = getVirtualServer(t, vsm,
+		serviceKey{"foo", 8443, namespace, v1.ProtocolTCP})
+	require.Equal(int32(8443), vs.VirtualServer.Backend.ServicePort)
+	require.EqualValues(30003, vs.VirtualServer.Backend.PoolMemberPort)
+	services := mw.Sections["services"].(VirtualServerConfigs)
+	require.Equal(1, len(services))
+	require.EqualValues(30003, services[0].VirtualServer.Backend.PoolMemberPort)
+	require.Equal(1, len(vsm.vservers.namedPorts["default/foo"]))
+
+	vsm.ProcessConfigMapUpdate(eventStream.Deleted,
+		eventStream.ChangedObject{cm, nil}, newStore(nil))
+	require.Empty(vsm.vservers.namedPorts)
+}
+
+func TestRuleNamedPortNodePort(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	bar := newService("bar", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{
+			{Name: "http", Port: 80, NodePort: 30002},
+			{Name: "http-alt", Port: 8080, NodePort: 30003},
+		})
+	fake := fake.NewSimpleClientset(
+		&v1.ServiceList{Items: []v1.Service{*foo, *bar}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data": strings.Replace(configmapFooRules,
+			`"serviceName": "bar", "servicePort": 8080`,
+			`"serviceName": "bar", "servicePort": "http-alt"`, 1)})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, newStore(nil))
+	require.Equal(3, len(vsm.vservers.m))
+	pool := vsm.vservers.m["default_foomap_bar_http-alt"]
+	require.NotNil(pool, "Rules naming a port get a pool named after it")
+	require.Equal(int32(8080), pool.VirtualServer.Backend.ServicePort)
+	require.EqualValues(30003, pool.VirtualServer.Backend.PoolMemberPort)
+}
+
+func TestParseIngressNamedPort(t *testing.T) {
+	require := require.New(t)
+
+	ing := newIngress("ingress", "1", namespace, ingressAnnotations,
+		v1beta1.IngressSpec{Rules: []v1beta1.IngressRule{
+			newIngressRule("foo.example.com", map[string]*v1beta1.IngressBackend{
+				"/": &v1beta1.IngressBackend{
+					ServiceName: "foo",
+					ServicePort: intstr.FromString("http"),
+				},
+			}),
+		}})
+	cfgs, err := parseIngress(ing)
+	require.Nil(err)
+	cfg := cfgs["ingress_default_ingress"]
+	require.NotNil(cfg)
+	require.Equal("http", cfg.VirtualServer.Backend.servicePortName)
+	require.Equal("http", cfg.VirtualServer.Frontend.Rules[0].servicePortName)
+	require.Equal("ingress_default_ingress",
+		cfg.VirtualServer.Frontend.Rules[0].Pool)
+
+	// Rules naming another service port get their own pool
+	ing.Spec.Backend = newIngressBackend("bar", 80)
+	cfgs, err = parseIngress(ing)
+	require.Nil(err)
+	require.Equal(2, len(cfgs))
+	pool := cfgs["ingress_default_ingress_foo_http"]
+	require.NotNil(pool)
+	require.Equal("http", pool.VirtualServer.Backend.servicePortName)
+}
+
+func TestParseServiceAnnotationsNamedPort(t *testing.T) {
+	require := require.New(t)
+	defer func(s string) { serviceSchema = s }(serviceSchema)
+	serviceSchema = schemaUrl
+	vsm := NewManager(&Params{DefaultPartition: "common"})
+
+	svc := newAnnotatedService("foo", "1", map[string]string{
+		serviceBindAddrAnnotation:    "10.128.10.240",
+		servicePortAnnotation:        "53",
+		serviceBackendPortAnnotation: "dns",
+		serviceModeAnnotation:        "udp",
+	}, []v1.ServicePort{
+		{Name: "metrics", Port: 9153},
+		{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+	})
+	cfg, err := vsm.parseServiceAnnotations(svc)
+	require.Nil(err)
+	require.Equal("dns", cfg.VirtualServer.Backend.servicePortName)
+	require.Equal("udp", cfg.VirtualServer.Backend.ServiceProtocol)
+}
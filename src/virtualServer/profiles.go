@@ -0,0 +1,114 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Sides of the connection a profile applies to
+const (
+	profileContextAll        = "all"
+	profileContextClientSide = "clientside"
+	profileContextServerSide = "serverside"
+)
+
+// Persistence methods supported on the Big-IP
+const (
+	persistCookie             = "cookie"
+	persistSourceAddress      = "source-address"
+	persistDestinationAddress = "destination-address"
+	persistSsl                = "ssl"
+	persistUniversal          = "universal"
+)
+
+// Existing Big-IP profile attached to a Virtual Server, such as a OneConnect,
+// HTTP compression, TCP or request logging profile
+type ProfileRef struct {
+	// Uses format 'partition_name/profile_name', like f5ProfileName
+	Name string `json:"name"`
+	// Side of the connection the profile applies to, defaults to all
+	Context string `json:"context,omitempty"`
+}
+
+// Session persistence of a Virtual Server
+type Persistence struct {
+	Method string `json:"method"`
+	// Seconds a session persists without traffic, the Big-IP default if 0
+	Timeout int `json:"timeout,omitempty"`
+	// Cookie inserted by the Big-IP, cookie persistence only
+	CookieName string `json:"cookieName,omitempty"`
+	// iRule building the persistence key, universal persistence only. Named
+	// like the entries of iRules.
+	Rule string `json:"rule,omitempty"`
+}
+
+// Check the profiles and persistence of a config
+func validateProfiles(cfg *VirtualServerConfig) error {
+	frontend := &cfg.VirtualServer.Frontend
+	if 0 != len(frontend.IApp) &&
+		(0 != len(frontend.Profiles) || nil != frontend.Persistence) {
+		return fmt.Errorf("iApps cannot have profiles or persistence")
+	}
+
+	seen := make(map[string]struct{})
+	for i, p := range frontend.Profiles {
+		if 0 == len(strings.TrimSpace(p.Name)) {
+			return fmt.Errorf("profile %v has no name", i)
+		}
+		if _, ok := seen[p.Name]; ok {
+			return fmt.Errorf("profile %v is listed more than once", p.Name)
+		}
+		seen[p.Name] = struct{}{}
+		switch p.Context {
+		case "", profileContextAll, profileContextClientSide,
+			profileContextServerSide:
+		default:
+			return fmt.Errorf("profile %v has unknown context %q", p.Name,
+				p.Context)
+		}
+	}
+
+	persist := frontend.Persistence
+	if nil == persist {
+		return nil
+	}
+	switch persist.Method {
+	case persistCookie:
+		if "http" != frontend.Mode {
+			return fmt.Errorf("%s persistence requires http mode", persistCookie)
+		}
+	case persistSourceAddress, persistDestinationAddress, persistSsl:
+	case persistUniversal:
+		if 0 == len(strings.TrimSpace(persist.Rule)) {
+			return fmt.Errorf("%s persistence requires rule", persistUniversal)
+		}
+	default:
+		return fmt.Errorf("persistence has unknown method %q", persist.Method)
+	}
+	if persist.Timeout < 0 {
+		return fmt.Errorf("persistence timeout cannot be negative")
+	}
+	if 0 != len(persist.CookieName) && persistCookie != persist.Method {
+		return fmt.Errorf("cookieName requires %s persistence", persistCookie)
+	}
+	if 0 != len(persist.Rule) && persistUniversal != persist.Method {
+		return fmt.Errorf("rule requires %s persistence", persistUniversal)
+	}
+	return nil
+}
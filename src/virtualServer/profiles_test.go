@@ -0,0 +1,149 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+var configmapFooProfiles string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 80
+      },
+      "profiles": [
+        { "name": "Common/oneconnect" },
+        { "name": "Common/tcp-wan-optimized", "context": "clientside" },
+        { "name": "Common/tcp-lan-optimized", "context": "serverside" }
+      ],
+      "persistence": {
+        "method": "universal",
+        "timeout": 600,
+        "rule": "persist-on-header"
+      }
+    }
+  }
+}`)
+
+func TestValidateProfiles(t *testing.T) {
+	var cfg VirtualServerConfig
+	cfg.VirtualServer.Frontend.Mode = "tcp"
+	cfg.VirtualServer.Frontend.Profiles = []ProfileRef{
+		{Name: "Common/oneconnect"},
+		{Name: "Common/tcp-wan-optimized", Context: "clientside"},
+	}
+	cfg.VirtualServer.Frontend.Persistence = &Persistence{
+		Method: "source-address", Timeout: 300}
+	assert.Nil(t, validateProfiles(&cfg))
+
+	cfg.VirtualServer.Frontend.Profiles[1].Context = "both"
+	assert.NotNil(t, validateProfiles(&cfg), "Unknown context")
+	cfg.VirtualServer.Frontend.Profiles[1] = ProfileRef{Name: "Common/oneconnect"}
+	assert.NotNil(t, validateProfiles(&cfg), "Duplicate profile")
+	cfg.VirtualServer.Frontend.Profiles = nil
+
+	persist := cfg.VirtualServer.Frontend.Persistence
+	persist.Method = "cookie"
+	assert.NotNil(t, validateProfiles(&cfg), "Cookie persistence needs http")
+	cfg.VirtualServer.Frontend.Mode = "http"
+	persist.CookieName = "foo-session"
+	assert.Nil(t, validateProfiles(&cfg))
+
+	persist.Method = "universal"
+	assert.NotNil(t, validateProfiles(&cfg), "Universal persistence needs rule")
+	persist.Rule = "/Common/persist-on-header"
+	assert.NotNil(t, validateProfiles(&cfg), "cookieName is for cookies")
+	persist.CookieName = ""
+	assert.Nil(t, validateProfiles(&cfg))
+
+	persist.Method = "sticky"
+	assert.NotNil(t, validateProfiles(&cfg))
+
+	cfg.VirtualServer.Frontend.IApp = "/Common/f5.http"
+	cfg.VirtualServer.Frontend.Persistence = nil
+	assert.Nil(t, validateProfiles(&cfg))
+	cfg.VirtualServer.Frontend.Profiles = []ProfileRef{{Name: "Common/oneconnect"}}
+	assert.NotNil(t, validateProfiles(&cfg), "iApps set their own profiles")
+}
+
+func TestProfilesOutput(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+
+	persistRule := newConfigMap("persist-on-header", "1", namespace,
+		map[string]string{"code": "when HTTP_REQUEST { persist uie [HTTP::header X-Session] }"})
+	vsm.ProcessIRuleUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, persistRule})
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFooProfiles})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, newStore(nil))
+
+	services := mw.Sections["services"].(VirtualServerConfigs)
+	require.Equal(1, len(services))
+	frontend := services[0].VirtualServer.Frontend
+	require.Equal([]ProfileRef{
+		{Name: "Common/oneconnect"},
+		{Name: "Common/tcp-wan-optimized", Context: "clientside"},
+		{Name: "Common/tcp-lan-optimized", Context: "serverside"},
+	}, frontend.Profiles)
+	// The persistence rule is written like any other iRule
+	require.Equal(&Persistence{Method: "universal", Timeout: 600,
+		Rule: "default_persist-on-header"}, frontend.Persistence)
+	require.Equal(1, len(mw.Sections["irules"].([]*IRule)))
+
+	// Changing the rule rewrites it
+	written := mw.WrittenTimes
+	persistRule2 := newConfigMap("persist-on-header", "2", namespace,
+		map[string]string{"code": "when HTTP_REQUEST { persist uie [HTTP::cookie sid] }"})
+	vsm.ProcessIRuleUpdate(eventStream.Updated,
+		eventStream.ChangedObject{persistRule, persistRule2})
+	require.True(mw.WrittenTimes > written)
+	require.Equal("when HTTP_REQUEST { persist uie [HTTP::cookie sid] }",
+		mw.Sections["irules"].([]*IRule)[0].Code)
+}
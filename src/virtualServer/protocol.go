@@ -0,0 +1,90 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Backend serviceProtocol values, and the frontend mode of UDP virtual servers
+const (
+	protocolTCP = "tcp"
+	protocolUDP = "udp"
+)
+
+// Protocol of a Service or Endpoints port, Kubernetes defaults it to TCP
+func portProtocol(protocol v1.Protocol) v1.Protocol {
+	if 0 == len(protocol) {
+		return v1.ProtocolTCP
+	}
+	return protocol
+}
+
+// Protocol of the Service port a config's backend uses
+func backendProtocol(cfg *VirtualServerConfig) v1.Protocol {
+	if protocolUDP == cfg.VirtualServer.Backend.ServiceProtocol {
+		return v1.ProtocolUDP
+	}
+	return v1.ProtocolTCP
+}
+
+// Backend serviceProtocol value for a Service port, empty for TCP so the
+// configs of TCP ports are unchanged
+func serviceProtocol(protocol v1.Protocol) string {
+	if v1.ProtocolTCP == portProtocol(protocol) {
+		return ""
+	}
+	return strings.ToLower(string(protocol))
+}
+
+// Key of the Service port a config's backend uses
+func backendKey(cfg *VirtualServerConfig, namespace string) serviceKey {
+	return serviceKey{cfg.VirtualServer.Backend.ServiceName,
+		cfg.VirtualServer.Backend.ServicePort, namespace, backendProtocol(cfg)}
+}
+
+// Check the backend protocol of a config matches its mode, UDP ports need
+// UDP virtual servers
+func validateProtocol(cfg *VirtualServerConfig) error {
+	udpBackend := false
+	switch cfg.VirtualServer.Backend.ServiceProtocol {
+	case "", protocolTCP:
+	case protocolUDP:
+		udpBackend = true
+	default:
+		return fmt.Errorf("backend has unknown serviceProtocol %q",
+			cfg.VirtualServer.Backend.ServiceProtocol)
+	}
+
+	frontend := &cfg.VirtualServer.Frontend
+	if 0 != len(frontend.IApp) {
+		return nil
+	}
+	udpMode := protocolUDP == frontend.Mode
+	if udpBackend && !udpMode {
+		return fmt.Errorf("serviceProtocol %s requires mode %s", protocolUDP,
+			protocolUDP)
+	}
+	if udpMode && !udpBackend {
+		return fmt.Errorf("mode %s requires serviceProtocol %s", protocolUDP,
+			protocolUDP)
+	}
+	return nil
+}
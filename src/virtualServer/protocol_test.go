@@ -0,0 +1,198 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+var configmapDNSUDP string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "dns",
+      "servicePort": 53,
+      "serviceProtocol": "udp"
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "udp",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 53
+      }
+    }
+  }
+}`)
+
+var configmapDNSTCP string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "dns",
+      "servicePort": 53
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "tcp",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 53
+      }
+    }
+  }
+}`)
+
+func newDNSService(rv string, serviceType v1.ServiceType) *v1.Service {
+	return newService("dns", rv, namespace, serviceType, []v1.ServicePort{
+		{Name: "dns-tcp", Port: 53, Protocol: v1.ProtocolTCP, NodePort: 30053},
+		{Name: "dns-udp", Port: 53, Protocol: v1.ProtocolUDP, NodePort: 30054},
+	})
+}
+
+func TestValidateProtocol(t *testing.T) {
+	var cfg VirtualServerConfig
+	cfg.VirtualServer.Frontend.Mode = "tcp"
+	assert.Nil(t, validateProtocol(&cfg))
+	cfg.VirtualServer.Backend.ServiceProtocol = "tcp"
+	assert.Nil(t, validateProtocol(&cfg))
+
+	cfg.VirtualServer.Backend.ServiceProtocol = "udp"
+	assert.NotNil(t, validateProtocol(&cfg), "UDP ports need udp mode")
+	cfg.VirtualServer.Frontend.Mode = "udp"
+	assert.Nil(t, validateProtocol(&cfg))
+	cfg.VirtualServer.Backend.ServiceProtocol = ""
+	assert.NotNil(t, validateProtocol(&cfg), "udp mode needs a UDP port")
+
+	cfg.VirtualServer.Backend.ServiceProtocol = "sctp"
+	assert.NotNil(t, validateProtocol(&cfg))
+}
+
+func TestParseLoadBalancerUDP(t *testing.T) {
+	require := require.New(t)
+
+	cfgs := parseLoadBalancer(newDNSService("1", v1.ServiceTypeLoadBalancer),
+		"10.128.10.240", "velcro")
+	require.Equal(2, len(cfgs))
+	tcp := cfgs["lb_default_dns_53"]
+	require.NotNil(tcp)
+	require.Equal("tcp", tcp.VirtualServer.Frontend.Mode)
+	require.Empty(tcp.VirtualServer.Backend.ServiceProtocol)
+	udp := cfgs["lb_default_dns_53_udp"]
+	require.NotNil(udp)
+	require.Equal("udp", udp.VirtualServer.Frontend.Mode)
+	require.Equal("udp", udp.VirtualServer.Backend.ServiceProtocol)
+	require.Equal(&VirtualAddress{BindAddr: "10.128.10.240", Port: 53},
+		udp.VirtualServer.Frontend.VirtualAddress)
+}
+
+func TestProtocolNodePort(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	dns := newDNSService("1", v1.ServiceTypeNodePort)
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*dns}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+
+	// Ports sharing a number do not collide
+	udpMap := newConfigMap("dnsudp", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapDNSUDP})
+	tcpMap := newConfigMap("dnstcp", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapDNSTCP})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, udpMap}, newStore(nil))
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, tcpMap}, newStore(nil))
+	require.Equal(2, len(vsm.vservers.m))
+	udpKey := serviceKey{"dns", 53, namespace, v1.ProtocolUDP}
+	tcpKey := serviceKey{"dns", 53, namespace, v1.ProtocolTCP}
+	require.EqualValues(30054,
+		getVirtualServer(t, vsm, udpKey).VirtualServer.Backend.PoolMemberPort)
+	require.EqualValues(30053,
+		getVirtualServer(t, vsm, tcpKey).VirtualServer.Backend.PoolMemberPort)
+
+	// Dropping the UDP port only affects the UDP virtual server
+	dns2 := newService("dns", "2", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{dns.Spec.Ports[0]})
+	vsm.ProcessServiceUpdate(eventStream.Updated,
+		eventStream.ChangedObject{dns, dns2}, newStore(nil))
+	require.EqualValues(-1,
+		getVirtualServer(t, vsm, udpKey).VirtualServer.Backend.PoolMemberPort)
+	require.EqualValues(30053,
+		getVirtualServer(t, vsm, tcpKey).VirtualServer.Backend.PoolMemberPort)
+}
+
+func TestProtocolCluster(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	dns := newDNSService("1", v1.ServiceTypeClusterIP)
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*dns}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   false,
+	})
+	svcStore := newStore(nil)
+	svcStore.Add(dns)
+
+	endptPorts := []v1.EndpointPort{
+		{Name: "dns-tcp", Port: 5353, Protocol: v1.ProtocolTCP},
+		{Name: "dns-udp", Port: 5354, Protocol: v1.ProtocolUDP},
+	}
+	eps := newEndpoints("dns", "1", namespace, []string{"10.2.96.0"}, nil,
+		endptPorts)
+	endptStore := newStore(nil)
+	endptStore.Add(eps)
+
+	udpMap := newConfigMap("dnsudp", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapDNSUDP})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, udpMap}, endptStore)
+	vs := getVirtualServer(t, vsm, serviceKey{"dns", 53, namespace, v1.ProtocolUDP})
+	require.Equal([]string{"10.2.96.0:5354"}, vs.VirtualServer.Backend.PoolMemberAddrs)
+
+	eps2 := newEndpoints("dns", "2", namespace, []string{"10.2.96.0", "10.2.96.1"},
+		nil, endptPorts)
+	vsm.ProcessEndpointsUpdate(eventStream.Updated,
+		eventStream.ChangedObject{eps, eps2}, svcStore)
+	require.Equal([]string{"10.2.96.0:5354", "10.2.96.1:5354"},
+		vs.VirtualServer.Backend.PoolMemberAddrs)
+}
@@ -0,0 +1,228 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "f5/vlogger"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// How long schemas that are not local files are used before they are
+// loaded again
+const remoteSchemaTTL = 5 * time.Minute
+
+// Schema validation metrics
+type SchemaStats struct {
+	// Documents validated, and those that were not valid
+	Validations uint64
+	Failures    uint64
+	// Schema lookups served from the cache, and schemas compiled
+	CacheHits uint64
+	Compiles  uint64
+	// Time spent validating, including loading schemas
+	TotalTime time.Duration
+	MaxTime   time.Duration
+	LastTime  time.Duration
+}
+
+// Compiled schema and what it was compiled from
+type cachedSchema struct {
+	schema *gojsonschema.Schema
+	// Local schema file, empty for remote schemas
+	path    string
+	modTime time.Time
+	size    int64
+	loaded  time.Time
+}
+
+// Compiles each schema once and reuses it until its file changes. Cached
+// entries are not modified once stored, they are replaced.
+type schemaRegistry struct {
+	sync.Mutex
+	schemas map[string]*cachedSchema
+	stats   SchemaStats
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{
+		schemas: make(map[string]*cachedSchema),
+	}
+}
+
+// Get the schema validation metrics
+func (vsm *Manager) GetSchemaStats() SchemaStats {
+	vsm.schemas.Lock()
+	defer vsm.schemas.Unlock()
+	return vsm.schemas.stats
+}
+
+// Local path of a file schema, empty for other schemas
+func schemaPath(schemaName string) string {
+	u, err := url.Parse(schemaName)
+	if nil != err || "file" != u.Scheme {
+		return ""
+	}
+	return u.Path
+}
+
+// Check if a cached schema is out of date
+func (cached *cachedSchema) stale(now time.Time) bool {
+	if 0 == len(cached.path) {
+		return now.Sub(cached.loaded) > remoteSchemaTTL
+	}
+	info, err := os.Stat(cached.path)
+	if nil != err {
+		return true
+	}
+	return !info.ModTime().Equal(cached.modTime) || info.Size() != cached.size
+}
+
+// Load and compile a schema
+func loadSchema(schemaName string, now time.Time) (*cachedSchema, error) {
+	cached := &cachedSchema{
+		path:   schemaPath(schemaName),
+		loaded: now,
+	}
+	// Stat before loading, so a change while loading is seen next time
+	if 0 != len(cached.path) {
+		info, err := os.Stat(cached.path)
+		if nil != err {
+			return nil, err
+		}
+		cached.modTime = info.ModTime()
+		cached.size = info.Size()
+	}
+	schema, err := gojsonschema.NewSchema(
+		gojsonschema.NewReferenceLoader(schemaName))
+	if nil != err {
+		return nil, err
+	}
+	cached.schema = schema
+	return cached, nil
+}
+
+// Get the compiled schema for a name, loading it if it is not cached or out
+// of date. Schemas are loaded without the registry lock held, so fetching a
+// remote schema does not hold up validation against other schemas.
+func (reg *schemaRegistry) get(schemaName string) (
+	*gojsonschema.Schema, error) {
+
+	now := time.Now()
+	reg.Lock()
+	cached, ok := reg.schemas[schemaName]
+	reg.Unlock()
+	if ok {
+		if !cached.stale(now) {
+			reg.Lock()
+			reg.stats.CacheHits++
+			reg.Unlock()
+			return cached.schema, nil
+		}
+		log.Debugf("Schema %s changed, loading it again", schemaName)
+	}
+
+	loaded, err := loadSchema(schemaName, now)
+
+	reg.Lock()
+	defer reg.Unlock()
+	if nil == err {
+		reg.stats.Compiles++
+		reg.schemas[schemaName] = loaded
+		return loaded.schema, nil
+	}
+	if ok && 0 == len(cached.path) {
+		// Keep using a remote schema that could not be loaded again, it is
+		// tried again once the TTL passes
+		log.Warningf("Schema %s could not be loaded again, using the one "+
+			"loaded at %v: %v", schemaName, cached.loaded, err)
+		kept := *cached
+		kept.loaded = now
+		reg.schemas[schemaName] = &kept
+		return kept.schema, nil
+	}
+	// Local schemas that are gone or broken are not used
+	if current, found := reg.schemas[schemaName]; found && current == cached {
+		delete(reg.schemas, schemaName)
+	}
+	return nil, err
+}
+
+// Record the time and outcome of a validation
+func (reg *schemaRegistry) record(elapsed time.Duration, valid bool) {
+	reg.Lock()
+	defer reg.Unlock()
+	reg.stats.Validations++
+	if !valid {
+		reg.stats.Failures++
+	}
+	reg.stats.TotalTime += elapsed
+	reg.stats.LastTime = elapsed
+	if elapsed > reg.stats.MaxTime {
+		reg.stats.MaxTime = elapsed
+	}
+}
+
+// Validate data against a schema
+func (reg *schemaRegistry) validate(schemaName string, data string) error {
+	start := time.Now()
+	err := reg.validateData(schemaName, data)
+	reg.record(time.Since(start), nil == err)
+	return err
+}
+
+// Validate data against the cached schema
+func (reg *schemaRegistry) validateData(schemaName string, data string) error {
+	schema, err := reg.get(schemaName)
+	if err != nil {
+		return err
+	}
+	// Load the data and validate
+	dataLoader := gojsonschema.NewStringLoader(data)
+	result, err := schema.Validate(dataLoader)
+	if err != nil {
+		return err
+	}
+
+	if !result.Valid() {
+		var errors []string
+		for _, desc := range result.Errors() {
+			errors = append(errors, desc.String())
+		}
+		return fmt.Errorf("config is not valid, errors: %q", errors)
+	}
+	return nil
+}
+
+// Resolve the name of a schema, "f5schemadb" names are local schemas
+func resolveSchemaName(schemaName string) string {
+	// FIXME For now, "f5schemadb" means the schema is local
+	// Trim whitespace and embedded quotes
+	schemaName = strings.TrimSpace(schemaName)
+	schemaName = strings.Trim(schemaName, "\"")
+	if strings.HasPrefix(schemaName, schemaIndicator) {
+		schemaName = strings.Replace(schemaName, schemaIndicator, schemaLocal, 1)
+	}
+	return schemaName
+}
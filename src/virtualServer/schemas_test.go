@@ -0,0 +1,100 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var portSchema string = `{
+  "type": "object",
+  "properties": {"port": {"type": "integer"}}
+}`
+
+var strictPortSchema string = `{
+  "type": "object",
+  "properties": {"port": {"type": "integer", "maximum": 1024}}
+}`
+
+func TestSchemaRegistry(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "schemas")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "port.json")
+	require.Nil(ioutil.WriteFile(path, []byte(portSchema), 0644))
+	schemaName := "file://" + path
+
+	reg := newSchemaRegistry()
+	assert.Nil(t, reg.validate(schemaName, `{"port": 8080}`))
+	assert.NotNil(t, reg.validate(schemaName, `{"port": "http"}`))
+	assert.EqualValues(t, 1, reg.stats.Compiles, "Schemas are compiled once")
+	assert.EqualValues(t, 1, reg.stats.CacheHits)
+	assert.EqualValues(t, 2, reg.stats.Validations)
+	assert.EqualValues(t, 1, reg.stats.Failures)
+	assert.True(t, reg.stats.MaxTime >= reg.stats.LastTime)
+	assert.True(t, reg.stats.TotalTime >= reg.stats.MaxTime)
+
+	// Changing the schema file compiles it again
+	require.Nil(ioutil.WriteFile(path, []byte(strictPortSchema), 0644))
+	later := time.Now().Add(time.Minute)
+	require.Nil(os.Chtimes(path, later, later))
+	assert.NotNil(t, reg.validate(schemaName, `{"port": 8080}`))
+	assert.Nil(t, reg.validate(schemaName, `{"port": 80}`))
+	assert.EqualValues(t, 2, reg.stats.Compiles)
+
+	// Missing schemas are errors, and are not cached
+	require.Nil(os.Remove(path))
+	assert.NotNil(t, reg.validate(schemaName, `{"port": 80}`))
+	assert.Equal(t, 0, len(reg.schemas))
+
+	// Remote schemas that cannot be loaded again keep being used
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, portSchema)
+		}))
+	remoteName := srv.URL + "/port.json"
+	assert.Nil(t, reg.validate(remoteName, `{"port": 80}`))
+	assert.EqualValues(t, 3, reg.stats.Compiles)
+	srv.Close()
+	expired := *reg.schemas[remoteName]
+	expired.loaded = time.Now().Add(-2 * remoteSchemaTTL)
+	reg.schemas[remoteName] = &expired
+	assert.Nil(t, reg.validate(remoteName, `{"port": 80}`))
+	assert.NotNil(t, reg.validate(remoteName, `{"port": "http"}`))
+	assert.EqualValues(t, 3, reg.stats.Compiles)
+	assert.True(t, time.Since(reg.schemas[remoteName].loaded) < remoteSchemaTTL,
+		"Failed reloads are tried again after the TTL")
+}
+
+func TestSchemaPath(t *testing.T) {
+	assert.Equal(t, "/app/vendor/src/f5/schemas/bigip-virtual-server_v0.1.2.json",
+		schemaPath(resolveSchemaName(
+			" \"f5schemadb://bigip-virtual-server_v0.1.2.json\"")))
+	assert.Empty(t, schemaPath("https://example.com/schema.json"))
+}
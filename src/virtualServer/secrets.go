@@ -0,0 +1,259 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"eventStream"
+	log "f5/vlogger"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/runtime"
+)
+
+// Certificate and key of a kubernetes.io/tls Secret, written to the
+// certificates section for the driver to create a client SSL profile from
+type SslCertificate struct {
+	// <namespace>_<secret>, what SslProfile.Certificate refers to
+	Name string `json:"name"`
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// Key of a Secret in the certificate cache
+func secretKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// Check a config's SSL profile names either a Big-IP profile or a Secret
+func validateSslProfile(cfg *VirtualServerConfig) error {
+	profile := cfg.VirtualServer.Frontend.SslProfile
+	if nil == profile {
+		return nil
+	}
+	if 0 != len(profile.F5ProfileName) && 0 != len(profile.SecretName) {
+		return fmt.Errorf("sslProfile cannot have both f5ProfileName and secretName")
+	}
+	return nil
+}
+
+// Get the certificate and key of a kubernetes.io/tls Secret
+func secretCertificate(secret *v1.Secret) (*SslCertificate, error) {
+	if v1.SecretTypeTLS != secret.Type {
+		return nil, fmt.Errorf("secret %s is type %s, it must be type %s",
+			secret.ObjectMeta.Name, secret.Type, v1.SecretTypeTLS)
+	}
+	cert := secret.Data[v1.TLSCertKey]
+	key := secret.Data[v1.TLSPrivateKeyKey]
+	if 0 == len(cert) || 0 == len(key) {
+		return nil, fmt.Errorf("secret %s must have both %s and %s",
+			secret.ObjectMeta.Name, v1.TLSCertKey, v1.TLSPrivateKeyKey)
+	}
+	return &SslCertificate{
+		Name: fmt.Sprintf("%v_%v", secret.ObjectMeta.Namespace,
+			secret.ObjectMeta.Name),
+		Cert: string(cert),
+		Key:  string(key),
+	}, nil
+}
+
+// Read Secrets from the store of a Secret event stream. Call once for each
+// watched namespace.
+func (vsm *Manager) AddSecretStore(store *eventStream.EventStore) {
+	vsm.secretStoresMutex.Lock()
+	defer vsm.secretStoresMutex.Unlock()
+	vsm.secretStores = append(vsm.secretStores, store)
+}
+
+// Get a Secret from the Secret event stream stores
+func (vsm *Manager) getSecret(namespace, name string) (*v1.Secret, bool) {
+	vsm.secretStoresMutex.Lock()
+	defer vsm.secretStoresMutex.Unlock()
+	for _, store := range vsm.secretStores {
+		obj, ok, _ := store.GetByKey(secretKey(namespace, name))
+		if ok {
+			return obj.(*v1.Secret), true
+		}
+	}
+	return nil, false
+}
+
+// Look up the Secret a config's SSL profile names and cache its certificate,
+// so the config can be written without waiting for the Secret's next event.
+// Problems with the Secret are recorded as events on owner.
+func (vsm *Manager) checkSslSecret(
+	cfg *VirtualServerConfig,
+	namespace string,
+	owner runtime.Object) error {
+
+	profile := cfg.VirtualServer.Frontend.SslProfile
+	if nil == profile || 0 == len(profile.SecretName) {
+		return nil
+	}
+
+	secret, ok := vsm.getSecret(namespace, profile.SecretName)
+	if !ok {
+		vsm.recordWarning(owner, reasonSecretNotFound,
+			"Secret %v not found", profile.SecretName)
+		return fmt.Errorf("secret %v not found", profile.SecretName)
+	}
+	cert, err := secretCertificate(secret)
+	if nil != err {
+		vsm.recordWarning(owner, reasonInvalidSecret, "%v", err)
+		return err
+	}
+
+	vsm.vservers.Lock()
+	defer vsm.vservers.Unlock()
+	vsm.secrets[secretKey(namespace, profile.SecretName)] = cert
+	return nil
+}
+
+// Process Secret objects from the eventStream
+func (vsm *Manager) ProcessSecretUpdate(
+	changeType eventStream.ChangeType,
+	obj interface{}) {
+
+	vsm.vservers.Lock()
+	defer vsm.vservers.Unlock()
+
+	updated := false
+	if changeType == eventStream.Replaced {
+		v := obj.([]interface{})
+		log.Debugf("ProcessSecretUpdate (%v) for %v Secrets", changeType, len(v))
+		for _, item := range v {
+			updated = vsm.processSecret(changeType, item) || updated
+		}
+	} else {
+		log.Debugf("ProcessSecretUpdate (%v) for 1 Secret", changeType)
+		updated = vsm.processSecret(changeType, obj) || updated
+	}
+
+	if updated {
+		// Output the Big-IP config
+		vsm.outputConfigLocked()
+	}
+}
+
+// Process a change in Secret state, only kubernetes.io/tls Secrets are kept.
+// Returns true if a virtual server uses the Secret's certificate.
+// This function MUST be called with the vservers lock held.
+func (vsm *Manager) processSecret(
+	changeType eventStream.ChangeType,
+	obj interface{}) bool {
+
+	var secret *v1.Secret
+	o, ok := obj.(eventStream.ChangedObject)
+	if !ok {
+		secret = obj.(*v1.Secret)
+	} else {
+		switch changeType {
+		case eventStream.Added, eventStream.Updated:
+			secret = o.New.(*v1.Secret)
+		case eventStream.Deleted:
+			secret = o.Old.(*v1.Secret)
+		}
+	}
+
+	namespace := secret.ObjectMeta.Namespace
+	if !vsm.watchingNamespace(namespace) {
+		return false
+	}
+
+	key := secretKey(namespace, secret.ObjectMeta.Name)
+	var cert *SslCertificate
+	if eventStream.Deleted != changeType && v1.SecretTypeTLS == secret.Type {
+		var err error
+		cert, err = secretCertificate(secret)
+		if nil != err {
+			log.Warningf("Could not get certificate from Secret: %v", err)
+		}
+	}
+	if reflect.DeepEqual(cert, vsm.secrets[key]) {
+		return false
+	}
+	if nil == cert {
+		delete(vsm.secrets, key)
+	} else {
+		vsm.secrets[key] = cert
+	}
+
+	for name, vs := range vsm.vservers.m {
+		profile := vs.VirtualServer.Frontend.SslProfile
+		if nil != profile && key == secretKey(
+			vsm.vservers.backends[name].Namespace, profile.SecretName) {
+			log.Debugf("Secret %v changed for virtual server %v", key, name)
+			return true
+		}
+	}
+	return false
+}
+
+// Get the config to write for a virtual server: the config itself, or a copy
+// whose SSL profile points at the certificate of its Secret, along with that
+// certificate. Returns false if the Secret has no certificate yet; the
+// virtual server is then not written.
+// This function MUST be called with the vservers lock held.
+func (vsm *Manager) attachCertificate(
+	vs *VirtualServerConfig,
+	namespace string) (*VirtualServerConfig, *SslCertificate, bool) {
+
+	profile := vs.VirtualServer.Frontend.SslProfile
+	if nil == profile || 0 == len(profile.SecretName) {
+		return vs, nil, true
+	}
+	cert, ok := vsm.secrets[secretKey(namespace, profile.SecretName)]
+	if !ok {
+		log.Warningf("No certificate for Secret %v in namespace %v, not "+
+			"writing virtual server %v", profile.SecretName, namespace,
+			vs.VirtualServer.Frontend.VirtualServerName)
+		return nil, nil, false
+	}
+	out := *vs
+	outProfile := *profile
+	outProfile.Certificate = cert.Name
+	out.VirtualServer.Frontend.SslProfile = &outProfile
+	return &out, cert, true
+}
+
+// Sorted list of the certificates the virtual servers use
+func sortedCertificates(used map[string]*SslCertificate) []*SslCertificate {
+	// Initialize as empty so the section is written as '[]'
+	certs := []*SslCertificate{}
+	for _, cert := range used {
+		certs = append(certs, cert)
+	}
+	sort.Sort(sslCertificates(certs))
+	return certs
+}
+
+type sslCertificates []*SslCertificate
+
+func (slice sslCertificates) Len() int {
+	return len(slice)
+}
+
+func (slice sslCertificates) Less(i, j int) bool {
+	return slice[i].Name < slice[j].Name
+}
+
+func (slice sslCertificates) Swap(i, j int) {
+	slice[i], slice[j] = slice[j], slice[i]
+}
@@ -0,0 +1,179 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/unversioned"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/tools/record"
+)
+
+var configmapFooSecret string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 443
+      },
+      "sslProfile": {
+        "secretName": "foo-tls"
+      }
+    }
+  }
+}`)
+
+func newTLSSecret(id, rv, namespace, cert, key string) *v1.Secret {
+	return &v1.Secret{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: "v1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:            id,
+			ResourceVersion: rv,
+			Namespace:       namespace,
+		},
+		Type: v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       []byte(cert),
+			v1.TLSPrivateKeyKey: []byte(key),
+		},
+	}
+}
+
+func TestSecretCertificate(t *testing.T) {
+	cert, err := secretCertificate(
+		newTLSSecret("foo-tls", "1", namespace, "CERT", "KEY"))
+	require.Nil(t, err)
+	assert.Equal(t, &SslCertificate{Name: "default_foo-tls", Cert: "CERT",
+		Key: "KEY"}, cert)
+
+	opaque := newTLSSecret("foo-tls", "1", namespace, "CERT", "KEY")
+	opaque.Type = v1.SecretTypeOpaque
+	_, err = secretCertificate(opaque)
+	assert.NotNil(t, err, "Only TLS Secrets have certificates")
+
+	_, err = secretCertificate(
+		newTLSSecret("foo-tls", "1", namespace, "CERT", ""))
+	assert.NotNil(t, err, "Secret needs a key")
+}
+
+func TestValidateSslProfile(t *testing.T) {
+	var cfg VirtualServerConfig
+	assert.Nil(t, validateSslProfile(&cfg))
+	cfg.VirtualServer.Frontend.SslProfile = &SslProfile{SecretName: "foo-tls"}
+	assert.Nil(t, validateSslProfile(&cfg))
+	cfg.VirtualServer.Frontend.SslProfile.F5ProfileName = "velcro/testcert"
+	assert.NotNil(t, validateSslProfile(&cfg))
+}
+
+func TestProcessSecretUpdate(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	secret := newTLSSecret("foo-tls", "1", namespace, "CERT", "KEY")
+	fake := fake.NewSimpleClientset(
+		&v1.ServiceList{Items: []v1.Service{*foo}})
+	recorder := record.NewFakeRecorder(100)
+	vsm := NewManager(&Params{
+		KubeClient:    fake,
+		ConfigWriter:  mw,
+		Namespaces:    []string{namespace},
+		IsNodePort:    true,
+		EventRecorder: recorder,
+	})
+	secretStore := newStore(nil)
+	secretStore.Add(secret)
+	vsm.AddSecretStore(secretStore)
+	services := func() VirtualServerConfigs {
+		return mw.Sections["services"].(VirtualServerConfigs)
+	}
+
+	// The Secret is read from the event stream store with the ConfigMap
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFooSecret})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, newStore(nil))
+	require.Equal([]*SslCertificate{
+		{Name: "default_foo-tls", Cert: "CERT", Key: "KEY"},
+	}, mw.Sections["certificates"])
+	require.Equal(1, len(services()))
+	require.Equal(&SslProfile{SecretName: "foo-tls",
+		Certificate: "default_foo-tls"}, services()[0].VirtualServer.Frontend.SslProfile)
+	vs := getVirtualServer(t, vsm, serviceKey{"foo", 80, namespace, v1.ProtocolTCP})
+	require.Empty(vs.VirtualServer.Frontend.SslProfile.Certificate,
+		"The stored config should be left alone")
+
+	// Renewing the certificate rewrites it
+	renewed := newTLSSecret("foo-tls", "2", namespace, "CERT2", "KEY2")
+	vsm.ProcessSecretUpdate(eventStream.Updated,
+		eventStream.ChangedObject{secret, renewed})
+	require.Equal([]*SslCertificate{
+		{Name: "default_foo-tls", Cert: "CERT2", Key: "KEY2"},
+	}, mw.Sections["certificates"])
+
+	// Resyncs and unrelated Secrets do not
+	written := mw.WrittenTimes
+	vsm.ProcessSecretUpdate(eventStream.Updated,
+		eventStream.ChangedObject{renewed, renewed})
+	vsm.ProcessSecretUpdate(eventStream.Added, eventStream.ChangedObject{nil,
+		newTLSSecret("bar-tls", "1", namespace, "CERT", "KEY")})
+	require.Equal(written, mw.WrittenTimes)
+
+	// Without the Secret the virtual server is not written
+	vsm.ProcessSecretUpdate(eventStream.Deleted,
+		eventStream.ChangedObject{renewed, nil})
+	require.Equal([]*SslCertificate{}, mw.Sections["certificates"])
+	require.Equal(0, len(services()))
+
+	vsm.ProcessSecretUpdate(eventStream.Replaced, []interface{}{renewed})
+	require.Equal(1, len(mw.Sections["certificates"].([]*SslCertificate)))
+	require.Equal(1, len(services()))
+	require.Equal("default_foo-tls",
+		services()[0].VirtualServer.Frontend.SslProfile.Certificate)
+	require.Empty(recordedReasons(recorder))
+
+	// A missing Secret is recorded against the ConfigMap
+	secretStore.Delete(secret)
+	cm2 := newConfigMap("foomap", "2", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFooSecret})
+	vsm.ProcessConfigMapUpdate(eventStream.Updated,
+		eventStream.ChangedObject{cm, cm2}, newStore(nil))
+	require.Equal([]string{reasonSecretNotFound}, recordedReasons(recorder))
+}
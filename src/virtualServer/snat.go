@@ -0,0 +1,68 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"fmt"
+	"net"
+)
+
+// Source address translation types supported on the Big-IP
+const (
+	snatAutomap = "automap"
+	snatPool    = "snat"
+	snatNone    = "none"
+)
+
+// Source address translation of a Virtual Server
+type Snat struct {
+	Type string `json:"type"`
+	// Existing Big-IP SNAT pool, snat type only. Uses format
+	// 'partition_name/pool_name'.
+	Pool string `json:"pool,omitempty"`
+}
+
+// Check the source address translation and restrictions of a config
+func validateSourceAddresses(cfg *VirtualServerConfig) error {
+	frontend := &cfg.VirtualServer.Frontend
+	if 0 != len(frontend.IApp) && (nil != frontend.Snat ||
+		0 != len(frontend.SourceAddresses)) {
+		return fmt.Errorf("iApps cannot have snat or sourceAddresses")
+	}
+
+	if snat := frontend.Snat; nil != snat {
+		switch snat.Type {
+		case snatAutomap, snatNone:
+			if 0 != len(snat.Pool) {
+				return fmt.Errorf("snat pool requires type %s", snatPool)
+			}
+		case snatPool:
+			if 0 == len(snat.Pool) {
+				return fmt.Errorf("snat type %s requires pool", snatPool)
+			}
+		default:
+			return fmt.Errorf("snat has unknown type %q", snat.Type)
+		}
+	}
+
+	for _, cidr := range frontend.SourceAddresses {
+		if _, _, err := net.ParseCIDR(cidr); nil != err {
+			return fmt.Errorf("sourceAddresses entry %q is not a CIDR", cidr)
+		}
+	}
+	return nil
+}
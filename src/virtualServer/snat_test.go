@@ -0,0 +1,111 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+var configmapFooSnat string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "port": 80
+      },
+      "snat": {
+        "type": "snat",
+        "pool": "Common/corp-snat"
+      },
+      "sourceAddresses": [ "10.0.0.0/8", "172.16.0.0/12" ]
+    }
+  }
+}`)
+
+func TestValidateSourceAddresses(t *testing.T) {
+	var cfg VirtualServerConfig
+	assert.Nil(t, validateSourceAddresses(&cfg))
+
+	frontend := &cfg.VirtualServer.Frontend
+	frontend.Snat = &Snat{Type: "automap"}
+	frontend.SourceAddresses = []string{"10.0.0.0/8", "2001:db8::/32"}
+	assert.Nil(t, validateSourceAddresses(&cfg))
+
+	frontend.Snat.Pool = "Common/corp-snat"
+	assert.NotNil(t, validateSourceAddresses(&cfg), "Only snat type has a pool")
+	frontend.Snat.Type = "snat"
+	assert.Nil(t, validateSourceAddresses(&cfg))
+	frontend.Snat.Pool = ""
+	assert.NotNil(t, validateSourceAddresses(&cfg), "snat type needs a pool")
+	frontend.Snat.Type = "masquerade"
+	assert.NotNil(t, validateSourceAddresses(&cfg))
+	frontend.Snat.Type = "none"
+	assert.Nil(t, validateSourceAddresses(&cfg))
+
+	frontend.SourceAddresses = []string{"10.0.0.1"}
+	assert.NotNil(t, validateSourceAddresses(&cfg), "Addresses must be CIDRs")
+
+	frontend.SourceAddresses = nil
+	frontend.IApp = "/Common/f5.http"
+	assert.NotNil(t, validateSourceAddresses(&cfg))
+}
+
+func TestSourceAddressesOutput(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFooSnat})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, newStore(nil))
+
+	services := mw.Sections["services"].(VirtualServerConfigs)
+	require.Equal(1, len(services))
+	frontend := services[0].VirtualServer.Frontend
+	require.Equal(&Snat{Type: "snat", Pool: "Common/corp-snat"}, frontend.Snat)
+	require.Equal([]string{"10.0.0.0/8", "172.16.0.0/12"},
+		frontend.SourceAddresses)
+}
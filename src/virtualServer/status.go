@@ -0,0 +1,145 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	log "f5/vlogger"
+
+	"k8s.io/client-go/1.4/pkg/api"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Annotation the controller writes its view of a ConfigMap into
+const statusAnnotation = "status.virtual-server.f5.com"
+
+// States reported in the status annotation
+const (
+	// The ConfigMap could not be parsed or validated
+	statusInvalid = "invalid"
+	// The ConfigMap is valid but its backend service does not exist yet
+	statusPending = "pending"
+	// The ConfigMap is valid but its config has not been written out
+	statusValid = "valid"
+	// The config was written out to the Big-IP driver
+	statusApplied = "applied"
+)
+
+// Status of a ConfigMap as seen by the controller
+type configMapStatus struct {
+	State             string   `json:"state"`
+	Errors            []string `json:"errors,omitempty"`
+	VirtualServerName string   `json:"virtualServerName,omitempty"`
+	BindAddr          string   `json:"bindAddr,omitempty"`
+	Members           int      `json:"members"`
+	LastUpdated       string   `json:"lastUpdated"`
+}
+
+// A status waiting to be written to its ConfigMap
+type pendingConfigMapStatus struct {
+	cm     *v1.ConfigMap
+	status configMapStatus
+}
+
+// Record the status of a ConfigMap, it is written on the next call to
+// writeConfigMapStatus
+func (vsm *Manager) setConfigMapStatus(cm *v1.ConfigMap, status configMapStatus) {
+	key := cm.ObjectMeta.Namespace + "/" + cm.ObjectMeta.Name
+	vsm.pendingStatusMutex.Lock()
+	defer vsm.pendingStatusMutex.Unlock()
+	vsm.pendingStatus[key] = pendingConfigMapStatus{cm, status}
+}
+
+// Drop any status waiting to be written for a deleted ConfigMap
+func (vsm *Manager) clearConfigMapStatus(cm *v1.ConfigMap) {
+	key := cm.ObjectMeta.Namespace + "/" + cm.ObjectMeta.Name
+	vsm.pendingStatusMutex.Lock()
+	defer vsm.pendingStatusMutex.Unlock()
+	delete(vsm.pendingStatus, key)
+}
+
+// Write the recorded statuses back onto their ConfigMaps, valid configs are
+// reported as applied if the config write was confirmed
+func (vsm *Manager) writeConfigMapStatus(applied bool) {
+	vsm.pendingStatusMutex.Lock()
+	pending := vsm.pendingStatus
+	vsm.pendingStatus = make(map[string]pendingConfigMapStatus)
+	vsm.pendingStatusMutex.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, p := range pending {
+		status := p.status
+		if applied && statusValid == status.State {
+			status.State = statusApplied
+		}
+		status.LastUpdated = now
+
+		patch, needed, err := configMapStatusPatch(p.cm, status)
+		if nil != err {
+			log.Warningf("Could not create status for ConfigMap %v/%v: %v",
+				p.cm.ObjectMeta.Namespace, p.cm.ObjectMeta.Name, err)
+			continue
+		}
+		if !needed {
+			continue
+		}
+		_, err = vsm.kubeClient.Core().ConfigMaps(p.cm.ObjectMeta.Namespace).Patch(
+			p.cm.ObjectMeta.Name, api.StrategicMergePatchType, patch)
+		if nil != err {
+			log.Warningf("Could not update status for ConfigMap %v/%v: %v",
+				p.cm.ObjectMeta.Namespace, p.cm.ObjectMeta.Name, err)
+		}
+	}
+}
+
+// Build the patch setting the status annotation on a ConfigMap. No patch is
+// needed if the ConfigMap already carries the same status, ignoring the
+// update time, which keeps our own updates from triggering new ones.
+func configMapStatusPatch(
+	cm *v1.ConfigMap,
+	status configMapStatus) ([]byte, bool, error) {
+
+	if current, ok := cm.ObjectMeta.Annotations[statusAnnotation]; ok {
+		var old configMapStatus
+		if err := json.Unmarshal([]byte(current), &old); nil == err {
+			old.LastUpdated = status.LastUpdated
+			if reflect.DeepEqual(old, status) {
+				return nil, false, nil
+			}
+		}
+	}
+
+	data, err := json.Marshal(status)
+	if nil != err {
+		return nil, false, fmt.Errorf("failed to encode status: %v", err)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				statusAnnotation: string(data),
+			},
+		},
+	})
+	if nil != err {
+		return nil, false, fmt.Errorf("failed to encode status patch: %v", err)
+	}
+	return patch, true, nil
+}
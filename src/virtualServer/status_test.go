@@ -0,0 +1,146 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"encoding/json"
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+func TestConfigMapStatusPatch(t *testing.T) {
+	require := require.New(t)
+
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	status := configMapStatus{
+		State:             statusApplied,
+		VirtualServerName: "default_foomap",
+		Members:           2,
+		LastUpdated:       "2017-01-01T00:00:00Z",
+	}
+
+	patch, needed, err := configMapStatusPatch(cm, status)
+	require.Nil(err)
+	require.True(needed, "ConfigMap without status should be patched")
+
+	var decoded struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	require.Nil(json.Unmarshal(patch, &decoded))
+	var written configMapStatus
+	require.Nil(json.Unmarshal(
+		[]byte(decoded.Metadata.Annotations[statusAnnotation]), &written))
+	require.Equal(status, written)
+
+	// Only the update time changed, nothing to patch
+	cm.ObjectMeta.Annotations = decoded.Metadata.Annotations
+	status.LastUpdated = "2017-01-01T00:01:00Z"
+	_, needed, err = configMapStatusPatch(cm, status)
+	require.Nil(err)
+	require.False(needed, "Unchanged status should not be patched")
+
+	status.Members = 3
+	_, needed, err = configMapStatusPatch(cm, status)
+	require.Nil(err)
+	require.True(needed, "Changed status should be patched")
+
+	// A status we cannot read is replaced
+	cm.ObjectMeta.Annotations[statusAnnotation] = "garbage"
+	_, needed, err = configMapStatusPatch(cm, status)
+	require.Nil(err)
+	require.True(needed)
+}
+
+func TestConfigMapStatusRecorded(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+	endptStore := newStore(nil)
+
+	setUseNodeInternal(vsm, true)
+	vsm.ProcessNodeUpdate([]v1.Node{
+		*newNode("node0", "0", false, []v1.NodeAddress{
+			{Type: "InternalIP", Address: "127.0.0.1"}}),
+		*newNode("node1", "0", false, []v1.NodeAddress{
+			{Type: "InternalIP", Address: "127.0.0.2"}}),
+	}, nil)
+
+	cfgFoo := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	cfgBar := newConfigMap("barmap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapBar})
+	cfgBad := newConfigMap("badmap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   "{"})
+
+	for _, cm := range []*v1.ConfigMap{cfgFoo, cfgBar, cfgBad} {
+		vsm.processConfigMap(eventStream.Added,
+			eventStream.ChangedObject{nil, cm}, endptStore)
+	}
+	require.Equal(3, len(vsm.pendingStatus))
+
+	status := vsm.pendingStatus["default/foomap"].status
+	require.Equal(statusValid, status.State)
+	require.Equal("default_foomap", status.VirtualServerName)
+	require.Equal(2, status.Members)
+	require.Nil(status.Errors)
+
+	status = vsm.pendingStatus["default/barmap"].status
+	require.Equal(statusPending, status.State,
+		"ConfigMap without a service should be pending")
+	require.Equal(0, status.Members)
+	require.Equal(1, len(status.Errors))
+
+	status = vsm.pendingStatus["default/badmap"].status
+	require.Equal(statusInvalid, status.State)
+	require.Equal(1, len(status.Errors))
+	require.Empty(status.VirtualServerName)
+
+	// Deleting a ConfigMap drops its status
+	vsm.processConfigMap(eventStream.Deleted,
+		eventStream.ChangedObject{cfgBar, nil}, endptStore)
+	require.Equal(2, len(vsm.pendingStatus))
+	require.NotContains(vsm.pendingStatus, "default/barmap")
+
+	// Statuses are only written once
+	vsm.writeConfigMapStatus(true)
+	require.Equal(0, len(vsm.pendingStatus))
+}
@@ -0,0 +1,147 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"reflect"
+	"sort"
+
+	"eventStream"
+
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Service annotation for the external traffic policy, with OnlyLocal a node
+// only forwards NodePort traffic to the Service's pods running on it. Its
+// spec.externalTrafficPolicy replacement does the same with Local.
+const (
+	serviceExternalTrafficAnnotation = "service.beta.kubernetes.io/external-traffic"
+	externalTrafficOnlyLocal         = "OnlyLocal"
+	externalTrafficLocal             = "Local"
+)
+
+// Check if a Service only sends NodePort traffic to pods on the same node.
+// The client predates spec.externalTrafficPolicy, the field is read from the
+// annotation eventStream.DecodeService records it in.
+func hasLocalTraffic(svc *v1.Service) bool {
+	annotations := svc.ObjectMeta.Annotations
+	return externalTrafficLocal ==
+		annotations[eventStream.ExternalTrafficPolicyAnnotation] ||
+		externalTrafficOnlyLocal == annotations[serviceExternalTrafficAnnotation]
+}
+
+// Get the annotations of a Service to write back to the API server, without
+// the one eventStream.DecodeService added
+func apiAnnotations(svc *v1.Service) map[string]string {
+	key := eventStream.ExternalTrafficPolicyAnnotation
+	if _, ok := svc.ObjectMeta.Annotations[key]; !ok {
+		return svc.ObjectMeta.Annotations
+	}
+	annotations := make(map[string]string)
+	for k, v := range svc.ObjectMeta.Annotations {
+		if key != k {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
+
+// Get the Endpoints of a Service from the store, nil if there are none
+func getServiceEndpoints(
+	endptStore *eventStream.EventStore,
+	svc *v1.Service) *v1.Endpoints {
+
+	if nil == endptStore {
+		return nil
+	}
+	item, _, _ := endptStore.GetByKey(
+		svc.ObjectMeta.Namespace + "/" + svc.ObjectMeta.Name)
+	if nil == item {
+		return nil
+	}
+	return item.(*v1.Endpoints)
+}
+
+// Get the sorted names of the Nodes running ready endpoints of a Service port
+func getEndpointNodesForService(
+	portName string,
+	protocol v1.Protocol,
+	eps *v1.Endpoints,
+) []string {
+	found := make(map[string]struct{})
+	for _, subset := range eps.Subsets {
+		for _, p := range subset.Ports {
+			if portName == p.Name && protocol == portProtocol(p.Protocol) {
+				for _, addr := range subset.Addresses {
+					if nil != addr.NodeName {
+						found[*addr.NodeName] = struct{}{}
+					}
+				}
+			}
+		}
+	}
+	var nodes []string
+	for node, _ := range found {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Record which Nodes can take the NodePort traffic of a config, when its
+// Service only sends it to local pods. eps may be nil if the Service has no
+// endpoints.
+// Returns true if the Nodes changed
+func setLocalNodes(
+	cfg *VirtualServerConfig,
+	svc *v1.Service,
+	portName string,
+	eps *v1.Endpoints) bool {
+
+	backend := &cfg.VirtualServer.Backend
+	onlyLocal := hasLocalTraffic(svc)
+	var nodes []string
+	if onlyLocal && nil != eps {
+		nodes = getEndpointNodesForService(portName, backendProtocol(cfg), eps)
+	}
+	changed := onlyLocal != backend.onlyLocal ||
+		!reflect.DeepEqual(nodes, backend.localNodes)
+	backend.onlyLocal = onlyLocal
+	backend.localNodes = nodes
+	return changed
+}
+
+// Keep the Node addresses that can take the NodePort traffic of a config
+func filterLocalNodes(
+	cfg *VirtualServerConfig,
+	nodes []string,
+	nodesByAddr map[string]nodeInfo) []string {
+
+	backend := &cfg.VirtualServer.Backend
+	if !backend.onlyLocal {
+		return nodes
+	}
+	local := []string{}
+	for _, addr := range nodes {
+		name := nodesByAddr[addr].name
+		i := sort.SearchStrings(backend.localNodes, name)
+		if i < len(backend.localNodes) && backend.localNodes[i] == name {
+			local = append(local, addr)
+		}
+	}
+	return local
+}
@@ -0,0 +1,158 @@
+/*-
+ * Copyright (c) 2017, F5 Networks, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package virtualServer
+
+import (
+	"testing"
+
+	"eventStream"
+	"test"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/1.4/kubernetes/fake"
+	"k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Endpoints of the foo Service with pods running on the given nodes
+func newLocalEndpoints(rv string, podNodes map[string]string) *v1.Endpoints {
+	var ips []string
+	for ip, _ := range podNodes {
+		ips = append(ips, ip)
+	}
+	eps := newEndpoints("foo", rv, namespace, ips, nil,
+		[]v1.EndpointPort{{Port: 8080}})
+	for i := range eps.Subsets[0].Addresses {
+		addr := &eps.Subsets[0].Addresses[i]
+		node := podNodes[addr.IP]
+		addr.NodeName = &node
+	}
+	return eps
+}
+
+func TestEndpointNodesForService(t *testing.T) {
+	eps := newLocalEndpoints("1", map[string]string{
+		"10.2.96.0": "node1",
+		"10.2.96.1": "node0",
+		"10.2.96.2": "node1",
+	})
+	assert.Equal(t, []string{"node0", "node1"},
+		getEndpointNodesForService("", v1.ProtocolTCP, eps))
+	assert.Nil(t, getEndpointNodesForService("http", v1.ProtocolTCP, eps))
+}
+
+func TestLocalTrafficPolicy(t *testing.T) {
+	require := require.New(t)
+
+	// spec.externalTrafficPolicy, without the annotation
+	foo, err := eventStream.DecodeService([]byte(`{
+	  "metadata": {"name": "foo", "namespace": "default"},
+	  "spec": {"type": "NodePort", "externalTrafficPolicy": "Local"}
+	}`))
+	require.Nil(err)
+	require.True(hasLocalTraffic(foo))
+	require.Empty(apiAnnotations(foo), "Recorded policy should not be written back")
+
+	foo, err = eventStream.DecodeService([]byte(`{
+	  "metadata": {"name": "foo", "namespace": "default",
+	    "annotations": {"team": "web"}},
+	  "spec": {"type": "NodePort", "externalTrafficPolicy": "Cluster"}
+	}`))
+	require.Nil(err)
+	require.False(hasLocalTraffic(foo))
+	require.Equal(map[string]string{"team": "web"}, apiAnnotations(foo))
+
+	foo.ObjectMeta.Annotations[serviceExternalTrafficAnnotation] =
+		externalTrafficOnlyLocal
+	require.True(hasLocalTraffic(foo))
+}
+
+func TestLocalTrafficNodePort(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	foo.ObjectMeta.Annotations = map[string]string{
+		serviceExternalTrafficAnnotation: externalTrafficOnlyLocal,
+	}
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+	setUseNodeInternal(vsm, false)
+	nodes := []v1.Node{
+		*newNode("node0", "1", false, []v1.NodeAddress{{"ExternalIP", "127.0.0.1"}}),
+		*newNode("node1", "1", false, []v1.NodeAddress{{"ExternalIP", "127.0.0.2"}}),
+		*newNode("node2", "1", false, []v1.NodeAddress{{"ExternalIP", "127.0.0.3"}}),
+	}
+	vsm.ProcessNodeUpdate(nodes, nil)
+
+	svcStore := newStore(nil)
+	svcStore.Add(foo)
+	eps := newLocalEndpoints("1", map[string]string{"10.2.96.0": "node1"})
+	endptStore := newStore(nil)
+	endptStore.Add(eps)
+
+	// Only nodes running the Service's pods are pool members
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, endptStore)
+	vs := getVirtualServer(t, vsm, serviceKey{"foo", 80, namespace, v1.ProtocolTCP})
+	require.EqualValues(30001, vs.VirtualServer.Backend.PoolMemberPort)
+	require.Equal([]string{"127.0.0.2"}, vs.VirtualServer.Backend.PoolMemberAddrs)
+
+	// Pool members follow the pods
+	eps2 := newLocalEndpoints("2", map[string]string{
+		"10.2.96.0": "node1",
+		"10.2.96.1": "node2",
+	})
+	vsm.ProcessEndpointsUpdate(eventStream.Updated,
+		eventStream.ChangedObject{eps, eps2}, svcStore)
+	require.Equal([]string{"127.0.0.2", "127.0.0.3"},
+		vs.VirtualServer.Backend.PoolMemberAddrs)
+	require.Equal([]string{"127.0.0.2", "127.0.0.3"},
+		mw.Sections["services"].(VirtualServerConfigs)[0].VirtualServer.Backend.PoolMemberAddrs)
+
+	// and the nodes
+	vsm.ProcessNodeUpdate(nodes[1:2], nil)
+	require.Equal([]string{"127.0.0.2"}, vs.VirtualServer.Backend.PoolMemberAddrs)
+	vsm.ProcessNodeUpdate(nodes, nil)
+	require.Equal([]string{"127.0.0.2", "127.0.0.3"},
+		vs.VirtualServer.Backend.PoolMemberAddrs)
+
+	// No pods, no pool members
+	vsm.ProcessEndpointsUpdate(eventStream.Deleted,
+		eventStream.ChangedObject{eps2, nil}, svcStore)
+	require.Equal([]string{}, vs.VirtualServer.Backend.PoolMemberAddrs)
+
+	// Without local traffic every node is a pool member again
+	foo2 := newService("foo", "2", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	vsm.ProcessServiceUpdate(eventStream.Updated,
+		eventStream.ChangedObject{foo, foo2}, newStore(nil))
+	require.Equal([]string{"127.0.0.1", "127.0.0.2", "127.0.0.3"},
+		vs.VirtualServer.Backend.PoolMemberAddrs)
+}
@@ -17,23 +17,25 @@
 package virtualServer
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"reflect"
 	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
 	"eventStream"
 	log "f5/vlogger"
+	"tools/nodeAddress"
 	"tools/writer"
 
-	"github.com/xeipuuv/gojsonschema"
 	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/tools/record"
 )
 
 // Definition of a Big-IP Virtual Server config
@@ -46,14 +48,34 @@ type VirtualServerConfig struct {
 		Backend struct {
 			ServiceName     string   `json:"serviceName"`
 			ServicePort     int32    `json:"servicePort"`
+			ServiceProtocol string   `json:"serviceProtocol,omitempty"`
 			PoolMemberPort  int32    `json:"poolMemberPort"`
 			PoolMemberAddrs []string `json:"poolMemberAddrs"`
-			HealthMonitors  []struct {
-				Interval int    `json:"interval,omitempty"`
-				Protocol string `json:"protocol"`
-				Send     string `json:"send,omitempty"`
-				Timeout  int    `json:"timeout,omitempty"`
-			} `json:"healthMonitors,omitempty"`
+			// Attributes of annotated members, keyed by PoolMemberAddrs entry
+			PoolMemberOptions map[string]PoolMemberOptions `json:"poolMemberOptions,omitempty"`
+			HealthMonitors    []HealthMonitor              `json:"healthMonitors,omitempty"`
+			// Priority group activation, traffic moves to a lower priority
+			// group when fewer members than this are up. 0 turns it off
+			MinActiveMembers int32 `json:"minActiveMembers,omitempty"`
+			// Seconds removed pool members drain before they are deleted
+			DrainPeriod int `json:"drainPeriod,omitempty"`
+			// Big-IP state of draining pool members
+			DrainState string `json:"drainState,omitempty"`
+			// Label selector of the Nodes used as NodePort pool members,
+			// overrides the selector of the controller
+			NodeSelector string `json:"nodeSelector,omitempty"`
+			// HealthMonitors were derived from pod readiness probes
+			probeMonitors bool
+			// Endpoints listed as not ready, in PoolMemberAddrs format
+			notReadyAddrs []string
+			// Name ServicePort was given as, the number is looked up
+			servicePortName string
+			// ServiceProtocol was set in the config, not from the Service
+			serviceProtocolGiven bool
+			// The Service only sends NodePort traffic to pods on the same
+			// node, the names of the nodes running its ready endpoints
+			onlyLocal  bool
+			localNodes []string
 		} `json:"backend"`
 		Frontend struct {
 			VirtualServerName string `json:"virtualServerName"`
@@ -61,15 +83,22 @@ type VirtualServerConfig struct {
 			Partition string `json:"partition"`
 
 			// VirtualServer parameters
-			Balance        string `json:"balance,omitempty"`
-			Mode           string `json:"mode,omitempty"`
-			VirtualAddress *struct {
-				BindAddr string `json:"bindAddr,omitempty"`
-				Port     int32  `json:"port,omitempty"`
-			} `json:"virtualAddress,omitempty"`
-			SslProfile *struct {
-				F5ProfileName string `json:"f5ProfileName,omitempty"`
-			} `json:"sslProfile,omitempty"`
+			Balance        string          `json:"balance,omitempty"`
+			Mode           string          `json:"mode,omitempty"`
+			VirtualAddress *VirtualAddress `json:"virtualAddress,omitempty"`
+			SslProfile     *SslProfile     `json:"sslProfile,omitempty"`
+			Profiles       []ProfileRef    `json:"profiles,omitempty"`
+			Persistence    *Persistence    `json:"persistence,omitempty"`
+			Snat           *Snat           `json:"snat,omitempty"`
+			// CIDRs of the clients accepted, any client if empty
+			SourceAddresses []string `json:"sourceAddresses,omitempty"`
+			// L7 routing rules, matched in order against each request
+			Rules []RuleConfig `json:"rules,omitempty"`
+			// Policy of the rules, set by the controller when it writes them
+			Policy *Policy `json:"policy,omitempty"`
+			// iRules attached in order, iRule ConfigMaps in the namespace of
+			// the virtual server or Big-IP iRules such as /Common/name
+			IRules []string `json:"iRules,omitempty"`
 
 			// iApp parameters
 			IApp                string `json:"iapp,omitempty"`
@@ -91,6 +120,38 @@ type VirtualServerConfig struct {
 	} `json:"virtualServer"`
 }
 
+// Address and port a Virtual Server listens on
+type VirtualAddress struct {
+	BindAddr string `json:"bindAddr,omitempty"`
+	Port     int32  `json:"port,omitempty"`
+	// IPv6 address of a dual-stack Virtual Server, whose bindAddr is IPv4
+	BindAddr6 string `json:"bindAddr6,omitempty"`
+}
+
+// Client SSL profile for a Virtual Server, either an existing Big-IP profile
+// or one created from a kubernetes.io/tls Secret
+type SslProfile struct {
+	F5ProfileName string `json:"f5ProfileName,omitempty"`
+	// Secret in the namespace of the virtual server
+	SecretName string `json:"secretName,omitempty"`
+	// Name of the Secret's entry in the certificates section, set by the
+	// controller once it has the Secret
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// Send requests matching Host and Path to a different service. Pool is the
+// virtualServerName of the (address-less) config that owns that service's
+// pool members.
+type RuleConfig struct {
+	Host        string `json:"host,omitempty"`
+	Path        string `json:"path,omitempty"`
+	ServiceName string `json:"serviceName"`
+	ServicePort int32  `json:"servicePort"`
+	Pool        string `json:"pool,omitempty"`
+	// Name of the Service port, ServicePort is 0 when it is set
+	servicePortName string
+}
+
 type VirtualServerConfigs []*VirtualServerConfig
 
 func (slice VirtualServerConfigs) Len() int {
@@ -116,85 +177,260 @@ var schemaIndicator string = "f5schemadb://"
 // Where the schemas reside locally
 var schemaLocal string = "file:///app/vendor/src/f5/schemas/"
 
-// Virtual Server Key - unique server is Name + Port
+// Virtual Server Key - unique server is Name + Port + Protocol
 type serviceKey struct {
 	ServiceName string
 	ServicePort int32
 	Namespace   string
+	Protocol    v1.Protocol
 }
 
-// Map of Virtual Server configs
-var virtualServers struct {
+// Map of Virtual Server configs, keyed by virtual server name, along with an
+// index of the Virtual Servers using each service port, and of those naming
+// their backend port, by namespace/Service name
+type virtualServers struct {
 	sync.Mutex
-	m map[serviceKey]*VirtualServerConfig
+	m          map[string]*VirtualServerConfig
+	svcIndex   map[serviceKey]map[string]*VirtualServerConfig
+	backends   map[string]serviceKey
+	namedPorts map[string]map[string]*VirtualServerConfig
 }
 
-// Nodes from previous iteration of node polling
-var oldNodes = []string{}
+// Add or replace a Virtual Server config and index it by its backend
+// This function MUST be called with the vservers lock held.
+func (vss *virtualServers) assign(namespace string, cfg *VirtualServerConfig) {
+	name := cfg.VirtualServer.Frontend.VirtualServerName
+	key := backendKey(cfg, namespace)
+
+	vss.remove(name)
+	vss.m[name] = cfg
+	vss.backends[name] = key
+	if _, ok := vss.svcIndex[key]; !ok {
+		vss.svcIndex[key] = make(map[string]*VirtualServerConfig)
+	}
+	vss.svcIndex[key][name] = cfg
+	if 0 != len(cfg.VirtualServer.Backend.servicePortName) {
+		svc := key.Namespace + "/" + key.ServiceName
+		if _, ok := vss.namedPorts[svc]; !ok {
+			vss.namedPorts[svc] = make(map[string]*VirtualServerConfig)
+		}
+		vss.namedPorts[svc][name] = cfg
+	}
+}
 
-// Mutex to control access to node data
-// FIXME: Simple synchronization for now, it remains to be determined if we'll
-// need something more complicated (channels, etc?)
-var mutex = &sync.Mutex{}
+// Remove a Virtual Server config and its index entry
+// This function MUST be called with the vservers lock held.
+func (vss *virtualServers) remove(name string) {
+	key, ok := vss.backends[name]
+	if !ok {
+		return
+	}
+	delete(vss.svcIndex[key], name)
+	if 0 == len(vss.svcIndex[key]) {
+		delete(vss.svcIndex, key)
+	}
+	svc := key.Namespace + "/" + key.ServiceName
+	delete(vss.namedPorts[svc], name)
+	if 0 == len(vss.namedPorts[svc]) {
+		delete(vss.namedPorts, svc)
+	}
+	delete(vss.backends, name)
+	delete(vss.m, name)
+}
 
-var config writer.Writer
-var namespace = ""
-var useNodeInternal = false
+// Manager translates Kubernetes resources into Virtual Server configs and
+// writes them out through its ConfigWriter. Each Manager keeps its own state,
+// so several can run independently in one process.
+type Manager struct {
+	vservers virtualServers
+	// Nodes from previous iteration of node polling
+	oldNodes []string
+	// Pool member attributes of annotated nodes, keyed by name and address
+	nodeMemberOptions map[string]PoolMemberOptions
+	// Names and labels of all schedulable nodes, keyed by address
+	nodesByAddr map[string]nodeInfo
+	// Mutex to control access to node data
+	// FIXME: Simple synchronization for now, it remains to be determined if we'll
+	// need something more complicated (channels, etc?)
+	oldNodesMutex sync.Mutex
+	// Kubernetes client
+	kubeClient kubernetes.Interface
+	// Where the Virtual Server configs are written
+	configWriter writer.Writer
+	// Namespaces being watched, an empty set means all namespaces are watched
+	namespaces map[string]struct{}
+	// Chooses the node IPs
+	addrPolicy *nodeAddress.Policy
+	// Running in nodeport (or cluster) mode
+	isNodePort bool
+	// Nodes used as NodePort pool members, nil selects all nodes
+	nodeSelector labels.Selector
+	// Allocates virtual addresses, may be nil
+	ipam *IPAM
+	// Partition for virtual servers of LoadBalancer Services
+	defaultPartition string
+	// Records Kubernetes Events for configuration problems, may be nil
+	eventRecorder record.EventRecorder
+	// Resource versions of the objects Warning Events were recorded for
+	warnings      map[warningKey]string
+	warningsMutex sync.Mutex
+	// ConfigMap statuses waiting to be written, keyed by namespace/name
+	pendingStatus      map[string]pendingConfigMapStatus
+	pendingStatusMutex sync.Mutex
+	// Default time removed pool members drain before they are deleted
+	drainPeriod time.Duration
+	// Pool members written for each virtual server, and removed members
+	// still draining, keyed by virtual server name then member address
+	lastMembers map[string]map[string]int32
+	draining    map[string]map[string]drainingMember
+	// Outputs the config when the next draining member may be deleted
+	drainTimer *time.Timer
+	// Certificates of kubernetes.io/tls Secrets, keyed by namespace/name
+	secrets map[string]*SslCertificate
+	// Stores of the Secret event streams, read for SSL profiles
+	secretStores      []*eventStream.EventStore
+	secretStoresMutex sync.Mutex
+	// The certificates section has been written with certificates in it
+	wroteCertificates bool
+	// Sources of iRule ConfigMaps, keyed by namespace/name
+	irules map[string]*IRule
+	// iRules in the last irules section written, keyed by name
+	writtenIRules map[string]*IRule
+	// Stores of the Pod event streams, read for readiness probes
+	podStores      []*eventStream.EventStore
+	podStoresMutex sync.Mutex
+	// Schemas ConfigMaps and annotations are validated against
+	schemas *schemaRegistry
+}
+
+// Struct to allow NewManager to receive all or only specific parameters.
+type Params struct {
+	KubeClient   kubernetes.Interface
+	ConfigWriter writer.Writer
+	// Namespaces to watch, if none are given all namespaces are watched
+	Namespaces      []string
+	UseNodeInternal bool
+	IsNodePort      bool
+	// Optional, one of the AddressFamily values, all node IPs are used
+	// without it
+	NodeAddressFamily string
+	// Optional, chooses the node IPs instead of UseNodeInternal and
+	// NodeAddressFamily
+	NodeAddressPolicy *nodeAddress.Policy
+	// Optional, all schedulable nodes are pool members without it
+	NodeSelector labels.Selector
+	// Optional, configuration problems are only logged without it
+	EventRecorder record.EventRecorder
+	// Optional, virtual servers must specify a bindAddr without it
+	IPAM *IPAM
+	// Partition for virtual servers of LoadBalancer Services
+	DefaultPartition string
+	// Optional, removed pool members are deleted right away without it
+	DrainPeriod time.Duration
+}
+
+// Create and return a new Manager
+func NewManager(params *Params) *Manager {
+	vsm := Manager{
+		vservers: virtualServers{
+			m:          make(map[string]*VirtualServerConfig),
+			svcIndex:   make(map[serviceKey]map[string]*VirtualServerConfig),
+			backends:   make(map[string]serviceKey),
+			namedPorts: make(map[string]map[string]*VirtualServerConfig),
+		},
+		oldNodes:         []string{},
+		nodesByAddr:      make(map[string]nodeInfo),
+		kubeClient:       params.KubeClient,
+		configWriter:     params.ConfigWriter,
+		namespaces:       make(map[string]struct{}),
+		addrPolicy:       params.NodeAddressPolicy,
+		isNodePort:       params.IsNodePort,
+		nodeSelector:     params.NodeSelector,
+		eventRecorder:    params.EventRecorder,
+		warnings:         make(map[warningKey]string),
+		ipam:             params.IPAM,
+		defaultPartition: params.DefaultPartition,
+		pendingStatus:    make(map[string]pendingConfigMapStatus),
+		drainPeriod:      params.DrainPeriod,
+		lastMembers:      make(map[string]map[string]int32),
+		draining:         make(map[string]map[string]drainingMember),
+		secrets:          make(map[string]*SslCertificate),
+		irules:           make(map[string]*IRule),
+		schemas:          newSchemaRegistry(),
+	}
+	for _, ns := range params.Namespaces {
+		vsm.namespaces[ns] = struct{}{}
+	}
+	if nil == vsm.addrPolicy {
+		vsm.addrPolicy = nodeAddress.NewInternalPolicy(params.UseNodeInternal,
+			params.NodeAddressFamily)
+	}
+	return &vsm
+}
 
-func SetConfigWriter(cw writer.Writer) {
-	config = cw
+// Check if a namespace is one of the namespaces being watched
+func (vsm *Manager) watchingNamespace(ns string) bool {
+	if 0 == len(vsm.namespaces) {
+		return true
+	}
+	_, ok := vsm.namespaces[ns]
+	return ok
 }
 
-func SetNamespace(ns string) {
-	namespace = ns
+// Validate Virtual Server config data against a schema, compiled schemas
+// are cached by the schema registry
+func (vsm *Manager) validateSchema(schemaName string, data string) error {
+	return vsm.schemas.validate(resolveSchemaName(schemaName), data)
 }
 
-func SetUseNodeInternal(ni bool) {
-	useNodeInternal = ni
+// Checks of a ConfigMap config beyond its schema, run in order
+var configMapValidators = []func(*VirtualServerConfig) error{
+	validateRules,
+	validateBackendMonitors,
+	validateDrain,
+	validateSslProfile,
+	validateIRules,
+	validateProfiles,
+	validateSourceAddresses,
+	validateProtocol,
+	validateNodeSelector,
+	validateVirtualAddress,
+	validateMinActiveMembers,
 }
 
-// Package init
-func init() {
-	virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
+// Run validators on a config in order, stopping at the first error
+func runValidators(
+	cfg *VirtualServerConfig,
+	validators []func(*VirtualServerConfig) error) error {
+
+	for _, validate := range validators {
+		if err := validate(cfg); nil != err {
+			return err
+		}
+	}
+	return nil
 }
 
 // Unmarshal an expected VirtualServerConfig object
-func parseVirtualServerConfig(cm *v1.ConfigMap) (*VirtualServerConfig, error) {
+func (vsm *Manager) parseVirtualServerConfig(
+	cm *v1.ConfigMap) (*VirtualServerConfig, error) {
+
 	var cfg VirtualServerConfig
 
 	if schemaName, ok := cm.Data["schema"]; ok {
 		if data, ok := cm.Data["data"]; ok {
-			// FIXME For now, "f5schemadb" means the schema is local
-			// Trim whitespace and embedded quotes
-			schemaName = strings.TrimSpace(schemaName)
-			schemaName = strings.Trim(schemaName, "\"")
-			if strings.HasPrefix(schemaName, schemaIndicator) {
-				schemaName = strings.Replace(schemaName, schemaIndicator, schemaLocal, 1)
-			}
-			// Load the schema
-			schemaLoader := gojsonschema.NewReferenceLoader(schemaName)
-			schema, err := gojsonschema.NewSchema(schemaLoader)
-			if err != nil {
+			err := vsm.validateSchema(schemaName, data)
+			if nil != err {
 				return nil, err
 			}
-			// Load the ConfigMap data and validate
-			dataLoader := gojsonschema.NewStringLoader(data)
-			result, err := schema.Validate(dataLoader)
-			if err != nil {
+
+			err = json.Unmarshal([]byte(data), &cfg)
+			if nil != err {
 				return nil, err
 			}
-
-			if result.Valid() {
-				err := json.Unmarshal([]byte(data), &cfg)
-				if nil != err {
-					return nil, err
-				}
-			} else {
-				var errors []string
-				for _, desc := range result.Errors() {
-					errors = append(errors, desc.String())
-				}
-				return nil, fmt.Errorf("configMap is not valid, errors: %q", errors)
+			err = runValidators(&cfg, configMapValidators)
+			if nil != err {
+				return nil, fmt.Errorf("configmap %s: %v", cm.ObjectMeta.Name, err)
 			}
 		} else {
 			return nil, fmt.Errorf("configmap %s does not contain data key",
@@ -209,11 +445,9 @@ func parseVirtualServerConfig(cm *v1.ConfigMap) (*VirtualServerConfig, error) {
 }
 
 // Process Service objects from the eventStream
-func ProcessServiceUpdate(
-	kubeClient kubernetes.Interface,
+func (vsm *Manager) ProcessServiceUpdate(
 	changeType eventStream.ChangeType,
 	obj interface{},
-	isNodePort bool,
 	endptStore *eventStream.EventStore) {
 
 	updated := false
@@ -222,25 +456,27 @@ func ProcessServiceUpdate(
 		v := obj.([]interface{})
 		log.Debugf("ProcessServiceUpdate (%v) for %v Services", changeType, len(v))
 		for _, item := range v {
-			updated = processService(kubeClient, changeType, item, isNodePort, endptStore) || updated
+			updated = vsm.processLoadBalancer(changeType, item, endptStore) || updated
+			updated = vsm.processAnnotatedService(changeType, item, endptStore) || updated
+			updated = vsm.processService(changeType, item, endptStore) || updated
 		}
 	} else {
 		log.Debugf("ProcessServiceUpdate (%v) for 1 Service", changeType)
-		updated = processService(kubeClient, changeType, obj, isNodePort, endptStore) || updated
+		updated = vsm.processLoadBalancer(changeType, obj, endptStore) || updated
+		updated = vsm.processAnnotatedService(changeType, obj, endptStore) || updated
+		updated = vsm.processService(changeType, obj, endptStore) || updated
 	}
 
 	if updated {
 		// Output the Big-IP config
-		outputConfig()
+		vsm.outputConfig()
 	}
 }
 
 // Process ConfigMap objects from the eventStream
-func ProcessConfigMapUpdate(
-	kubeClient kubernetes.Interface,
+func (vsm *Manager) ProcessConfigMapUpdate(
 	changeType eventStream.ChangeType,
 	obj interface{},
-	isNodePort bool,
 	endptStore *eventStream.EventStore) {
 
 	updated := false
@@ -249,21 +485,22 @@ func ProcessConfigMapUpdate(
 		v := obj.([]interface{})
 		for _, item := range v {
 			log.Debugf("ProcessConfigMapUpdate (%v) for %v ConfigMaps", changeType, len(v))
-			updated = processConfigMap(kubeClient, changeType, item, isNodePort, endptStore) || updated
+			updated = vsm.processConfigMap(changeType, item, endptStore) || updated
 		}
 	} else {
 		log.Debugf("ProcessConfigMapUpdate (%v) for 1 ConfigMap", changeType)
-		updated = processConfigMap(kubeClient, changeType, obj, isNodePort, endptStore) || updated
+		updated = vsm.processConfigMap(changeType, obj, endptStore) || updated
 	}
 
+	applied := false
 	if updated {
 		// Output the Big-IP config
-		outputConfig()
+		applied = vsm.outputConfig()
 	}
+	vsm.writeConfigMapStatus(applied)
 }
 
-func ProcessEndpointsUpdate(
-	kubeClient kubernetes.Interface,
+func (vsm *Manager) ProcessEndpointsUpdate(
 	changeType eventStream.ChangeType,
 	obj interface{},
 	serviceStore *eventStream.EventStore) {
@@ -274,21 +511,22 @@ func ProcessEndpointsUpdate(
 		v := obj.([]interface{})
 		log.Debugf("ProcessEndpointsUpdate (%v) for %v Pod", changeType, len(v))
 		for _, item := range v {
-			updated = processEndpoints(kubeClient, changeType, item, serviceStore) || updated
+			updated = vsm.processEndpoints(changeType, item, serviceStore) || updated
 		}
 	} else {
 		log.Debugf("ProcessEndpointsUpdate (%v) for 1 Pod", changeType)
-		updated = processEndpoints(kubeClient, changeType, obj, serviceStore) || updated
+		updated = vsm.processEndpoints(changeType, obj, serviceStore) || updated
 	}
 
 	if updated {
 		// Output the Big-IP config
-		outputConfig()
+		vsm.outputConfig()
 	}
 }
 
 func getEndpointsForService(
 	portName string,
+	protocol v1.Protocol,
 	eps *v1.Endpoints,
 ) []string {
 	// FIXME(yacobucci) #87
@@ -298,14 +536,11 @@ func getEndpointsForService(
 
 	for _, subset := range eps.Subsets {
 		for _, p := range subset.Ports {
-			if portName == p.Name {
+			if portName == p.Name && protocol == portProtocol(p.Protocol) {
 				port := strconv.Itoa(int(p.Port))
 				for _, addr := range subset.Addresses {
-					var b bytes.Buffer
-					b.WriteString(addr.IP)
-					b.WriteRune(':')
-					b.WriteString(port)
-					ipPorts = append(ipPorts, b.String())
+					// IPv6 addresses are bracketed, [2001:db8::1]:8080
+					ipPorts = append(ipPorts, net.JoinHostPort(addr.IP, port))
 				}
 			}
 		}
@@ -316,16 +551,38 @@ func getEndpointsForService(
 	return ipPorts
 }
 
+// Get the endpoints of a Service port that are not ready, such as pods that
+// are shutting down, in the same format as getEndpointsForService
+func getNotReadyEndpointsForService(
+	portName string,
+	protocol v1.Protocol,
+	eps *v1.Endpoints,
+) []string {
+	var ipPorts []string
+	for _, subset := range eps.Subsets {
+		for _, p := range subset.Ports {
+			if portName == p.Name && protocol == portProtocol(p.Protocol) {
+				port := strconv.Itoa(int(p.Port))
+				for _, addr := range subset.NotReadyAddresses {
+					ipPorts = append(ipPorts, net.JoinHostPort(addr.IP, port))
+				}
+			}
+		}
+	}
+	sort.Strings(ipPorts)
+	return ipPorts
+}
+
 // Process a change in Service state
-func processService(
-	kubeClient kubernetes.Interface,
+func (vsm *Manager) processService(
 	changeType eventStream.ChangeType,
 	obj interface{},
-	isNodePort bool,
 	endptStore *eventStream.EventStore) bool {
 
 	var svc *v1.Service
-	rmvdPortsMap := make(map[int32]*struct{})
+	rmvdPortsMap := make(map[serviceKey]*struct{})
+	// Resyncs update unchanged Services, only look up pods when it matters
+	probesChanged := true
 	o, ok := obj.(eventStream.ChangedObject)
 	if !ok {
 		svc = obj.(*v1.Service)
@@ -338,66 +595,100 @@ func processService(
 			oldSvc := o.Old.(*v1.Service)
 
 			for _, o := range oldSvc.Spec.Ports {
-				rmvdPortsMap[o.Port] = nil
+				rmvdPortsMap[serviceKey{oldSvc.ObjectMeta.Name, o.Port,
+					oldSvc.ObjectMeta.Namespace, portProtocol(o.Protocol)}] = nil
 			}
+			probesChanged = !reflect.DeepEqual(oldSvc.Spec, svc.Spec)
 		case eventStream.Deleted:
 			svc = o.Old.(*v1.Service)
+			vsm.forgetWarnings(svc)
 		}
 	}
 
 	serviceName := svc.ObjectMeta.Name
+	namespace := svc.ObjectMeta.Namespace
 	updateConfig := false
 
-	if svc.ObjectMeta.Namespace != namespace {
+	if !vsm.watchingNamespace(namespace) {
 		log.Warningf("Recieving service updates for unwatched namespace %s", svc.ObjectMeta.Namespace)
 		return false
 	}
 
 	// Check if the service that changed is associated with a ConfigMap
-	virtualServers.Lock()
-	defer virtualServers.Unlock()
+	vsm.vservers.Lock()
+	defer vsm.vservers.Unlock()
+	if eventStream.Deleted != changeType {
+		// Named ports that were renumbered move to their new number
+		vsm.resolveNamedPorts(svc)
+	}
 	for _, portSpec := range svc.Spec.Ports {
-		if vs, ok := virtualServers.m[serviceKey{serviceName, portSpec.Port, namespace}]; ok {
-			delete(rmvdPortsMap, portSpec.Port)
+		protocol := portProtocol(portSpec.Protocol)
+		key := serviceKey{serviceName, portSpec.Port, namespace, protocol}
+		vss, ok := vsm.vservers.svcIndex[key]
+		if !ok {
+			continue
+		}
+		delete(rmvdPortsMap, key)
+		for _, vs := range vss {
 			switch changeType {
 			case eventStream.Added, eventStream.Replaced, eventStream.Updated:
-				if isNodePort {
-					if svc.Spec.Type == v1.ServiceTypeNodePort {
+				if probesChanged && vsm.setProbeMonitors(vs, svc) {
+					updateConfig = true
+				}
+				if vsm.isNodePort {
+					if hasNodePorts(svc) {
+						vsm.clearWarning(svc, reasonServiceNotNodePort)
 						log.Debugf("Service backend matched %+v: using node port %v",
-							serviceKey{serviceName, portSpec.Port, namespace}, portSpec.NodePort)
+							key, portSpec.NodePort)
 
 						vs.VirtualServer.Backend.PoolMemberPort = portSpec.NodePort
-						vs.VirtualServer.Backend.PoolMemberAddrs = getNodesFromCache()
+						if hasLocalTraffic(svc) || vs.VirtualServer.Backend.onlyLocal {
+							setLocalNodes(vs, svc, portSpec.Name,
+								getServiceEndpoints(endptStore, svc))
+						}
+						vs.VirtualServer.Backend.PoolMemberAddrs = vsm.getConfigNodesFromCache(vs)
+						setPoolMemberOptions(vs, vsm.getNodeMemberOptionsFromCache())
 						updateConfig = true
+					} else {
+						vsm.recordWarning(svc, reasonServiceNotNodePort,
+							"Service %v is type %v, virtual server %v needs type "+
+								"NodePort or LoadBalancer",
+							serviceName, svc.Spec.Type,
+							vs.VirtualServer.Frontend.VirtualServerName)
 					}
 				} else {
 					item, _, err := endptStore.GetByKey(namespace + "/" + serviceName)
 					if nil != item {
 						eps := item.(*v1.Endpoints)
-						ipPorts := getEndpointsForService(portSpec.Name, eps)
+						ipPorts := getEndpointsForService(portSpec.Name, protocol, eps)
 
-						log.Debugf("Found endpoints for backend %+v: %v",
-							serviceKey{serviceName, portSpec.Port, namespace}, ipPorts)
+						log.Debugf("Found endpoints for backend %+v: %v", key, ipPorts)
 
 						vs.VirtualServer.Backend.PoolMemberPort,
 							vs.VirtualServer.Backend.PoolMemberAddrs = 0, ipPorts
+						vs.VirtualServer.Backend.notReadyAddrs =
+							getNotReadyEndpointsForService(portSpec.Name, protocol, eps)
+						setPoolMemberOptions(vs, vsm.getEndpointsMemberOptions(svc, eps))
 						updateConfig = true
 					} else {
-						log.Debugf("No endpoints for backend %+v: %v",
-							serviceKey{serviceName, portSpec.Port, namespace}, err)
+						log.Debugf("No endpoints for backend %+v: %v", key, err)
 					}
 				}
 			case eventStream.Deleted:
 				vs.VirtualServer.Backend.PoolMemberPort = -1
 				vs.VirtualServer.Backend.PoolMemberAddrs = nil
+				vs.VirtualServer.Backend.PoolMemberOptions = nil
+				vs.VirtualServer.Backend.notReadyAddrs = nil
 				updateConfig = true
 			}
 		}
 	}
-	for p, _ := range rmvdPortsMap {
-		if vs, ok := virtualServers.m[serviceKey{serviceName, p, namespace}]; ok {
+	for key, _ := range rmvdPortsMap {
+		for _, vs := range vsm.vservers.svcIndex[key] {
 			vs.VirtualServer.Backend.PoolMemberPort = -1
 			vs.VirtualServer.Backend.PoolMemberAddrs = nil
+			vs.VirtualServer.Backend.PoolMemberOptions = nil
+			vs.VirtualServer.Backend.notReadyAddrs = nil
 			updateConfig = true
 		}
 	}
@@ -405,12 +696,170 @@ func processService(
 	return updateConfig
 }
 
+// Check if a Service has node ports that pool members can use
+func hasNodePorts(svc *v1.Service) bool {
+	return svc.Spec.Type == v1.ServiceTypeNodePort ||
+		svc.Spec.Type == v1.ServiceTypeLoadBalancer
+}
+
+// Get the backend Service of a Virtual Server config from the API server,
+// for configs from resources other than the Service. A missing Service is
+// recorded as an event on owner, the resource the config came from.
+// Returns false if the Service could not be found
+func (vsm *Manager) getBackendService(
+	cfg *VirtualServerConfig,
+	namespace string,
+	owner runtime.Object) (*v1.Service, bool) {
+
+	serviceName := cfg.VirtualServer.Backend.ServiceName
+
+	// FIXME(yacobucci) Issue #13 this shouldn't go to the API server but
+	// use the eventStream and eventStore functionality
+	svc, err := vsm.kubeClient.Core().Services(namespace).Get(serviceName)
+	if nil != err {
+		vsm.recordWarning(owner, reasonServiceNotFound,
+			"Service %v not found", serviceName)
+		return nil, false
+	}
+	vsm.clearWarning(owner, reasonServiceNotFound)
+	return svc, true
+}
+
+// Fill in the pool members of a Virtual Server config from its backend
+// Service svc, using node ports or endpoints depending on the pool member
+// mode. Problems with the Service are recorded as events on owner, the
+// resource the config came from.
+func (vsm *Manager) setPoolMembers(
+	cfg *VirtualServerConfig,
+	svc *v1.Service,
+	endptStore *eventStream.EventStore,
+	owner runtime.Object) {
+
+	serviceName := cfg.VirtualServer.Backend.ServiceName
+	namespace := svc.ObjectMeta.Namespace
+	_, resolveErr := resolveServicePort(cfg, svc)
+	vsm.setProbeMonitors(cfg, svc)
+	servicePort := cfg.VirtualServer.Backend.ServicePort
+	protocol := backendProtocol(cfg)
+	key := backendKey(cfg, namespace)
+
+	// Pool members come from the port with the backend's number and protocol
+	// A named port that could not be resolved has none
+	isBackendPort := func(portSpec v1.ServicePort) bool {
+		return nil == resolveErr && portSpec.Port == servicePort &&
+			portProtocol(portSpec.Protocol) == protocol
+	}
+	portFound := false
+	for _, portSpec := range svc.Spec.Ports {
+		if isBackendPort(portSpec) {
+			portFound = true
+		}
+	}
+	if nil != resolveErr {
+		vsm.recordWarning(owner, reasonServicePortNotFound, "%v", resolveErr)
+	} else if !portFound {
+		vsm.recordWarning(owner, reasonServicePortNotFound,
+			"Service %v does not have %v port %v", serviceName, protocol,
+			backendPortRef(cfg))
+	} else {
+		vsm.clearWarning(owner, reasonServicePortNotFound)
+	}
+
+	// Check if service is of type NodePort
+	if vsm.isNodePort {
+		if !hasNodePorts(svc) {
+			vsm.recordWarning(owner, reasonServiceNotNodePort,
+				"Service %v is type %v, it must be type NodePort or LoadBalancer",
+				serviceName, svc.Spec.Type)
+		} else {
+			vsm.clearWarning(owner, reasonServiceNotNodePort)
+			for _, portSpec := range svc.Spec.Ports {
+				if isBackendPort(portSpec) {
+					log.Debugf("Service backend matched %+v: using node port %v",
+						key, portSpec.NodePort)
+
+					cfg.VirtualServer.Backend.PoolMemberPort = portSpec.NodePort
+					if hasLocalTraffic(svc) || cfg.VirtualServer.Backend.onlyLocal {
+						setLocalNodes(cfg, svc, portSpec.Name,
+							getServiceEndpoints(endptStore, svc))
+					}
+					cfg.VirtualServer.Backend.PoolMemberAddrs = vsm.getConfigNodesFromCache(cfg)
+					setPoolMemberOptions(cfg, vsm.getNodeMemberOptionsFromCache())
+				}
+			}
+		}
+	} else {
+		item, _, _ := endptStore.GetByKey(namespace + "/" + serviceName)
+		if nil != item {
+			eps := item.(*v1.Endpoints)
+			for _, portSpec := range svc.Spec.Ports {
+				if isBackendPort(portSpec) {
+					ipPorts := getEndpointsForService(portSpec.Name, protocol, eps)
+
+					log.Debugf("Found endpoints for backend %+v: %v", key, ipPorts)
+
+					cfg.VirtualServer.Backend.PoolMemberPort,
+						cfg.VirtualServer.Backend.PoolMemberAddrs = 0, ipPorts
+					cfg.VirtualServer.Backend.notReadyAddrs =
+						getNotReadyEndpointsForService(portSpec.Name, protocol, eps)
+					setPoolMemberOptions(cfg, vsm.getEndpointsMemberOptions(svc, eps))
+				}
+			}
+		} else {
+			log.Debugf("No endpoints for backend %+v", key)
+		}
+	}
+}
+
+// Expand a Virtual Server config into itself plus a pool-only config (one
+// without a virtual address) for each other service its rules route to,
+// keyed by virtual server name
+func expandRules(
+	cfg *VirtualServerConfig,
+	namespace string) map[string]*VirtualServerConfig {
+
+	frontend := &cfg.VirtualServer.Frontend
+	cfgs := map[string]*VirtualServerConfig{frontend.VirtualServerName: cfg}
+	// Keyed by service and port number or name, rules need http mode so
+	// their services are always TCP
+	pools := map[string]*VirtualServerConfig{
+		cfg.VirtualServer.Backend.ServiceName + "_" + backendPortRef(cfg): cfg,
+	}
+	for i := range frontend.Rules {
+		rule := &frontend.Rules[i]
+		pool := &VirtualServerConfig{}
+		pool.VirtualServer.Backend.ServiceName = rule.ServiceName
+		pool.VirtualServer.Backend.ServicePort = rule.ServicePort
+		pool.VirtualServer.Backend.servicePortName = rule.servicePortName
+		key := rule.ServiceName + "_" + backendPortRef(pool)
+		if existing, ok := pools[key]; ok {
+			pool = existing
+		} else {
+			pool.VirtualServer.Frontend.VirtualServerName = fmt.Sprintf("%v_%v",
+				frontend.VirtualServerName, key)
+			pool.VirtualServer.Frontend.Partition = frontend.Partition
+			pool.VirtualServer.Frontend.Balance = frontend.Balance
+			pool.VirtualServer.Frontend.Mode = frontend.Mode
+			pool.VirtualServer.Backend.NodeSelector =
+				cfg.VirtualServer.Backend.NodeSelector
+			pools[key] = pool
+			cfgs[pool.VirtualServer.Frontend.VirtualServerName] = pool
+		}
+		rule.Pool = pool.VirtualServer.Frontend.VirtualServerName
+	}
+
+	return cfgs
+}
+
+// Name of the virtual server of a ConfigMap
+func configMapName(cm *v1.ConfigMap) string {
+	return fmt.Sprintf("%v_%v", cm.ObjectMeta.Namespace, cm.ObjectMeta.Name)
+}
+
 // Process a change in ConfigMap state
-func processConfigMap(
-	kubeClient kubernetes.Interface,
+func (vsm *Manager) processConfigMap(
 	changeType eventStream.ChangeType,
 	obj interface{},
-	isNodePort bool,
 	endptStore *eventStream.EventStore) bool {
 
 	var cfg *VirtualServerConfig
@@ -434,120 +883,133 @@ func processConfigMap(
 		}
 	}
 
-	if cm.ObjectMeta.Namespace != namespace {
+	namespace := cm.ObjectMeta.Namespace
+	if !vsm.watchingNamespace(namespace) {
 		log.Warningf("Recieving config map updates for unwatched namespace %s", cm.ObjectMeta.Namespace)
 		return false
 	}
 
+	name := configMapName(cm)
+	if eventStream.Deleted == changeType {
+		vsm.releaseBindAddr(name)
+		vsm.forgetWarnings(cm)
+	}
+
 	// Decode the JSON data in the ConfigMap
-	cfg, err := parseVirtualServerConfig(cm)
+	cfg, err := vsm.parseVirtualServerConfig(cm)
 	if nil != err {
 		log.Warningf("Could not get config for ConfigMap: %v - %v",
 			cm.ObjectMeta.Name, err)
+		if eventStream.Deleted != changeType {
+			vsm.recordWarning(cm, reasonInvalidConfig, "%v", err)
+			vsm.setConfigMapStatus(cm, configMapStatus{
+				State:  statusInvalid,
+				Errors: []string{err.Error()},
+			})
+		}
 		return false
 	}
 
-	serviceName := cfg.VirtualServer.Backend.ServiceName
-	servicePort := cfg.VirtualServer.Backend.ServicePort
+	cfg.VirtualServer.Frontend.VirtualServerName = name
+	if eventStream.Deleted != changeType {
+		err = vsm.assignBindAddr(cfg, namespace)
+		if nil != err {
+			log.Warningf("Could not get virtual address for ConfigMap: %v - %v",
+				cm.ObjectMeta.Name, err)
+			vsm.recordWarning(cm, reasonAddressNotAllocated, "%v", err)
+			vsm.setConfigMapStatus(cm, configMapStatus{
+				State:             statusInvalid,
+				Errors:            []string{err.Error()},
+				VirtualServerName: name,
+			})
+			return false
+		}
+	}
+	cfgs := expandRules(cfg, namespace)
 
 	switch changeType {
 	case eventStream.Added, eventStream.Replaced, eventStream.Updated:
-		// FIXME(yacobucci) Issue #13 this shouldn't go to the API server but
-		// use the eventStream and eventStore functionality
-		svc, err := kubeClient.Core().Services(namespace).Get(serviceName)
-
-		if nil == err {
-			// Check if service is of type NodePort
-			if isNodePort {
-				if svc.Spec.Type == v1.ServiceTypeNodePort {
-					for _, portSpec := range svc.Spec.Ports {
-						if portSpec.Port == servicePort {
-							log.Debugf("Service backend matched %+v: using node port %v",
-								serviceKey{serviceName, portSpec.Port, namespace}, portSpec.NodePort)
-
-							cfg.VirtualServer.Backend.PoolMemberPort = portSpec.NodePort
-							cfg.VirtualServer.Backend.PoolMemberAddrs = getNodesFromCache()
-						}
-					}
-				}
+		status := configMapStatus{
+			State:             statusValid,
+			VirtualServerName: name,
+		}
+		if nil != cfg.VirtualServer.Frontend.VirtualAddress {
+			status.BindAddr = cfg.VirtualServer.Frontend.VirtualAddress.BindAddr
+		}
+		if err := vsm.checkSslSecret(cfg, namespace, cm); nil != err {
+			status.State = statusPending
+			status.Errors = append(status.Errors, err.Error())
+		}
+		if err := vsm.checkIRules(cfg, namespace, cm); nil != err {
+			status.State = statusPending
+			status.Errors = append(status.Errors, err.Error())
+		}
+		for _, c := range cfgs {
+			if svc, ok := vsm.getBackendService(c, namespace, cm); ok {
+				vsm.setPoolMembers(c, svc, endptStore, cm)
 			} else {
-				item, _, _ := endptStore.GetByKey(namespace + "/" + serviceName)
-				if nil != item {
-					eps := item.(*v1.Endpoints)
-					for _, portSpec := range svc.Spec.Ports {
-						if portSpec.Port == servicePort {
-							ipPorts := getEndpointsForService(portSpec.Name, eps)
-
-							log.Debugf("Found endpoints for backend %+v: %v",
-								serviceKey{serviceName, portSpec.Port, namespace}, ipPorts)
-
-							cfg.VirtualServer.Backend.PoolMemberPort,
-								cfg.VirtualServer.Backend.PoolMemberAddrs = 0, ipPorts
-						}
-					}
-				} else {
-					log.Debugf("No endpoints for backend %+v: %v",
-						serviceKey{serviceName, servicePort, namespace}, err)
-				}
+				status.State = statusPending
+				status.Errors = append(status.Errors, fmt.Sprintf(
+					"service %v not found", c.VirtualServer.Backend.ServiceName))
 			}
+			status.Members += len(c.VirtualServer.Backend.PoolMemberAddrs)
 		}
+		vsm.setConfigMapStatus(cm, status)
 
-		var oldCfg *VirtualServerConfig
-		backendChange := false
+		var oldCfgs map[string]*VirtualServerConfig
 		if eventStream.Updated == changeType {
-			oldCfg, err = parseVirtualServerConfig(oldCm)
+			oldCfg, err := vsm.parseVirtualServerConfig(oldCm)
 			if nil != err {
 				log.Warningf("Cannot parse previous value for ConfigMap %s",
 					oldCm.ObjectMeta.Name)
 			} else {
-				oldName := oldCfg.VirtualServer.Backend.ServiceName
-				oldPort := oldCfg.VirtualServer.Backend.ServicePort
-				if oldName != cfg.VirtualServer.Backend.ServiceName ||
-					oldPort != cfg.VirtualServer.Backend.ServicePort {
-					backendChange = true
-				}
+				oldCfg.VirtualServer.Frontend.VirtualServerName = name
+				oldCfgs = expandRules(oldCfg, namespace)
 			}
 		}
 
-		virtualServers.Lock()
-		defer virtualServers.Unlock()
-		if eventStream.Added == changeType {
-			if _, ok := virtualServers.m[serviceKey{serviceName, servicePort, namespace}]; ok {
-				log.Warningf(
-					"Overwriting existing entry for backend %+v - change type: %v",
-					serviceKey{serviceName, servicePort, namespace}, changeType)
+		vsm.vservers.Lock()
+		defer vsm.vservers.Unlock()
+		for vsName, _ := range oldCfgs {
+			if _, ok := cfgs[vsName]; !ok {
+				vsm.vservers.remove(vsName)
 			}
-		} else if eventStream.Updated == changeType && true == backendChange {
-			if _, ok := virtualServers.m[serviceKey{serviceName, servicePort, namespace}]; ok {
-				log.Warningf(
-					"Overwriting existing entry for backend %+v - change type: %v",
-					serviceKey{serviceName, servicePort, namespace}, changeType)
+		}
+		for vsName, c := range cfgs {
+			_, owned := oldCfgs[vsName]
+			if eventStream.Replaced != changeType && !owned {
+				if _, ok := vsm.vservers.m[vsName]; ok {
+					log.Warningf(
+						"Overwriting existing entry for virtual server %v - change type: %v",
+						vsName, changeType)
+					vsm.recordWarning(cm, reasonOverwrite,
+						"Overwrote existing virtual server %v", vsName)
+				}
 			}
-			delete(virtualServers.m,
-				serviceKey{oldCfg.VirtualServer.Backend.ServiceName,
-					oldCfg.VirtualServer.Backend.ServicePort, namespace})
+			vsm.vservers.assign(namespace, c)
 		}
-		name := fmt.Sprintf("%v_%v", namespace, cm.ObjectMeta.Name)
-		cfg.VirtualServer.Frontend.VirtualServerName = name
-		virtualServers.m[serviceKey{serviceName, servicePort, namespace}] = cfg
 		verified = true
 	case eventStream.Deleted:
-		virtualServers.Lock()
-		defer virtualServers.Unlock()
-		delete(virtualServers.m, serviceKey{serviceName, servicePort, namespace})
+		vsm.clearConfigMapStatus(cm)
+		vsm.vservers.Lock()
+		defer vsm.vservers.Unlock()
+		for vsName, _ := range cfgs {
+			vsm.vservers.remove(vsName)
+		}
 		verified = true
 	}
 
 	return verified
 }
 
-func processEndpoints(
-	kubeClient kubernetes.Interface,
+func (vsm *Manager) processEndpoints(
 	changeType eventStream.ChangeType,
 	obj interface{},
 	serviceStore *eventStream.EventStore) bool {
 
 	var eps *v1.Endpoints
+	// New pods may come with new readiness probes
+	podsChanged := true
 	o, ok := obj.(eventStream.ChangedObject)
 	if !ok {
 		eps = obj.(*v1.Endpoints)
@@ -555,6 +1017,10 @@ func processEndpoints(
 		switch changeType {
 		case eventStream.Added, eventStream.Updated, eventStream.Replaced:
 			eps = o.New.(*v1.Endpoints)
+			if eventStream.Updated == changeType {
+				podsChanged = !reflect.DeepEqual(
+					o.Old.(*v1.Endpoints).Subsets, eps.Subsets)
+			}
 		case eventStream.Deleted:
 			eps = o.Old.(*v1.Endpoints)
 		}
@@ -562,33 +1028,81 @@ func processEndpoints(
 
 	serviceName := eps.ObjectMeta.Name
 	namespace := eps.ObjectMeta.Namespace
+	if !vsm.watchingNamespace(namespace) {
+		log.Warningf("Recieving endpoints updates for unwatched namespace %s", namespace)
+		return false
+	}
 	item, _, _ := serviceStore.GetByKey(namespace + "/" + serviceName)
 	if nil == item {
 		return false
 	}
 	svc := item.(*v1.Service)
 
-	virtualServers.Lock()
-	defer virtualServers.Unlock()
+	vsm.vservers.Lock()
+	defer vsm.vservers.Unlock()
+	vsm.resolveNamedPorts(svc)
 
 	updateConfig := false
+	// Looked up once, for the first virtual server of the Service
+	var memberOptions map[string]PoolMemberOptions
 	for _, portSpec := range svc.Spec.Ports {
-		if vs, ok := virtualServers.m[serviceKey{serviceName, portSpec.Port, namespace}]; ok {
+		protocol := portProtocol(portSpec.Protocol)
+		key := serviceKey{serviceName, portSpec.Port, namespace, protocol}
+		for _, vs := range vsm.vservers.svcIndex[key] {
 			switch changeType {
 			case eventStream.Added, eventStream.Updated, eventStream.Replaced:
-				ipPorts := getEndpointsForService(portSpec.Name, eps)
+				if podsChanged && vsm.setProbeMonitors(vs, svc) {
+					updateConfig = true
+				}
+				if vsm.isNodePort {
+					// Pool members are node ports, endpoints only matter for
+					// their probes and the nodes of Services with local traffic
+					if hasNodePorts(svc) && setLocalNodes(vs, svc, portSpec.Name, eps) {
+						vs.VirtualServer.Backend.PoolMemberAddrs =
+							vsm.getConfigNodesFromCache(vs)
+						setPoolMemberOptions(vs, vsm.getNodeMemberOptionsFromCache())
+						updateConfig = true
+					}
+					continue
+				}
+				ipPorts := getEndpointsForService(portSpec.Name, protocol, eps)
 				if !reflect.DeepEqual(ipPorts, vs.VirtualServer.Backend.PoolMemberAddrs) {
 
 					log.Debugf("Updating endpoints for backend: %+v: from %v to %v",
-						serviceKey{serviceName, portSpec.Port, namespace},
-						vs.VirtualServer.Backend.PoolMemberAddrs, ipPorts)
+						key, vs.VirtualServer.Backend.PoolMemberAddrs, ipPorts)
 
 					vs.VirtualServer.Backend.PoolMemberPort,
 						vs.VirtualServer.Backend.PoolMemberAddrs = 0, ipPorts
 					updateConfig = true
 				}
+				// Draining members wait for their pods to stop being listed
+				notReady := getNotReadyEndpointsForService(portSpec.Name, protocol, eps)
+				if !reflect.DeepEqual(notReady, vs.VirtualServer.Backend.notReadyAddrs) {
+					vs.VirtualServer.Backend.notReadyAddrs = notReady
+					if _, ok := vsm.draining[vs.VirtualServer.Frontend.VirtualServerName]; ok {
+						updateConfig = true
+					}
+				}
+				// Annotations can change without the endpoints changing
+				if nil == memberOptions {
+					memberOptions = vsm.getEndpointsMemberOptions(svc, eps)
+				}
+				if setPoolMemberOptions(vs, memberOptions) {
+					updateConfig = true
+				}
 			case eventStream.Deleted:
+				if vsm.isNodePort {
+					if hasNodePorts(svc) && setLocalNodes(vs, svc, portSpec.Name, nil) {
+						vs.VirtualServer.Backend.PoolMemberAddrs =
+							vsm.getConfigNodesFromCache(vs)
+						setPoolMemberOptions(vs, vsm.getNodeMemberOptionsFromCache())
+						updateConfig = true
+					}
+					continue
+				}
 				vs.VirtualServer.Backend.PoolMemberAddrs = nil
+				vs.VirtualServer.Backend.PoolMemberOptions = nil
+				vs.VirtualServer.Backend.notReadyAddrs = nil
 				vs.VirtualServer.Backend.PoolMemberPort = -1
 				updateConfig = true
 			}
@@ -599,68 +1113,117 @@ func processEndpoints(
 }
 
 // Check for a change in Node state
-func ProcessNodeUpdate(obj interface{}, err error) {
+func (vsm *Manager) ProcessNodeUpdate(obj interface{}, err error) {
 	if nil != err {
 		log.Warningf("Unable to get list of nodes, err=%+v", err)
 		return
 	}
 
-	newNodes, err := getNodeAddresses(obj)
+	resolved, err := vsm.resolveNodes(obj)
 	if nil != err {
 		log.Warningf("Unable to get list of nodes, err=%+v", err)
 		return
 	}
+	newNodes := vsm.selectedNodeAddrs(resolved)
 	sort.Strings(newNodes)
+	newNodesByAddr := getNodeInfo(resolved)
+	newOptions := vsm.getNodeMemberOptions(obj)
 
-	virtualServers.Lock()
-	defer virtualServers.Unlock()
-	mutex.Lock()
-	defer mutex.Unlock()
+	vsm.vservers.Lock()
+	defer vsm.vservers.Unlock()
+	vsm.oldNodesMutex.Lock()
+	defer vsm.oldNodesMutex.Unlock()
 	// Compare last set of nodes with new one
-	if !reflect.DeepEqual(newNodes, oldNodes) {
+	if !reflect.DeepEqual(newNodes, vsm.oldNodes) ||
+		!reflect.DeepEqual(newNodesByAddr, vsm.nodesByAddr) ||
+		!reflect.DeepEqual(newOptions, vsm.nodeMemberOptions) {
 		log.Infof("ProcessNodeUpdate: Change in Node state detected")
-		for _, vs := range virtualServers.m {
-			vs.VirtualServer.Backend.PoolMemberAddrs = newNodes
+		for _, vs := range vsm.vservers.m {
+			vs.VirtualServer.Backend.PoolMemberAddrs =
+				configNodes(vs, newNodes, newNodesByAddr)
+			setPoolMemberOptions(vs, newOptions)
 		}
 		// Output the Big-IP config
-		outputConfigLocked()
+		vsm.outputConfigLocked()
 
 		// Update node cache
-		oldNodes = newNodes
+		vsm.oldNodes = newNodes
+		vsm.nodesByAddr = newNodesByAddr
+		vsm.nodeMemberOptions = newOptions
 	}
 }
 
 // Dump out the Virtual Server configs to a file
-func outputConfig() {
-	virtualServers.Lock()
-	outputConfigLocked()
-	virtualServers.Unlock()
+// Returns true if the write was confirmed
+func (vsm *Manager) outputConfig() bool {
+	vsm.vservers.Lock()
+	defer vsm.vservers.Unlock()
+	return vsm.outputConfigLocked()
 }
 
 // Dump out the Virtual Server configs to a file
-// This function MUST be called with the virtualServers
+// Returns true if the write was confirmed
+// This function MUST be called with the vservers
 // lock held.
-func outputConfigLocked() {
+func (vsm *Manager) outputConfigLocked() bool {
 
 	// Initialize the Services array as empty; json.Marshal() writes
 	// an uninitialized array as 'null', but we want an empty array
 	// written as '[]' instead
 	services := VirtualServerConfigs{}
 
-	// Filter the configs to only those that have active services
-	for _, vs := range virtualServers.m {
+	// Filter the configs to only those that have active services, or
+	// pool members still draining
+	now := time.Now()
+	usedCerts := make(map[string]*SslCertificate)
+	usedIRules := make(map[string]*IRule)
+	written := make(map[string]map[string]int32)
+	for name, vs := range vsm.vservers.m {
+		vs, written[name] = vsm.drainMembers(vs, now)
 		if vs.VirtualServer.Backend.PoolMemberPort != -1 {
-			services = append(services, vs)
+			namespace := vsm.vservers.backends[name].Namespace
+			var cert *SslCertificate
+			var ok bool
+			vs, cert, ok = vsm.attachCertificate(vs, namespace)
+			if ok {
+				vs, ok = vsm.attachIRules(vs, namespace, usedIRules)
+			}
+			if !ok {
+				// Withheld until its certificate and iRules exist, none of
+				// its members are on the Big-IP
+				written[name] = nil
+				continue
+			}
+			if nil != cert {
+				usedCerts[cert.Name] = cert
+			}
+			services = append(services, splitDualStack(attachPolicy(vs))...)
+		}
+	}
+	vsm.scheduleDrain(now)
+
+	// Certificates and iRules go first, so the virtual servers using them
+	// never reach the driver before they do. Removed iRules go last, once no
+	// virtual server attaches them
+	certs := sortedCertificates(usedCerts)
+	if 0 != len(certs) || vsm.wroteCertificates {
+		if !vsm.sendSection("certificates", certs, len(certs)) {
+			return false
 		}
+		vsm.wroteCertificates = 0 != len(certs)
+	}
+	if !vsm.stageIRules(usedIRules) {
+		return false
 	}
 
-	doneCh, errCh, err := config.SendSection("services", services)
+	doneCh, errCh, err := vsm.configWriter.SendSection("services", services)
 	if nil != err {
 		log.Warningf("Failed to write Big-IP config data: %v", err)
 	} else {
 		select {
 		case <-doneCh:
 			log.Infof("Wrote %v Virtual Server configs", len(services))
+			vsm.commitMembers(written)
 			if log.LL_DEBUG == log.GetLogLevel() {
 				output, err := json.Marshal(services)
 				if nil != err {
@@ -669,53 +1232,53 @@ func outputConfigLocked() {
 					log.Debugf("Services: %s", output)
 				}
 			}
+			return vsm.pruneIRules(usedIRules)
 		case e := <-errCh:
 			log.Warningf("Failed to write Big-IP config data: %v", e)
 		case <-time.After(time.Second):
 			log.Warning("Did not receive config write response in 1s")
 		}
 	}
+	return false
+}
+
+// Write a section other than services and wait for the write to be confirmed
+func (vsm *Manager) sendSection(
+	name string,
+	section interface{},
+	count int) bool {
+
+	doneCh, errCh, err := vsm.configWriter.SendSection(name, section)
+	if nil != err {
+		log.Warningf("Failed to write Big-IP %v: %v", name, err)
+		return false
+	}
+	select {
+	case <-doneCh:
+		log.Infof("Wrote %v %v", count, name)
+		return true
+	case e := <-errCh:
+		log.Warningf("Failed to write Big-IP %v: %v", name, e)
+	case <-time.After(time.Second):
+		log.Warningf("Did not receive %v write response in 1s", name)
+	}
+	return false
 }
 
 // Return a copy of the node cache
-func getNodesFromCache() []string {
-	mutex.Lock()
-	defer mutex.Unlock()
-	nodes := oldNodes
+func (vsm *Manager) getNodesFromCache() []string {
+	vsm.oldNodesMutex.Lock()
+	defer vsm.oldNodesMutex.Unlock()
+	nodes := vsm.oldNodes
 
 	return nodes
 }
 
 // Get a list of Node addresses
-func getNodeAddresses(obj interface{}) ([]string, error) {
-	nodes, ok := obj.([]v1.Node)
-	if false == ok {
-		return nil,
-			fmt.Errorf("poll update unexpected type, interface is not []v1.Node")
-	}
-
-	addrs := []string{}
-
-	var addrType v1.NodeAddressType
-	if useNodeInternal {
-		addrType = v1.NodeInternalIP
-	} else {
-		addrType = v1.NodeExternalIP
-	}
-
-	for _, node := range nodes {
-		if node.Spec.Unschedulable {
-			// Skip master node
-			continue
-		} else {
-			nodeAddrs := node.Status.Addresses
-			for _, addr := range nodeAddrs {
-				if addr.Type == addrType {
-					addrs = append(addrs, addr.Address)
-				}
-			}
-		}
+func (vsm *Manager) getNodeAddresses(obj interface{}) ([]string, error) {
+	resolved, err := vsm.resolveNodes(obj)
+	if nil != err {
+		return nil, err
 	}
-
-	return addrs, nil
+	return vsm.selectedNodeAddrs(resolved), nil
 }
@@ -18,14 +18,17 @@ package virtualServer
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"eventStream"
 	"test"
+	"tools/nodeAddress"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -33,17 +36,21 @@ import (
 	"k8s.io/client-go/1.4/pkg/api"
 	"k8s.io/client-go/1.4/pkg/api/unversioned"
 	"k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
 	"k8s.io/client-go/1.4/tools/cache"
 )
 
 func init() {
-	namespace = "default"
-
 	workingDir, _ := os.Getwd()
-	schemaUrl = "file://" + workingDir + "/../../vendor/src/f5/schemas/bigip-virtual-server_v0.1.2.json"
+	schemaUrl = "file://" + workingDir + "/../../schemas/bigip-virtual-server_v0.1.3.json"
+	legacySchemaUrl = "file://" + workingDir +
+		"/../../vendor/src/f5/schemas/bigip-virtual-server_v0.1.2.json"
 }
 
 var schemaUrl string
+var legacySchemaUrl string
+
+var namespace string = "default"
 
 var configmapFoo string = string(`{
   "virtualServer": {
@@ -145,6 +152,25 @@ var configmapBar string = string(`{
   }
 }`)
 
+var configmapFooDualStack string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80
+    },
+    "frontend": {
+      "balance": "round-robin",
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "bindAddr6": "2001:db8::f0",
+        "port": 80
+      }
+    }
+  }
+}`)
+
 var configmapIApp1 string = string(`{
   "virtualServer": {
     "backend": {
@@ -303,11 +329,17 @@ func newNode(id, rv string, unsched bool,
 	}
 }
 
+// Pool the InternalIP, or else the ExternalIP, addresses of Nodes
+func setUseNodeInternal(vsm *Manager, useNodeInternal bool) {
+	vsm.addrPolicy = nodeAddress.NewInternalPolicy(useNodeInternal, "")
+}
+
 func convertSvcPortsToEndpointPorts(svcPorts []v1.ServicePort) []v1.EndpointPort {
 	eps := make([]v1.EndpointPort, len(svcPorts))
 	for i, v := range svcPorts {
 		eps[i].Name = v.Name
 		eps[i].Port = v.Port
+		eps[i].Protocol = v.Protocol
 	}
 	return eps
 }
@@ -371,46 +403,43 @@ func newStore(onChange eventStream.OnChangeFunc) *eventStream.EventStore {
 }
 
 func TestVirtualServerSendFail(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.ImmediateFail,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	require.NotNil(t, mw)
-	assert.True(t, ok)
 
+	vsm := NewManager(&Params{ConfigWriter: mw})
 	require.NotPanics(t, func() {
-		outputConfig()
+		vsm.outputConfig()
 	})
 	assert.Equal(t, 1, mw.WrittenTimes)
 }
 
 func TestVirtualServerSendFailAsync(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.AsyncFail,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	require.NotNil(t, mw)
-	assert.True(t, ok)
 
+	vsm := NewManager(&Params{ConfigWriter: mw})
 	require.NotPanics(t, func() {
-		outputConfig()
+		vsm.outputConfig()
 	})
 	assert.Equal(t, 1, mw.WrittenTimes)
 }
 
 func TestVirtualServerSendFailTimeout(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Timeout,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	require.NotNil(t, mw)
-	assert.True(t, ok)
 
+	vsm := NewManager(&Params{ConfigWriter: mw})
 	require.NotPanics(t, func() {
-		outputConfig()
+		vsm.outputConfig()
 	})
 	assert.Equal(t, 1, mw.WrittenTimes)
 }
@@ -488,6 +517,54 @@ func TestVirtualServerSort(t *testing.T) {
 	}
 }
 
+func TestExpandRules(t *testing.T) {
+	require := require.New(t)
+
+	vs := VirtualServerConfig{}
+	vs.VirtualServer.Backend.ServiceName = "foo"
+	vs.VirtualServer.Backend.ServicePort = 80
+	vs.VirtualServer.Frontend.VirtualServerName = "default_foomap"
+	vs.VirtualServer.Frontend.Partition = "velcro"
+	vs.VirtualServer.Frontend.Mode = "http"
+	vs.VirtualServer.Frontend.Balance = "round-robin"
+	vs.VirtualServer.Frontend.VirtualAddress = &VirtualAddress{BindAddr: "10.128.10.240", Port: 80}
+
+	// No rules, only the config itself
+	cfgs := expandRules(&vs, namespace)
+	require.Equal(1, len(cfgs))
+	require.Equal(&vs, cfgs["default_foomap"])
+
+	vs.VirtualServer.Frontend.Rules = []RuleConfig{
+		{Host: "bar.example.com", ServiceName: "bar", ServicePort: 80},
+		{Host: "bar.example.com", Path: "/api", ServiceName: "bar", ServicePort: 8080},
+		{Path: "/foo", ServiceName: "foo", ServicePort: 80},
+		{Path: "/bar", ServiceName: "bar", ServicePort: 80},
+	}
+	cfgs = expandRules(&vs, namespace)
+	require.Equal(3, len(cfgs), "Expected one config per referenced service port")
+	require.Equal(&vs, cfgs["default_foomap"])
+
+	pools := []string{}
+	for _, rule := range vs.VirtualServer.Frontend.Rules {
+		pools = append(pools, rule.Pool)
+	}
+	require.Equal([]string{
+		"default_foomap_bar_80",
+		"default_foomap_bar_8080",
+		"default_foomap",
+		"default_foomap_bar_80",
+	}, pools)
+
+	pool := cfgs["default_foomap_bar_8080"]
+	require.NotNil(pool)
+	require.Equal("bar", pool.VirtualServer.Backend.ServiceName)
+	require.Equal(int32(8080), pool.VirtualServer.Backend.ServicePort)
+	require.Equal("velcro", pool.VirtualServer.Frontend.Partition)
+	require.Nil(pool.VirtualServer.Frontend.VirtualAddress,
+		"Rule pools should not have a virtual address")
+	require.Nil(pool.VirtualServer.Frontend.Rules)
+}
+
 func TestGetAddresses(t *testing.T) {
 	// Existing Node data
 	expectedNodes := []*v1.Node{
@@ -513,6 +590,7 @@ func TestGetAddresses(t *testing.T) {
 
 	fake := fake.NewSimpleClientset()
 	assert.NotNil(t, fake, "Mock client cannot be nil")
+	vsm := NewManager(&Params{KubeClient: fake})
 
 	for _, expectedNode := range expectedNodes {
 		node, err := fake.Core().Nodes().Create(expectedNode)
@@ -520,10 +598,10 @@ func TestGetAddresses(t *testing.T) {
 		require.EqualValues(t, expectedNode, node, "Nodes should be equal")
 	}
 
-	useNodeInternal = false
+	setUseNodeInternal(vsm, false)
 	nodes, err := fake.Core().Nodes().List(api.ListOptions{})
 	assert.Nil(t, err, "Should not fail listing nodes")
-	addresses, err := getNodeAddresses(nodes.Items)
+	addresses, err := vsm.getNodeAddresses(nodes.Items)
 	require.Nil(t, err, "Should not fail getting addresses")
 	assert.EqualValues(t, expectedReturn, addresses,
 		"Should receive the correct addresses")
@@ -533,8 +611,8 @@ func TestGetAddresses(t *testing.T) {
 		"127.0.0.4",
 	}
 
-	useNodeInternal = true
-	addresses, err = getNodeAddresses(nodes.Items)
+	setUseNodeInternal(vsm, true)
+	addresses, err = vsm.getNodeAddresses(nodes.Items)
 	require.Nil(t, err, "Should not fail getting internal addresses")
 	assert.EqualValues(t, expectedInternal, addresses,
 		"Should receive the correct addresses")
@@ -546,14 +624,25 @@ func TestGetAddresses(t *testing.T) {
 	}
 
 	expectedReturn = []string{}
-	useNodeInternal = false
+	setUseNodeInternal(vsm, false)
 	nodes, err = fake.Core().Nodes().List(api.ListOptions{})
 	assert.Nil(t, err, "Should not fail listing nodes")
-	addresses, err = getNodeAddresses(nodes.Items)
+	addresses, err = vsm.getNodeAddresses(nodes.Items)
 	require.Nil(t, err, "Should not fail getting empty addresses")
 	assert.EqualValues(t, expectedReturn, addresses, "Should get no addresses")
 }
 
+// Get the one Virtual Server using a service port
+func getVirtualServer(t *testing.T, vsm *Manager, key serviceKey) *VirtualServerConfig {
+	vss, ok := vsm.vservers.svcIndex[key]
+	require.True(t, ok, "No virtual servers for %+v", key)
+	require.Equal(t, 1, len(vss), "Expected one virtual server for %+v", key)
+	for _, vs := range vss {
+		return vs
+	}
+	return nil
+}
+
 func validateConfig(t *testing.T, mw *test.MockWriter, expected string) {
 	mw.Lock()
 	_, ok := mw.Sections["services"].(VirtualServerConfigs)
@@ -582,21 +671,23 @@ func validateConfig(t *testing.T, mw *test.MockWriter, expected string) {
 		return
 	}
 
+	// Compare what gets written, leaving out unexported bookkeeping such as
+	// the not ready addresses of draining members
+	written, err := json.Marshal(services)
+	require.Nil(t, err)
+	services.Services = VirtualServerConfigs{}
+	err = json.Unmarshal(written, &services)
+	require.Nil(t, err)
+
 	require.True(t, assert.ObjectsAreEqualValues(expectedOutput, services))
 }
 
 func TestProcessNodeUpdate(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	originalSet := []v1.Node{
 		*newNode("node0", "0", true, []v1.NodeAddress{
@@ -621,18 +712,24 @@ func TestProcessNodeUpdate(t *testing.T) {
 
 	fake := fake.NewSimpleClientset(&v1.NodeList{Items: originalSet})
 	assert.NotNil(t, fake, "Mock client should not be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
 
-	useNodeInternal = false
+	setUseNodeInternal(vsm, false)
 	nodes, err := fake.Core().Nodes().List(api.ListOptions{})
 	assert.Nil(t, err, "Should not fail listing nodes")
-	ProcessNodeUpdate(nodes.Items, err)
+	vsm.ProcessNodeUpdate(nodes.Items, err)
 	validateConfig(t, mw, emptyConfig)
-	require.EqualValues(t, expectedOgSet, oldNodes,
+	require.EqualValues(t, expectedOgSet, vsm.oldNodes,
 		"Should have cached correct node set")
 
-	cachedNodes := getNodesFromCache()
-	require.EqualValues(t, oldNodes, cachedNodes,
-		"Cached nodes should be oldNodes")
+	cachedNodes := vsm.getNodesFromCache()
+	require.EqualValues(t, vsm.oldNodes, cachedNodes,
+		"Cached nodes should be vsm.oldNodes")
 	require.EqualValues(t, expectedOgSet, cachedNodes,
 		"Cached nodes should be expected set")
 
@@ -641,17 +738,17 @@ func TestProcessNodeUpdate(t *testing.T) {
 		"127.0.0.4",
 	}
 
-	useNodeInternal = true
+	setUseNodeInternal(vsm, true)
 	nodes, err = fake.Core().Nodes().List(api.ListOptions{})
 	assert.Nil(t, err, "Should not fail listing nodes")
-	ProcessNodeUpdate(nodes.Items, err)
+	vsm.ProcessNodeUpdate(nodes.Items, err)
 	validateConfig(t, mw, emptyConfig)
-	require.EqualValues(t, expectedInternal, oldNodes,
+	require.EqualValues(t, expectedInternal, vsm.oldNodes,
 		"Should have cached correct node set")
 
-	cachedNodes = getNodesFromCache()
-	require.EqualValues(t, oldNodes, cachedNodes,
-		"Cached nodes should be oldNodes")
+	cachedNodes = vsm.getNodesFromCache()
+	require.EqualValues(t, vsm.oldNodes, cachedNodes,
+		"Cached nodes should be vsm.oldNodes")
 	require.EqualValues(t, expectedInternal, cachedNodes,
 		"Cached nodes should be expected set")
 
@@ -663,34 +760,34 @@ func TestProcessNodeUpdate(t *testing.T) {
 	_, err = fake.Core().Nodes().Create(newNode("nodeExclude", "nodeExclude",
 		true, []v1.NodeAddress{{"InternalIP", "127.0.0.7"}}))
 
-	useNodeInternal = false
+	setUseNodeInternal(vsm, false)
 	nodes, err = fake.Core().Nodes().List(api.ListOptions{})
 	assert.Nil(t, err, "Should not fail listing nodes")
-	ProcessNodeUpdate(nodes.Items, err)
+	vsm.ProcessNodeUpdate(nodes.Items, err)
 	validateConfig(t, mw, emptyConfig)
 	expectedAddSet := append(expectedOgSet, "127.0.0.6")
 
-	require.EqualValues(t, expectedAddSet, oldNodes)
+	require.EqualValues(t, expectedAddSet, vsm.oldNodes)
 
-	cachedNodes = getNodesFromCache()
-	require.EqualValues(t, oldNodes, cachedNodes,
-		"Cached nodes should be oldNodes")
+	cachedNodes = vsm.getNodesFromCache()
+	require.EqualValues(t, vsm.oldNodes, cachedNodes,
+		"Cached nodes should be vsm.oldNodes")
 	require.EqualValues(t, expectedAddSet, cachedNodes,
 		"Cached nodes should be expected set")
 
 	// make no changes and re-run process
-	useNodeInternal = false
+	setUseNodeInternal(vsm, false)
 	nodes, err = fake.Core().Nodes().List(api.ListOptions{})
 	assert.Nil(t, err, "Should not fail listing nodes")
-	ProcessNodeUpdate(nodes.Items, err)
+	vsm.ProcessNodeUpdate(nodes.Items, err)
 	validateConfig(t, mw, emptyConfig)
 	expectedAddSet = append(expectedOgSet, "127.0.0.6")
 
-	require.EqualValues(t, expectedAddSet, oldNodes)
+	require.EqualValues(t, expectedAddSet, vsm.oldNodes)
 
-	cachedNodes = getNodesFromCache()
-	require.EqualValues(t, oldNodes, cachedNodes,
-		"Cached nodes should be oldNodes")
+	cachedNodes = vsm.getNodesFromCache()
+	require.EqualValues(t, vsm.oldNodes, cachedNodes,
+		"Cached nodes should be vsm.oldNodes")
 	require.EqualValues(t, expectedAddSet, cachedNodes,
 		"Cached nodes should be expected set")
 
@@ -704,33 +801,27 @@ func TestProcessNodeUpdate(t *testing.T) {
 
 	expectedDelSet := []string{"127.0.0.6"}
 
-	useNodeInternal = false
+	setUseNodeInternal(vsm, false)
 	nodes, err = fake.Core().Nodes().List(api.ListOptions{})
 	assert.Nil(t, err, "Should not fail listing nodes")
-	ProcessNodeUpdate(nodes.Items, err)
+	vsm.ProcessNodeUpdate(nodes.Items, err)
 	validateConfig(t, mw, emptyConfig)
 
-	require.EqualValues(t, expectedDelSet, oldNodes)
+	require.EqualValues(t, expectedDelSet, vsm.oldNodes)
 
-	cachedNodes = getNodesFromCache()
-	require.EqualValues(t, oldNodes, cachedNodes,
-		"Cached nodes should be oldNodes")
+	cachedNodes = vsm.getNodesFromCache()
+	require.EqualValues(t, vsm.oldNodes, cachedNodes,
+		"Cached nodes should be vsm.oldNodes")
 	require.EqualValues(t, expectedDelSet, cachedNodes,
 		"Cached nodes should be expected set")
 }
 
 func testOverwriteAddImpl(t *testing.T, isNodePort bool) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	require := require.New(t)
 
@@ -740,32 +831,38 @@ func testOverwriteAddImpl(t *testing.T, isNodePort bool) {
 
 	fake := fake.NewSimpleClientset()
 	require.NotNil(fake, "Mock client cannot be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   isNodePort,
+	})
 
 	endptStore := newStore(nil)
-	r := processConfigMap(fake, eventStream.Added,
-		eventStream.ChangedObject{nil, cfgFoo}, isNodePort, endptStore)
+	r := vsm.processConfigMap(eventStream.Added,
+		eventStream.ChangedObject{nil, cfgFoo}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	require.Equal(1, len(virtualServers.m))
-	require.Contains(virtualServers.m, serviceKey{"foo", 80, "default"},
+	require.Equal(1, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should have entry")
 	require.Equal("http",
-		virtualServers.m[serviceKey{"foo", 80, "default"}].VirtualServer.Frontend.Mode,
+		getVirtualServer(t, vsm, serviceKey{"foo", 80, "default", v1.ProtocolTCP}).VirtualServer.Frontend.Mode,
 		"Mode should be http")
 
 	cfgFoo = newConfigMap("foomap", "1", "default", map[string]string{
 		"schema": schemaUrl,
 		"data":   configmapFooTcp})
 
-	r = processConfigMap(fake, eventStream.Added,
-		eventStream.ChangedObject{nil, cfgFoo}, isNodePort, endptStore)
+	r = vsm.processConfigMap(eventStream.Added,
+		eventStream.ChangedObject{nil, cfgFoo}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	require.Equal(1, len(virtualServers.m))
-	require.Contains(virtualServers.m, serviceKey{"foo", 80, "default"},
+	require.Equal(1, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should have new entry")
 	require.Equal("tcp",
-		virtualServers.m[serviceKey{"foo", 80, "default"}].VirtualServer.Frontend.Mode,
+		getVirtualServer(t, vsm, serviceKey{"foo", 80, "default", v1.ProtocolTCP}).VirtualServer.Frontend.Mode,
 		"Mode should be tcp after overwrite")
 }
 
@@ -778,17 +875,11 @@ func TestOverwriteAddCluster(t *testing.T) {
 }
 
 func testServiceChangeUpdateImpl(t *testing.T, isNodePort bool) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	require := require.New(t)
 
@@ -798,26 +889,32 @@ func testServiceChangeUpdateImpl(t *testing.T, isNodePort bool) {
 
 	fake := fake.NewSimpleClientset()
 	require.NotNil(fake, "Mock client cannot be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
 
 	endptStore := newStore(nil)
-	r := processConfigMap(fake, eventStream.Added,
-		eventStream.ChangedObject{nil, cfgFoo}, true, endptStore)
+	r := vsm.processConfigMap(eventStream.Added,
+		eventStream.ChangedObject{nil, cfgFoo}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	require.Equal(1, len(virtualServers.m))
-	require.Contains(virtualServers.m, serviceKey{"foo", 80, "default"},
+	require.Equal(1, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should have an entry")
 
 	cfgFoo8080 := newConfigMap("foomap", "1", "default", map[string]string{
 		"schema": schemaUrl,
 		"data":   configmapFoo8080})
 
-	r = processConfigMap(fake, eventStream.Updated,
-		eventStream.ChangedObject{cfgFoo, cfgFoo8080}, true, endptStore)
+	r = vsm.processConfigMap(eventStream.Updated,
+		eventStream.ChangedObject{cfgFoo, cfgFoo8080}, endptStore)
 	require.True(r, "Config map should be processed")
-	require.Contains(virtualServers.m, serviceKey{"foo", 8080, "default"},
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 8080, "default", v1.ProtocolTCP},
 		"Virtual servers should have new entry")
-	require.NotContains(virtualServers.m, serviceKey{"foo", 80, "default"},
+	require.NotContains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should have old config removed")
 }
 
@@ -829,18 +926,120 @@ func TestServiceChangeUpdateCluster(t *testing.T) {
 	testServiceChangeUpdateImpl(t, false)
 }
 
+func TestSharedServicePort(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	// An internal and an external virtual server for the same service port
+	cfgInt := newConfigMap("foomap-int", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	cfgExt := newConfigMap("foomap-ext", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	require.NotNil(fake, "Mock client should not be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+	endptStore := newStore(nil)
+
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgInt}, endptStore)
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgExt}, endptStore)
+	require.Equal(2, len(vsm.vservers.m), "Both config maps should be kept")
+	require.Equal(2, len(vsm.vservers.svcIndex[serviceKey{"foo", 80, namespace, v1.ProtocolTCP}]))
+
+	// Service and node updates reach both virtual servers
+	foo.Spec.Ports[0].NodePort = 30002
+	vsm.ProcessServiceUpdate(eventStream.Updated, eventStream.ChangedObject{
+		foo, foo}, endptStore)
+	setUseNodeInternal(vsm, true)
+	vsm.ProcessNodeUpdate([]v1.Node{
+		*newNode("node0", "0", false, []v1.NodeAddress{
+			{"InternalIP", "127.0.0.1"}}),
+	}, nil)
+	for _, name := range []string{"default_foomap-int", "default_foomap-ext"} {
+		vs, ok := vsm.vservers.m[name]
+		require.True(ok, "Expected virtual server %s", name)
+		require.EqualValues(30002, vs.VirtualServer.Backend.PoolMemberPort)
+		require.EqualValues([]string{"127.0.0.1"}, vs.VirtualServer.Backend.PoolMemberAddrs)
+	}
+
+	// Deleting one leaves the other in place
+	vsm.ProcessConfigMapUpdate(eventStream.Deleted, eventStream.ChangedObject{
+		cfgInt, nil}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.m, "default_foomap-ext")
+	require.Equal(1, len(vsm.vservers.svcIndex[serviceKey{"foo", 80, namespace, v1.ProtocolTCP}]))
+
+	vsm.ProcessConfigMapUpdate(eventStream.Deleted, eventStream.ChangedObject{
+		cfgExt, nil}, endptStore)
+	require.Equal(0, len(vsm.vservers.m))
+	require.NotContains(vsm.vservers.svcIndex, serviceKey{"foo", 80, namespace, v1.ProtocolTCP},
+		"Index should not keep unused service ports")
+}
+
+func TestSharedServicePortCluster(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	cfgInt := newConfigMap("foomap-int", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	cfgExt := newConfigMap("foomap-ext", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	svcPorts := []v1.ServicePort{newServicePort("port0", 80)}
+	foo := newService("foo", "1", namespace, v1.ServiceTypeClusterIP, svcPorts)
+
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	require.NotNil(fake, "Mock client should not be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   false,
+	})
+	endptStore := newStore(nil)
+	svcStore := newStore(nil)
+	svcStore.Add(foo)
+
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgInt}, endptStore)
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgExt}, endptStore)
+	require.Equal(2, len(vsm.vservers.m))
+
+	endpts := newEndpoints("foo", "1", namespace, []string{"10.2.96.1"}, nil,
+		convertSvcPortsToEndpointPorts(svcPorts))
+	vsm.ProcessEndpointsUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, endpts}, svcStore)
+	for _, vs := range vsm.vservers.m {
+		require.EqualValues([]string{"10.2.96.1:80"},
+			vs.VirtualServer.Backend.PoolMemberAddrs)
+	}
+}
+
 func TestServicePortsRemovedNodePort(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	require := require.New(t)
 
@@ -860,50 +1059,57 @@ func TestServicePortsRemovedNodePort(t *testing.T) {
 			{Port: 9090, NodePort: 39001}})
 
 	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	require.NotNil(fake, "Mock client cannot be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
 
 	endptStore := newStore(nil)
-	r := processConfigMap(fake, eventStream.Added, eventStream.ChangedObject{
+	r := vsm.processConfigMap(eventStream.Added, eventStream.ChangedObject{
 		nil,
-		cfgFoo}, true, endptStore)
+		cfgFoo}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	r = processConfigMap(fake, eventStream.Added, eventStream.ChangedObject{
+	r = vsm.processConfigMap(eventStream.Added, eventStream.ChangedObject{
 		nil,
-		cfgFoo8080}, true, endptStore)
+		cfgFoo8080}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	r = processConfigMap(fake, eventStream.Added, eventStream.ChangedObject{
+	r = vsm.processConfigMap(eventStream.Added, eventStream.ChangedObject{
 		nil,
-		cfgFoo9090}, true, endptStore)
+		cfgFoo9090}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	require.Equal(3, len(virtualServers.m))
-	require.Contains(virtualServers.m, serviceKey{"foo", 80, "default"})
-	require.Contains(virtualServers.m, serviceKey{"foo", 8080, "default"})
-	require.Contains(virtualServers.m, serviceKey{"foo", 9090, "default"})
+	require.Equal(3, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP})
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 8080, "default", v1.ProtocolTCP})
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 9090, "default", v1.ProtocolTCP})
 
 	// Create a new service with less ports and update
 	newFoo := newService("foo", "1", "default", "NodePort",
 		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
 
-	r = processService(fake, eventStream.Updated, eventStream.ChangedObject{
+	r = vsm.processService(eventStream.Updated, eventStream.ChangedObject{
 		foo,
-		newFoo}, true, endptStore)
+		newFoo}, endptStore)
 	require.True(r, "Service should be processed")
 
-	require.Equal(3, len(virtualServers.m))
-	require.Contains(virtualServers.m, serviceKey{"foo", 80, "default"})
-	require.Contains(virtualServers.m, serviceKey{"foo", 8080, "default"})
-	require.Contains(virtualServers.m, serviceKey{"foo", 9090, "default"})
+	require.Equal(3, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP})
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 8080, "default", v1.ProtocolTCP})
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 9090, "default", v1.ProtocolTCP})
 
 	require.Equal(int32(30001),
-		virtualServers.m[serviceKey{"foo", 80, "default"}].VirtualServer.Backend.PoolMemberPort,
+		getVirtualServer(t, vsm, serviceKey{"foo", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberPort,
 		"Existing NodePort should be set")
 	require.Equal(int32(-1),
-		virtualServers.m[serviceKey{"foo", 8080, "default"}].VirtualServer.Backend.PoolMemberPort,
+		getVirtualServer(t, vsm, serviceKey{"foo", 8080, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberPort,
 		"Removed NodePort should be unset")
 	require.Equal(int32(-1),
-		virtualServers.m[serviceKey{"foo", 9090, "default"}].VirtualServer.Backend.PoolMemberPort,
+		getVirtualServer(t, vsm, serviceKey{"foo", 9090, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberPort,
 		"Removed NodePort should be unset")
 
 	// Re-add port in new service
@@ -911,39 +1117,33 @@ func TestServicePortsRemovedNodePort(t *testing.T) {
 		[]v1.ServicePort{{Port: 80, NodePort: 20001},
 			{Port: 8080, NodePort: 45454}})
 
-	r = processService(fake, eventStream.Updated, eventStream.ChangedObject{
+	r = vsm.processService(eventStream.Updated, eventStream.ChangedObject{
 		newFoo,
-		newFoo2}, true, endptStore)
+		newFoo2}, endptStore)
 	require.True(r, "Service should be processed")
 
-	require.Equal(3, len(virtualServers.m))
-	require.Contains(virtualServers.m, serviceKey{"foo", 80, "default"})
-	require.Contains(virtualServers.m, serviceKey{"foo", 8080, "default"})
-	require.Contains(virtualServers.m, serviceKey{"foo", 9090, "default"})
+	require.Equal(3, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP})
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 8080, "default", v1.ProtocolTCP})
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 9090, "default", v1.ProtocolTCP})
 
 	require.Equal(int32(20001),
-		virtualServers.m[serviceKey{"foo", 80, "default"}].VirtualServer.Backend.PoolMemberPort,
+		getVirtualServer(t, vsm, serviceKey{"foo", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberPort,
 		"Existing NodePort should be set")
 	require.Equal(int32(45454),
-		virtualServers.m[serviceKey{"foo", 8080, "default"}].VirtualServer.Backend.PoolMemberPort,
+		getVirtualServer(t, vsm, serviceKey{"foo", 8080, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberPort,
 		"Removed NodePort should be unset")
 	require.Equal(int32(-1),
-		virtualServers.m[serviceKey{"foo", 9090, "default"}].VirtualServer.Backend.PoolMemberPort,
+		getVirtualServer(t, vsm, serviceKey{"foo", 9090, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberPort,
 		"Removed NodePort should be unset")
 }
 
 func TestUpdatesConcurrentNodePort(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	assert := assert.New(t)
 	require := require.New(t)
@@ -970,7 +1170,12 @@ func TestUpdatesConcurrentNodePort(t *testing.T) {
 		[]v1.NodeAddress{{"ExternalIP", "127.0.0.3"}})
 
 	fake := fake.NewSimpleClientset()
-	require.NotNil(fake, "Mock client cannot be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
 
 	nodeCh := make(chan struct{})
 	mapCh := make(chan struct{})
@@ -982,10 +1187,10 @@ func TestUpdatesConcurrentNodePort(t *testing.T) {
 			require.Nil(err, "Should not fail creating node")
 			require.EqualValues(node, n, "Nodes should be equal")
 
-			useNodeInternal = false
+			setUseNodeInternal(vsm, false)
 			nodes, err := fake.Core().Nodes().List(api.ListOptions{})
 			assert.Nil(err, "Should not fail listing nodes")
-			ProcessNodeUpdate(nodes.Items, err)
+			vsm.ProcessNodeUpdate(nodes.Items, err)
 		}
 
 		nodeCh <- struct{}{}
@@ -997,19 +1202,19 @@ func TestUpdatesConcurrentNodePort(t *testing.T) {
 		require.EqualValues(f, cfgFoo, "Maps should be equal")
 
 		endptStore := newStore(nil)
-		ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+		vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 			nil,
 			cfgFoo,
-		}, true, endptStore)
+		}, endptStore)
 
 		b, err := fake.Core().ConfigMaps("default").Create(cfgBar)
 		require.Nil(err, "Should not fail creating configmap")
 		require.EqualValues(b, cfgBar, "Maps should be equal")
 
-		ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+		vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 			nil,
 			cfgBar,
-		}, true, endptStore)
+		}, endptStore)
 
 		mapCh <- struct{}{}
 	}()
@@ -1020,17 +1225,17 @@ func TestUpdatesConcurrentNodePort(t *testing.T) {
 		require.EqualValues(fSvc, foo, "Service should be equal")
 
 		endptStore := newStore(nil)
-		ProcessServiceUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+		vsm.ProcessServiceUpdate(eventStream.Added, eventStream.ChangedObject{
 			nil,
-			foo}, true, endptStore)
+			foo}, endptStore)
 
 		bSvc, err := fake.Core().Services("default").Create(bar)
 		require.Nil(err, "Should not fail creating service")
 		require.EqualValues(bSvc, bar, "Maps should be equal")
 
-		ProcessServiceUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+		vsm.ProcessServiceUpdate(eventStream.Added, eventStream.ChangedObject{
 			nil,
-			bar}, true, endptStore)
+			bar}, endptStore)
 
 		serviceCh <- struct{}{}
 	}()
@@ -1060,10 +1265,10 @@ func TestUpdatesConcurrentNodePort(t *testing.T) {
 		require.Nil(err)
 		_, err = fake.Core().Nodes().Create(extraNode)
 		require.Nil(err)
-		useNodeInternal = false
+		setUseNodeInternal(vsm, false)
 		nodes, err := fake.Core().Nodes().List(api.ListOptions{})
 		assert.Nil(err, "Should not fail listing nodes")
-		ProcessNodeUpdate(nodes.Items, err)
+		vsm.ProcessNodeUpdate(nodes.Items, err)
 
 		nodeCh <- struct{}{}
 	}()
@@ -1075,11 +1280,11 @@ func TestUpdatesConcurrentNodePort(t *testing.T) {
 		m, _ := fake.Core().ConfigMaps("").List(api.ListOptions{})
 		assert.Equal(1, len(m.Items))
 		endptStore := newStore(nil)
-		ProcessConfigMapUpdate(fake, eventStream.Deleted, eventStream.ChangedObject{
+		vsm.ProcessConfigMapUpdate(eventStream.Deleted, eventStream.ChangedObject{
 			cfgFoo,
 			nil,
-		}, true, endptStore)
-		assert.Equal(1, len(virtualServers.m))
+		}, endptStore)
+		assert.Equal(1, len(vsm.vservers.m))
 
 		mapCh <- struct{}{}
 	}()
@@ -1091,9 +1296,9 @@ func TestUpdatesConcurrentNodePort(t *testing.T) {
 		s, _ := fake.Core().Services("").List(api.ListOptions{})
 		assert.Equal(1, len(s.Items))
 		endptStore := newStore(nil)
-		ProcessServiceUpdate(fake, eventStream.Deleted, eventStream.ChangedObject{
+		vsm.ProcessServiceUpdate(eventStream.Deleted, eventStream.ChangedObject{
 			foo,
-			nil}, true, endptStore)
+			nil}, endptStore)
 
 		serviceCh <- struct{}{}
 	}()
@@ -1118,17 +1323,11 @@ func TestUpdatesConcurrentNodePort(t *testing.T) {
 }
 
 func TestProcessUpdatesNodePort(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	assert := assert.New(t)
 	require := require.New(t)
@@ -1170,6 +1369,12 @@ func TestProcessUpdatesNodePort(t *testing.T) {
 		&v1.ServiceList{Items: []v1.Service{*foo, *bar}},
 		&v1.NodeList{Items: nodes})
 	require.NotNil(fake, "Mock client cannot be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
 
 	m, err := fake.Core().ConfigMaps("").List(api.ListOptions{})
 	require.Nil(err)
@@ -1182,133 +1387,133 @@ func TestProcessUpdatesNodePort(t *testing.T) {
 	assert.Equal(2, len(s.Items))
 	assert.Equal(3, len(n.Items))
 
-	useNodeInternal = false
-	ProcessNodeUpdate(n.Items, err)
+	setUseNodeInternal(vsm, false)
+	vsm.ProcessNodeUpdate(n.Items, err)
 
 	// ConfigMap ADDED
 	endptStore := newStore(nil)
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
 		cfgFoo,
-	}, true, endptStore)
-	assert.Equal(1, len(virtualServers.m))
+	}, endptStore)
+	assert.Equal(1, len(vsm.vservers.m))
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"foo", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"foo", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 
 	// Second ConfigMap ADDED
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
 		cfgBar,
-	}, true, endptStore)
-	assert.Equal(2, len(virtualServers.m))
+	}, endptStore)
+	assert.Equal(2, len(vsm.vservers.m))
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"foo", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"foo", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"bar", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"bar", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 
 	// Service ADDED
-	ProcessServiceUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessServiceUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
-		foo}, true, endptStore)
-	assert.Equal(2, len(virtualServers.m))
+		foo}, endptStore)
+	assert.Equal(2, len(vsm.vservers.m))
 
 	// Second Service ADDED
-	ProcessServiceUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessServiceUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
-		bar}, true, endptStore)
-	assert.Equal(2, len(virtualServers.m))
+		bar}, endptStore)
+	assert.Equal(2, len(vsm.vservers.m))
 
 	// ConfigMap UPDATED
-	ProcessConfigMapUpdate(fake, eventStream.Updated, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Updated, eventStream.ChangedObject{
 		cfgFoo,
 		cfgFoo,
-	}, true, endptStore)
-	assert.Equal(2, len(virtualServers.m))
+	}, endptStore)
+	assert.Equal(2, len(vsm.vservers.m))
 
 	// Service UPDATED
-	ProcessServiceUpdate(fake, eventStream.Updated, eventStream.ChangedObject{
+	vsm.ProcessServiceUpdate(eventStream.Updated, eventStream.ChangedObject{
 		foo,
-		foo}, true, endptStore)
-	assert.Equal(2, len(virtualServers.m))
+		foo}, endptStore)
+	assert.Equal(2, len(vsm.vservers.m))
 
 	// ConfigMap ADDED second foo port
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
-		cfgFoo8080}, true, endptStore)
-	assert.Equal(3, len(virtualServers.m))
+		cfgFoo8080}, endptStore)
+	assert.Equal(3, len(vsm.vservers.m))
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"foo", 8080, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"foo", 8080, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"foo", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"foo", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"bar", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"bar", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 
 	// ConfigMap ADDED third foo port
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
-		cfgFoo9090}, true, endptStore)
-	assert.Equal(4, len(virtualServers.m))
+		cfgFoo9090}, endptStore)
+	assert.Equal(4, len(vsm.vservers.m))
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"foo", 9090, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"foo", 9090, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"foo", 8080, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"foo", 8080, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"foo", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"foo", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"bar", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"bar", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 
 	// Nodes ADDED
 	_, err = fake.Core().Nodes().Create(extraNode)
 	require.Nil(err)
-	useNodeInternal = false
+	setUseNodeInternal(vsm, false)
 	n, err = fake.Core().Nodes().List(api.ListOptions{})
 	assert.Nil(err, "Should not fail listing nodes")
-	ProcessNodeUpdate(n.Items, err)
-	assert.Equal(4, len(virtualServers.m))
+	vsm.ProcessNodeUpdate(n.Items, err)
+	assert.Equal(4, len(vsm.vservers.m))
 	assert.EqualValues(append(addrs, "127.0.0.3"),
-		virtualServers.m[serviceKey{"foo", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"foo", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues(append(addrs, "127.0.0.3"),
-		virtualServers.m[serviceKey{"bar", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"bar", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues(append(addrs, "127.0.0.3"),
-		virtualServers.m[serviceKey{"foo", 8080, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"foo", 8080, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues(append(addrs, "127.0.0.3"),
-		virtualServers.m[serviceKey{"foo", 9090, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"foo", 9090, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	validateConfig(t, mw, twoSvcsFourPortsThreeNodesConfig)
 
 	// ConfigMap DELETED third foo port
-	ProcessConfigMapUpdate(fake, eventStream.Deleted, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Deleted, eventStream.ChangedObject{
 		cfgFoo9090,
-		nil}, true, endptStore)
-	assert.Equal(3, len(virtualServers.m))
-	assert.NotContains(virtualServers.m, serviceKey{"foo", 9090, "default"},
+		nil}, endptStore)
+	assert.Equal(3, len(vsm.vservers.m))
+	assert.NotContains(vsm.vservers.svcIndex, serviceKey{"foo", 9090, "default", v1.ProtocolTCP},
 		"Virtual servers should not contain removed port")
-	assert.Contains(virtualServers.m, serviceKey{"foo", 8080, "default"},
+	assert.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 8080, "default", v1.ProtocolTCP},
 		"Virtual servers should contain remaining ports")
-	assert.Contains(virtualServers.m, serviceKey{"foo", 80, "default"},
+	assert.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should contain remaining ports")
-	assert.Contains(virtualServers.m, serviceKey{"bar", 80, "default"},
+	assert.Contains(vsm.vservers.svcIndex, serviceKey{"bar", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should contain remaining ports")
 
 	// ConfigMap UPDATED second foo port
-	ProcessConfigMapUpdate(fake, eventStream.Updated, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Updated, eventStream.ChangedObject{
 		cfgFoo8080,
-		cfgFoo8080}, true, endptStore)
-	assert.Equal(3, len(virtualServers.m))
-	assert.Contains(virtualServers.m, serviceKey{"foo", 8080, "default"},
+		cfgFoo8080}, endptStore)
+	assert.Equal(3, len(vsm.vservers.m))
+	assert.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 8080, "default", v1.ProtocolTCP},
 		"Virtual servers should contain remaining ports")
-	assert.Contains(virtualServers.m, serviceKey{"foo", 80, "default"},
+	assert.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should contain remaining ports")
-	assert.Contains(virtualServers.m, serviceKey{"bar", 80, "default"},
+	assert.Contains(vsm.vservers.svcIndex, serviceKey{"bar", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should contain remaining ports")
 
 	// ConfigMap DELETED second foo port
-	ProcessConfigMapUpdate(fake, eventStream.Deleted, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Deleted, eventStream.ChangedObject{
 		cfgFoo8080,
-		nil}, true, endptStore)
-	assert.Equal(2, len(virtualServers.m))
-	assert.Contains(virtualServers.m, serviceKey{"foo", 80, "default"},
+		nil}, endptStore)
+	assert.Equal(2, len(vsm.vservers.m))
+	assert.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should contain remaining ports")
-	assert.Contains(virtualServers.m, serviceKey{"bar", 80, "default"},
+	assert.Contains(vsm.vservers.svcIndex, serviceKey{"bar", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should contain remaining ports")
 
 	// Nodes DELETES
@@ -1316,27 +1521,27 @@ func TestProcessUpdatesNodePort(t *testing.T) {
 	require.Nil(err)
 	err = fake.Core().Nodes().Delete("node2", &api.DeleteOptions{})
 	require.Nil(err)
-	useNodeInternal = false
+	setUseNodeInternal(vsm, false)
 	n, err = fake.Core().Nodes().List(api.ListOptions{})
 	assert.Nil(err, "Should not fail listing nodes")
-	ProcessNodeUpdate(n.Items, err)
-	assert.Equal(2, len(virtualServers.m))
+	vsm.ProcessNodeUpdate(n.Items, err)
+	assert.Equal(2, len(vsm.vservers.m))
 	assert.EqualValues([]string{"127.0.0.3"},
-		virtualServers.m[serviceKey{"foo", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"foo", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues([]string{"127.0.0.3"},
-		virtualServers.m[serviceKey{"bar", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"bar", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	validateConfig(t, mw, twoSvcsOneNodeConfig)
 
 	// ConfigMap DELETED
 	err = fake.Core().ConfigMaps("default").Delete("foomap", &api.DeleteOptions{})
 	m, err = fake.Core().ConfigMaps("").List(api.ListOptions{})
 	assert.Equal(1, len(m.Items))
-	ProcessConfigMapUpdate(fake, eventStream.Deleted, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Deleted, eventStream.ChangedObject{
 		cfgFoo,
 		nil,
-	}, true, endptStore)
-	assert.Equal(1, len(virtualServers.m))
-	assert.NotContains(virtualServers.m, serviceKey{"foo", 80, "default"},
+	}, endptStore)
+	assert.Equal(1, len(vsm.vservers.m))
+	assert.NotContains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP},
 		"Config map should be removed after delete")
 	validateConfig(t, mw, oneSvcOneNodeConfig)
 
@@ -1345,25 +1550,19 @@ func TestProcessUpdatesNodePort(t *testing.T) {
 	require.Nil(err)
 	s, err = fake.Core().Services("").List(api.ListOptions{})
 	assert.Equal(1, len(s.Items))
-	ProcessServiceUpdate(fake, eventStream.Deleted, eventStream.ChangedObject{
+	vsm.ProcessServiceUpdate(eventStream.Deleted, eventStream.ChangedObject{
 		bar,
-		nil}, true, endptStore)
-	assert.Equal(1, len(virtualServers.m))
+		nil}, endptStore)
+	assert.Equal(1, len(vsm.vservers.m))
 	validateConfig(t, mw, emptyConfig)
 }
 
 func TestDontCareConfigMapNodePort(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	assert := assert.New(t)
 	require := require.New(t)
@@ -1377,6 +1576,12 @@ func TestDontCareConfigMapNodePort(t *testing.T) {
 	fake := fake.NewSimpleClientset(&v1.ConfigMapList{Items: []v1.ConfigMap{*cfg}},
 		&v1.ServiceList{Items: []v1.Service{*svc}})
 	require.NotNil(fake, "Mock client cannot be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
 
 	m, err := fake.Core().ConfigMaps("").List(api.ListOptions{})
 	require.Nil(err)
@@ -1387,73 +1592,73 @@ func TestDontCareConfigMapNodePort(t *testing.T) {
 	assert.Equal(1, len(s.Items))
 
 	// ConfigMap ADDED
-	assert.Equal(0, len(virtualServers.m))
+	assert.Equal(0, len(vsm.vservers.m))
 	endptStore := newStore(nil)
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
 		cfg,
-	}, true, endptStore)
-	assert.Equal(0, len(virtualServers.m))
+	}, endptStore)
+	assert.Equal(0, len(vsm.vservers.m))
 }
 
 func testConfigMapKeysImpl(t *testing.T, isNodePort bool) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	require := require.New(t)
 	assert := assert.New(t)
 
 	fake := fake.NewSimpleClientset()
 	require.NotNil(fake, "Mock client should not be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   isNodePort,
+	})
 
 	noschemakey := newConfigMap("noschema", "1", "default", map[string]string{
 		"data": "bar"})
-	cfg, err := parseVirtualServerConfig(noschemakey)
+	cfg, err := vsm.parseVirtualServerConfig(noschemakey)
 	require.Nil(cfg, "Should not have parsed bad configmap")
 	require.EqualError(err, "configmap noschema does not contain schema key",
 		"Should receive no schema error")
 	endptStore := newStore(nil)
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
 		noschemakey,
-	}, isNodePort, endptStore)
-	require.Equal(0, len(virtualServers.m))
+	}, endptStore)
+	require.Equal(0, len(vsm.vservers.m))
 
 	nodatakey := newConfigMap("nodata", "1", "default", map[string]string{
 		"schema": schemaUrl,
 	})
-	cfg, err = parseVirtualServerConfig(nodatakey)
+	cfg, err = vsm.parseVirtualServerConfig(nodatakey)
 	require.Nil(cfg, "Should not have parsed bad configmap")
 	require.EqualError(err, "configmap nodata does not contain data key",
 		"Should receive no data error")
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
 		nodatakey,
-	}, isNodePort, endptStore)
-	require.Equal(0, len(virtualServers.m))
+	}, endptStore)
+	require.Equal(0, len(vsm.vservers.m))
 
 	badjson := newConfigMap("badjson", "1", "default", map[string]string{
 		"schema": schemaUrl,
 		"data":   "///// **invalid json** /////",
 	})
-	cfg, err = parseVirtualServerConfig(badjson)
+	cfg, err = vsm.parseVirtualServerConfig(badjson)
 	require.Nil(cfg, "Should not have parsed bad configmap")
 	require.EqualError(err,
 		"invalid character '/' looking for beginning of value")
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
 		badjson,
-	}, isNodePort, endptStore)
-	require.Equal(0, len(virtualServers.m))
+	}, endptStore)
+	require.Equal(0, len(vsm.vservers.m))
 
 	extrakeys := newConfigMap("extrakeys", "1", "default", map[string]string{
 		"schema": schemaUrl,
@@ -1461,16 +1666,16 @@ func testConfigMapKeysImpl(t *testing.T, isNodePort bool) {
 		"key1":   "value1",
 		"key2":   "value2",
 	})
-	cfg, err = parseVirtualServerConfig(extrakeys)
+	cfg, err = vsm.parseVirtualServerConfig(extrakeys)
 	require.NotNil(cfg, "Config map should parse with extra keys")
 	require.Nil(err, "Should not receive errors")
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
 		extrakeys,
-	}, isNodePort, endptStore)
-	require.Equal(1, len(virtualServers.m))
+	}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
 
-	vs, ok := virtualServers.m[serviceKey{"foo", 80, "default"}]
+	vs, ok := vsm.vservers.m["default_extrakeys"]
 	assert.True(ok, "Config map should be accessible")
 	assert.NotNil(vs, "Config map should be object")
 
@@ -1483,23 +1688,23 @@ func testConfigMapKeysImpl(t *testing.T, isNodePort bool) {
 }
 
 func TestNamespaceIsolation(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	require := require.New(t)
 	assert := assert.New(t)
 
 	fake := fake.NewSimpleClientset()
 	require.NotNil(fake, "Mock client should not be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
 
 	cfgFoo := newConfigMap("foomap", "1", "default", map[string]string{
 		"schema": schemaUrl,
@@ -1513,63 +1718,138 @@ func TestNamespaceIsolation(t *testing.T) {
 		[]v1.ServicePort{{Port: 80, NodePort: 50000}})
 
 	endptStore := newStore(nil)
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
-		nil, cfgFoo}, true, endptStore)
-	_, ok = virtualServers.m[serviceKey{"foo", 80, "default"}]
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgFoo}, endptStore)
+	_, ok := vsm.vservers.svcIndex[serviceKey{"foo", 80, "default", v1.ProtocolTCP}]
 	assert.True(ok, "Config map should be accessible")
 
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
-		nil, cfgBar}, true, endptStore)
-	_, ok = virtualServers.m[serviceKey{"foo", 80, "wrongnamespace"}]
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgBar}, endptStore)
+	_, ok = vsm.vservers.svcIndex[serviceKey{"foo", 80, "wrongnamespace", v1.ProtocolTCP}]
 	assert.False(ok, "Config map should not be added if namespace does not match flag")
-	assert.Contains(virtualServers.m, serviceKey{"foo", 80, "default"},
+	assert.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should contain original config")
-	assert.Equal(1, len(virtualServers.m), "There should only be 1 virtual server")
+	assert.Equal(1, len(vsm.vservers.m), "There should only be 1 virtual server")
 
-	ProcessConfigMapUpdate(fake, eventStream.Updated, eventStream.ChangedObject{
-		cfgBar, cfgBar}, true, endptStore)
-	_, ok = virtualServers.m[serviceKey{"foo", 80, "wrongnamespace"}]
+	vsm.ProcessConfigMapUpdate(eventStream.Updated, eventStream.ChangedObject{
+		cfgBar, cfgBar}, endptStore)
+	_, ok = vsm.vservers.svcIndex[serviceKey{"foo", 80, "wrongnamespace", v1.ProtocolTCP}]
 	assert.False(ok, "Config map should not be added if namespace does not match flag")
-	assert.Contains(virtualServers.m, serviceKey{"foo", 80, "default"},
+	assert.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should contain original config")
-	assert.Equal(1, len(virtualServers.m), "There should only be 1 virtual server")
+	assert.Equal(1, len(vsm.vservers.m), "There should only be 1 virtual server")
 
-	ProcessConfigMapUpdate(fake, eventStream.Deleted, eventStream.ChangedObject{
-		cfgBar, nil}, true, endptStore)
-	_, ok = virtualServers.m[serviceKey{"foo", 80, "wrongnamespace"}]
+	vsm.ProcessConfigMapUpdate(eventStream.Deleted, eventStream.ChangedObject{
+		cfgBar, nil}, endptStore)
+	_, ok = vsm.vservers.svcIndex[serviceKey{"foo", 80, "wrongnamespace", v1.ProtocolTCP}]
 	assert.False(ok, "Config map should not be deleted if namespace does not match flag")
-	_, ok = virtualServers.m[serviceKey{"foo", 80, "default"}]
+	_, ok = vsm.vservers.svcIndex[serviceKey{"foo", 80, "default", v1.ProtocolTCP}]
 	assert.True(ok, "Config map should be accessible after delete called on incorrect namespace")
 
-	ProcessServiceUpdate(fake, eventStream.Added, eventStream.ChangedObject{
-		nil, servFoo}, true, endptStore)
-	vs, ok := virtualServers.m[serviceKey{"foo", 80, "default"}]
+	vsm.ProcessServiceUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, servFoo}, endptStore)
+	vs, ok := vsm.vservers.m["default_foomap"]
 	assert.True(ok, "Service should be accessible")
 	assert.EqualValues(37001, vs.VirtualServer.Backend.PoolMemberPort, "Port should match initial config")
 
-	ProcessServiceUpdate(fake, eventStream.Added, eventStream.ChangedObject{
-		nil, servBar}, true, endptStore)
-	_, ok = virtualServers.m[serviceKey{"foo", 80, "wrongnamespace"}]
+	vsm.ProcessServiceUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, servBar}, endptStore)
+	_, ok = vsm.vservers.svcIndex[serviceKey{"foo", 80, "wrongnamespace", v1.ProtocolTCP}]
 	assert.False(ok, "Service should not be added if namespace does not match flag")
-	vs, ok = virtualServers.m[serviceKey{"foo", 80, "default"}]
+	vs, ok = vsm.vservers.m["default_foomap"]
 	assert.True(ok, "Service should be accessible")
 	assert.EqualValues(37001, vs.VirtualServer.Backend.PoolMemberPort, "Port should match initial config")
 
-	ProcessServiceUpdate(fake, eventStream.Updated, eventStream.ChangedObject{
-		servBar, servBar}, true, endptStore)
-	_, ok = virtualServers.m[serviceKey{"foo", 80, "wrongnamespace"}]
+	vsm.ProcessServiceUpdate(eventStream.Updated, eventStream.ChangedObject{
+		servBar, servBar}, endptStore)
+	_, ok = vsm.vservers.svcIndex[serviceKey{"foo", 80, "wrongnamespace", v1.ProtocolTCP}]
 	assert.False(ok, "Service should not be added if namespace does not match flag")
-	vs, ok = virtualServers.m[serviceKey{"foo", 80, "default"}]
+	vs, ok = vsm.vservers.m["default_foomap"]
 	assert.True(ok, "Service should be accessible")
 	assert.EqualValues(37001, vs.VirtualServer.Backend.PoolMemberPort, "Port should match initial config")
 
-	ProcessServiceUpdate(fake, eventStream.Deleted, eventStream.ChangedObject{
-		servBar, nil}, true, endptStore)
-	vs, ok = virtualServers.m[serviceKey{"foo", 80, "default"}]
+	vsm.ProcessServiceUpdate(eventStream.Deleted, eventStream.ChangedObject{
+		servBar, nil}, endptStore)
+	vs, ok = vsm.vservers.m["default_foomap"]
 	assert.True(ok, "Service should not have been deleted")
 	assert.EqualValues(37001, vs.VirtualServer.Backend.PoolMemberPort, "Port should match initial config")
 }
 
+func TestMultipleNamespaces(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	assert.NotNil(t, mw)
+
+	require := require.New(t)
+
+	cfgFoo := newConfigMap("foomap", "1", "default", map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	cfgBar := newConfigMap("foomap", "1", "production", map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	cfgBaz := newConfigMap("foomap", "1", "staging", map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFoo})
+	servFoo := newService("foo", "1", "default", "NodePort",
+		[]v1.ServicePort{{Port: 80, NodePort: 37001}})
+	servBar := newService("foo", "1", "production", "NodePort",
+		[]v1.ServicePort{{Port: 80, NodePort: 50000}})
+
+	fake := fake.NewSimpleClientset()
+	require.NotNil(fake, "Mock client should not be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{"default", "production"},
+		IsNodePort:   true,
+	})
+	endptStore := newStore(nil)
+
+	for _, cm := range []*v1.ConfigMap{cfgFoo, cfgBar, cfgBaz} {
+		vsm.ProcessConfigMapUpdate(eventStream.Added,
+			eventStream.ChangedObject{nil, cm}, endptStore)
+	}
+	require.Equal(2, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP})
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "production", v1.ProtocolTCP})
+	require.NotContains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "staging", v1.ProtocolTCP})
+	require.Equal("production_foomap",
+		getVirtualServer(t, vsm, serviceKey{"foo", 80, "production", v1.ProtocolTCP}).VirtualServer.Frontend.VirtualServerName)
+
+	// Services only update the virtual server in their own namespace
+	vsm.ProcessServiceUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, servFoo}, endptStore)
+	vsm.ProcessServiceUpdate(eventStream.Added, eventStream.ChangedObject{
+		nil, servBar}, endptStore)
+	require.EqualValues(37001, getVirtualServer(t, vsm, serviceKey{"foo", 80, "default", v1.ProtocolTCP}).
+		VirtualServer.Backend.PoolMemberPort)
+	require.EqualValues(50000, getVirtualServer(t, vsm, serviceKey{"foo", 80, "production", v1.ProtocolTCP}).
+		VirtualServer.Backend.PoolMemberPort)
+
+	vsm.ProcessConfigMapUpdate(eventStream.Deleted, eventStream.ChangedObject{
+		cfgBar, nil}, endptStore)
+	require.Equal(1, len(vsm.vservers.m))
+	require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", 80, "default", v1.ProtocolTCP})
+
+	// An empty namespace list watches everything
+	vsmAll := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		IsNodePort:   true,
+	})
+	for _, cm := range []*v1.ConfigMap{cfgFoo, cfgBar, cfgBaz} {
+		vsmAll.ProcessConfigMapUpdate(eventStream.Added,
+			eventStream.ChangedObject{nil, cm}, endptStore)
+	}
+	require.Equal(3, len(vsmAll.vservers.m))
+	require.Contains(vsmAll.vservers.m, "staging_foomap")
+	require.Equal(1, len(vsm.vservers.m),
+		"Managers should not share virtual servers")
+}
+
 func TestConfigMapKeysNodePort(t *testing.T) {
 	testConfigMapKeysImpl(t, true)
 }
@@ -1579,17 +1859,11 @@ func TestConfigMapKeysCluster(t *testing.T) {
 }
 
 func TestProcessUpdatesIAppNodePort(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	assert := assert.New(t)
 	require := require.New(t)
@@ -1625,6 +1899,12 @@ func TestProcessUpdatesIAppNodePort(t *testing.T) {
 		&v1.ServiceList{Items: []v1.Service{*iapp1, *iapp2}},
 		&v1.NodeList{Items: nodes})
 	require.NotNil(fake, "Mock client cannot be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
 
 	m, err := fake.Core().ConfigMaps("").List(api.ListOptions{})
 	require.Nil(err)
@@ -1637,67 +1917,67 @@ func TestProcessUpdatesIAppNodePort(t *testing.T) {
 	assert.Equal(2, len(s.Items))
 	assert.Equal(4, len(n.Items))
 
-	useNodeInternal = true
-	ProcessNodeUpdate(n.Items, err)
+	setUseNodeInternal(vsm, true)
+	vsm.ProcessNodeUpdate(n.Items, err)
 
 	// ConfigMap ADDED
 	endptStore := newStore(nil)
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
 		cfgIapp1,
-	}, true, endptStore)
-	assert.Equal(1, len(virtualServers.m))
+	}, endptStore)
+	assert.Equal(1, len(vsm.vservers.m))
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"iapp1", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"iapp1", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 
 	// Second ConfigMap ADDED
-	ProcessConfigMapUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
 		cfgIapp2,
-	}, true, endptStore)
-	assert.Equal(2, len(virtualServers.m))
+	}, endptStore)
+	assert.Equal(2, len(vsm.vservers.m))
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"iapp1", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"iapp1", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues(addrs,
-		virtualServers.m[serviceKey{"iapp2", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"iapp2", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 
 	// Service ADDED
-	ProcessServiceUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessServiceUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
-		iapp1}, true, endptStore)
-	assert.Equal(2, len(virtualServers.m))
+		iapp1}, endptStore)
+	assert.Equal(2, len(vsm.vservers.m))
 
 	// Second Service ADDED
-	ProcessServiceUpdate(fake, eventStream.Added, eventStream.ChangedObject{
+	vsm.ProcessServiceUpdate(eventStream.Added, eventStream.ChangedObject{
 		nil,
-		iapp2}, true, endptStore)
-	assert.Equal(2, len(virtualServers.m))
+		iapp2}, endptStore)
+	assert.Equal(2, len(vsm.vservers.m))
 
 	// ConfigMap UPDATED
-	ProcessConfigMapUpdate(fake, eventStream.Updated, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Updated, eventStream.ChangedObject{
 		cfgIapp1,
 		cfgIapp1,
-	}, true, endptStore)
-	assert.Equal(2, len(virtualServers.m))
+	}, endptStore)
+	assert.Equal(2, len(vsm.vservers.m))
 
 	// Service UPDATED
-	ProcessServiceUpdate(fake, eventStream.Updated, eventStream.ChangedObject{
+	vsm.ProcessServiceUpdate(eventStream.Updated, eventStream.ChangedObject{
 		iapp1,
-		iapp1}, true, endptStore)
-	assert.Equal(2, len(virtualServers.m))
+		iapp1}, endptStore)
+	assert.Equal(2, len(vsm.vservers.m))
 
 	// Nodes ADDED
 	_, err = fake.Core().Nodes().Create(extraNode)
 	require.Nil(err)
-	useNodeInternal = true
+	setUseNodeInternal(vsm, true)
 	n, err = fake.Core().Nodes().List(api.ListOptions{})
 	assert.Nil(err, "Should not fail listing nodes")
-	ProcessNodeUpdate(n.Items, err)
-	assert.Equal(2, len(virtualServers.m))
+	vsm.ProcessNodeUpdate(n.Items, err)
+	assert.Equal(2, len(vsm.vservers.m))
 	assert.EqualValues(append(addrs, "192.168.0.4"),
-		virtualServers.m[serviceKey{"iapp1", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"iapp1", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues(append(addrs, "192.168.0.4"),
-		virtualServers.m[serviceKey{"iapp2", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"iapp2", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	validateConfig(t, mw, twoIappsThreeNodesConfig)
 
 	// Nodes DELETES
@@ -1705,15 +1985,15 @@ func TestProcessUpdatesIAppNodePort(t *testing.T) {
 	require.Nil(err)
 	err = fake.Core().Nodes().Delete("node2", &api.DeleteOptions{})
 	require.Nil(err)
-	useNodeInternal = true
+	setUseNodeInternal(vsm, true)
 	n, err = fake.Core().Nodes().List(api.ListOptions{})
 	assert.Nil(err, "Should not fail listing nodes")
-	ProcessNodeUpdate(n.Items, err)
-	assert.Equal(2, len(virtualServers.m))
+	vsm.ProcessNodeUpdate(n.Items, err)
+	assert.Equal(2, len(vsm.vservers.m))
 	assert.EqualValues([]string{"192.168.0.4"},
-		virtualServers.m[serviceKey{"iapp1", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"iapp1", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	assert.EqualValues([]string{"192.168.0.4"},
-		virtualServers.m[serviceKey{"iapp2", 80, "default"}].VirtualServer.Backend.PoolMemberAddrs)
+		getVirtualServer(t, vsm, serviceKey{"iapp2", 80, "default", v1.ProtocolTCP}).VirtualServer.Backend.PoolMemberAddrs)
 	validateConfig(t, mw, twoIappsOneNodeConfig)
 
 	// ConfigMap DELETED
@@ -1721,12 +2001,12 @@ func TestProcessUpdatesIAppNodePort(t *testing.T) {
 		&api.DeleteOptions{})
 	m, err = fake.Core().ConfigMaps("").List(api.ListOptions{})
 	assert.Equal(1, len(m.Items))
-	ProcessConfigMapUpdate(fake, eventStream.Deleted, eventStream.ChangedObject{
+	vsm.ProcessConfigMapUpdate(eventStream.Deleted, eventStream.ChangedObject{
 		cfgIapp1,
 		nil,
-	}, true, endptStore)
-	assert.Equal(1, len(virtualServers.m))
-	assert.NotContains(virtualServers.m, serviceKey{"iapp1", 80, "default"},
+	}, endptStore)
+	assert.Equal(1, len(vsm.vservers.m))
+	assert.NotContains(vsm.vservers.svcIndex, serviceKey{"iapp1", 80, "default", v1.ProtocolTCP},
 		"Config map should be removed after delete")
 	validateConfig(t, mw, oneIappOneNodeConfig)
 
@@ -1735,32 +2015,23 @@ func TestProcessUpdatesIAppNodePort(t *testing.T) {
 	require.Nil(err)
 	s, err = fake.Core().Services("").List(api.ListOptions{})
 	assert.Equal(1, len(s.Items))
-	ProcessServiceUpdate(fake, eventStream.Deleted, eventStream.ChangedObject{
+	vsm.ProcessServiceUpdate(eventStream.Deleted, eventStream.ChangedObject{
 		iapp2,
-		nil}, true, endptStore)
-	assert.Equal(1, len(virtualServers.m))
+		nil}, endptStore)
+	assert.Equal(1, len(vsm.vservers.m))
 	validateConfig(t, mw, emptyConfig)
 }
 
 func TestSchemaValidation(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	require := require.New(t)
 	assert := assert.New(t)
 
-	fake := fake.NewSimpleClientset()
-	require.NotNil(fake, "Mock client should not be nil")
-
 	// JSON is valid, but values are invalid
 	var configmapFoo string = string(`{
 	  "virtualServer": {
@@ -1770,7 +2041,7 @@ func TestSchemaValidation(t *testing.T) {
 	    },
 	    "frontend": {
 	      "balance": "super-duper-mojo",
-	      "mode": "udp",
+	      "mode": "sctp",
 	      "partition": "",
 	      "virtualAddress": {
 	        "bindAddr": "10.128.10.260",
@@ -1787,12 +2058,13 @@ func TestSchemaValidation(t *testing.T) {
 		"schema": schemaUrl,
 		"data":   configmapFoo,
 	})
-	cfg, err := parseVirtualServerConfig(badjson)
+	vsm := NewManager(&Params{ConfigWriter: mw})
+	cfg, err := vsm.parseVirtualServerConfig(badjson)
 	require.Nil(cfg, "Should not have parsed bad configmap")
 	assert.Contains(err.Error(),
 		"virtualServer.frontend.partition: String length must be greater than or equal to 1")
 	assert.Contains(err.Error(),
-		"virtualServer.frontend.mode: virtualServer.frontend.mode must be one of the following: \\\"http\\\", \\\"tcp\\\"")
+		"virtualServer.frontend.mode: virtualServer.frontend.mode must be one of the following: \\\"http\\\", \\\"tcp\\\", \\\"udp\\\"")
 	assert.Contains(err.Error(),
 		"virtualServer.frontend.balance: virtualServer.frontend.balance must be one of the following:")
 	assert.Contains(err.Error(),
@@ -1807,12 +2079,61 @@ func TestSchemaValidation(t *testing.T) {
 		"virtualServer.backend.servicePort: Must be greater than or equal to 1")
 }
 
-func validateServiceIps(t *testing.T, serviceName, namespace string,
+func TestSchemaVersions(t *testing.T) {
+	require := require.New(t)
+	vsm := NewManager(&Params{})
+
+	// ConfigMaps written against v0.1.2 keep working
+	legacy := newConfigMap("foomap", "1", "default", map[string]string{
+		"schema": legacySchemaUrl,
+		"data":   configmapFoo,
+	})
+	cfg, err := vsm.parseVirtualServerConfig(legacy)
+	require.Nil(err, "v0.1.2 config should parse")
+	require.NotNil(cfg)
+	require.Equal("foo", cfg.VirtualServer.Backend.ServiceName)
+
+	var configmapRules string = string(`{
+	  "virtualServer": {
+	    "backend": {
+	      "serviceName": "foo",
+	      "servicePort": 80
+	    },
+	    "frontend": {
+	      "partition": "velcro",
+	      "mode": "http",
+	      "virtualAddress": {
+	        "bindAddr": "10.128.10.240",
+	        "port": 80
+	      },
+	      "rules": [
+	        {"host": "bar.example.com", "serviceName": "bar", "servicePort": 80}
+	      ]
+	    }
+	  }
+	}`)
+	rules := newConfigMap("rulesmap", "1", "default", map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapRules,
+	})
+	cfg, err = vsm.parseVirtualServerConfig(rules)
+	require.Nil(err, "v0.1.3 config with rules should parse")
+	require.Equal([]RuleConfig{
+		{Host: "bar.example.com", ServiceName: "bar", ServicePort: 80},
+	}, cfg.VirtualServer.Frontend.Rules)
+
+	// v0.1.3 validates the rules themselves
+	rules.Data["data"] = strings.Replace(configmapRules,
+		`"serviceName": "bar", `, "", 1)
+	cfg, err = vsm.parseVirtualServerConfig(rules)
+	require.Nil(cfg)
+	require.Contains(err.Error(), "serviceName is required")
+}
+
+func validateServiceIps(t *testing.T, vsm *Manager, serviceName, namespace string,
 	svcPorts []v1.ServicePort, ips []string) {
 	for _, p := range svcPorts {
-		vs, ok := virtualServers.m[serviceKey{serviceName, p.Port, namespace}]
-		require.True(t, ok)
-		require.NotNil(t, vs)
+		vs := getVirtualServer(t, vsm, serviceKey{serviceName, p.Port, namespace, v1.ProtocolTCP})
 		var expectedIps []string
 		if ips != nil {
 			expectedIps = []string{}
@@ -1827,17 +2148,11 @@ func validateServiceIps(t *testing.T, serviceName, namespace string,
 }
 
 func TestVirtualServerWhenEndpointsEmpty(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	require := require.New(t)
 
@@ -1855,12 +2170,19 @@ func TestVirtualServerWhenEndpointsEmpty(t *testing.T) {
 
 	foo := newService(svcName, "1", namespace, v1.ServiceTypeClusterIP, svcPorts)
 	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	require.NotNil(fake, "Mock client cannot be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   false,
+	})
 
 	svcStore := newStore(nil)
 	svcStore.Add(foo)
 	var endptStore *eventStream.EventStore
 	onEndptChange := func(changeType eventStream.ChangeType, obj interface{}) {
-		ProcessEndpointsUpdate(fake, changeType, obj, svcStore)
+		vsm.ProcessEndpointsUpdate(changeType, obj, svcStore)
 	}
 	endptStore = newStore(onEndptChange)
 
@@ -1876,50 +2198,44 @@ func TestVirtualServerWhenEndpointsEmpty(t *testing.T) {
 	err = endptStore.Add(badEndpts)
 	require.Nil(err)
 
-	r := processConfigMap(fake, eventStream.Added, eventStream.ChangedObject{
-		nil, cfgFoo}, false, endptStore)
+	r := vsm.processConfigMap(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgFoo}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	require.Equal(len(svcPorts), len(virtualServers.m))
+	require.Equal(len(svcPorts), len(vsm.vservers.m))
 	for _, p := range svcPorts {
-		require.Contains(virtualServers.m, serviceKey{"foo", p.Port, namespace})
-		vs := virtualServers.m[serviceKey{"foo", p.Port, namespace}]
+		require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", p.Port, namespace, v1.ProtocolTCP})
+		vs := getVirtualServer(t, vsm, serviceKey{"foo", p.Port, namespace, v1.ProtocolTCP})
 		require.EqualValues(0, vs.VirtualServer.Backend.PoolMemberPort)
 	}
 
-	validateServiceIps(t, svcName, namespace, svcPorts, []string{})
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, []string{})
 
 	// Move it back to ready from not ready and make sure it is re-added
 	err = endptStore.Update(newEndpoints(svcName, "2", namespace, readyIps,
 		notReadyIps, endptPorts))
 	require.Nil(err)
-	validateServiceIps(t, svcName, namespace, svcPorts, readyIps)
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, readyIps)
 
 	// Remove all endpoints make sure they are removed but virtual server exists
 	err = endptStore.Update(newEndpoints(svcName, "3", namespace, emptyIps,
 		emptyIps, endptPorts))
 	require.Nil(err)
-	validateServiceIps(t, svcName, namespace, svcPorts, []string{})
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, []string{})
 
 	// Move it back to ready from not ready and make sure it is re-added
 	err = endptStore.Update(newEndpoints(svcName, "4", namespace, readyIps,
 		notReadyIps, endptPorts))
 	require.Nil(err)
-	validateServiceIps(t, svcName, namespace, svcPorts, readyIps)
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, readyIps)
 }
 
 func TestVirtualServerWhenEndpointsChange(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	require := require.New(t)
 
@@ -1945,30 +2261,36 @@ func TestVirtualServerWhenEndpointsChange(t *testing.T) {
 
 	foo := newService(svcName, "1", namespace, v1.ServiceTypeClusterIP, svcPorts)
 	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   false,
+	})
 
 	svcStore := newStore(nil)
 	svcStore.Add(foo)
 	var endptStore *eventStream.EventStore
 	onEndptChange := func(changeType eventStream.ChangeType, obj interface{}) {
-		ProcessEndpointsUpdate(fake, changeType, obj, svcStore)
+		vsm.ProcessEndpointsUpdate(changeType, obj, svcStore)
 	}
 	endptStore = newStore(onEndptChange)
 
-	r := processConfigMap(fake, eventStream.Added, eventStream.ChangedObject{
-		nil, cfgFoo}, false, endptStore)
+	r := vsm.processConfigMap(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgFoo}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	r = processConfigMap(fake, eventStream.Added, eventStream.ChangedObject{
-		nil, cfgFoo8080}, false, endptStore)
+	r = vsm.processConfigMap(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgFoo8080}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	r = processConfigMap(fake, eventStream.Added, eventStream.ChangedObject{
-		nil, cfgFoo9090}, false, endptStore)
+	r = vsm.processConfigMap(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgFoo9090}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	require.Equal(len(svcPorts), len(virtualServers.m))
+	require.Equal(len(svcPorts), len(vsm.vservers.m))
 	for _, p := range svcPorts {
-		require.Contains(virtualServers.m, serviceKey{"foo", p.Port, namespace})
+		require.Contains(vsm.vservers.svcIndex, serviceKey{"foo", p.Port, namespace, v1.ProtocolTCP})
 	}
 
 	endptPorts := convertSvcPortsToEndpointPorts(svcPorts)
@@ -1982,7 +2304,7 @@ func TestVirtualServerWhenEndpointsChange(t *testing.T) {
 	err = endptStore.Add(badEndpts)
 	require.Nil(err)
 
-	validateServiceIps(t, svcName, namespace, svcPorts, readyIps)
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, readyIps)
 
 	// Move an endpoint from ready to not ready and make sure it
 	// goes away from virtual servers
@@ -1991,7 +2313,7 @@ func TestVirtualServerWhenEndpointsChange(t *testing.T) {
 	err = endptStore.Update(newEndpoints(svcName, "2", namespace, readyIps,
 		notReadyIps, endptPorts))
 	require.Nil(err)
-	validateServiceIps(t, svcName, namespace, svcPorts, readyIps)
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, readyIps)
 
 	// Move it back to ready from not ready and make sure it is re-added
 	readyIps = append(readyIps, notReadyIps[len(notReadyIps)-1])
@@ -1999,33 +2321,27 @@ func TestVirtualServerWhenEndpointsChange(t *testing.T) {
 	err = endptStore.Update(newEndpoints(svcName, "3", namespace, readyIps,
 		notReadyIps, endptPorts))
 	require.Nil(err)
-	validateServiceIps(t, svcName, namespace, svcPorts, readyIps)
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, readyIps)
 
 	// Remove all endpoints make sure they are removed but virtual server exists
 	err = endptStore.Update(newEndpoints(svcName, "4", namespace, emptyIps,
 		emptyIps, endptPorts))
 	require.Nil(err)
-	validateServiceIps(t, svcName, namespace, svcPorts, []string{})
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, []string{})
 
 	// Move it back to ready from not ready and make sure it is re-added
 	err = endptStore.Update(newEndpoints(svcName, "5", namespace, readyIps,
 		notReadyIps, endptPorts))
 	require.Nil(err)
-	validateServiceIps(t, svcName, namespace, svcPorts, readyIps)
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, readyIps)
 }
 
 func TestVirtualServerWhenServiceChanges(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	require := require.New(t)
 
@@ -2040,15 +2356,21 @@ func TestVirtualServerWhenServiceChanges(t *testing.T) {
 
 	foo := newService(svcName, "1", namespace, v1.ServiceTypeClusterIP, svcPorts)
 	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   false,
+	})
 
 	onSvcChange := func(changeType eventStream.ChangeType, obj interface{}) {
 		if changeType == eventStream.Replaced {
 			v := obj.([]interface{})
 			for _, item := range v {
-				processService(fake, changeType, item, false, endptStore)
+				vsm.processService(changeType, item, endptStore)
 			}
 		} else {
-			processService(fake, changeType, obj, false, endptStore)
+			vsm.processService(changeType, obj, endptStore)
 		}
 	}
 	svcStore := newStore(onSvcChange)
@@ -2069,45 +2391,39 @@ func TestVirtualServerWhenServiceChanges(t *testing.T) {
 		"schema": schemaUrl,
 		"data":   configmapFoo9090})
 
-	r := processConfigMap(fake, eventStream.Added, eventStream.ChangedObject{
-		nil, cfgFoo}, false, endptStore)
+	r := vsm.processConfigMap(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgFoo}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	r = processConfigMap(fake, eventStream.Added, eventStream.ChangedObject{
-		nil, cfgFoo8080}, false, endptStore)
+	r = vsm.processConfigMap(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgFoo8080}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	r = processConfigMap(fake, eventStream.Added, eventStream.ChangedObject{
-		nil, cfgFoo9090}, false, endptStore)
+	r = vsm.processConfigMap(eventStream.Added, eventStream.ChangedObject{
+		nil, cfgFoo9090}, endptStore)
 	require.True(r, "Config map should be processed")
 
-	require.Equal(len(svcPorts), len(virtualServers.m))
-	validateServiceIps(t, svcName, namespace, svcPorts, svcPodIps)
+	require.Equal(len(svcPorts), len(vsm.vservers.m))
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, svcPodIps)
 
 	// delete the service and make sure the IPs go away on the VS
 	svcStore.Delete(foo)
-	require.Equal(len(svcPorts), len(virtualServers.m))
-	validateServiceIps(t, svcName, namespace, svcPorts, nil)
+	require.Equal(len(svcPorts), len(vsm.vservers.m))
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, nil)
 
 	// re-add the service
 	foo.ObjectMeta.ResourceVersion = "2"
 	svcStore.Add(foo)
-	require.Equal(len(svcPorts), len(virtualServers.m))
-	validateServiceIps(t, svcName, namespace, svcPorts, svcPodIps)
+	require.Equal(len(svcPorts), len(vsm.vservers.m))
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts, svcPodIps)
 }
 
 func TestVirtualServerWhenConfigMapChanges(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	require := require.New(t)
 
@@ -2126,18 +2442,24 @@ func TestVirtualServerWhenConfigMapChanges(t *testing.T) {
 
 	foo := newService(svcName, "1", namespace, v1.ServiceTypeClusterIP, svcPorts)
 	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   false,
+	})
 
 	// no virtual servers yet
-	require.Equal(0, len(virtualServers.m))
+	require.Equal(0, len(vsm.vservers.m))
 
 	onCfgChange := func(changeType eventStream.ChangeType, obj interface{}) {
 		if changeType == eventStream.Replaced {
 			v := obj.([]interface{})
 			for _, item := range v {
-				processConfigMap(fake, changeType, item, false, endptStore)
+				vsm.processConfigMap(changeType, item, endptStore)
 			}
 		} else {
-			processConfigMap(fake, changeType, obj, false, endptStore)
+			vsm.processConfigMap(changeType, obj, endptStore)
 		}
 	}
 	cfgStore := newStore(onCfgChange)
@@ -2147,35 +2469,29 @@ func TestVirtualServerWhenConfigMapChanges(t *testing.T) {
 		"schema": schemaUrl,
 		"data":   configmapFoo})
 	cfgStore.Add(cfgFoo)
-	require.Equal(1, len(virtualServers.m))
-	validateServiceIps(t, svcName, namespace, svcPorts[:1], svcPodIps)
+	require.Equal(1, len(vsm.vservers.m))
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts[:1], svcPodIps)
 
 	// add another
 	cfgFoo8080 := newConfigMap("foomap8080", "1", namespace, map[string]string{
 		"schema": schemaUrl,
 		"data":   configmapFoo8080})
 	cfgStore.Add(cfgFoo8080)
-	require.Equal(2, len(virtualServers.m))
-	validateServiceIps(t, svcName, namespace, svcPorts[:2], svcPodIps)
+	require.Equal(2, len(vsm.vservers.m))
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts[:2], svcPodIps)
 
 	// remove first one
 	cfgStore.Delete(cfgFoo)
-	require.Equal(1, len(virtualServers.m))
-	validateServiceIps(t, svcName, namespace, svcPorts[1:2], svcPodIps)
+	require.Equal(1, len(vsm.vservers.m))
+	validateServiceIps(t, vsm, svcName, namespace, svcPorts[1:2], svcPodIps)
 }
 
 func TestUpdatesConcurrentCluster(t *testing.T) {
-	config = &test.MockWriter{
+	mw := &test.MockWriter{
 		FailStyle: test.Success,
 		Sections:  make(map[string]interface{}),
 	}
-	mw, ok := config.(*test.MockWriter)
 	assert.NotNil(t, mw)
-	assert.True(t, ok)
-
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
 
 	assert := assert.New(t)
 	require := require.New(t)
@@ -2196,24 +2512,29 @@ func TestUpdatesConcurrentCluster(t *testing.T) {
 	bar := newService("bar", "1", namespace, v1.ServiceTypeClusterIP, barPorts)
 
 	fake := fake.NewSimpleClientset()
-	require.NotNil(fake, "Mock client cannot be nil")
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   false,
+	})
 
 	var cfgStore *eventStream.EventStore
 	var endptStore *eventStream.EventStore
 	var svcStore *eventStream.EventStore
 
 	onCfgChange := func(changeType eventStream.ChangeType, obj interface{}) {
-		ProcessConfigMapUpdate(fake, changeType, obj, false, endptStore)
+		vsm.ProcessConfigMapUpdate(changeType, obj, endptStore)
 	}
 	cfgStore = newStore(onCfgChange)
 
 	onEndptChange := func(changeType eventStream.ChangeType, obj interface{}) {
-		ProcessEndpointsUpdate(fake, changeType, obj, svcStore)
+		vsm.ProcessEndpointsUpdate(changeType, obj, svcStore)
 	}
 	endptStore = newStore(onEndptChange)
 
 	onSvcChange := func(changeType eventStream.ChangeType, obj interface{}) {
-		ProcessServiceUpdate(fake, changeType, obj, false, endptStore)
+		vsm.ProcessServiceUpdate(changeType, obj, endptStore)
 		o, ok := obj.(eventStream.ChangedObject)
 		require.True(ok, "expected eventStream.ChangedObject")
 		switch changeType {
@@ -2325,15 +2646,11 @@ func TestUpdatesConcurrentCluster(t *testing.T) {
 	case <-time.After(time.Second * 30):
 		assert.FailNow("Timed out excpecting service channel notification")
 	}
-	assert.Equal(1, len(virtualServers.m))
+	assert.Equal(1, len(vsm.vservers.m))
 	validateConfig(t, mw, oneSvcTwoPodsConfig)
 }
 
 func TestNonNodePortServiceModeNodePort(t *testing.T) {
-	defer func() {
-		virtualServers.m = make(map[serviceKey]*VirtualServerConfig)
-	}()
-
 	assert := assert.New(t)
 	require := require.New(t)
 
@@ -2349,21 +2666,23 @@ func TestNonNodePortServiceModeNodePort(t *testing.T) {
 
 	fake := fake.NewSimpleClientset()
 	require.NotNil(fake, "Mock client cannot be nil")
+	vsm := NewManager(&Params{
+		KubeClient: fake,
+		Namespaces: []string{namespace},
+		IsNodePort: true,
+	})
 
 	endptStore := newStore(nil)
-	r := processConfigMap(
-		fake,
-		eventStream.Added,
+	r := vsm.processConfigMap(eventStream.Added,
 		eventStream.ChangedObject{nil, cfgFoo},
-		true,
 		endptStore,
 	)
 	require.True(r, "Config map should be processed")
 
-	require.Equal(1, len(virtualServers.m))
+	require.Equal(1, len(vsm.vservers.m))
 	require.Contains(
-		virtualServers.m,
-		serviceKey{"foo", 80, "default"},
+		vsm.vservers.svcIndex,
+		serviceKey{"foo", 80, "default", v1.ProtocolTCP},
 		"Virtual servers should have an entry",
 	)
 
@@ -2375,13 +2694,262 @@ func TestNonNodePortServiceModeNodePort(t *testing.T) {
 		[]v1.ServicePort{{Port: 80}},
 	)
 
-	r = processService(
-		fake,
-		eventStream.Added,
+	r = vsm.processService(eventStream.Added,
 		eventStream.ChangedObject{nil, foo},
-		true,
 		endptStore,
 	)
 
 	assert.False(r, "Should not process non NodePort Service")
 }
+
+func TestEndpointsIPv6(t *testing.T) {
+	require := require.New(t)
+
+	ports := []v1.EndpointPort{{Name: "http", Port: 8080}}
+	eps := newEndpoints("foo", "1", namespace,
+		[]string{"2001:db8::2", "10.2.96.1"}, []string{"2001:db8::3"}, ports)
+	require.Equal([]string{"10.2.96.1:8080", "[2001:db8::2]:8080"},
+		getEndpointsForService("http", v1.ProtocolTCP, eps))
+	require.Equal([]string{"[2001:db8::3]:8080"},
+		getNotReadyEndpointsForService("http", v1.ProtocolTCP, eps))
+
+	// Member attributes are still found by address
+	var cfg VirtualServerConfig
+	cfg.VirtualServer.Backend.PoolMemberAddrs =
+		getEndpointsForService("http", v1.ProtocolTCP, eps)
+	require.True(setPoolMemberOptions(&cfg, map[string]PoolMemberOptions{
+		"2001:db8::2": {Ratio: 2},
+	}))
+	require.Equal(map[string]PoolMemberOptions{
+		"[2001:db8::2]:8080": {Ratio: 2},
+	}, cfg.VirtualServer.Backend.PoolMemberOptions)
+}
+
+func TestNodeAddressFamily(t *testing.T) {
+	nodes := []v1.Node{
+		*newNode("node0", "0", false, []v1.NodeAddress{
+			{"InternalIP", "10.10.0.1"}, {"InternalIP", "fd00::1"}}),
+		*newNode("node1", "1", false, []v1.NodeAddress{
+			{"InternalIP", "fd00::2"}, {"ExternalIP", "2001:db8::2"}}),
+		*newNode("node2", "2", false, []v1.NodeAddress{
+			{"InternalIP", "10.10.0.3"}}),
+	}
+
+	tests := map[string][]string{
+		"":                {"10.10.0.1", "fd00::1", "fd00::2", "10.10.0.3"},
+		AddressFamilyAny:  {"10.10.0.1", "fd00::1", "fd00::2", "10.10.0.3"},
+		AddressFamilyIPv4: {"10.10.0.1", "10.10.0.3"},
+		AddressFamilyIPv6: {"fd00::1", "fd00::2"},
+	}
+	for family, expected := range tests {
+		vsm := NewManager(&Params{
+			UseNodeInternal:   true,
+			NodeAddressFamily: family,
+		})
+		addrs, err := vsm.getNodeAddresses(nodes)
+		require.Nil(t, err)
+		assert.Equal(t, expected, addrs, "Wrong addresses for %q", family)
+	}
+
+	vsm := NewManager(&Params{UseNodeInternal: false})
+	addrs, err := vsm.getNodeAddresses(nodes)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"2001:db8::2"}, addrs)
+}
+
+func TestParseBindAddrs(t *testing.T) {
+	addr, addr6, err := parseBindAddrs("10.128.10.240")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.128.10.240", addr)
+	assert.Empty(t, addr6)
+
+	addr, addr6, err = parseBindAddrs("2001:db8::f0")
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::f0", addr)
+	assert.Empty(t, addr6, "IPv6 only virtual servers are not dual-stack")
+
+	for _, value := range []string{
+		"2001:db8::f0, 10.128.10.240",
+		"10.128.10.240,2001:db8::f0",
+	} {
+		addr, addr6, err = parseBindAddrs(value)
+		assert.Nil(t, err)
+		assert.Equal(t, "10.128.10.240", addr)
+		assert.Equal(t, "2001:db8::f0", addr6)
+	}
+
+	for _, value := range []string{
+		"",
+		"10.128.10.260",
+		"10.128.10.240,10.128.10.241",
+		"10.128.10.240,2001:db8::f0,2001:db8::f1",
+	} {
+		_, _, err = parseBindAddrs(value)
+		assert.NotNil(t, err, "Expected an error for %q", value)
+	}
+}
+
+func TestValidateVirtualAddress(t *testing.T) {
+	var cfg VirtualServerConfig
+	assert.Nil(t, validateVirtualAddress(&cfg))
+
+	cfg.VirtualServer.Frontend.VirtualAddress = &VirtualAddress{
+		BindAddr: "2001:db8::f0", Port: 80}
+	assert.Nil(t, validateVirtualAddress(&cfg))
+	cfg.VirtualServer.Frontend.VirtualAddress.BindAddr6 = "2001:db8::f1"
+	assert.NotNil(t, validateVirtualAddress(&cfg), "bindAddr must be IPv4")
+
+	cfg.VirtualServer.Frontend.VirtualAddress.BindAddr = "10.128.10.240"
+	assert.Nil(t, validateVirtualAddress(&cfg))
+	cfg.VirtualServer.Frontend.VirtualAddress.BindAddr6 = "10.128.10.241"
+	assert.NotNil(t, validateVirtualAddress(&cfg), "bindAddr6 must be IPv6")
+
+	cfg.VirtualServer.Frontend.VirtualAddress.BindAddr6 = ""
+	cfg.VirtualServer.Frontend.VirtualAddress.BindAddr = "velcro"
+	assert.NotNil(t, validateVirtualAddress(&cfg))
+}
+
+var configmapFooAllFields string = string(`{
+  "virtualServer": {
+    "backend": {
+      "serviceName": "foo",
+      "servicePort": 80,
+      "serviceProtocol": "tcp",
+      "healthMonitors": [ { "protocol": "http", "send": "GET /" } ],
+      "minActiveMembers": 2,
+      "drainPeriod": 30,
+      "drainState": "forced-offline",
+      "nodeSelector": "pool=web"
+    },
+    "frontend": {
+      "mode": "http",
+      "partition": "velcro",
+      "virtualAddress": {
+        "bindAddr": "10.128.10.240",
+        "bindAddr6": "2001:db8::f0",
+        "port": 80
+      },
+      "sslProfile": { "secretName": "foo-tls" },
+      "profiles": [ { "name": "Common/http2", "context": "clientside" } ],
+      "persistence": { "method": "cookie", "timeout": 60 },
+      "snat": { "type": "snat", "pool": "Common/pool1" },
+      "sourceAddresses": [ "10.0.0.0/8" ],
+      "rules": [ { "host": "bar.com", "path": "/bar",
+        "serviceName": "bar", "servicePort": 80 } ],
+      "iRules": [ "log-requests" ]
+    }
+  }
+}`)
+
+func TestVirtualServerSchema(t *testing.T) {
+	require := require.New(t)
+	vsm := NewManager(&Params{})
+	require.Nil(vsm.validateSchema(schemaUrl, configmapFooAllFields))
+	cfg, err := vsm.parseVirtualServerConfig(newConfigMap("foomap", "1",
+		namespace, map[string]string{
+			"schema": schemaUrl, "data": configmapFooAllFields}))
+	require.Nil(err)
+	require.Equal("foo-tls", cfg.VirtualServer.Frontend.SslProfile.SecretName)
+	require.Nil(vsm.validateSchema(schemaUrl, strings.Replace(configmapFooAllFields,
+		`"servicePort": 80`, `"servicePort": "http"`, 1)),
+		"The backend servicePort can be a port name")
+
+	for _, replace := range [][2]string{
+		{`"servicePort": 80`, `"servicePort": ""`},
+		{`"serviceProtocol": "tcp"`, `"serviceProtocol": "sctp"`},
+		{`"minActiveMembers": 2`, `"minActiveMembers": -1`},
+		{`"drainPeriod": 30`, `"drainPeriod": "30"`},
+		{`"drainState": "forced-offline"`, `"drainState": "offline"`},
+		{`"context": "clientside"`, `"context": "client"`},
+		{`"method": "cookie"`, `"method": "hash"`},
+		{`"type": "snat"`, `"type": "pool"`},
+		{`"serviceName": "bar", `, ``},
+		{`[ "log-requests" ]`, `[ "" ]`},
+		{`"2001:db8::f0"`, `"10.128.10.241"`},
+	} {
+		require.NotNil(vsm.validateSchema(schemaUrl,
+			strings.Replace(configmapFooAllFields, replace[0], replace[1], 1)),
+			"Expected %s to be rejected", replace[1])
+	}
+}
+
+func TestRunValidators(t *testing.T) {
+	var cfg VirtualServerConfig
+	require.Nil(t, runValidators(&cfg, configMapValidators))
+
+	var ran []string
+	validator := func(name string, err error) func(*VirtualServerConfig) error {
+		return func(*VirtualServerConfig) error {
+			ran = append(ran, name)
+			return err
+		}
+	}
+	err := runValidators(&cfg, []func(*VirtualServerConfig) error{
+		validator("first", nil),
+		validator("second", fmt.Errorf("second failed")),
+		validator("third", nil),
+	})
+	assert.EqualError(t, err, "second failed")
+	assert.Equal(t, []string{"first", "second"}, ran,
+		"Validators after a failure are not run")
+}
+
+func TestDualStackVirtualServer(t *testing.T) {
+	mw := &test.MockWriter{
+		FailStyle: test.Success,
+		Sections:  make(map[string]interface{}),
+	}
+	require := require.New(t)
+
+	foo := newService("foo", "1", namespace, v1.ServiceTypeNodePort,
+		[]v1.ServicePort{{Port: 80, NodePort: 30001}})
+	fake := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{*foo}})
+	vsm := NewManager(&Params{
+		KubeClient:   fake,
+		ConfigWriter: mw,
+		Namespaces:   []string{namespace},
+		IsNodePort:   true,
+	})
+
+	cm := newConfigMap("foomap", "1", namespace, map[string]string{
+		"schema": schemaUrl,
+		"data":   configmapFooDualStack})
+	vsm.ProcessConfigMapUpdate(eventStream.Added,
+		eventStream.ChangedObject{nil, cm}, newStore(nil))
+	require.Equal(1, len(vsm.vservers.m))
+
+	// One virtual server per address family, sharing the pool members
+	services := make(map[string]*VirtualServerConfig)
+	for _, cfg := range mw.Sections["services"].(VirtualServerConfigs) {
+		services[cfg.VirtualServer.Frontend.VirtualServerName] = cfg
+	}
+	require.Equal(2, len(services))
+	require.Equal(&VirtualAddress{BindAddr: "10.128.10.240", Port: 80},
+		services["default_foomap"].VirtualServer.Frontend.VirtualAddress)
+	ipv6 := services["default_foomap_ipv6"]
+	require.NotNil(ipv6)
+	require.Equal(&VirtualAddress{BindAddr: "2001:db8::f0", Port: 80},
+		ipv6.VirtualServer.Frontend.VirtualAddress)
+	require.EqualValues(30001, ipv6.VirtualServer.Backend.PoolMemberPort)
+
+	// The stored config keeps both addresses
+	vs := getVirtualServer(t, vsm, serviceKey{"foo", 80, namespace, v1.ProtocolTCP})
+	require.Equal("2001:db8::f0",
+		vs.VirtualServer.Frontend.VirtualAddress.BindAddr6)
+
+	// Ingresses can be dual-stack or IPv6 only
+	ing := newIngress("ingress", "1", namespace, map[string]string{
+		ingressBindAddrAnnotation:  "10.128.10.250,2001:db8::fa",
+		ingressPartitionAnnotation: "velcro",
+	}, v1beta1.IngressSpec{Backend: newIngressBackend("foo", 80)})
+	cfgs, err := parseIngress(ing)
+	require.Nil(err)
+	require.Equal(&VirtualAddress{BindAddr: "10.128.10.250", Port: 80,
+		BindAddr6: "2001:db8::fa"},
+		cfgs["ingress_default_ingress"].VirtualServer.Frontend.VirtualAddress)
+	ing.ObjectMeta.Annotations[ingressBindAddrAnnotation] = "2001:db8::fa"
+	cfgs, err = parseIngress(ing)
+	require.Nil(err)
+	require.Equal(&VirtualAddress{BindAddr: "2001:db8::fa", Port: 80},
+		cfgs["ingress_default_ingress"].VirtualServer.Frontend.VirtualAddress)
+}